@@ -0,0 +1,71 @@
+// +build linux
+
+/*
+http://www.apache.org/licenses/LICENSE-2.0.txt
+
+
+Copyright 2016 Intel Corporation
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// bmcsim is fake BMC answering IPMI v1.5 and RMCP+ sessions on UDP port.
+// Answers come from simulated platform supporting Node Manager and DCMI,
+// so oob and oob_native modes can be tried on localhost, e.g.:
+//
+//	bmcsim -listen 127.0.0.1:6230 &
+//	ipmitool -I lanplus -H 127.0.0.1 -p 6230 -U admin -P admin raw 0x06 0x01
+package main
+
+import (
+	"flag"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/intelsdi-x/snap-plugin-collector-intel-dcm-platform/ipmi/bmcsim"
+	"github.com/intelsdi-x/snap-plugin-collector-intel-dcm-platform/ipmi/rmcp"
+)
+
+func main() {
+	listen := flag.String("listen", "127.0.0.1:6230", "UDP address to listen on")
+	user := flag.String("user", "admin", "user name accepted by BMC")
+	password := flag.String("password", "admin", "password of user")
+	noNM := flag.Bool("no-nm", false, "reject Node Manager requests")
+	noDCMI := flag.Bool("no-dcmi", false, "reject DCMI requests")
+	deviceSdr := flag.Bool("device-sdr", false, "expose sensors as device SDRs instead of SDR repository")
+	debug := flag.Bool("debug", false, "log every request")
+	flag.Parse()
+
+	bmc := bmcsim.NewBMC()
+	bmc.NodeManager = !*noNM
+	bmc.DCMI = !*noDCMI
+	bmc.DeviceSdr = *deviceSdr
+
+	var handler rmcp.Handler = bmc
+	if *debug {
+		log.SetLevel(log.DebugLevel)
+		handler = rmcp.HandlerFunc(func(request []byte) []byte {
+			response := bmc.Handle(request)
+			log.WithFields(log.Fields{
+				"request":  request,
+				"response": response,
+			}).Debug("bmcsim")
+			return response
+		})
+	}
+
+	srv := &rmcp.Server{User: *user, Password: *password, Handler: handler}
+	log.Info("Simulated BMC listening on ", *listen)
+	if err := srv.ListenAndServe(*listen); err != nil {
+		log.Fatal(err)
+	}
+}
@@ -0,0 +1,344 @@
+// +build linux
+
+/*
+http://www.apache.org/licenses/LICENSE-2.0.txt
+
+
+Copyright 2016 Intel Corporation
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// nmpolicy changes Node Manager power capping policies or DCMI power limit
+// of platform monitored by the collector, through the same backends and
+// bridging. Either -dry-run or -confirm is required, only confirmed changes
+// are sent. Every change is appended to audit log. Password is taken from
+// -password-file or IPMI_PASSWORD environment variable, so that it is not
+// visible in process list, e.g.:
+//
+//	IPMI_PASSWORD=admin nmpolicy -mode oob_native -host 10.0.0.5 -user admin -dry-run \
+//		set -domain platform -policy 2 -limit 300 -correction 2s -period 30s
+//	nmpolicy ... -confirm disable -scope policy -domain platform -policy 2
+//	nmpolicy ... -confirm thresholds -domain platform -policy 2 250 280
+//	nmpolicy ... -confirm dcmi-limit -limit 300 -correction 2s -action log_sel
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/user"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/intelsdi-x/snap-plugin-collector-intel-dcm-platform/ipmi"
+)
+
+// passwordEnv is environment variable holding IPMI password.
+const passwordEnv = "IPMI_PASSWORD"
+
+const usage = `Usage: nmpolicy [options] -dry-run|-confirm command [command options]
+
+Commands:
+  set              create or replace policy
+  remove           remove policy
+  enable           enable policy control (globally, in domain or of single policy)
+  disable          disable policy control
+  thresholds       set alert thresholds of policy, given as arguments (none clears them)
+  dcmi-limit       set DCMI power limit, applied once activated
+  dcmi-activate    activate DCMI power limit
+  dcmi-deactivate  deactivate DCMI power limit
+
+Options:
+`
+
+// newLayer creates IPMI backend of mode, as configured for the collector.
+func newLayer(mode, user, password, iface string, cipherSuite int, retry ipmi.RetryPolicy) (ipmi.IpmiAL, error) {
+	switch mode {
+	case "legacy_inband":
+		return &ipmi.LinuxInBandIpmitool{Device: "ipmitool", Protocol: "node_manager", Retry: retry}, nil
+	case "legacy_inband_openipmi":
+		return &ipmi.LinuxInband{Device: "/dev/ipmi0", Protocol: "node_manager", Retry: retry}, nil
+	case "oob":
+		return &ipmi.LinuxOutOfBand{Device: "ipmitool", User: user, Pass: password, Protocol: "node_manager",
+			Interface: iface, Retry: retry}, nil
+	case "oob_native":
+		return &ipmi.LinuxOutOfBandNative{User: user, Pass: password, Protocol: "node_manager",
+			CipherSuite: cipherSuite, Interface: iface, Retry: retry}, nil
+	}
+	return nil, fmt.Errorf("Unknown mode %q", mode)
+}
+
+// readPassword returns IPMI password given by option, read from file
+// or taken from environment, in this order.
+func readPassword(password, path string) (string, error) {
+	if password != "" {
+		return password, nil
+	}
+	if path != "" {
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			return "", fmt.Errorf("Unable to read password: %v", err)
+		}
+		return strings.TrimRight(string(data), "\r\n"), nil
+	}
+	return os.Getenv(passwordEnv), nil
+}
+
+// policyFlags adds domain and policy ID options to command.
+func policyFlags(fs *flag.FlagSet) (*string, *uint) {
+	return fs.String("domain", "platform", "policy domain: platform, cpu, memory, hw_protection, io or number"),
+		fs.Uint("policy", 1, "policy ID")
+}
+
+// policyTarget parses policy domain and checks policy ID options.
+func policyTarget(domainName string, policyID uint) (uint8, uint8, error) {
+	domain, err := ipmi.ParsePolicyDomain(domainName)
+	if err != nil {
+		return 0, 0, err
+	}
+	id, err := optionValue("policy", uint64(policyID), 8)
+	return domain, uint8(id), err
+}
+
+// optionValue returns value of option checking that it fits into request
+// field of given width in bits, so that it is not truncated.
+func optionValue(name string, value uint64, bits uint) (uint64, error) {
+	if value>>bits != 0 {
+		return 0, fmt.Errorf("Option -%s out of range: %d, maximum is %d", name, value, uint64(1)<<bits-1)
+	}
+	return value, nil
+}
+
+// durationValue returns duration option in given units checking that it
+// fits into request field of given width in bits.
+func durationValue(name string, d, unit time.Duration, bits uint) (uint64, error) {
+	if d < 0 {
+		return 0, fmt.Errorf("Option -%s must not be negative: %v", name, d)
+	}
+	return optionValue(name, uint64(d/unit), bits)
+}
+
+// runCommand parses command options and performs it with control.
+func runCommand(control *ipmi.PowerControl, host string, args []string) (ipmi.IpmiRequest, error) {
+	if len(args) == 0 {
+		return ipmi.IpmiRequest{}, errors.New("Command is required")
+	}
+	fs := flag.NewFlagSet(args[0], flag.ContinueOnError)
+	switch args[0] {
+	case "dcmi-limit":
+		limit := fs.Uint("limit", 0, "power limit (W)")
+		correction := fs.Duration("correction", 0, "correction time limit, e.g. 2s")
+		sampling := fs.Duration("sampling", 10*time.Second, "statistics sampling period")
+		action := fs.String("action", "none", "exception action: none, power_off or log_sel")
+		if err := fs.Parse(args[1:]); err != nil {
+			return ipmi.IpmiRequest{}, err
+		}
+		actions := map[string]uint8{
+			"none":      ipmi.DCMIActionNone,
+			"power_off": ipmi.DCMIActionPowerOff,
+			"log_sel":   ipmi.DCMIActionLogSEL,
+		}
+		a, ok := actions[*action]
+		if !ok {
+			return ipmi.IpmiRequest{}, fmt.Errorf("Unknown exception action %q", *action)
+		}
+		powerLimit, err := optionValue("limit", uint64(*limit), 16)
+		if err != nil {
+			return ipmi.IpmiRequest{}, err
+		}
+		correctionTime, err := durationValue("correction", *correction, time.Millisecond, 32)
+		if err != nil {
+			return ipmi.IpmiRequest{}, err
+		}
+		samplingPeriod, err := durationValue("sampling", *sampling, time.Second, 16)
+		if err != nil {
+			return ipmi.IpmiRequest{}, err
+		}
+		return control.SetPowerLimit(host, ipmi.DCMIPowerLimit{Action: a, Limit: uint16(powerLimit),
+			CorrectionTime: uint32(correctionTime), SamplingPeriod: uint16(samplingPeriod)})
+	case "dcmi-activate", "dcmi-deactivate":
+		if err := fs.Parse(args[1:]); err != nil {
+			return ipmi.IpmiRequest{}, err
+		}
+		return control.ActivatePowerLimit(host, args[0] == "dcmi-activate")
+	}
+	domainName, policyID := policyFlags(fs)
+	switch args[0] {
+	case "set":
+		limit := fs.Uint("limit", 0, "power limit (W)")
+		correction := fs.Duration("correction", 0, "correction time limit, e.g. 2s")
+		period := fs.Duration("period", 10*time.Second, "statistics reporting period")
+		trigger := fs.String("trigger", "none", "policy trigger: none, inlet_temperature, missing_power_reading_timeout, time_after_platform_reset or boot_time")
+		triggerLimit := fs.Uint("trigger-limit", 0, "trigger limit in units of trigger (C or 0.1 s)")
+		disabled := fs.Bool("disabled", false, "create policy disabled")
+		alert := fs.Bool("alert", false, "send alert when limit cannot be kept")
+		shutdown := fs.Bool("shutdown", false, "shut system down when limit cannot be kept")
+		volatile := fs.Bool("volatile", false, "keep policy only until Node Manager reset")
+		if err := fs.Parse(args[1:]); err != nil {
+			return ipmi.IpmiRequest{}, err
+		}
+		domain, id, err := policyTarget(*domainName, *policyID)
+		if err != nil {
+			return ipmi.IpmiRequest{}, err
+		}
+		triggerType, err := ipmi.ParsePolicyTrigger(*trigger)
+		if err != nil {
+			return ipmi.IpmiRequest{}, err
+		}
+		powerLimit, err := optionValue("limit", uint64(*limit), 16)
+		if err != nil {
+			return ipmi.IpmiRequest{}, err
+		}
+		triggerValue, err := optionValue("trigger-limit", uint64(*triggerLimit), 16)
+		if err != nil {
+			return ipmi.IpmiRequest{}, err
+		}
+		correctionTime, err := durationValue("correction", *correction, time.Millisecond, 32)
+		if err != nil {
+			return ipmi.IpmiRequest{}, err
+		}
+		reportingPeriod, err := durationValue("period", *period, time.Second, 16)
+		if err != nil {
+			return ipmi.IpmiRequest{}, err
+		}
+		policy := ipmi.PolicyConfig{Domain: domain, ID: id, Enabled: !*disabled, Trigger: triggerType,
+			TriggerLimit: uint16(triggerValue), PowerLimit: uint16(powerLimit), CorrectionTime: uint32(correctionTime),
+			ReportingPeriod: uint16(reportingPeriod), Volatile: *volatile}
+		if *alert {
+			policy.Actions |= ipmi.PolicyActionAlert
+		}
+		if *shutdown {
+			policy.Actions |= ipmi.PolicyActionShutdown
+		}
+		return control.SetPolicy(host, policy)
+	case "remove", "thresholds":
+		if err := fs.Parse(args[1:]); err != nil {
+			return ipmi.IpmiRequest{}, err
+		}
+		domain, id, err := policyTarget(*domainName, *policyID)
+		if err != nil {
+			return ipmi.IpmiRequest{}, err
+		}
+		if args[0] == "remove" {
+			return control.RemovePolicy(host, domain, id)
+		}
+		var thresholds []uint16
+		for _, arg := range fs.Args() {
+			value, err := strconv.ParseUint(arg, 0, 16)
+			if err != nil {
+				return ipmi.IpmiRequest{}, fmt.Errorf("Invalid alert threshold %q", arg)
+			}
+			thresholds = append(thresholds, uint16(value))
+		}
+		return control.SetAlertThresholds(host, domain, id, thresholds)
+	case "enable", "disable":
+		scope := fs.String("scope", "policy", "scope of policy control: global, domain or policy")
+		if err := fs.Parse(args[1:]); err != nil {
+			return ipmi.IpmiRequest{}, err
+		}
+		domain, id, err := policyTarget(*domainName, *policyID)
+		if err != nil {
+			return ipmi.IpmiRequest{}, err
+		}
+		scopes := map[string]uint8{
+			"global": ipmi.PolicyControlGlobal,
+			"domain": ipmi.PolicyControlDomain,
+			"policy": ipmi.PolicyControlPolicy,
+		}
+		s, ok := scopes[*scope]
+		if !ok {
+			return ipmi.IpmiRequest{}, fmt.Errorf("Unknown scope %q", *scope)
+		}
+		return control.SetPolicyControl(host, s, domain, id, args[0] == "enable")
+	}
+	return ipmi.IpmiRequest{}, fmt.Errorf("Unknown command %q", args[0])
+}
+
+func run() error {
+	mode := flag.String("mode", "oob_native", "backend: legacy_inband, legacy_inband_openipmi, oob or oob_native")
+	host := flag.String("host", "", "BMC address, local host name for in-band modes")
+	userName := flag.String("user", "", "IPMI user")
+	password := flag.String("password", "", "IPMI password, visible in process list; prefer -password-file or "+passwordEnv)
+	passwordFile := flag.String("password-file", "", "file holding IPMI password")
+	iface := flag.String("interface", "", "out of band interface: lan or lanplus (default)")
+	cipherSuite := flag.Int("cipher_suite", 0, "RMCP+ cipher suite, 0 chooses automatically")
+	bridge := flag.String("bridge", "", "bridging path to Node Manager, e.g. 0x06:0x2c (default path of collector)")
+	timeout := flag.Duration("timeout", 0, "time limit of single request")
+	dryRun := flag.Bool("dry-run", false, "validate and log changes without sending them")
+	confirm := flag.Bool("confirm", false, "send changes")
+	auditPath := flag.String("audit", "/var/log/intel-dcm-platform-audit.log", "audit log, changes are appended as JSON lines")
+	flag.Usage = func() {
+		fmt.Fprint(os.Stderr, usage)
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	if *dryRun == *confirm {
+		flag.Usage()
+		return errors.New("Exactly one of -dry-run and -confirm is required")
+	}
+	path, err := ipmi.ParseBridgePath(*bridge)
+	if err != nil {
+		return err
+	}
+	if *host == "" {
+		if *host, err = os.Hostname(); err != nil {
+			return err
+		}
+	}
+	pass, err := readPassword(*password, *passwordFile)
+	if err != nil {
+		return err
+	}
+	layer, err := newLayer(*mode, *userName, pass, *iface, *cipherSuite, ipmi.RetryPolicy{Timeout: *timeout})
+	if err != nil {
+		return err
+	}
+	if closer, ok := layer.(io.Closer); ok {
+		defer closer.Close()
+	}
+	// symbolic link in place of audit log is refused
+	audit, err := os.OpenFile(*auditPath, os.O_APPEND|os.O_CREATE|os.O_WRONLY|syscall.O_NOFOLLOW, 0600)
+	if err != nil {
+		return fmt.Errorf("Unable to open audit log: %v", err)
+	}
+	defer audit.Close()
+
+	control := &ipmi.PowerControl{Layer: layer, Path: path, Confirm: *confirm, Audit: audit}
+	if u, err := user.Current(); err == nil {
+		control.User = u.Username
+	}
+	request, err := runCommand(control, *host, flag.Args())
+	if err != nil {
+		return err
+	}
+	status := "sent"
+	if !*confirm {
+		status = "dry run, not sent"
+	}
+	fmt.Printf("%s: % x (path %v)\n", status, request.Data, request.Path())
+	return nil
+}
+
+func main() {
+	if err := run(); err != nil {
+		log.Fatal(err)
+	}
+}
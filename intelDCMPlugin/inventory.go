@@ -0,0 +1,245 @@
+// +build linux
+
+/*
+http://www.apache.org/licenses/LICENSE-2.0.txt
+
+
+Copyright 2016 Intel Corporation
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package intelDCMPlugin
+
+import (
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/intelsdi-x/snap-plugin-collector-intel-dcm-platform/ipmi/rmcp"
+	"github.com/intelsdi-x/snap/core/ctypes"
+)
+
+// HostConfig describes single monitored host. Fields left empty in
+// inventory are taken from plugin configuration.
+type HostConfig struct {
+	Host        string `json:"host"`
+	User        string `json:"user"`
+	Password    string `json:"password"`
+	Mode        string `json:"mode"`
+	Protocol    string `json:"protocol"`
+	Interface   string `json:"interface"`
+	CipherSuite int    `json:"cipher_suite"`
+	Bridge      string `json:"bridge"`
+}
+
+// isInband checks whether host is the local system.
+func (h *HostConfig) isInband() bool {
+	return h.Mode == "legacy_inband" || h.Mode == "legacy_inband_openipmi"
+}
+
+// loadInventory reads list of hosts from file. Files with ".csv" extension
+// are read as CSV with header row naming columns, other files as JSON array.
+func loadInventory(path string) ([]HostConfig, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	if strings.ToLower(filepath.Ext(path)) == ".csv" {
+		return readInventoryCSV(f)
+	}
+	var hosts []HostConfig
+	if err := json.NewDecoder(f).Decode(&hosts); err != nil {
+		return nil, fmt.Errorf("Invalid inventory %s: %v", path, err)
+	}
+	return hosts, nil
+}
+
+// readInventoryCSV reads hosts from CSV, columns are named as JSON fields of HostConfig.
+func readInventoryCSV(r io.Reader) ([]HostConfig, error) {
+	reader := csv.NewReader(r)
+	reader.TrimLeadingSpace = true
+	reader.Comment = '#'
+	records, err := reader.ReadAll()
+	if err != nil {
+		return nil, err
+	}
+	if len(records) == 0 {
+		return nil, nil
+	}
+	header := records[0]
+	hosts := make([]HostConfig, 0, len(records)-1)
+	for line, record := range records[1:] {
+		var h HostConfig
+		for i, column := range header {
+			value := strings.TrimSpace(record[i])
+			switch strings.TrimSpace(column) {
+			case "host":
+				h.Host = value
+			case "user":
+				h.User = value
+			case "password":
+				h.Password = value
+			case "mode":
+				h.Mode = value
+			case "protocol":
+				h.Protocol = value
+			case "interface":
+				h.Interface = value
+			case "cipher_suite":
+				if value == "" {
+					continue
+				}
+				if h.CipherSuite, err = strconv.Atoi(value); err != nil {
+					return nil, fmt.Errorf("Invalid cipher_suite in line %d: %v", line+2, err)
+				}
+			case "bridge":
+				h.Bridge = value
+			default:
+				return nil, fmt.Errorf("Unknown inventory column %q", column)
+			}
+		}
+		hosts = append(hosts, h)
+	}
+	return hosts, nil
+}
+
+// getNetworks returns networks listed in "discover" option.
+func getNetworks(config map[string]ctypes.ConfigValue) []string {
+	var networks []string
+	for _, network := range strings.Split(getOption(config, "discover"), ",") {
+		if network = strings.TrimSpace(network); network != "" {
+			networks = append(networks, network)
+		}
+	}
+	return networks
+}
+
+// discoverHosts sweeps networks listed in "discover" option with RMCP presence ping.
+// Found BMCs are reached in configured OOB mode (oob_native by default)
+// over the best interface they support. Responses are awaited for "timeout".
+func discoverHosts(config map[string]ctypes.ConfigValue) ([]HostConfig, error) {
+	cfg := rmcp.SweepConfig{Timeout: getRetryPolicy(config).Timeout}
+	if port, err := strconv.Atoi(getOption(config, "discovery_port")); err == nil {
+		cfg.Port = port
+	}
+	bmcs, err := rmcp.Sweep(context.Background(), getNetworks(config), cfg)
+	if err != nil {
+		return nil, err
+	}
+	mode := getMode(config)
+	if mode != "oob" {
+		mode = "oob_native"
+	}
+	hosts := make([]HostConfig, len(bmcs))
+	for i, bmc := range bmcs {
+		hosts[i] = HostConfig{Host: bmc.Addr, Mode: mode, Interface: bmc.Auth.Interface()}
+	}
+	return hosts, nil
+}
+
+// discoveryDue checks whether networks should be swept: at first construction
+// and then every "discovery_interval" (never again when it is not set).
+func (ic *IpmiCollector) discoveryDue(config map[string]ctypes.ConfigValue) bool {
+	if len(getNetworks(config)) == 0 {
+		return false
+	}
+	if ic.discoveredAt.IsZero() {
+		return true
+	}
+	interval, err := time.ParseDuration(getOption(config, "discovery_interval"))
+	return err == nil && interval > 0 && time.Since(ic.discoveredAt) >= interval
+}
+
+// discover sweeps configured networks. Hosts found previously are kept when sweep fails.
+// Returns true when list of discovered hosts changed.
+func (ic *IpmiCollector) discover(config map[string]ctypes.ConfigValue) bool {
+	ic.discoveredAt = time.Now()
+	hosts, err := discoverHosts(config)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"error": err,
+		}).Warn("Discovery failed")
+		return false
+	}
+	changed := len(hosts) != len(ic.discovered)
+	for i := 0; !changed && i < len(hosts); i++ {
+		changed = hosts[i].Host != ic.discovered[i].Host
+	}
+	ic.discovered = hosts
+	return changed
+}
+
+// getHosts returns hosts read from "inventory" file or listed in "host"
+// option (comma separated), followed by discovered ones which are not listed.
+// Missing settings are filled from configuration.
+// In-band hosts are named by hostname of local system.
+func getHosts(config map[string]ctypes.ConfigValue, discovered []HostConfig) ([]HostConfig, error) {
+	var hosts []HostConfig
+	if path := getOption(config, "inventory"); path != "" {
+		var err error
+		if hosts, err = loadInventory(path); err != nil {
+			return nil, err
+		}
+	} else if host := getHost(config); host != "" || len(getNetworks(config)) == 0 {
+		for _, host := range strings.Split(host, ",") {
+			hosts = append(hosts, HostConfig{Host: strings.TrimSpace(host)})
+		}
+	}
+	listed := make(map[string]bool, len(hosts))
+	for _, h := range hosts {
+		listed[h.Host] = true
+	}
+	for _, h := range discovered {
+		if !listed[h.Host] {
+			hosts = append(hosts, h)
+		}
+	}
+
+	iface, ifaces := getInterface(config)
+	localhost, _ := os.Hostname()
+	for i := range hosts {
+		h := &hosts[i]
+		if h.Mode == "" {
+			h.Mode = getMode(config)
+		}
+		if h.Protocol == "" {
+			h.Protocol = getProtocol(config)
+		}
+		if h.User == "" && h.Password == "" {
+			h.User, h.Password = getUser(config), getPass(config)
+		}
+		if h.Interface == "" {
+			h.Interface = iface
+			if override, ok := ifaces[h.Host]; ok {
+				h.Interface = override
+			}
+		}
+		if h.CipherSuite == 0 {
+			h.CipherSuite = getCipherSuite(config)
+		}
+		if h.isInband() {
+			h.Host = localhost
+		}
+	}
+	return hosts, nil
+}
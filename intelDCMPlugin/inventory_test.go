@@ -0,0 +1,192 @@
+// +build unit
+
+/*
+http://www.apache.org/licenses/LICENSE-2.0.txt
+
+
+Copyright 2016 Intel Corporation
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package intelDCMPlugin
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/intelsdi-x/snap-plugin-collector-intel-dcm-platform/ipmi"
+	"github.com/intelsdi-x/snap-plugin-collector-intel-dcm-platform/ipmi/bmcsim"
+	"github.com/intelsdi-x/snap-plugin-collector-intel-dcm-platform/ipmi/rmcp"
+	"github.com/intelsdi-x/snap/control/plugin"
+	"github.com/intelsdi-x/snap/core/ctypes"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+// startBMC serves simulated BMC on local UDP port and returns its address.
+func startBMC(bmc *bmcsim.BMC) (string, *rmcp.Server) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		panic(err)
+	}
+	srv := &rmcp.Server{User: "admin", Password: "secret", Handler: bmc}
+	go srv.Serve(conn)
+	return conn.LocalAddr().String(), srv
+}
+
+func TestInventory(t *testing.T) {
+	Convey("Check host inventory", t, func() {
+		config := map[string]ctypes.ConfigValue{
+			"mode":     ctypes.ConfigValueStr{Value: "oob_native"},
+			"protocol": ctypes.ConfigValueStr{Value: "node_manager"},
+			"user":     ctypes.ConfigValueStr{Value: "admin"},
+			"password": ctypes.ConfigValueStr{Value: "secret"},
+		}
+
+		Convey("hosts are listed in configuration", func() {
+			config["host"] = ctypes.ConfigValueStr{Value: "10.0.0.5, 10.0.0.6"}
+			config["interface"] = ctypes.ConfigValueStr{Value: "lanplus,10.0.0.6=lan"}
+			hosts, err := getHosts(config, nil)
+			So(err, ShouldBeNil)
+			So(hosts, ShouldResemble, []HostConfig{
+				{Host: "10.0.0.5", User: "admin", Password: "secret", Mode: "oob_native", Protocol: "node_manager", Interface: "lanplus"},
+				{Host: "10.0.0.6", User: "admin", Password: "secret", Mode: "oob_native", Protocol: "node_manager", Interface: "lan"},
+			})
+		})
+
+		Convey("hosts are read from CSV file", func() {
+			hosts, err := readInventoryCSV(strings.NewReader(
+				"host,user,password,protocol,cipher_suite,bridge\n" +
+					"# comment\n" +
+					"10.0.0.5,root,pass,dcmi,17,\n" +
+					"10.0.0.7,,,node_manager,,\"0x07:0x72,0x06:0x2c\"\n"))
+			So(err, ShouldBeNil)
+			So(hosts, ShouldResemble, []HostConfig{
+				{Host: "10.0.0.5", User: "root", Password: "pass", Protocol: "dcmi", CipherSuite: 17},
+				{Host: "10.0.0.7", Protocol: "node_manager", Bridge: "0x07:0x72,0x06:0x2c"},
+			})
+			_, err = readInventoryCSV(strings.NewReader("address\n10.0.0.5\n"))
+			So(err, ShouldNotBeNil)
+		})
+
+		Convey("hosts are read from JSON file", func() {
+			dir, err := ioutil.TempDir("", "inventory")
+			So(err, ShouldBeNil)
+			defer os.RemoveAll(dir)
+			path := filepath.Join(dir, "hosts.json")
+			So(ioutil.WriteFile(path, []byte(`[{"host": "10.0.0.5", "protocol": "dcmi"}, {"host": "10.0.0.6", "mode": "oob", "user": "root"}]`), 0644), ShouldBeNil)
+			config["inventory"] = ctypes.ConfigValueStr{Value: path}
+			hosts, err := getHosts(config, nil)
+			So(err, ShouldBeNil)
+			So(len(hosts), ShouldEqual, 2)
+			So(hosts[0].Protocol, ShouldEqual, "dcmi")
+			So(hosts[0].User, ShouldEqual, "admin")
+			So(hosts[1].Mode, ShouldEqual, "oob")
+			So(hosts[1].Protocol, ShouldEqual, "node_manager")
+			So(hosts[1].User, ShouldEqual, "root")
+			So(hosts[1].Password, ShouldEqual, "")
+		})
+
+		Convey("hosts are discovered", func() {
+			addr, srv := startBMC(bmcsim.NewBMC())
+			defer srv.Close()
+			_, port, _ := net.SplitHostPort(addr)
+			config["host"] = ctypes.ConfigValueStr{Value: "10.0.0.5"}
+			config["discover"] = ctypes.ConfigValueStr{Value: "127.0.0.1, 127.0.0.2/32"}
+			config["discovery_port"] = ctypes.ConfigValueStr{Value: port}
+			config["discovery_interval"] = ctypes.ConfigValueStr{Value: "1h"}
+			config["timeout"] = ctypes.ConfigValueStr{Value: "300ms"}
+
+			ic := New()
+			So(ic.discoveryDue(config), ShouldBeTrue)
+			So(ic.discover(config), ShouldBeTrue)
+			So(ic.discoveryDue(config), ShouldBeFalse)
+			So(ic.discover(config), ShouldBeFalse)
+			hosts, err := getHosts(config, ic.discovered)
+			So(err, ShouldBeNil)
+			So(hosts, ShouldResemble, []HostConfig{
+				{Host: "10.0.0.5", User: "admin", Password: "secret", Mode: "oob_native", Protocol: "node_manager"},
+				{Host: addr, User: "admin", Password: "secret", Mode: "oob_native", Protocol: "node_manager", Interface: "lanplus"},
+			})
+		})
+
+		Convey("mixed fleet is collected", func() {
+			nm, srv1 := startBMC(bmcsim.NewBMC())
+			defer srv1.Close()
+			dcmiBMC := bmcsim.NewBMC()
+			dcmiBMC.NodeManager = false
+			dcmiBMC.Sensors = append(dcmiBMC.Sensors[:1], bmcsim.Sensor{
+				Number: 0x41, Type: bmcsim.SensorFan, ReadingType: bmcsim.ReadingThreshold, Entity: bmcsim.EntityFan, Instance: 1, Name: "Fan 2", Reading: 12, State: 0x10})
+			dcmi, srv2 := startBMC(dcmiBMC)
+			defer srv2.Close()
+
+			config["timeout"] = ctypes.ConfigValueStr{Value: "1s"}
+			config["device_timestamp"] = ctypes.ConfigValueStr{Value: "true"}
+			dir, err := ioutil.TempDir("", "inventory")
+			So(err, ShouldBeNil)
+			defer os.RemoveAll(dir)
+			path := filepath.Join(dir, "hosts.csv")
+			So(ioutil.WriteFile(path, []byte(fmt.Sprintf("host,protocol\n%s,node_manager\n%s,dcmi\n", nm, dcmi)), 0644), ShouldBeNil)
+			config["inventory"] = ctypes.ConfigValueStr{Value: path}
+
+			ic := New()
+			ic.construct(config)
+			defer ic.IpmiLayer.(*ipmi.Scheduler).Close()
+			So(ic.Hosts, ShouldResemble, []string{nm, dcmi})
+			// two policies of simulated BMC are read by both policy requests
+			So(len(ic.Vendor[nm]), ShouldEqual, len(ipmi.GenericVendor)+2)
+			So(len(ic.Vendor[dcmi]), ShouldEqual, 3)
+
+			mts, err := ic.CollectMetrics([]plugin.MetricType{{Namespace_: makeName("power/system/cur")}})
+			So(err, ShouldBeNil)
+			So(len(mts), ShouldEqual, 2)
+			So(mts[0].Tags()["source"], ShouldEqual, nm)
+			So(mts[0].Data(), ShouldEqual, 212)
+			So(mts[1].Tags()["source"], ShouldEqual, dcmi)
+			So(mts[1].Data(), ShouldEqual, 215)
+			// Node Manager reports sample time in seconds
+			So(mts[0].Timestamp().Nanosecond(), ShouldEqual, 0)
+
+			mts, err = ic.CollectMetrics([]plugin.MetricType{{Namespace_: makeName("power/system/reporting_period")}})
+			So(err, ShouldBeNil)
+			So(len(mts), ShouldEqual, 1)
+			So(mts[0].Data(), ShouldEqual, 3600)
+
+			// every host is checked with own SDR
+			mts, err = ic.CollectMetrics([]plugin.MetricType{{Namespace_: makeName("health/fan")}})
+			So(err, ShouldBeNil)
+			So(len(mts), ShouldEqual, 2)
+			So(mts[0].Data(), ShouldEqual, "OK")
+			So(mts[1].Data(), ShouldEqual, "CRITICAL")
+
+			mts, err = ic.CollectMetrics([]plugin.MetricType{{Namespace_: makeName("sensors/Inlet_Temp/value")}, {Namespace_: makeName("sensors/Fan_2/status")}})
+			So(err, ShouldBeNil)
+			So(len(mts), ShouldEqual, 3)
+			So(mts[0].Data(), ShouldEqual, 24)
+			So(mts[0].Unit(), ShouldEqual, "C")
+			So(mts[1].Data(), ShouldEqual, 24)
+			So(mts[2].Tags()["source"], ShouldEqual, dcmi)
+			So(mts[2].Data(), ShouldEqual, "CRITICAL")
+
+			mts, err = ic.CollectMetrics([]plugin.MetricType{{Namespace_: makeName("sensors/Inlet_Temp/upper_critical")}})
+			So(err, ShouldBeNil)
+			So(len(mts), ShouldEqual, 2)
+			So(mts[1].Data(), ShouldEqual, 45)
+		})
+	})
+}
@@ -22,9 +22,13 @@ limitations under the License.
 package intelDCMPlugin
 
 import (
+	"context"
 	"fmt"
+	"io"
 	"os"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
 	log "github.com/Sirupsen/logrus"
 	"github.com/intelsdi-x/snap-plugin-collector-intel-dcm-platform/ipmi"
@@ -75,6 +79,15 @@ type IpmiCollector struct {
 	NSim        int
 	Inventory   map[string]map[string]string
 	ComponentHealth      map[string]map[string]string
+	Sensors     map[string]map[string]ipmi.Value
+	discovered   []HostConfig
+	discoveredAt time.Time
+	vendors      map[string][]ipmi.RequestDescription
+	groups       map[string][]string
+	policiesAt   time.Time
+	cache        *ipmi.Cache
+	sdrParser    *ipmi.SdrParser
+	deviceTimestamp bool
 }
 func init() {
 	f, err := os.OpenFile("/tmp/intel-dcm-platform-collector.log", os.O_APPEND|os.O_CREATE|os.O_RDWR, 0666)
@@ -88,16 +101,25 @@ func init() {
 
 // CollectMetrics Performs metric collection.
 // Ipmi request are never duplicated in order to read multiple metrics.
-// Timestamp is set to time when batch processing is complete.
+// Timestamp is set to time when batch processing is complete, or to sample
+// time reported by device when "device_timestamp" is set.
 // Source is hostname returned by operating system.
 func (ic *IpmiCollector) CollectMetrics(mts []plugin.MetricType) ([]plugin.MetricType, error) {
+	if ic.Initialized && mts[0].Config() != nil {
+		if cfg := mts[0].Config().Table(); ic.discoveryDue(cfg) && ic.discover(cfg) {
+			ic.Initialized = false //hosts changed
+		}
+	}
 	if !ic.Initialized {
 		ic.construct(mts[0].Config().Table()) //reinitialize plugin
+	} else if mts[0].Config() != nil && ic.policiesDue(mts[0].Config().Table()) {
+		ic.refreshPolicies()
 	}
 
 	requestList := make(map[string][]ipmi.IpmiRequest, 0)
 	requestDescList := make(map[string][]ipmi.RequestDescription, 0)
-	responseCache := map[string]map[string]uint16{}
+	responseCache := map[string]map[string]ipmi.Value{}
+	sampleTimes := map[string]map[string]time.Time{}
 	for _, host := range ic.Hosts {
 		requestList[host] = make([]ipmi.IpmiRequest, 0)
 		requestDescList[host] = make([]ipmi.RequestDescription, 0)
@@ -106,28 +128,59 @@ func (ic *IpmiCollector) CollectMetrics(mts []plugin.MetricType) ([]plugin.Metri
 			requestDescList[host] = append(requestDescList[host], request)
 		}
 	}
-	response := make(map[string][]ipmi.IpmiResponse, 0)
-
-	for _, host := range ic.Hosts {
-		response[host], _ = ic.IpmiLayer.BatchExecRaw(requestList[host], host)
+	scheduler, ok := ic.IpmiLayer.(*ipmi.Scheduler)
+	if !ok {
+		scheduler = ipmi.NewScheduler(ic.IpmiLayer)
 	}
+	response, _ := scheduler.CollectAll(context.Background(), requestList)
 
 	for nmResponseIdx, hostResponses := range response {
-		cached := map[string]uint16{}
+		cached := map[string]ipmi.Value{}
+		sampled := map[string]time.Time{}
 		for i, resp := range hostResponses {
 			format := requestDescList[nmResponseIdx][i].Format
-			if err := format.Validate(resp); err != nil {
-				return nil, err
+			err := ipmi.ValidateResponse(requestList[nmResponseIdx][i], resp, format)
+			if err != nil {
+				log.WithFields(log.Fields{
+					"host":        nmResponseIdx,
+					"metric":      requestDescList[nmResponseIdx][i].MetricsRoot,
+					"transient":   ipmi.IsTransient(err),
+					"unsupported": ipmi.IsUnsupported(err),
+					"error":       err,
+				}).Warn("Skipping invalid response")
+				continue
 			}
 			submetrics := format.Parse(resp)
+			sampleTime, hasSampleTime := ipmi.SampleTime(submetrics)
 			for k, v := range submetrics {
 				path := extendPath(requestDescList[nmResponseIdx][i].MetricsRoot, k)
 				cached[path] = v
+				if ic.deviceTimestamp && hasSampleTime {
+					sampled[path] = sampleTime
+				}
 			}
 			responseCache[nmResponseIdx] = cached
+			sampleTimes[nmResponseIdx] = sampled
 		}
 	}
 
+	for _, mt := range mts {
+		if strings.Contains(parseName(mt.Namespace()), "health/") {
+			ic.updateHealth()
+			break
+		}
+	}
+	sensors, limits := false, false
+	for _, mt := range mts {
+		if key := parseName(mt.Namespace()); strings.HasPrefix(key, "sensors/") {
+			sensors = true
+			limits = limits || isSensorLimit(key)
+		}
+	}
+	if sensors {
+		ic.updateSensors(limits)
+	}
+
 	results := make([]plugin.MetricType, len(mts))
 	var responseMetrics []plugin.MetricType
 	responseMetrics = make([]plugin.MetricType, 0)
@@ -139,23 +192,32 @@ func (ic *IpmiCollector) CollectMetrics(mts []plugin.MetricType) ([]plugin.Metri
 			key := parseName(ns)
 
 			var data interface{}
-			if strings.Contains(key, "inventory/") {
+			var unit string
+			timestamp := t
+			if strings.HasPrefix(key, "sensors/") {
+				value, ok := ic.Sensors[host][key]
+				if !ok || !value.Valid {
+					continue
+				}
+				data, unit = value.Data, value.Unit
+			} else if strings.Contains(key, "inventory/") {
 				data = ic.Inventory[host][key]
 			}else if strings.Contains(key,"health/"){
-				sdrParser := &ipmi.SdrParser{}
-				sdrParser.IpmiLayer = ic.IpmiLayer
-				ic.ComponentHealth = make(map[string]map[string]string, len(ic.Hosts))
-				for _, host := range ic.Hosts {
-					health, _ := sdrParser.GetComponentHealth(host)
-					ic.ComponentHealth[host] = health
-				}				
 				data = ic.ComponentHealth[host][key]
 			} else {
-				data = responseCache[host][key]
+				value, ok := responseCache[host][key]
+				if !ok || !value.Valid {
+					// not reported by host
+					continue
+				}
+				data, unit = value.Data, value.Unit
+				if sampleTime, ok := sampleTimes[host][key]; ok {
+					timestamp = sampleTime
+				}
 			}
 
 			metric := plugin.MetricType{Namespace_: ns, Tags_: map[string]string{"source": host},
-				Timestamp_: t, Data_: data}
+				Timestamp_: timestamp, Data_: data, Unit_: unit}
 			results[i] = metric
 			responseMetrics = append(responseMetrics, metric)
 		}
@@ -164,6 +226,106 @@ func (ic *IpmiCollector) CollectMetrics(mts []plugin.MetricType) ([]plugin.Metri
 	return responseMetrics, nil
 }
 
+// forEachHost calls read for every host concurrently.
+func (ic *IpmiCollector) forEachHost(read func(host string)) {
+	var wg sync.WaitGroup
+	for _, host := range ic.Hosts {
+		wg.Add(1)
+		go func(host string) {
+			defer wg.Done()
+			read(host)
+		}(host)
+	}
+	wg.Wait()
+}
+
+// updateHealth reads component health of all hosts concurrently.
+func (ic *IpmiCollector) updateHealth() {
+	health := make(map[string]map[string]string, len(ic.Hosts))
+	var mutex sync.Mutex
+	ic.forEachHost(func(host string) {
+		components, err := ic.sdrParser.GetComponentHealth(host)
+		if err != nil {
+			log.WithFields(log.Fields{
+				"host":  host,
+				"error": err,
+			}).Warn("Unable to read component health")
+		}
+		mutex.Lock()
+		defer mutex.Unlock()
+		health[host] = components
+	})
+	ic.ComponentHealth = health
+}
+
+// isSensorLimit tells whether metric is threshold, hysteresis or characteristic reading of sensor.
+func isSensorLimit(key string) bool {
+	for _, limit := range ipmi.SensorLimitMetrics {
+		if strings.HasSuffix(key, "/"+limit) {
+			return true
+		}
+	}
+	return false
+}
+
+// updateSensors reads SDR sensors of all hosts concurrently, together
+// with their limits when requested.
+func (ic *IpmiCollector) updateSensors(limits bool) {
+	sensors := make(map[string]map[string]ipmi.Value, len(ic.Hosts))
+	var mutex sync.Mutex
+	ic.forEachHost(func(host string) {
+		values := make(map[string]ipmi.Value)
+		readings, err := ic.sdrParser.GetSensorReadings(host)
+		if err != nil {
+			log.WithFields(log.Fields{
+				"host":  host,
+				"error": err,
+			}).Warn("Unable to read sensors")
+		}
+		for _, reading := range readings {
+			values[ipmi.SensorMetric(reading.Name, "value")] = reading.Value
+			values[ipmi.SensorMetric(reading.Name, "status")] = reading.Status
+		}
+		if limits && err == nil {
+			sensorLimits, err := ic.sdrParser.GetSensorLimits(host)
+			if err != nil {
+				log.WithFields(log.Fields{
+					"host":  host,
+					"error": err,
+				}).Warn("Unable to read sensor limits")
+			}
+			for name, sensorLimit := range sensorLimits {
+				for limit, value := range sensorLimit {
+					values[ipmi.SensorMetric(name, limit)] = value
+				}
+			}
+		}
+		mutex.Lock()
+		defer mutex.Unlock()
+		sensors[host] = values
+	})
+	ic.Sensors = sensors
+}
+
+// sensorMetrics reads metrics of SDR sensors of all hosts concurrently.
+func (ic *IpmiCollector) sensorMetrics() map[string][]string {
+	metrics := make(map[string][]string, len(ic.Hosts))
+	var mutex sync.Mutex
+	ic.forEachHost(func(host string) {
+		sensors, err := ic.sdrParser.GetSensorMetrics(host)
+		if err != nil {
+			log.WithFields(log.Fields{
+				"host":  host,
+				"error": err,
+			}).Warn("Unable to read sensor names")
+		}
+		mutex.Lock()
+		defer mutex.Unlock()
+		metrics[host] = sensors
+	})
+	return metrics
+}
+
 // GetMetricTypes Returns list of metrics available for current vendor.
 func (ic *IpmiCollector) GetMetricTypes(cfg plugin.ConfigType) ([]plugin.MetricType, error) {
 	log.Debug("Enter fun GetMetricTypes")
@@ -200,6 +362,13 @@ func (ic *IpmiCollector) GetMetricTypes(cfg plugin.ConfigType) ([]plugin.MetricT
 		}
 	}
 
+	sensors := ic.sensorMetrics()
+	for _, host := range ic.Hosts {
+		for _, metric := range sensors[host] {
+			mts = append(mts, plugin.MetricType{Namespace_: makeName(metric), Tags_: map[string]string{"source": host}})
+		}
+	}
+
 	ic.Initialized = true
 	return mts, nil
 }
@@ -225,6 +394,13 @@ func (ic *IpmiCollector) validateName(namespace []string) error {
 	return nil
 }
 
+func getOption(config map[string]ctypes.ConfigValue, name string) string {
+	if value, ok := config[name]; ok {
+		return value.(ctypes.ConfigValueStr).Value
+	}
+	return ""
+}
+
 func getMode(config map[string]ctypes.ConfigValue) string {
 	if mode, ok := config["mode"]; ok {
 		return mode.(ctypes.ConfigValueStr).Value
@@ -246,6 +422,27 @@ func getSlave(config map[string]ctypes.ConfigValue) string {
 	return "0x00" //Default slave addr
 }
 
+// getBridgePath returns path to Management Engine configured by "bridge"
+// option or by "channel" and "slave" options. Nil means default path
+// of vendor requests.
+func getBridgePath(config map[string]ctypes.ConfigValue) []ipmi.BridgeHop {
+	if bridge := getOption(config, "bridge"); bridge != "" {
+		path, err := ipmi.ParseBridgePath(bridge)
+		if err != nil {
+			log.WithFields(log.Fields{
+				"error": err,
+			}).Error("Invalid bridge option")
+			return nil
+		}
+		return path
+	}
+	path, err := ipmi.ParseBridgePath(getChannel(config) + ":" + getSlave(config))
+	if err != nil || len(path) == 0 || path[0].Address == 0 {
+		return nil
+	}
+	return path
+}
+
 func getPass(config map[string]ctypes.ConfigValue) string {
 	if pass, ok := config["password"]; ok {
 		return pass.(ctypes.ConfigValueStr).Value
@@ -274,37 +471,276 @@ func getProtocol(config map[string]ctypes.ConfigValue) string {
 	return "ipmi"
 }
 
+func getCipherSuite(config map[string]ctypes.ConfigValue) int {
+	if suite, ok := config["cipher_suite"]; ok {
+		value, err := strconv.Atoi(suite.(ctypes.ConfigValueStr).Value)
+		if err == nil {
+			return value
+		}
+	}
+	return 0 //Default cipher suite is chosen by ipmi layer
+}
+
+// getInterface parses "interface" option: comma separated list of
+// default interface ("lan" or "lanplus") and host=interface overrides.
+func getInterface(config map[string]ctypes.ConfigValue) (string, map[string]string) {
+	def := ""
+	perHost := make(map[string]string)
+	if iface, ok := config["interface"]; ok {
+		for _, item := range strings.Split(iface.(ctypes.ConfigValueStr).Value, ",") {
+			item = strings.TrimSpace(item)
+			if kv := strings.SplitN(item, "=", 2); len(kv) == 2 {
+				perHost[strings.TrimSpace(kv[0])] = strings.TrimSpace(kv[1])
+			} else if item != "" {
+				def = item
+			}
+		}
+	}
+	return def, perHost //Empty default means lanplus
+}
+
+// getDeviceTimestamp reads "device_timestamp" option: metrics are stamped
+// with sample time reported by device instead of collection time.
+func getDeviceTimestamp(config map[string]ctypes.ConfigValue) bool {
+	if value, err := strconv.ParseBool(getOption(config, "device_timestamp")); err == nil {
+		return value
+	}
+	return false
+}
+
+func getIpmitoolShell(config map[string]ctypes.ConfigValue) bool {
+	if shell, ok := config["ipmitool_shell"]; ok {
+		value, err := strconv.ParseBool(shell.(ctypes.ConfigValueStr).Value)
+		if err == nil {
+			return value
+		}
+	}
+	return false
+}
+
+// policiesDue checks whether "policy_interval" passed since Node Manager
+// policies were enumerated (never when it is not set).
+func (ic *IpmiCollector) policiesDue(config map[string]ctypes.ConfigValue) bool {
+	interval, err := time.ParseDuration(getOption(config, "policy_interval"))
+	return err == nil && interval > 0 && time.Since(ic.policiesAt) >= interval
+}
+
+// refreshPolicies enumerates Node Manager policies of hosts again, so that
+// policies created or removed since capabilities were discovered are collected.
+func (ic *IpmiCollector) refreshPolicies() {
+	ic.policiesAt = time.Now()
+	for key, group := range ic.groups {
+		var templates []ipmi.RequestDescription
+		for _, desc := range ic.vendors[key] {
+			if ipmi.IsPolicyRequest(desc.Request) {
+				templates = append(templates, desc)
+			}
+		}
+		if len(templates) == 0 {
+			continue
+		}
+		policies := ic.IpmiLayer.GetPlatformCapabilities(templates, group)
+		for _, host := range group {
+			requests := make([]ipmi.RequestDescription, 0, len(ic.Vendor[host]))
+			for _, desc := range ic.Vendor[host] {
+				if !ipmi.IsPolicyRequest(desc.Request) {
+					requests = append(requests, desc)
+				}
+			}
+			ic.Vendor[host] = append(requests, policies[host]...)
+		}
+	}
+}
+
+// getRetryPolicy reads "timeout" and "backoff" (durations, e.g. "5s")
+// and "retries" options. Zero values mean ipmi layer defaults.
+func getRetryPolicy(config map[string]ctypes.ConfigValue) ipmi.RetryPolicy {
+	var policy ipmi.RetryPolicy
+	if timeout, ok := config["timeout"]; ok {
+		if value, err := time.ParseDuration(timeout.(ctypes.ConfigValueStr).Value); err == nil {
+			policy.Timeout = value
+		}
+	}
+	if retries, ok := config["retries"]; ok {
+		if value, err := strconv.Atoi(retries.(ctypes.ConfigValueStr).Value); err == nil {
+			policy.Retries = value
+		}
+	}
+	if backoff, ok := config["backoff"]; ok {
+		if value, err := time.ParseDuration(backoff.(ctypes.ConfigValueStr).Value); err == nil {
+			policy.Backoff = value
+		}
+	}
+	return policy
+}
+
+// getScheduler wraps layer with scheduler configured by "workers"
+// (requests in flight across hosts), "host_requests" (requests in flight
+// to single host) and "deadline" (time limit of single collection) options.
+func getScheduler(config map[string]ctypes.ConfigValue, layer ipmi.IpmiAL) *ipmi.Scheduler {
+	scheduler := ipmi.NewScheduler(layer)
+	if workers, err := strconv.Atoi(getOption(config, "workers")); err == nil && workers > 0 {
+		scheduler.Workers = workers
+	}
+	if limit, err := strconv.Atoi(getOption(config, "host_requests")); err == nil && limit > 0 {
+		scheduler.HostLimit = limit
+	}
+	if deadline, err := time.ParseDuration(getOption(config, "deadline")); err == nil {
+		scheduler.Deadline = deadline
+	}
+	return scheduler
+}
+
+// newLayer creates IPMI backend reaching host in its mode.
+// Nil is returned for unknown mode.
+func newLayer(h HostConfig, config map[string]ctypes.ConfigValue) ipmi.IpmiAL {
+	persistent := getIpmitoolShell(config)
+	retry := getRetryPolicy(config)
+	switch h.Mode {
+	case "legacy_inband":
+		return &ipmi.LinuxInBandIpmitool{Device: "ipmitool", Protocol: h.Protocol, Persistent: persistent, Retry: retry}
+	case "oob":
+		return &ipmi.LinuxOutOfBand{Device: "ipmitool", User: h.User, Pass: h.Password, Protocol: h.Protocol,
+			Interface: h.Interface, Persistent: persistent, Retry: retry}
+	case "oob_native":
+		return &ipmi.LinuxOutOfBandNative{User: h.User, Pass: h.Password, Protocol: h.Protocol,
+			CipherSuite: h.CipherSuite, Interface: h.Interface, Retry: retry}
+	case "legacy_inband_openipmi":
+		return &ipmi.LinuxInband{Device: "/dev/ipmi0", Protocol: h.Protocol, Retry: retry}
+	}
+	return nil
+}
+
+// getVendor returns requests matching protocol of host, bridged along its path.
+func getVendor(h HostConfig, config map[string]ctypes.ConfigValue) []ipmi.RequestDescription {
+	vendor := ipmi.DCMIVendor
+	if h.Protocol == "node_manager" {
+		vendor = ipmi.GenericVendor
+	}
+	path := getBridgePath(config)
+	if h.Bridge != "" {
+		hostPath, err := ipmi.ParseBridgePath(h.Bridge)
+		if err != nil {
+			log.WithFields(log.Fields{
+				"host":  h.Host,
+				"error": err,
+			}).Error("Invalid bridge of host")
+		} else {
+			path = hostPath
+		}
+	}
+	if path != nil {
+		vendor = ipmi.WithBridge(vendor, path)
+	}
+	return vendor
+}
+
 func (ic *IpmiCollector) construct(cfg map[string]ctypes.ConfigValue) {
-	var hostList []string
-	var ipmiLayer ipmi.IpmiAL
 	ic.Mode = getMode(cfg)
-	channel := getChannel(cfg)
-	slave := getSlave(cfg)
-	user := getUser(cfg)
-	pass := getPass(cfg)
-	protocol := getProtocol(cfg)
-
-	host, _ := os.Hostname()
-
-	hostList = []string{host}
-	if ic.Mode == "legacy_inband" {
-		ipmiLayer = &ipmi.LinuxInBandIpmitool{Device: "ipmitool", Channel: channel, Slave: slave, Protocol: protocol}
-	} else if ic.Mode == "oob" {
-		ipmiLayer = &ipmi.LinuxOutOfBand{Device: "ipmitool", Channel: channel, Slave: slave, User: user, Pass: pass, Protocol: protocol}
-		hostList = []string{getHost(cfg)}
-	} else if ic.Mode == "legacy_inband_openipmi" {
-		ipmiLayer = &ipmi.LinuxInband{Device: "/dev/ipmi0", Protocol: protocol}
-	} else {
+	ic.deviceTimestamp = getDeviceTimestamp(cfg)
+	if ic.discoveryDue(cfg) {
+		ic.discover(cfg)
+	}
+	hosts, err := getHosts(cfg, ic.discovered)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"error": err,
+		}).Error("Unable to read hosts")
+		return
+	}
+
+	var replayer *ipmi.Replayer
+	var entries []HostConfig
+	for _, h := range hosts {
+		if h.Mode != "replay" {
+			entries = append(entries, h)
+			continue
+		}
+		if replayer == nil {
+			if replayer, err = ipmi.LoadTranscript(getOption(cfg, "transcript")); err != nil {
+				log.WithFields(log.Fields{
+					"error": err,
+				}).Error("Unable to load transcript")
+				return
+			}
+		}
+		if h.Host != "" {
+			entries = append(entries, h)
+			continue
+		}
+		for _, host := range replayer.Hosts() { //all recorded hosts
+			h.Host = host
+			entries = append(entries, h)
+		}
+	}
+
+	router := &ipmi.HostRouter{Layers: make(map[string]ipmi.IpmiAL)}
+	var hostList []string
+	vendors := make(map[string][]ipmi.RequestDescription)
+	groups := make(map[string][]string)
+	for _, h := range entries {
+		if _, ok := router.Layers[h.Host]; ok {
+			log.WithFields(log.Fields{
+				"host": h.Host,
+			}).Warn("Skipping duplicated host")
+			continue
+		}
+		var layer ipmi.IpmiAL
+		if h.Mode == "replay" {
+			layer = replayer
+		} else if layer = newLayer(h, cfg); layer == nil {
+			log.WithFields(log.Fields{
+				"host": h.Host,
+				"mode": h.Mode,
+			}).Error("Unknown mode of host")
+			continue
+		}
+		router.Layers[h.Host] = layer
+		hostList = append(hostList, h.Host)
+
+		// hosts using the same requests are checked together
+		vendor := getVendor(h, cfg)
+		key := h.Protocol + "/" + h.Bridge
+		vendors[key] = vendor
+		groups[key] = append(groups[key], h.Host)
+	}
+	if len(hostList) == 0 {
 		return
 	}
 
+	var ipmiLayer ipmi.IpmiAL = router
+	ic.cache = nil
+	if dir := getOption(cfg, "cache_dir"); dir != "" {
+		ic.cache = &ipmi.Cache{Layer: ipmiLayer, Dir: dir}
+		ipmiLayer = ic.cache
+	}
+	if path := getOption(cfg, "record"); path != "" && replayer == nil {
+		recorder, err := ipmi.OpenRecorder(ipmiLayer, path)
+		if err != nil {
+			log.WithFields(log.Fields{
+				"error": err,
+			}).Error("Unable to open transcript")
+		} else {
+			ipmiLayer = recorder
+		}
+	}
+
+	ipmiLayer = getScheduler(cfg, ipmiLayer)
+
+	if closer, ok := ic.IpmiLayer.(io.Closer); ok {
+		closer.Close() //release sessions of previous configuration
+	}
 	ic.IpmiLayer = ipmiLayer
 	ic.Hosts = hostList
-	if protocol == "node_manager" {
-		ic.Vendor = ipmiLayer.GetPlatformCapabilities(ipmi.GenericVendor, hostList)
-	} else {
-		ic.Vendor = ipmiLayer.GetPlatformCapabilities(ipmi.DCMIVendor, hostList)
+	ic.Vendor = make(map[string][]ipmi.RequestDescription, len(hostList))
+	for key, group := range groups {
+		for host, requests := range ipmiLayer.GetPlatformCapabilities(vendors[key], group) {
+			ic.Vendor[host] = requests
+		}
 	}
+	ic.vendors, ic.groups, ic.policiesAt = vendors, groups, time.Now()
+
+	ic.sdrParser = &ipmi.SdrParser{IpmiLayer: ic.IpmiLayer, Cache: ic.cache}
 
 	parser := &ipmi.FruParser{}
 	parser.IpmiLayer = ic.IpmiLayer
@@ -0,0 +1,774 @@
+// +build linux
+
+/*
+http://www.apache.org/licenses/LICENSE-2.0.txt
+
+
+Copyright 2016 Intel Corporation
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package bmcsim implements simulated BMC answering raw IPMI requests
+// with Node Manager, DCMI, SDR, FRU and SEL data. Simulator exposes
+// simulated BMCs through ipmi.IpmiAL so collector can be exercised
+// without hardware.
+package bmcsim
+
+import (
+	"encoding/binary"
+	"sync"
+	"time"
+
+	"github.com/intelsdi-x/snap-plugin-collector-intel-dcm-platform/ipmi"
+)
+
+// Completion codes returned by simulated BMC.
+const (
+	ccOK              = 0x00
+	ccInvalidPolicy   = 0x80
+	ccNoActiveLimit   = 0x80
+	ccInvalidDomain   = 0x81
+	ccUnknownTrigger  = 0x82
+	ccPowerLimitRange = 0x84
+	ccCorrectionRange = 0x85
+	ccPeriodRange     = 0x89
+	ccInvalidParam    = 0x80
+	ccBusy            = 0xc0
+	ccInvalidCmd      = 0xc1
+	ccReservation     = 0xc5
+	ccLength          = 0xc7
+	ccCannotReturn    = 0xca
+	ccOutOfRange      = 0xc9
+	ccNotPresent      = 0xcb
+	ccInvalidField    = 0xcc
+)
+
+// Network functions served by simulated BMC.
+const (
+	netFnSensor    = 0x04
+	netFnApp       = 0x06
+	netFnStorage   = 0x0a
+	netFnTransport = 0x0c
+	netFnDCMI      = 0x2c
+	netFnNM        = 0x2e
+)
+
+// bmcAddress is slave address of BMC, owner of sensors without Owner.
+const bmcAddress = 0x20
+
+// Node Manager statistics modes.
+const (
+	ModePower             = 0x01
+	ModeInletTemperature  = 0x02
+	ModeAirflow           = 0x04
+	ModeOutletTemperature = 0x05
+)
+
+// Node Manager domains.
+const (
+	DomainPlatform = 0x00
+	DomainCPU      = 0x01
+	DomainMemory   = 0x02
+)
+
+// dcmiGroup is DCMI group extension identification.
+const dcmiGroup = 0xdc
+
+// intelIANA prefixes all Node Manager requests and responses.
+var intelIANA = []byte{0x57, 0x01, 0x00}
+
+// Statistic is value reported by Get Node Manager Statistics
+// or Get DCMI Power Reading.
+type Statistic struct {
+	Cur uint16
+	Min uint16
+	Max uint16
+	Avg uint16
+}
+
+// PowerLimit is DCMI power limit. CorrectionTime is in milliseconds,
+// SamplingPeriod in seconds.
+type PowerLimit struct {
+	Action         uint8
+	Limit          uint16
+	CorrectionTime uint32
+	SamplingPeriod uint16
+}
+
+// StatisticKey identifies Node Manager statistic.
+type StatisticKey struct {
+	Mode   uint8
+	Domain uint8
+}
+
+// CUPS is Compute Usage Per Second data of Node Manager.
+type CUPS struct {
+	Index  uint16
+	CPU    uint16
+	Memory uint16
+	IO     uint16
+}
+
+// PECI is CPU temperature target returned through Node Manager PECI proxy.
+type PECI struct {
+	MarginOffset uint8
+	TjMax        uint16
+}
+
+// PolicyKey identifies Node Manager policy.
+type PolicyKey struct {
+	Domain uint8
+	ID     uint8
+}
+
+// Policy is Node Manager power limiting policy.
+// CorrectionTime is in milliseconds, ReportingPeriod in seconds.
+type Policy struct {
+	Enabled         bool
+	Trigger         uint8
+	Limit           uint16
+	CorrectionTime  uint32
+	TriggerLimit    uint16
+	ReportingPeriod uint16
+	Actions         uint8
+	Volatile        bool
+	SuspendPeriods  []SuspendPeriod
+	AlertThresholds []uint16
+}
+
+// SuspendPeriod is time of day policy is not active on, Start and Stop are
+// in 6 minute units, bit 0 of Days is Monday.
+type SuspendPeriod struct {
+	Start uint8
+	Stop  uint8
+	Days  uint8
+}
+
+// BMC is simulated baseboard management controller.
+// Node Manager commands are answered only when NodeManager is set,
+// DCMI commands only when DCMI is set. Sensors are exposed as device
+// SDRs when DeviceSdr is set, otherwise through SDR repository.
+// Busy BMC is simulated with MaxSdrRead, limiting bytes returned by
+// single Get SDR, SdrReservationLifetime, number of Get SDR commands
+// after which reservation is canceled, and NMBusy, number of next Node
+// Manager requests answered with node busy. MaxPolicies is number of
+// policies per domain reported by Node Manager capabilities, 16 when 0.
+// Fields may be changed concurrently with requests while BMC is locked.
+type BMC struct {
+	sync.Mutex
+
+	DeviceID       uint8
+	FirmwareMajor  uint8
+	FirmwareMinor  uint8
+	ManufacturerID uint32
+	ProductID      uint16
+	MAC            [6]byte
+
+	FRU         []byte
+	Sensors     []Sensor
+	DeviceSdr   bool
+	SdrAddition uint32
+	SdrErase    uint32
+
+	MaxSdrRead             uint8
+	SdrReservationLifetime int
+	SEL                    []Event
+
+	NodeManager      bool
+	NMVersion        uint8
+	NMBusy           int
+	Statistics       map[StatisticKey]Statistic
+	StatisticsPeriod uint32
+	CUPS             *CUPS
+	CPUTemperatures  []uint8
+	DIMMTemperatures []uint8
+	PECI             *PECI
+	Policies         map[PolicyKey]Policy
+	MaxPolicies      uint8
+	// policy control disabled globally or in domains
+	PolicyControlDisabled bool
+	DomainControlDisabled map[uint8]bool
+
+	DCMI             bool
+	PowerReading     Statistic
+	PowerLimit       PowerLimit
+	PowerLimitActive bool
+
+	sdrReservation uint16
+	sdrReads       int
+	selReservation uint16
+}
+
+// NewBMC returns BMC of two socket platform supporting both
+// Node Manager and DCMI.
+func NewBMC() *BMC {
+	return &BMC{
+		DeviceID:       0x20,
+		FirmwareMajor:  1,
+		FirmwareMinor:  43,
+		ManufacturerID: 0x000157,
+		ProductID:      0x0b2f,
+		MAC:            [6]byte{0x00, 0x1e, 0x67, 0x12, 0x34, 0x56},
+
+		FRU: ProductFRU("Intel Corporation", "S2600WT2R", "H48104-850", "1.0", "BQWL52100456"),
+		Sensors: []Sensor{
+			{Number: 0x30, Type: SensorTemperature, ReadingType: ReadingThreshold, Entity: EntityAirInlet, Instance: 1, Name: "Inlet Temp", Reading: 24,
+				Unit: ipmi.UnitCodeCelsius, M: 1, Thresholds: [6]uint8{5, 0, 0, 40, 45, 0}, ThresholdMask: 0x1b, Hysteresis: [2]uint8{2, 2}, Nominal: 25},
+			{Number: 0x08, Owner: 0x2c, Type: SensorTemperature, ReadingType: ReadingThreshold, Entity: EntitySystemBoard, Instance: 1, Name: "SSB Temp", Reading: 41,
+				Unit: ipmi.UnitCodeCelsius, M: 1},
+			{Number: 0xd0, Type: SensorVoltage, ReadingType: ReadingThreshold, Entity: EntitySystemBoard, Instance: 1, Name: "BB +12.0V", Reading: 186,
+				Unit: ipmi.UnitCodeVolts, M: 63, RExp: -3, Thresholds: [6]uint8{0, 171, 0, 0, 210, 0}, ThresholdMask: 0x12, Nominal: 190},
+			{Number: 0xa0, Type: SensorFan, ReadingType: ReadingThreshold, Entity: EntityFan, Instance: 1, Name: "System Fan 1", Reading: 94,
+				Unit: ipmi.UnitCodeRPM, M: 64},
+			{Number: 0x50, Type: SensorProcessor, ReadingType: ReadingSensorSpecific, Entity: EntityProcessor, Instance: 1, Name: "P1 Status"},
+		},
+		SEL: []Event{
+			{Timestamp: 0x57f3a0c0, GeneratorID: 0x0020, SensorType: 0x12, SensorNumber: 0x83, ReadingType: ReadingSensorSpecific, Data: [3]byte{0x01, 0xff, 0xff}},
+		},
+
+		NodeManager: true,
+		NMVersion:   ipmi.NMVersion30,
+		Statistics: map[StatisticKey]Statistic{
+			{ModePower, DomainPlatform}:             {Cur: 212, Min: 150, Max: 305, Avg: 220},
+			{ModePower, DomainCPU}:                  {Cur: 120, Min: 60, Max: 190, Avg: 125},
+			{ModePower, DomainMemory}:               {Cur: 18, Min: 10, Max: 30, Avg: 19},
+			{ModeInletTemperature, DomainPlatform}:  {Cur: 24, Min: 21, Max: 27, Avg: 24},
+			{ModeOutletTemperature, DomainPlatform}: {Cur: 38, Min: 30, Max: 45, Avg: 37},
+			{ModeAirflow, DomainPlatform}:           {Cur: 350, Min: 200, Max: 480, Avg: 340},
+		},
+		StatisticsPeriod: 3600,
+		CUPS:             &CUPS{Index: 45, CPU: 4000, Memory: 1200, IO: 300},
+		CPUTemperatures:  []uint8{52, 49},
+		DIMMTemperatures: []uint8{33, 34, 0, 0, 32, 33, 0, 0},
+		PECI:             &PECI{MarginOffset: 0, TjMax: 95},
+		Policies: map[PolicyKey]Policy{
+			{DomainPlatform, 1}: {Enabled: true, Limit: 350, CorrectionTime: 6000, ReportingPeriod: 10},
+			{DomainCPU, 5}: {Trigger: ipmi.PolicyTriggerInletTemp, Limit: 150, CorrectionTime: 1000, TriggerLimit: 35, ReportingPeriod: 10,
+				SuspendPeriods: []SuspendPeriod{{Start: 80, Stop: 95, Days: 0x1f}}},
+		},
+
+		DCMI:         true,
+		PowerReading: Statistic{Cur: 215, Min: 148, Max: 310, Avg: 221},
+		PowerLimit:   PowerLimit{Action: ipmi.DCMIActionLogSEL, Limit: 400, CorrectionTime: 6000, SamplingPeriod: 10},
+	}
+}
+
+// Handle executes raw request (netfn, command and data) sent to BMC
+// and returns response data starting with completion code.
+func (b *BMC) Handle(request []byte) []byte {
+	return b.HandleAddress(bmcAddress, request)
+}
+
+// HandleAddress executes raw request sent to controller at given slave
+// address. Sensor commands are answered for sensors owned by the controller,
+// other requests are answered the same for all controllers.
+func (b *BMC) HandleAddress(address byte, request []byte) []byte {
+	if len(request) < 2 {
+		return []byte{ccLength}
+	}
+	b.Lock()
+	defer b.Unlock()
+
+	cmd, data := request[1], request[2:]
+	switch request[0] {
+	case netFnApp:
+		return b.app(cmd, data)
+	case netFnSensor:
+		return b.sensor(address, cmd, data)
+	case netFnStorage:
+		return b.storage(cmd, data)
+	case netFnTransport:
+		return b.transport(cmd, data)
+	case netFnDCMI:
+		if b.DCMI {
+			return b.dcmi(cmd, data)
+		}
+	case netFnNM:
+		if b.NodeManager && b.NMBusy > 0 {
+			b.NMBusy--
+			return []byte{ccBusy}
+		}
+		if b.NodeManager {
+			return b.nodeManager(cmd, data)
+		}
+	}
+	return []byte{ccInvalidCmd}
+}
+
+// ok returns successful response with given data.
+func ok(data ...byte) []byte {
+	return append([]byte{ccOK}, data...)
+}
+
+func putUint16(data []byte, v uint16) []byte {
+	return append(data, byte(v), byte(v>>8))
+}
+
+func putUint32(data []byte, v uint32) []byte {
+	var b [4]byte
+	binary.LittleEndian.PutUint32(b[:], v)
+	return append(data, b[:]...)
+}
+
+func (b *BMC) app(cmd byte, data []byte) []byte {
+	if cmd != 0x01 {
+		return []byte{ccInvalidCmd}
+	}
+	// Get Device ID: device revision bit 7 announces device SDRs,
+	// additional device support tells where SDRs are kept.
+	revision, support := byte(0x01), byte(0x02)
+	if b.DeviceSdr {
+		revision, support = 0x81, 0x01
+	}
+	minor := (b.FirmwareMinor/10)<<4 | b.FirmwareMinor%10
+	resp := ok(b.DeviceID, revision, b.FirmwareMajor&0x7f, minor, 0x02, support|0x0c,
+		byte(b.ManufacturerID), byte(b.ManufacturerID>>8), byte(b.ManufacturerID>>16))
+	return putUint16(resp, b.ProductID)
+}
+
+func (b *BMC) sensor(address byte, cmd byte, data []byte) []byte {
+	switch {
+	case cmd == 0x2d:
+		return b.sensorReading(address, data)
+	case cmd == 0x23:
+		return b.sensorFactors(address, data)
+	case cmd == 0x25 || cmd == 0x27:
+		return b.sensorThresholds(address, cmd, data)
+	case cmd == 0x20 && b.DeviceSdr:
+		// dynamic sensor population, change indicator follows
+		return putUint32(ok(byte(len(b.Sensors)), 0x81), b.SdrAddition)
+	case cmd == 0x21 && b.DeviceSdr:
+		return b.getSdr(data)
+	case cmd == 0x22 && b.DeviceSdr:
+		return b.reserveSdr()
+	}
+	return []byte{ccInvalidCmd}
+}
+
+func (b *BMC) storage(cmd byte, data []byte) []byte {
+	switch {
+	case cmd == 0x10:
+		return b.fruInfo(data)
+	case cmd == 0x11:
+		return b.readFru(data)
+	case cmd == 0x20 && !b.DeviceSdr:
+		resp := putUint16(ok(0x51), uint16(len(b.Sensors)))
+		resp = putUint16(resp, 0)
+		resp = putUint32(resp, b.SdrAddition)
+		resp = putUint32(resp, b.SdrErase)
+		return append(resp, 0x02)
+	case cmd == 0x21 && !b.DeviceSdr:
+		// Allocation unit size limits single Get SDR read.
+		resp := putUint16(ok(), uint16(len(b.Sensors)))
+		resp = putUint16(resp, 16)
+		resp = putUint16(resp, 0)
+		resp = putUint16(resp, 0)
+		return append(resp, 4)
+	case cmd == 0x22 && !b.DeviceSdr:
+		return b.reserveSdr()
+	case cmd == 0x23 && !b.DeviceSdr:
+		return b.getSdr(data)
+	case cmd == 0x40:
+		resp := putUint16(ok(0x51), uint16(len(b.SEL)))
+		resp = putUint16(resp, 0)
+		resp = putUint32(resp, 0)
+		resp = putUint32(resp, 0)
+		return append(resp, 0x02)
+	case cmd == 0x42:
+		b.selReservation++
+		if b.selReservation == 0 {
+			b.selReservation++
+		}
+		return putUint16(ok(), b.selReservation)
+	case cmd == 0x43:
+		return b.getSelEntry(data)
+	}
+	return []byte{ccInvalidCmd}
+}
+
+func (b *BMC) transport(cmd byte, data []byte) []byte {
+	if cmd != 0x02 {
+		return []byte{ccInvalidCmd}
+	}
+	if len(data) < 4 {
+		return []byte{ccLength}
+	}
+	// Get LAN Configuration Parameters, only MAC address (5) is known.
+	if data[1] != 0x05 {
+		return []byte{ccInvalidParam}
+	}
+	return append(ok(0x11), b.MAC[:]...)
+}
+
+func (b *BMC) dcmi(cmd byte, data []byte) []byte {
+	if len(data) < 1 || data[0] != dcmiGroup {
+		return []byte{ccInvalidField}
+	}
+	switch cmd {
+	case 0x02:
+		// Get Power Reading: current, minimum, maximum, average,
+		// timestamp, statistics period (ms) and reading state.
+		resp := ok(dcmiGroup)
+		resp = putUint16(resp, b.PowerReading.Cur)
+		resp = putUint16(resp, b.PowerReading.Min)
+		resp = putUint16(resp, b.PowerReading.Max)
+		resp = putUint16(resp, b.PowerReading.Avg)
+		resp = putUint32(resp, uint32(time.Now().Unix()))
+		resp = putUint32(resp, b.StatisticsPeriod*1000)
+		return append(resp, 0x40)
+	case 0x03:
+		// Get Power Limit, completed with 80h while limit is not active
+		resp := ok(dcmiGroup, 0x00, 0x00, b.PowerLimit.Action)
+		if !b.PowerLimitActive {
+			resp[0] = ccNoActiveLimit
+		}
+		resp = putUint16(resp, b.PowerLimit.Limit)
+		resp = putUint32(resp, b.PowerLimit.CorrectionTime)
+		resp = append(resp, 0x00, 0x00)
+		return putUint16(resp, b.PowerLimit.SamplingPeriod)
+	case 0x04:
+		return b.setPowerLimit(data)
+	case 0x05:
+		// Activate/Deactivate Power Limit
+		if len(data) < 2 {
+			return []byte{ccLength}
+		}
+		if data[1] > 0x01 {
+			return []byte{ccInvalidField}
+		}
+		b.PowerLimitActive = data[1] == 0x01
+		return ok(dcmiGroup)
+	case 0x01:
+		return b.dcmiCapabilities(data)
+	case 0x07:
+		return b.dcmiSensorInfo(data)
+	}
+	return []byte{ccInvalidCmd}
+}
+
+// setPowerLimit answers Set Power Limit, ranges are the same as of Node Manager policies.
+func (b *BMC) setPowerLimit(data []byte) []byte {
+	if len(data) < 15 {
+		return []byte{ccLength}
+	}
+	limit := PowerLimit{
+		Action:         data[4],
+		Limit:          binary.LittleEndian.Uint16(data[5:]),
+		CorrectionTime: binary.LittleEndian.Uint32(data[7:]),
+		SamplingPeriod: binary.LittleEndian.Uint16(data[13:]),
+	}
+	switch {
+	case limit.Limit < 50 || limit.Limit > 800:
+		return []byte{ccPowerLimitRange}
+	case limit.CorrectionTime < 1000 || limit.CorrectionTime > 600000:
+		return []byte{ccCorrectionRange}
+	case limit.SamplingPeriod < 1 || limit.SamplingPeriod > 3600:
+		return []byte{ccPeriodRange}
+	}
+	b.PowerLimit = limit
+	return ok(dcmiGroup)
+}
+
+// dcmiCapabilities answers Get DCMI Capabilities Info of supported capabilities
+// (DCMI 1.5): identification, SEL and chassis power are always reported,
+// temperature monitoring when inlet temperature sensor is present, power management always.
+func (b *BMC) dcmiCapabilities(data []byte) []byte {
+	if len(data) < 2 {
+		return []byte{ccLength}
+	}
+	if data[1] != 0x01 {
+		return []byte{ccInvalidParam}
+	}
+	mandatory := byte(0x07)
+	for _, s := range b.Sensors {
+		if s.Type == SensorTemperature && s.Entity == EntityAirInlet {
+			mandatory |= 0x08
+		}
+	}
+	return ok(dcmiGroup, 0x01, 0x05, 0x02, 0x00, mandatory, 0x01, 0x08)
+}
+
+// dcmiSensorInfo answers Get DCMI Sensor Info with record IDs of sensors
+// matching requested sensor type, entity and instance (0 means all).
+func (b *BMC) dcmiSensorInfo(data []byte) []byte {
+	if len(data) < 5 {
+		return []byte{ccLength}
+	}
+	var ids []uint16
+	for i, s := range b.Sensors {
+		if s.Type == data[1] && s.Entity == data[2] && (data[3] == 0 || s.Instance == data[3]) {
+			ids = append(ids, recordID(i))
+		}
+	}
+	start := int(data[4])
+	if start > 0 {
+		start--
+	}
+	if start > len(ids) {
+		return []byte{ccOutOfRange}
+	}
+	page := ids[start:]
+	if len(page) > 8 {
+		page = page[:8]
+	}
+	resp := ok(dcmiGroup, byte(len(ids)), byte(len(page)))
+	for _, id := range page {
+		resp = putUint16(resp, id)
+	}
+	return resp
+}
+
+func (b *BMC) nodeManager(cmd byte, data []byte) []byte {
+	if len(data) < 3 || data[0] != intelIANA[0] || data[1] != intelIANA[1] || data[2] != intelIANA[2] {
+		return []byte{ccInvalidField}
+	}
+	resp := ok(intelIANA...)
+	data = data[3:]
+	switch cmd {
+	case 0xca:
+		// Get Node Manager Version: version, IPMI interface version, patch and firmware revision
+		return append(resp, b.NMVersion, 0x03, 0x00, b.FirmwareMajor, b.FirmwareMinor)
+	case 0xc9:
+		return b.nmCapabilities(data)
+	case 0xc8:
+		// Get Node Manager Statistics
+		if len(data) < 3 {
+			return []byte{ccLength}
+		}
+		domain := data[1] & 0x0f
+		stat, found := b.Statistics[StatisticKey{data[0] & 0x1f, domain}]
+		if !found {
+			return []byte{ccNotPresent}
+		}
+		resp = putUint16(resp, stat.Cur)
+		resp = putUint16(resp, stat.Min)
+		resp = putUint16(resp, stat.Max)
+		resp = putUint16(resp, stat.Avg)
+		resp = putUint32(resp, uint32(time.Now().Unix()))
+		resp = putUint32(resp, b.StatisticsPeriod)
+		return append(resp, 0x70|domain)
+	case 0x65:
+		// Get CUPS Data: parameter 1 is index, 2 dynamic load factors.
+		if b.CUPS == nil {
+			return []byte{ccInvalidCmd}
+		}
+		if len(data) < 1 {
+			return []byte{ccLength}
+		}
+		switch data[0] {
+		case 0x01:
+			return putUint16(resp, b.CUPS.Index)
+		case 0x02:
+			resp = putUint16(resp, b.CUPS.CPU)
+			resp = putUint16(resp, b.CUPS.Memory)
+			return putUint16(resp, b.CUPS.IO)
+		}
+		return []byte{ccInvalidField}
+	case 0x4b:
+		// Get CPU and Memory Temperature: four sockets followed by DIMMs.
+		if b.CPUTemperatures == nil && b.DIMMTemperatures == nil {
+			return []byte{ccInvalidCmd}
+		}
+		var cpus [4]byte
+		copy(cpus[:], b.CPUTemperatures)
+		resp = append(resp, cpus[:]...)
+		return append(resp, b.DIMMTemperatures...)
+	case 0x40:
+		// Send Raw PECI, only Get Temp Target is simulated.
+		if b.PECI == nil {
+			return []byte{ccInvalidCmd}
+		}
+		resp = append(resp, 0x40, 0x00, b.PECI.MarginOffset)
+		return putUint16(resp, b.PECI.TjMax)
+	case 0xc2:
+		// Get Node Manager Policy
+		if len(data) < 2 {
+			return []byte{ccLength}
+		}
+		domain := data[0] & 0x0f
+		policy, found := b.Policies[PolicyKey{domain, data[1]}]
+		if !found {
+			return []byte{ccInvalidPolicy}
+		}
+		flags := domain
+		if policy.Enabled {
+			flags |= 0x10
+		}
+		if !b.DomainControlDisabled[domain] {
+			flags |= 0x20
+		}
+		if !b.PolicyControlDisabled {
+			flags |= 0x40
+		}
+		trigger := 0x10 | policy.Trigger&0x0f
+		if policy.Volatile {
+			trigger |= 0x80
+		}
+		resp = append(resp, flags, trigger, policy.Actions)
+		resp = putUint16(resp, policy.Limit)
+		resp = putUint32(resp, policy.CorrectionTime)
+		resp = putUint16(resp, policy.TriggerLimit)
+		return putUint16(resp, policy.ReportingPeriod)
+	case 0xc1:
+		return b.setPolicy(data)
+	case 0xc0:
+		// Enable/Disable Node Manager Policy Control
+		if len(data) < 3 {
+			return []byte{ccLength}
+		}
+		enable := data[0]&0x01 != 0
+		domain := data[1] & 0x0f
+		switch data[0] & 0x07 {
+		case 0x00, 0x01:
+			b.PolicyControlDisabled = !enable
+		case 0x02, 0x03:
+			if b.DomainControlDisabled == nil {
+				b.DomainControlDisabled = make(map[uint8]bool)
+			}
+			b.DomainControlDisabled[domain] = !enable
+		case 0x04, 0x05:
+			key := PolicyKey{domain, data[2]}
+			policy, found := b.Policies[key]
+			if !found {
+				return []byte{ccInvalidPolicy}
+			}
+			policy.Enabled = enable
+			b.Policies[key] = policy
+		default:
+			return []byte{ccInvalidField}
+		}
+		return resp
+	case 0xc3:
+		// Set Node Manager Policy Alert Thresholds
+		if len(data) < 3 || len(data) < 3+2*int(data[2]) {
+			return []byte{ccLength}
+		}
+		key := PolicyKey{data[0] & 0x0f, data[1]}
+		policy, found := b.Policies[key]
+		if !found {
+			return []byte{ccInvalidPolicy}
+		}
+		if data[2] > 3 {
+			return []byte{ccInvalidField}
+		}
+		policy.AlertThresholds = nil
+		for i := 0; i < int(data[2]); i++ {
+			policy.AlertThresholds = append(policy.AlertThresholds, binary.LittleEndian.Uint16(data[3+2*i:]))
+		}
+		b.Policies[key] = policy
+		return resp
+	case 0xc6:
+		// Get Node Manager Policy Suspend Periods
+		if len(data) < 2 {
+			return []byte{ccLength}
+		}
+		policy, found := b.Policies[PolicyKey{data[0] & 0x0f, data[1]}]
+		if !found {
+			return []byte{ccInvalidPolicy}
+		}
+		resp = append(resp, byte(len(policy.SuspendPeriods)))
+		for _, period := range policy.SuspendPeriods {
+			resp = append(resp, period.Start, period.Stop, period.Days)
+		}
+		return resp
+	}
+	return []byte{ccInvalidCmd}
+}
+
+// setPolicy answers Set Node Manager Policy, limits are checked against
+// ranges reported by Get Node Manager Capabilities.
+func (b *BMC) setPolicy(data []byte) []byte {
+	if len(data) < 4 {
+		return []byte{ccLength}
+	}
+	domain := data[0] & 0x0f
+	key := PolicyKey{domain, data[1]}
+	if data[2]&0x10 == 0 {
+		// remove policy
+		if _, found := b.Policies[key]; !found {
+			return []byte{ccInvalidPolicy}
+		}
+		delete(b.Policies, key)
+		return ok(intelIANA...)
+	}
+	if len(data) < 14 {
+		return []byte{ccLength}
+	}
+	if _, found := b.Statistics[StatisticKey{ModePower, domain}]; !found {
+		return []byte{ccInvalidDomain}
+	}
+	policy := Policy{
+		Enabled:         data[0]&0x10 != 0,
+		Trigger:         data[2] & 0x0f,
+		Volatile:        data[2]&0x80 != 0,
+		Actions:         data[3],
+		Limit:           binary.LittleEndian.Uint16(data[4:]),
+		CorrectionTime:  binary.LittleEndian.Uint32(data[6:]),
+		TriggerLimit:    binary.LittleEndian.Uint16(data[10:]),
+		ReportingPeriod: binary.LittleEndian.Uint16(data[12:]),
+	}
+	switch {
+	case policy.Trigger > ipmi.PolicyTriggerBootTime:
+		return []byte{ccUnknownTrigger}
+	case policy.Limit < 50 || policy.Limit > 800:
+		return []byte{ccPowerLimitRange}
+	case policy.CorrectionTime < 1000 || policy.CorrectionTime > 600000:
+		return []byte{ccCorrectionRange}
+	case policy.ReportingPeriod < 1 || policy.ReportingPeriod > 3600:
+		return []byte{ccPeriodRange}
+	}
+	if old, found := b.Policies[key]; found {
+		policy.SuspendPeriods, policy.AlertThresholds = old.SuspendPeriods, old.AlertThresholds
+	}
+	if b.Policies == nil {
+		b.Policies = make(map[PolicyKey]Policy)
+	}
+	b.Policies[key] = policy
+	return ok(intelIANA...)
+}
+
+// nmCapabilities answers Get Node Manager Capabilities. Power control policies
+// are supported in domains with power statistics, inlet temperature trigger
+// when domain has inlet temperature statistics.
+func (b *BMC) nmCapabilities(data []byte) []byte {
+	if len(data) < 3 {
+		return []byte{ccLength}
+	}
+	domain := data[0] & 0x0f
+	mode := byte(ModePower)
+	switch data[1] {
+	case 0x00:
+	case 0x01:
+		mode = ModeInletTemperature
+	default:
+		return []byte{ccInvalidField}
+	}
+	if _, found := b.Statistics[StatisticKey{mode, domain}]; !found {
+		return []byte{ccInvalidField}
+	}
+	// maximal concurrent settings, limits, correction times, reporting periods, limiting scope
+	resp := ok(intelIANA...)
+	if b.MaxPolicies == 0 {
+		resp = append(resp, 16)
+	} else {
+		resp = append(resp, b.MaxPolicies)
+	}
+	resp = putUint16(resp, 800)
+	resp = putUint16(resp, 50)
+	resp = putUint32(resp, 1000)
+	resp = putUint32(resp, 600000)
+	resp = putUint16(resp, 1)
+	resp = putUint16(resp, 3600)
+	return append(resp, domain)
+}
@@ -0,0 +1,93 @@
+// +build linux
+
+/*
+http://www.apache.org/licenses/LICENSE-2.0.txt
+
+
+Copyright 2016 Intel Corporation
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package bmcsim
+
+import (
+	"context"
+
+	"github.com/intelsdi-x/snap-plugin-collector-intel-dcm-platform/ipmi"
+)
+
+// Simulator implements ipmi.IpmiAL serving requests with simulated BMCs
+// indexed by host. Requests to unknown hosts fail with ipmi.ErrNoResponse.
+// Protocol has the same meaning as in other backends: "dcmi" enables
+// discovery of DCMI inlet temperature sensor.
+type Simulator struct {
+	BMCs     map[string]*BMC
+	Protocol string
+}
+
+// BatchExecRaw performs batch of requests to given host.
+func (s *Simulator) BatchExecRaw(requests []ipmi.IpmiRequest, host string) ([]ipmi.IpmiResponse, error) {
+	return s.BatchExecRawContext(context.Background(), requests, host)
+}
+
+// ExecRaw performs single request to given host.
+func (s *Simulator) ExecRaw(request ipmi.IpmiRequest, host string) (*ipmi.IpmiResponse, error) {
+	return s.ExecRawContext(context.Background(), request, host)
+}
+
+// BatchExecRawContext performs batch of requests to given host until ctx is done.
+func (s *Simulator) BatchExecRawContext(ctx context.Context, requests []ipmi.IpmiRequest, host string) ([]ipmi.IpmiResponse, error) {
+	results := make([]ipmi.IpmiResponse, len(requests))
+	failed := ipmi.BatchError{}
+	for i, r := range requests {
+		resp, err := s.ExecRawContext(ctx, r, host)
+		if resp != nil {
+			results[i] = *resp
+		}
+		if err != nil {
+			failed[i] = err
+		}
+	}
+	if len(failed) == 0 {
+		return results, nil
+	}
+	return results, failed
+}
+
+// ExecRawContext performs single request to given host unless ctx is done.
+func (s *Simulator) ExecRawContext(ctx context.Context, request ipmi.IpmiRequest, host string) (*ipmi.IpmiResponse, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	bmc, ok := s.BMCs[host]
+	if !ok {
+		return nil, ipmi.ErrNoResponse
+	}
+	address := byte(bmcAddress)
+	if path := request.Path(); path != nil {
+		address = path[len(path)-1].Address
+	}
+	resp := &ipmi.IpmiResponse{Data: bmc.HandleAddress(address, request.Data), IsValid: 1}
+	return resp, ipmi.CheckResponse(request, *resp)
+}
+
+// GetPlatformCapabilities returns requests supported by each of hosts,
+// discovered the same way as by hardware backends.
+func (s *Simulator) GetPlatformCapabilities(requests []ipmi.RequestDescription, host []string) map[string][]ipmi.RequestDescription {
+	validRequests := make(map[string][]ipmi.RequestDescription, 0)
+	for _, addr := range host {
+		validRequests[addr] = ipmi.ProbeCapabilities(s, requests, addr, s.Protocol)
+	}
+	return validRequests
+}
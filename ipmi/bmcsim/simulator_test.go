@@ -0,0 +1,590 @@
+// +build unit
+
+/*
+http://www.apache.org/licenses/LICENSE-2.0.txt
+
+
+Copyright 2016 Intel Corporation
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package bmcsim
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/intelsdi-x/snap-plugin-collector-intel-dcm-platform/ipmi"
+	"github.com/intelsdi-x/snap-plugin-collector-intel-dcm-platform/ipmi/rmcp"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestSimulator(t *testing.T) {
+	Convey("Check simulated BMC", t, func() {
+		bmc := NewBMC()
+		sim := &Simulator{BMCs: map[string]*BMC{"bmc1": bmc}}
+		// policy requests are repeated for both simulated policies
+		supported := len(ipmi.GenericVendor) + 2
+
+		Convey("Node Manager requests are supported", func() {
+			caps := sim.GetPlatformCapabilities(ipmi.GenericVendor, []string{"bmc1"})
+			So(len(caps["bmc1"]), ShouldEqual, supported)
+
+			results, err := sim.BatchExecRaw([]ipmi.IpmiRequest{ipmi.GenericVendor[2].Request, ipmi.GenericVendor[0].Request}, "bmc1")
+			So(err, ShouldBeNil)
+			power := ipmi.FormatNodeManager.Parse(results[0])
+			So(power["cur"].Data, ShouldEqual, 212)
+			So(power["avg"].Data, ShouldEqual, 220)
+			So(ipmi.FormatCUPS.Parse(results[1])["memory_bandwith"].Data, ShouldEqual, 1200)
+
+			bmc.NodeManager = false
+			_, err = sim.ExecRaw(ipmi.GenericVendor[2].Request, "bmc1")
+			So(ipmi.IsUnsupported(err), ShouldBeTrue)
+		})
+
+		Convey("Node Manager policies of all domains are enumerated", func() {
+			caps := sim.GetPlatformCapabilities(ipmi.GenericVendor, []string{"bmc1"})
+			policies := caps["bmc1"][len(caps["bmc1"])-4:]
+			So(policies[0].MetricsRoot, ShouldEqual, "power/policy/platform/1")
+			So(policies[1].MetricsRoot, ShouldEqual, "power/policy/cpu/5")
+			resp, err := sim.ExecRaw(policies[1].Request, "bmc1")
+			So(err, ShouldBeNil)
+			policy := policies[1].Format.Parse(*resp)
+			So(policy["enabled"], ShouldResemble, ipmi.BoolValue(false))
+			So(policy["trigger_limit"], ShouldResemble, ipmi.IntValue(35, ipmi.UnitCelsius))
+			So(policy["power_limit"], ShouldResemble, ipmi.IntValue(150, ipmi.UnitWatt))
+			resp, err = sim.ExecRaw(policies[3].Request, "bmc1")
+			So(err, ShouldBeNil)
+			So(policies[3].Format.Parse(*resp)["suspend_schedule"], ShouldResemble, ipmi.StringValue("08:00-09:30 mon,tue,wed,thu,fri"))
+		})
+
+		Convey("Node Manager policies are enumerated up to maximum, busy replies are repeated", func() {
+			bmc.MaxPolicies = 1
+			layer := &busyPolicies{Simulator: sim, busy: 2}
+			caps := ipmi.ProbeCapabilities(layer, ipmi.GenericVendor, "bmc1", "")
+			policies := caps[len(caps)-4:]
+			So(policies[0].MetricsRoot, ShouldEqual, "power/policy/platform/1")
+			So(policies[1].MetricsRoot, ShouldEqual, "power/policy/cpu/5")
+			// platform stops at policy 1 answered after two busy replies,
+			// cpu at policy 5, memory has no policies and every ID is tried;
+			// found policy is read once more to check the command
+			So(layer.requests, ShouldEqual, 2+2+6+256+1)
+		})
+
+		Convey("Node Manager capabilities limit supported requests", func() {
+			bmc.NMVersion = ipmi.NMVersion15
+			delete(bmc.Statistics, StatisticKey{ModePower, DomainCPU})
+			delete(bmc.Statistics, StatisticKey{ModePower, DomainMemory})
+			caps := sim.GetPlatformCapabilities(ipmi.GenericVendor, []string{"bmc1"})
+			metrics := []string{}
+			for _, req := range caps["bmc1"] {
+				metrics = append(metrics, req.MetricsRoot)
+			}
+			So(metrics, ShouldResemble, []string{"power/system", "thermal/inlet", "thermal/chipset", "power/policy/platform/1"})
+
+			bmc.Sensors = bmc.Sensors[1:]
+			sim.Protocol = "dcmi"
+			caps = sim.GetPlatformCapabilities(ipmi.DCMIVendor, []string{"bmc1"})
+			So(len(caps["bmc1"]), ShouldEqual, 2)
+		})
+
+		Convey("DCMI power and inlet sensor are discovered", func() {
+			sim.Protocol = "dcmi"
+			caps := sim.GetPlatformCapabilities(ipmi.DCMIVendor, []string{"bmc1", "bmc2"})
+			So(len(caps["bmc1"]), ShouldEqual, 3)
+			So(len(caps["bmc2"]), ShouldEqual, 0)
+			So(caps["bmc1"][2].Request.Data, ShouldResemble, []byte{0x04, 0x2d, 0x30})
+
+			resp, err := sim.ExecRaw(caps["bmc1"][0].Request, "bmc1")
+			So(err, ShouldBeNil)
+			So(ipmi.FormatDCMIPower.Parse(*resp)["max"].Data, ShouldEqual, 310)
+			resp, err = sim.ExecRaw(caps["bmc1"][1].Request, "bmc1")
+			So(ipmi.ValidateResponse(caps["bmc1"][1].Request, *resp, caps["bmc1"][1].Format), ShouldBeNil)
+			So(ipmi.FormatDCMIPowerLimit.Parse(*resp)["active"], ShouldResemble, ipmi.BoolValue(false))
+			resp, err = sim.ExecRaw(caps["bmc1"][2].Request, "bmc1")
+			So(err, ShouldBeNil)
+			So(ipmi.FormatSensorReading.Parse(*resp)["cur"].Data, ShouldEqual, 24)
+			So(caps["bmc1"][2].Format.Parse(*resp)["cur"], ShouldResemble, ipmi.FloatValue(24, ipmi.UnitCelsius))
+		})
+
+		Convey("sensor readings are converted with SDR factors", func() {
+			bmc.Sensors[1].NonLinear = true
+			caps := sim.GetPlatformCapabilities(ipmi.GenericVendor, []string{"bmc1"})
+			chipset := caps["bmc1"][len(ipmi.GenericVendor)-3]
+			So(chipset.MetricsRoot, ShouldEqual, "thermal/chipset")
+			resp, err := sim.ExecRaw(chipset.Request, "bmc1")
+			So(err, ShouldBeNil)
+			So(chipset.Format.Parse(*resp)[""], ShouldResemble, ipmi.FloatValue(41, ipmi.UnitCelsius))
+
+			sdrs, err := (&ipmi.SdrParser{IpmiLayer: sim}).ScanSdr(false, "bmc1")
+			So(err, ShouldBeNil)
+			So(sdrs[2].Conversion, ShouldResemble, &ipmi.SensorConversion{UnitCode: ipmi.UnitCodeVolts, Factors: ipmi.SensorFactors{M: 63, RExp: -3}})
+			v, _ := sdrs[2].Conversion.Convert(186)
+			So(v, ShouldEqual, 11.718)
+			So(sdrs[4].Conversion, ShouldBeNil)
+		})
+
+		Convey("capabilities and SDRs are cached until BMC changes", func() {
+			dir, err := ioutil.TempDir("", "cache")
+			So(err, ShouldBeNil)
+			defer os.RemoveAll(dir)
+			cache := &ipmi.Cache{Layer: sim, Dir: dir}
+			So(len(cache.GetPlatformCapabilities(ipmi.GenericVendor, []string{"bmc1"})["bmc1"]), ShouldEqual, supported)
+			scans := 0
+			scan := func() ([]ipmi.SdrInfo, error) {
+				scans++
+				return (&ipmi.SdrParser{IpmiLayer: sim}).ScanSdr(false, "bmc1")
+			}
+			sdrs, err := cache.Sdr("bmc1", scan)
+			So(err, ShouldBeNil)
+			So(len(sdrs), ShouldEqual, len(bmc.Sensors))
+
+			// policies are enumerated again, other capabilities are kept
+			bmc.Policies[PolicyKey{DomainMemory, 7}] = Policy{Limit: 50, CorrectionTime: 1000, ReportingPeriod: 10}
+			cache = &ipmi.Cache{Layer: sim, Dir: dir}
+			caps := cache.GetPlatformCapabilities(ipmi.GenericVendor, []string{"bmc1"})["bmc1"]
+			So(len(caps), ShouldEqual, supported+2)
+			So(caps[len(caps)-1].MetricsRoot, ShouldEqual, "power/policy/memory/7")
+			bmc.NodeManager = false
+			So(len(cache.GetPlatformCapabilities(ipmi.GenericVendor, []string{"bmc1"})["bmc1"]), ShouldEqual, supported-4)
+			cached, err := cache.Sdr("bmc1", scan)
+			So(err, ShouldBeNil)
+			So(cached, ShouldResemble, sdrs)
+			So(scans, ShouldEqual, 1)
+
+			bmc.SdrAddition++
+			So(len(cache.GetPlatformCapabilities(ipmi.GenericVendor, []string{"bmc1"})["bmc1"]), ShouldEqual, 1)
+			_, err = cache.Sdr("bmc1", scan)
+			So(err, ShouldBeNil)
+			So(scans, ShouldEqual, 2)
+		})
+
+		Convey("busy Node Manager is not taken for absent", func() {
+			dir, err := ioutil.TempDir("", "cache")
+			So(err, ShouldBeNil)
+			defer os.RemoveAll(dir)
+			cache := &ipmi.Cache{Layer: sim, Dir: dir}
+			// version is asked again by requests following busy reply
+			bmc.NMBusy = 1
+			caps := cache.GetPlatformCapabilities(ipmi.GenericVendor, []string{"bmc1"})
+			So(len(caps["bmc1"]), ShouldEqual, supported-1)
+
+			// probing hit busy BMC, capabilities are probed again
+			bmc.NMBusy = 100
+			caps = cache.GetPlatformCapabilities(ipmi.GenericVendor, []string{"bmc1"})
+			So(len(caps["bmc1"]), ShouldEqual, 1)
+			bmc.NMBusy = 0
+			So(len(cache.GetPlatformCapabilities(ipmi.GenericVendor, []string{"bmc1"})["bmc1"]), ShouldEqual, supported)
+			bmc.NodeManager = false
+			So(len(cache.GetPlatformCapabilities(ipmi.GenericVendor, []string{"bmc1"})["bmc1"]), ShouldEqual, supported-4)
+		})
+
+		Convey("SDR is read again when repository changes", func() {
+			sp := &ipmi.SdrParser{IpmiLayer: sim}
+			health, err := sp.GetComponentHealth("bmc1")
+			So(err, ShouldBeNil)
+			So(health["health/fan"], ShouldEqual, "OK")
+
+			// stale SDR addresses missing sensor
+			bmc.Sensors[3].Number, bmc.Sensors[3].State = 0xa1, 0x10
+			health, err = sp.GetComponentHealth("bmc1")
+			So(err, ShouldBeNil)
+			So(health["health/fan"], ShouldNotEqual, "CRITICAL")
+			bmc.SdrAddition++
+			health, err = sp.GetComponentHealth("bmc1")
+			So(err, ShouldBeNil)
+			So(health["health/fan"], ShouldEqual, "CRITICAL")
+		})
+
+		Convey("every SDR sensor is read", func() {
+			bmc.Sensors[0].Unavailable = true
+			bmc.Sensors[3].State = 0x10
+			bmc.Sensors = append(bmc.Sensors, Sensor{Number: 0xa2, Type: SensorFan, ReadingType: ReadingThreshold,
+				Entity: EntityFan, Instance: 2, Name: "System Fan 1", Reading: 10, Unit: ipmi.UnitCodeRPM, M: 50, NonLinear: true})
+			sp := &ipmi.SdrParser{IpmiLayer: sim}
+			names, err := sp.GetSensorNames("bmc1")
+			So(err, ShouldBeNil)
+			So(names, ShouldResemble, []string{"Inlet_Temp", "SSB_Temp", "BB_12_0V", "System_Fan_1_160", "P1_Status", "System_Fan_1_162"})
+			readings, err := sp.GetSensorReadings("bmc1")
+			So(err, ShouldBeNil)
+			So(readings[0].Value, ShouldResemble, ipmi.InvalidValue(ipmi.UnitCelsius))
+			So(readings[0].Status.Valid, ShouldBeFalse)
+			So(readings[2].Value, ShouldResemble, ipmi.FloatValue(11.718, "V"))
+			So(readings[2].Status, ShouldResemble, ipmi.StringValue("OK"))
+			So(readings[3].Value, ShouldResemble, ipmi.FloatValue(6016, "RPM"))
+			So(readings[3].Status, ShouldResemble, ipmi.StringValue("CRITICAL"))
+			So(readings[4].Value, ShouldResemble, ipmi.IntValue(0, ""))
+			So(readings[5].Value, ShouldResemble, ipmi.FloatValue(500, "RPM"))
+		})
+
+		Convey("sensors are read from their owners", func() {
+			bmc.Sensors = append(bmc.Sensors,
+				Sensor{Number: 0x08, Type: SensorTemperature, ReadingType: ReadingThreshold, Entity: EntitySystemBoard,
+					Instance: 2, Name: "BB Temp", Reading: 30, Unit: ipmi.UnitCodeCelsius, M: 1},
+				Sensor{Number: 0x09, LUN: 1, Type: SensorTemperature, ReadingType: ReadingThreshold, Entity: EntitySystemBoard,
+					Instance: 3, Name: "LUN Temp", Reading: 50, Unit: ipmi.UnitCodeCelsius, M: 1})
+			sp := &ipmi.SdrParser{IpmiLayer: sim}
+			names, err := sp.GetSensorNames("bmc1")
+			So(err, ShouldBeNil)
+			So(names, ShouldResemble, []string{"Inlet_Temp", "SSB_Temp", "BB_12_0V", "System_Fan_1", "P1_Status", "BB_Temp"})
+			readings, err := sp.GetSensorReadings("bmc1")
+			So(err, ShouldBeNil)
+			So(readings[1].Value, ShouldResemble, ipmi.FloatValue(41, "C"))
+			So(readings[5].Value, ShouldResemble, ipmi.FloatValue(30, "C"))
+		})
+
+		Convey("thresholds of sensors are read", func() {
+			sp := &ipmi.SdrParser{IpmiLayer: sim}
+			metrics, err := sp.GetSensorMetrics("bmc1")
+			So(err, ShouldBeNil)
+			So(len(metrics), ShouldEqual, 4*(2+len(ipmi.SensorLimitMetrics))+2)
+			limits, err := sp.GetSensorLimits("bmc1")
+			So(err, ShouldBeNil)
+			So(len(limits), ShouldEqual, 4)
+			So(limits["Inlet_Temp"], ShouldResemble, map[string]ipmi.Value{
+				"lower_non_critical":  ipmi.FloatValue(5, "C"),
+				"lower_critical":      ipmi.FloatValue(0, "C"),
+				"upper_non_critical":  ipmi.FloatValue(40, "C"),
+				"upper_critical":      ipmi.FloatValue(45, "C"),
+				"positive_hysteresis": ipmi.FloatValue(2, "C"),
+				"negative_hysteresis": ipmi.FloatValue(2, "C"),
+				"nominal":             ipmi.FloatValue(25, "C"),
+			})
+			So(limits["BB_12_0V"]["upper_critical"], ShouldResemble, ipmi.FloatValue(13.23, "V"))
+			So(limits["BB_12_0V"]["nominal"], ShouldResemble, ipmi.FloatValue(11.97, "V"))
+			So(limits["System_Fan_1"], ShouldResemble, map[string]ipmi.Value{
+				"positive_hysteresis": ipmi.FloatValue(0, "RPM"),
+				"negative_hysteresis": ipmi.FloatValue(0, "RPM"),
+			})
+
+			// limits are read again only when SDR repository changes
+			bmc.Sensors[0].Thresholds[3] = 42
+			limits, err = sp.GetSensorLimits("bmc1")
+			So(err, ShouldBeNil)
+			So(limits["Inlet_Temp"]["upper_non_critical"], ShouldResemble, ipmi.FloatValue(40, "C"))
+			bmc.SdrAddition++
+			limits, err = sp.GetSensorLimits("bmc1")
+			So(err, ShouldBeNil)
+			So(limits["Inlet_Temp"]["upper_non_critical"], ShouldResemble, ipmi.FloatValue(42, "C"))
+		})
+
+		Convey("SDR scan survives busy BMC", func() {
+			bmc.MaxSdrRead = 8
+			bmc.SdrReservationLifetime = 10
+			bmc.Sensors[1].Corrupt = true
+			sdrs, err := (&ipmi.SdrParser{IpmiLayer: sim}).ScanSdr(false, "bmc1")
+			So(err, ShouldBeNil)
+			numbers := []uint16{}
+			for _, sdr := range sdrs {
+				numbers = append(numbers, sdr.SensorNumber)
+			}
+			So(numbers, ShouldResemble, []uint16{0x30, 0xd0, 0xa0, 0x50})
+		})
+
+		Convey("inventory is read from FRU", func() {
+			fp := &ipmi.FruParser{IpmiLayer: sim}
+			info, err := fp.GetInventoryInfo("bmc1")
+			So(err, ShouldBeNil)
+			So(info["inventory/product_manufacturer"], ShouldEqual, "Intel Corporation")
+			So(info["inventory/product_name"], ShouldEqual, "S2600WT2R")
+			So(info["inventory/product_serial"], ShouldEqual, "BQWL52100456")
+			So(info["inventory/firmware_version"], ShouldEqual, "1.43")
+			So(info["inventory/bmc_mac"], ShouldEqual, "00:1E:67:12:34:56")
+		})
+
+		Convey("component health is read from SDR", func() {
+			bmc.Sensors[2].State = 0x10
+			sp := &ipmi.SdrParser{IpmiLayer: sim}
+			health, err := sp.GetComponentHealth("bmc1")
+			So(err, ShouldBeNil)
+			So(health["health/temperature"], ShouldEqual, "OK")
+			So(health["health/voltage"], ShouldEqual, "CRITICAL")
+		})
+
+		Convey("absent sensor does not fail collection", func() {
+			bmc.Sensors[1].Absent = true
+			sp := &ipmi.SdrParser{IpmiLayer: sim}
+			readings, err := sp.GetSensorReadings("bmc1")
+			So(err, ShouldBeNil)
+			So(readings[1].Value.Valid, ShouldBeFalse)
+			So(readings[2].Value, ShouldResemble, ipmi.FloatValue(11.718, "V"))
+			health, err := sp.GetComponentHealth("bmc1")
+			So(err, ShouldBeNil)
+			So(health["health/voltage"], ShouldEqual, "OK")
+		})
+
+		Convey("SEL entries are returned in order", func() {
+			bmc.SEL = append(bmc.SEL, Event{Timestamp: 0x57f3a100, SensorType: SensorFan, SensorNumber: 0xa0, ReadingType: ReadingThreshold})
+			resp, err := sim.ExecRaw(ipmi.IpmiRequest{Data: []byte{0x0a, 0x43, 0x00, 0x00, 0x00, 0x00, 0x00, 0xff}}, "bmc1")
+			So(err, ShouldBeNil)
+			So(resp.Data[1:3], ShouldResemble, []byte{0x02, 0x00})
+			So(len(resp.Data), ShouldEqual, 19)
+			resp, err = sim.ExecRaw(ipmi.IpmiRequest{Data: []byte{0x0a, 0x43, 0x00, 0x00, 0x02, 0x00, 0x00, 0xff}}, "bmc1")
+			So(err, ShouldBeNil)
+			So(resp.Data[1:3], ShouldResemble, []byte{0xff, 0xff})
+			So(resp.Data[14], ShouldEqual, 0xa0)
+		})
+
+		Convey("BMC is reachable out of band through LAN server", func() {
+			conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+			So(err, ShouldBeNil)
+			srv := &rmcp.Server{User: "admin", Password: "secret", Handler: bmc}
+			go srv.Serve(conn)
+			defer srv.Close()
+			host := conn.LocalAddr().String()
+
+			for _, iface := range []string{rmcp.InterfaceLanPlus, rmcp.InterfaceLan} {
+				layer := &ipmi.LinuxOutOfBandNative{User: "admin", Pass: "secret",
+					Protocol: "node_manager", Interface: iface, Retry: ipmi.RetryPolicy{Timeout: time.Second}}
+				caps := layer.GetPlatformCapabilities(ipmi.GenericVendor, []string{host})
+				So(len(caps[host]), ShouldEqual, supported)
+				results, err := layer.BatchExecRaw([]ipmi.IpmiRequest{ipmi.GenericVendor[6].Request}, host)
+				So(err, ShouldBeNil)
+				So(ipmi.FormatNodeManager.Parse(results[0])["max"].Data, ShouldEqual, 45)
+
+				bridged := ipmi.WithBridge(ipmi.GenericVendor[6:7], []ipmi.BridgeHop{{Channel: 7, Address: 0x72}, {Channel: 6, Address: 0x2c}})
+				resp, err := layer.ExecRaw(bridged[0].Request, host)
+				So(err, ShouldBeNil)
+				So(ipmi.FormatNodeManager.Parse(*resp)["max"].Data, ShouldEqual, 45)
+
+				fp := &ipmi.FruParser{IpmiLayer: layer}
+				info, err := fp.GetInventoryInfo(host)
+				So(err, ShouldBeNil)
+				So(info["inventory/product_name"], ShouldEqual, "S2600WT2R")
+				layer.Close()
+			}
+		})
+
+		Convey("lost request is retried out of band", func() {
+			conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+			So(err, ShouldBeNil)
+			srv := &rmcp.Server{User: "admin", Password: "secret", Handler: bmc}
+			// session repeats request twice, the request is lost
+			// until retry policy repeats it in new session
+			go srv.Serve(&lossyConn{PacketConn: conn, netFn: 0x06, cmd: 0x01, drops: 3})
+			defer srv.Close()
+			host := conn.LocalAddr().String()
+
+			layer := &ipmi.LinuxOutOfBandNative{User: "admin", Pass: "secret", Interface: rmcp.InterfaceLan,
+				Retry: ipmi.RetryPolicy{Timeout: 50 * time.Millisecond, Retries: 1}}
+			defer layer.Close()
+			resp, err := layer.ExecRaw(ipmi.IpmiRequest{Data: []byte{0x06, 0x01}}, host)
+			So(err, ShouldBeNil)
+			So(resp.Data[0], ShouldEqual, 0x00)
+		})
+
+		Convey("dead host does not hold up other hosts and is not dialed again", func() {
+			conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+			So(err, ShouldBeNil)
+			srv := &rmcp.Server{User: "admin", Password: "secret", Handler: bmc}
+			go srv.Serve(conn)
+			defer srv.Close()
+			host := conn.LocalAddr().String()
+
+			dead, err := net.ListenPacket("udp", "127.0.0.1:0")
+			So(err, ShouldBeNil)
+			defer dead.Close()
+			received := make(chan struct{}, 16)
+			go func() {
+				buf := make([]byte, 1024)
+				for {
+					if _, _, err := dead.ReadFrom(buf); err != nil {
+						return
+					}
+					received <- struct{}{}
+				}
+			}()
+
+			layer := &ipmi.LinuxOutOfBandNative{User: "admin", Pass: "secret", Retry: ipmi.RetryPolicy{Timeout: 200 * time.Millisecond}}
+			defer layer.Close()
+			failed := make(chan error)
+			go func() {
+				_, err := layer.ExecRaw(ipmi.IpmiRequest{Data: []byte{0x06, 0x01}}, dead.LocalAddr().String())
+				failed <- err
+			}()
+			<-received
+			start := time.Now()
+			_, err = layer.ExecRaw(ipmi.IpmiRequest{Data: []byte{0x06, 0x01}}, host)
+			So(err, ShouldBeNil)
+			So(time.Since(start), ShouldBeLessThan, 400*time.Millisecond)
+			So(<-failed, ShouldNotBeNil)
+
+			sent := len(received)
+			start = time.Now()
+			_, err = layer.ExecRaw(ipmi.IpmiRequest{Data: []byte{0x06, 0x01}}, dead.LocalAddr().String())
+			So(err, ShouldNotBeNil)
+			So(time.Since(start), ShouldBeLessThan, 100*time.Millisecond)
+			So(len(received), ShouldEqual, sent)
+		})
+	})
+}
+
+// busyPolicies answers first Get Node Manager Policy requests for existing
+// policies with node busy and counts Get Node Manager Policy requests.
+type busyPolicies struct {
+	*Simulator
+	busy     int
+	requests int
+}
+
+func (l *busyPolicies) ExecRaw(request ipmi.IpmiRequest, host string) (*ipmi.IpmiResponse, error) {
+	if len(request.Data) < 2 || request.Data[0] != 0x2e || request.Data[1] != 0xc2 {
+		return l.Simulator.ExecRaw(request, host)
+	}
+	l.requests++
+	resp, err := l.Simulator.ExecRaw(request, host)
+	if err == nil && l.busy > 0 {
+		l.busy--
+		resp = &ipmi.IpmiResponse{Data: []byte{0xc0}, IsValid: 1}
+		return resp, ipmi.CheckResponse(request, *resp)
+	}
+	return resp, err
+}
+
+// lossyConn drops first requests with given network function and command
+// received within IPMI v1.5 MD5 sessions.
+type lossyConn struct {
+	net.PacketConn
+	netFn byte
+	cmd   byte
+	drops int
+}
+
+func (c *lossyConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	for {
+		n, addr, err := c.PacketConn.ReadFrom(b)
+		// message follows 30 bytes of RMCP and MD5 session headers
+		if err == nil && c.drops > 0 && n > 35 && b[4] == 0x02 && b[31]>>2 == c.netFn && b[35] == c.cmd {
+			c.drops--
+			continue
+		}
+		return n, addr, err
+	}
+}
+
+func TestPowerControl(t *testing.T) {
+	Convey("Check power capping of simulated BMC", t, func() {
+		bmc := NewBMC()
+		sim := &Simulator{BMCs: map[string]*BMC{"bmc1": bmc}}
+		var audit bytes.Buffer
+		control := &ipmi.PowerControl{Layer: sim, Audit: &audit, User: "operator"}
+		key := PolicyKey{DomainPlatform, 2}
+		policy := ipmi.PolicyConfig{Domain: DomainPlatform, ID: 2, Enabled: true, PowerLimit: 300,
+			CorrectionTime: 2000, ReportingPeriod: 30, Actions: ipmi.PolicyActionAlert}
+
+		Convey("changes are sent only when confirmed", func() {
+			req, err := control.SetPolicy("bmc1", policy)
+			So(err, ShouldBeNil)
+			So(req.Data, ShouldResemble, []byte{0x2e, 0xc1, 0x57, 0x01, 0x00, 0x10, 0x02, 0x10, 0x01,
+				0x2c, 0x01, 0xd0, 0x07, 0x00, 0x00, 0x00, 0x00, 0x1e, 0x00})
+			So(req.Slave, ShouldEqual, 0x2c)
+			_, found := bmc.Policies[key]
+			So(found, ShouldBeFalse)
+
+			control.Confirm = true
+			_, err = control.SetPolicy("bmc1", policy)
+			So(err, ShouldBeNil)
+			So(bmc.Policies[key], ShouldResemble, Policy{Enabled: true, Limit: 300, CorrectionTime: 2000,
+				ReportingPeriod: 30, Actions: ipmi.PolicyActionAlert})
+			_, err = control.SetPolicyControl("bmc1", ipmi.PolicyControlPolicy, DomainPlatform, 2, false)
+			So(err, ShouldBeNil)
+			So(bmc.Policies[key].Enabled, ShouldBeFalse)
+			_, err = control.SetPolicyControl("bmc1", ipmi.PolicyControlGlobal, 0, 0, false)
+			So(err, ShouldBeNil)
+			So(bmc.PolicyControlDisabled, ShouldBeTrue)
+			_, err = control.SetAlertThresholds("bmc1", DomainPlatform, 2, []uint16{250, 280})
+			So(err, ShouldBeNil)
+			So(bmc.Policies[key].AlertThresholds, ShouldResemble, []uint16{250, 280})
+
+			policy.PowerLimit = 900
+			_, err = control.SetPolicy("bmc1", policy)
+			So(err, ShouldNotBeNil)
+			So(err.Error(), ShouldContainSubstring, "power limit out of range")
+			_, err = control.RemovePolicy("bmc1", DomainPlatform, 2)
+			So(err, ShouldBeNil)
+			_, found = bmc.Policies[key]
+			So(found, ShouldBeFalse)
+
+			lines := strings.Split(strings.TrimSpace(audit.String()), "\n")
+			So(len(lines), ShouldEqual, 1+2*6)
+			var entries [3]ipmi.AuditEntry
+			for i, line := range []string{lines[0], lines[1], lines[10]} {
+				So(json.Unmarshal([]byte(line), &entries[i]), ShouldBeNil)
+			}
+			So(entries[0].Kind, ShouldEqual, ipmi.AuditDryRun)
+			So(entries[0].User, ShouldEqual, "operator")
+			So(entries[0].Operation, ShouldEqual, "set_policy")
+			So(entries[1].Kind, ShouldEqual, ipmi.AuditRequest)
+			So(entries[2].Kind, ShouldEqual, ipmi.AuditResponse)
+			So(entries[2].Error, ShouldContainSubstring, "0x84")
+		})
+
+		Convey("DCMI power limit is set and activated", func() {
+			limit := ipmi.DCMIPowerLimit{Action: ipmi.DCMIActionPowerOff, Limit: 320, CorrectionTime: 2000, SamplingPeriod: 5}
+			req, err := control.SetPowerLimit("bmc1", limit)
+			So(err, ShouldBeNil)
+			So(req.Data, ShouldResemble, []byte{0x2c, 0x04, 0xdc, 0x00, 0x00, 0x00, 0x01, 0x40, 0x01,
+				0xd0, 0x07, 0x00, 0x00, 0x00, 0x00, 0x05, 0x00})
+			So(req.Path(), ShouldBeEmpty)
+			So(bmc.PowerLimit.Limit, ShouldEqual, 400)
+
+			control.Confirm = true
+			_, err = control.SetPowerLimit("bmc1", limit)
+			So(err, ShouldBeNil)
+			So(bmc.PowerLimit, ShouldResemble, PowerLimit{Action: ipmi.DCMIActionPowerOff, Limit: 320,
+				CorrectionTime: 2000, SamplingPeriod: 5})
+			_, err = control.ActivatePowerLimit("bmc1", true)
+			So(err, ShouldBeNil)
+			So(bmc.PowerLimitActive, ShouldBeTrue)
+
+			resp, err := sim.ExecRaw(ipmi.DCMIVendor[1].Request, "bmc1")
+			So(err, ShouldBeNil)
+			parserOut := ipmi.FormatDCMIPowerLimit.Parse(*resp)
+			So(parserOut["active"], ShouldResemble, ipmi.BoolValue(true))
+			So(parserOut["exception_action"], ShouldResemble, ipmi.StringValue("power_off"))
+			So(parserOut["limit"], ShouldResemble, ipmi.IntValue(320, ipmi.UnitWatt))
+
+			limit.SamplingPeriod = 7200
+			_, err = control.SetPowerLimit("bmc1", limit)
+			So(err, ShouldNotBeNil)
+			So(err.Error(), ShouldContainSubstring, "reporting period out of range")
+			_, err = control.ActivatePowerLimit("bmc1", false)
+			So(err, ShouldBeNil)
+			So(bmc.PowerLimitActive, ShouldBeFalse)
+			So(len(strings.Split(strings.TrimSpace(audit.String()), "\n")), ShouldEqual, 1+2*4)
+		})
+
+		Convey("changes are refused without audit log or with invalid settings", func() {
+			control.Confirm = true
+			control.Audit = nil
+			_, err := control.SetPolicy("bmc1", policy)
+			So(err, ShouldNotBeNil)
+			control.Audit = &audit
+			policy.CorrectionTime = 0
+			_, err = control.SetPolicy("bmc1", policy)
+			So(err, ShouldNotBeNil)
+			_, err = control.SetAlertThresholds("bmc1", DomainPlatform, 1, []uint16{1, 2, 3, 4})
+			So(err, ShouldNotBeNil)
+			So(audit.Len(), ShouldEqual, 0)
+			_, found := bmc.Policies[key]
+			So(found, ShouldBeFalse)
+		})
+	})
+}
@@ -0,0 +1,391 @@
+// +build linux
+
+/*
+http://www.apache.org/licenses/LICENSE-2.0.txt
+
+
+Copyright 2016 Intel Corporation
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package bmcsim
+
+// Sensor types used by simulated sensors.
+const (
+	SensorTemperature = 0x01
+	SensorVoltage     = 0x02
+	SensorFan         = 0x04
+	SensorProcessor   = 0x07
+	SensorPowerSupply = 0x08
+	SensorMemory      = 0x0c
+)
+
+// Event/reading types of simulated sensors.
+const (
+	ReadingThreshold      = 0x01
+	ReadingSensorSpecific = 0x6f
+)
+
+// Entity IDs of simulated sensors.
+const (
+	EntityProcessor   = 0x03
+	EntitySystemBoard = 0x07
+	EntityFan         = 0x1d
+	EntityAirInlet    = 0x40
+)
+
+// Sensor is described by SDR record and answers Get Sensor Reading.
+// State holds threshold comparison bits for threshold sensors
+// or asserted state offsets for discrete ones. Record of Corrupt sensor
+// has damaged length, reading of Absent sensor is not present. Sensors with conversion factor M are described by
+// full records with Unit (IPMI unit code), NonLinear ones report their
+// factors only with Get Sensor Reading Factors. Owner 0 means BMC,
+// sensors behind other LUN of owner are not answered.
+type Sensor struct {
+	Number      uint8
+	Owner       uint8
+	LUN         uint8
+	Type        uint8
+	ReadingType uint8
+	Entity      uint8
+	Instance    uint8
+	Name        string
+	Reading     uint8
+	State       uint16
+	Unavailable bool
+	Corrupt     bool
+	Absent      bool
+
+	Unit      uint8
+	M         int16
+	B         int16
+	BExp      int8
+	RExp      int8
+	NonLinear bool
+
+	// Thresholds are raw lower non-critical, critical, non-recoverable and
+	// upper non-critical, critical, non-recoverable thresholds, readable
+	// when their bit of ThresholdMask is set. Characteristic readings of
+	// full record are specified when not zero.
+	Thresholds    [6]uint8
+	ThresholdMask uint8
+	Hysteresis    [2]uint8
+	Nominal       uint8
+	NormalMax     uint8
+	NormalMin     uint8
+}
+
+// Event is system event log entry.
+type Event struct {
+	Timestamp    uint32
+	GeneratorID  uint16
+	SensorType   uint8
+	SensorNumber uint8
+	Deassertion  bool
+	ReadingType  uint8
+	Data         [3]byte
+}
+
+// recordID returns SDR or SEL record ID of entry with given index.
+func recordID(index int) uint16 {
+	return uint16(index + 1)
+}
+
+// nextRecordID returns ID of record following index in list of size entries.
+func nextRecordID(index, size int) uint16 {
+	if index+1 >= size {
+		return 0xffff
+	}
+	return recordID(index + 1)
+}
+
+// findRecord returns index of record with given ID, 0 means first record
+// and 0xffff last one.
+func findRecord(id uint16, size int) (int, bool) {
+	switch {
+	case size == 0:
+		return 0, false
+	case id == 0:
+		return 0, true
+	case id == 0xffff:
+		return size - 1, true
+	case int(id) > size:
+		return 0, false
+	}
+	return int(id) - 1, true
+}
+
+// factors returns M, tolerance, B, accuracy and exponent bytes of sensor.
+func (s Sensor) factors() []byte {
+	return []byte{byte(s.M), byte(s.M>>2) & 0xc0, byte(s.B), byte(s.B>>2) & 0xc0,
+		0x00, byte(s.RExp)<<4 | byte(s.BExp)&0x0f}
+}
+
+// record returns full (type 01h) or compact (type 02h) sensor record with given ID.
+func (s Sensor) record(id uint16) []byte {
+	name := s.Name
+	if len(name) > 16 {
+		name = name[:16]
+	}
+	size := 32
+	if s.M != 0 {
+		size = 48
+	}
+	r := make([]byte, size, size+len(name))
+	r[0], r[1] = byte(id), byte(id>>8)
+	r[2] = 0x51
+	r[3] = 0x02
+	r[5] = s.owner()
+	r[6] = s.LUN & 0x03
+	r[7] = s.Number
+	r[8] = s.Entity
+	r[9] = s.Instance
+	r[10] = 0x63
+	r[12] = s.Type
+	r[13] = s.ReadingType
+	if s.M != 0 {
+		r[3] = 0x01
+		r[21] = s.Unit
+		copy(r[24:30], s.factors())
+		if s.NonLinear {
+			r[23] = 0x70
+			copy(r[24:30], make([]byte, 6))
+		}
+		for i, v := range []uint8{s.Nominal, s.NormalMax, s.NormalMin} {
+			if v != 0 {
+				r[30] |= 1 << uint(i)
+				r[31+i] = v
+			}
+		}
+		// record holds upper thresholds first, from non-recoverable
+		for i := 0; i < 6; i++ {
+			r[36+i] = s.Thresholds[5-i]
+		}
+		r[42], r[43] = s.Hysteresis[0], s.Hysteresis[1]
+	}
+	r[size-1] = 0xc0 | byte(len(name))
+	r = append(r, name...)
+	r[4] = byte(len(r) - 5)
+	if s.Corrupt {
+		// record length damaged, record ends within key bytes
+		r[4] = 3
+		r = r[:8]
+	}
+	return r
+}
+
+// record returns 16 byte SEL record with given ID.
+func (e Event) record(id uint16) []byte {
+	r := putUint16(nil, id)
+	r = append(r, 0x02)
+	r = putUint32(r, e.Timestamp)
+	r = putUint16(r, e.GeneratorID)
+	dir := e.ReadingType & 0x7f
+	if e.Deassertion {
+		dir |= 0x80
+	}
+	r = append(r, 0x04, e.SensorType, e.SensorNumber, dir)
+	return append(r, e.Data[:]...)
+}
+
+// readRecord returns requested part of record preceded by next record ID
+// as returned by Get SDR and Get SEL Entry.
+func readRecord(record []byte, next uint16, offset, count byte) []byte {
+	if int(offset) > len(record) {
+		return []byte{ccOutOfRange}
+	}
+	data := record[offset:]
+	if count != 0xff && int(count) < len(data) {
+		data = data[:count]
+	}
+	return append(putUint16(ok(), next), data...)
+}
+
+func (b *BMC) reserveSdr() []byte {
+	b.sdrReads = 0
+	b.sdrReservation++
+	if b.sdrReservation == 0 {
+		b.sdrReservation++
+	}
+	return putUint16(ok(), b.sdrReservation)
+}
+
+// getSdr answers Get SDR and Get Device SDR. Reservation is checked
+// only for partial reads, as required by specification.
+func (b *BMC) getSdr(data []byte) []byte {
+	if len(data) < 6 {
+		return []byte{ccLength}
+	}
+	if b.MaxSdrRead != 0 && data[5] > b.MaxSdrRead {
+		return []byte{ccCannotReturn}
+	}
+	if b.SdrReservationLifetime != 0 {
+		if b.sdrReads++; b.sdrReads > b.SdrReservationLifetime {
+			b.sdrReads = 0
+			b.sdrReservation++ // canceled
+		}
+	}
+	reservation := uint16(data[0]) | uint16(data[1])<<8
+	if data[4] != 0 && reservation != b.sdrReservation {
+		return []byte{ccReservation}
+	}
+	index, found := findRecord(uint16(data[2])|uint16(data[3])<<8, len(b.Sensors))
+	if !found {
+		return []byte{ccNotPresent}
+	}
+	record := b.Sensors[index].record(recordID(index))
+	return readRecord(record, nextRecordID(index, len(b.Sensors)), data[4], data[5])
+}
+
+// owner returns slave address of controller owning sensor.
+func (s Sensor) owner() byte {
+	if s.Owner == 0 {
+		return bmcAddress
+	}
+	return s.Owner
+}
+
+// sensorReading answers Get Sensor Reading of sensors owned by controller at address.
+func (b *BMC) sensorReading(address byte, data []byte) []byte {
+	if len(data) < 1 {
+		return []byte{ccLength}
+	}
+	for _, s := range b.Sensors {
+		if s.Number != data[0] || s.owner() != address || s.LUN != 0 {
+			continue
+		}
+		if s.Absent {
+			return []byte{ccNotPresent}
+		}
+		// Scanning is always enabled, bit 5 marks unavailable reading.
+		flags := byte(0x40)
+		if s.Unavailable {
+			flags |= 0x20
+		}
+		if s.ReadingType == ReadingThreshold {
+			return ok(s.Reading, flags, byte(s.State&0x3f)|0xc0)
+		}
+		return ok(s.Reading, flags, byte(s.State), byte(s.State>>8)&0x7f|0x80)
+	}
+	return []byte{ccNotPresent}
+}
+
+// sensorThresholds answers Get Sensor Thresholds and Get Sensor Hysteresis of threshold sensors.
+func (b *BMC) sensorThresholds(address byte, cmd byte, data []byte) []byte {
+	if len(data) < 1 {
+		return []byte{ccLength}
+	}
+	for _, s := range b.Sensors {
+		if s.Number != data[0] || s.owner() != address {
+			continue
+		}
+		if s.ReadingType != ReadingThreshold {
+			return []byte{ccInvalidCmd}
+		}
+		if cmd == 0x25 {
+			return ok(s.Hysteresis[0], s.Hysteresis[1])
+		}
+		return append(ok(s.ThresholdMask), s.Thresholds[:]...)
+	}
+	return []byte{ccNotPresent}
+}
+
+// sensorFactors answers Get Sensor Reading Factors, factors of all readings are equal.
+func (b *BMC) sensorFactors(address byte, data []byte) []byte {
+	if len(data) < 2 {
+		return []byte{ccLength}
+	}
+	for _, s := range b.Sensors {
+		if s.Number == data[0] && s.owner() == address && s.M != 0 {
+			return append(ok(0xff), s.factors()...)
+		}
+	}
+	return []byte{ccNotPresent}
+}
+
+func (b *BMC) getSelEntry(data []byte) []byte {
+	if len(data) < 6 {
+		return []byte{ccLength}
+	}
+	reservation := uint16(data[0]) | uint16(data[1])<<8
+	if data[4] != 0 && reservation != b.selReservation {
+		return []byte{ccReservation}
+	}
+	index, found := findRecord(uint16(data[2])|uint16(data[3])<<8, len(b.SEL))
+	if !found {
+		return []byte{ccNotPresent}
+	}
+	record := b.SEL[index].record(recordID(index))
+	return readRecord(record, nextRecordID(index, len(b.SEL)), data[4], data[5])
+}
+
+func (b *BMC) fruInfo(data []byte) []byte {
+	if len(data) < 1 {
+		return []byte{ccLength}
+	}
+	if data[0] != 0 || b.FRU == nil {
+		return []byte{ccNotPresent}
+	}
+	return append(putUint16(ok(), uint16(len(b.FRU))), 0x00)
+}
+
+func (b *BMC) readFru(data []byte) []byte {
+	if len(data) < 4 {
+		return []byte{ccLength}
+	}
+	if data[0] != 0 || b.FRU == nil {
+		return []byte{ccNotPresent}
+	}
+	offset := int(data[1]) | int(data[2])<<8
+	if offset >= len(b.FRU) {
+		return []byte{ccOutOfRange}
+	}
+	fru := b.FRU[offset:]
+	if int(data[3]) < len(fru) {
+		fru = fru[:data[3]]
+	}
+	return append(ok(byte(len(fru))), fru...)
+}
+
+// ProductFRU returns FRU image containing only product info area
+// with given fields encoded as 8-bit ASCII.
+func ProductFRU(manufacturer, name, part, version, serial string) []byte {
+	area := []byte{0x01, 0x00, 0x00}
+	for _, field := range []string{manufacturer, name, part, version, serial, "", ""} {
+		if len(field) > 63 {
+			field = field[:63]
+		}
+		area = append(area, 0xc0|byte(len(field)))
+		area = append(area, field...)
+	}
+	area = append(area, 0xc1)
+	for (len(area)+1)%8 != 0 {
+		area = append(area, 0x00)
+	}
+	area[1] = byte((len(area) + 1) / 8)
+	area = append(area, checksum(area))
+
+	header := []byte{0x01, 0x00, 0x00, 0x00, 0x01, 0x00, 0x00}
+	header = append(header, checksum(header))
+	return append(header, area...)
+}
+
+// checksum returns zero checksum of FRU area.
+func checksum(data []byte) byte {
+	var sum byte
+	for _, b := range data {
+		sum += b
+	}
+	return -sum
+}
@@ -0,0 +1,162 @@
+// +build linux
+
+/*
+http://www.apache.org/licenses/LICENSE-2.0.txt
+
+
+Copyright 2016 Intel Corporation
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package ipmi
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// BridgeHop is single level of IPMB bridging: request is forwarded
+// on Channel to controller at Address.
+type BridgeHop struct {
+	Channel uint8 `json:"channel"`
+	Address uint8 `json:"address"`
+}
+
+// String formats hop as "channel:address", e.g. "0x06:0x2c".
+func (h BridgeHop) String() string {
+	return fmt.Sprintf("0x%02x:0x%02x", h.Channel, h.Address)
+}
+
+// Path returns bridging path of request from BMC to target controller,
+// last hop addresses the target. Nil is returned for requests handled by BMC.
+func (req IpmiRequest) Path() []BridgeHop {
+	if req.Slave == 0 && len(req.Transit) == 0 {
+		return nil
+	}
+	return append(append([]BridgeHop{}, req.Transit...), BridgeHop{Channel: uint8(req.Channel), Address: req.Slave})
+}
+
+// SetPath makes request bridged along path, empty path addresses BMC itself.
+func (req *IpmiRequest) SetPath(path []BridgeHop) {
+	req.Channel, req.Slave, req.Transit = 0, 0, nil
+	if len(path) == 0 {
+		return
+	}
+	last := path[len(path)-1]
+	req.Channel, req.Slave = int16(last.Channel), last.Address
+	if len(path) > 1 {
+		req.Transit = append([]BridgeHop{}, path[:len(path)-1]...)
+	}
+}
+
+// ParseBridgePath parses comma separated list of "channel:address" hops,
+// starting with the one closest to BMC, e.g. "0x07:0x72,0x06:0x2c".
+// Empty string means no bridging.
+func ParseBridgePath(s string) ([]BridgeHop, error) {
+	var path []BridgeHop
+	for _, hop := range strings.Split(s, ",") {
+		hop = strings.TrimSpace(hop)
+		if hop == "" {
+			continue
+		}
+		parts := strings.Split(hop, ":")
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("Invalid bridging hop %q, expected channel:address", hop)
+		}
+		channel, err := strconv.ParseUint(strings.TrimSpace(parts[0]), 0, 4)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid channel of bridging hop %q: %v", hop, err)
+		}
+		address, err := strconv.ParseUint(strings.TrimSpace(parts[1]), 0, 8)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid address of bridging hop %q: %v", hop, err)
+		}
+		path = append(path, BridgeHop{Channel: uint8(channel), Address: uint8(address)})
+	}
+	return path, nil
+}
+
+// WithBridge returns copy of requests where bridged ones are sent along path.
+// Requests handled by BMC itself are left unchanged.
+func WithBridge(requests []RequestDescription, path []BridgeHop) []RequestDescription {
+	result := make([]RequestDescription, len(requests))
+	for i, desc := range requests {
+		result[i] = desc
+		if desc.Request.Path() != nil {
+			result[i].Request = desc.Request.Clone()
+			result[i].Request.SetPath(path)
+		}
+	}
+	return result
+}
+
+// bridgeOptions returns ipmitool options bridging request along path.
+// ipmitool supports at most double bridging (-B/-T followed by -b/-t).
+func bridgeOptions(path []BridgeHop) ([]string, error) {
+	switch len(path) {
+	case 0:
+		return []string{}, nil
+	case 1:
+		return []string{"-b", fmt.Sprint(path[0].Channel), "-t", fmt.Sprintf("0x%02x", path[0].Address)}, nil
+	case 2:
+		return []string{"-B", fmt.Sprint(path[0].Channel), "-T", fmt.Sprintf("0x%02x", path[0].Address),
+			"-b", fmt.Sprint(path[1].Channel), "-t", fmt.Sprintf("0x%02x", path[1].Address)}, nil
+	}
+	return nil, fmt.Errorf("ipmitool supports up to 2 bridging hops, got %d", len(path))
+}
+
+// ipmbChecksum returns two's complement checksum of IPMB message fields.
+func ipmbChecksum(data []byte) byte {
+	var sum byte
+	for _, b := range data {
+		sum += b
+	}
+	return -sum
+}
+
+// sendMessage wraps request data (netfn, cmd and data bytes) in Send Message
+// commands, one per hop, starting with the last one. Result is addressed to
+// controller of first hop, which is reached by the driver itself.
+func sendMessage(path []BridgeHop, request []byte) []byte {
+	data := request
+	for i := len(path) - 1; i > 0; i-- {
+		header := []byte{path[i].Address, data[0] << 2}
+		body := append([]byte{path[i-1].Address, 0x00}, data[1:]...)
+		message := append(append(header, ipmbChecksum(header)), body...)
+		message = append(message, ipmbChecksum(body))
+		data = append([]byte{0x06, 0x34, path[i].Channel&0x0f | 0x40}, message...)
+	}
+	return data
+}
+
+// receiveMessage extracts response of bridged request from depth nested
+// Send Message responses. Failed completion code of any level is returned as is.
+func receiveMessage(data []byte, depth int) []byte {
+	for ; depth > 0; depth-- {
+		if len(data) < 1 {
+			return data
+		}
+		if data[0] != 0 {
+			return data[:1]
+		}
+		if len(data) < 9 {
+			return []byte{0xff}
+		}
+		// skip completion code, responder header with checksum, requester
+		// address, sequence and command, drop trailing checksum
+		data = data[7 : len(data)-1]
+	}
+	return data
+}
@@ -0,0 +1,64 @@
+// +build unit
+
+/*
+http://www.apache.org/licenses/LICENSE-2.0.txt
+
+
+Copyright 2016 Intel Corporation
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package ipmi
+
+import (
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestBridging(t *testing.T) {
+	Convey("Check bridging paths", t, func() {
+		path, err := ParseBridgePath("0x07:0x72, 6:0x2c")
+		So(err, ShouldBeNil)
+		So(path, ShouldResemble, []BridgeHop{{7, 0x72}, {6, 0x2c}})
+		_, err = ParseBridgePath("0x06")
+		So(err, ShouldNotBeNil)
+		_, err = ParseBridgePath("0x16:0x2c")
+		So(err, ShouldNotBeNil)
+
+		Convey("vendor requests are redirected", func() {
+			requests := WithBridge(append([]RequestDescription{DcmiThermal}, GenericVendor[0]), path)
+			So(requests[0].Request.Path(), ShouldBeNil)
+			So(requests[1].Request.Path(), ShouldResemble, path)
+			So(requests[1].Request.Transit, ShouldResemble, []BridgeHop{{7, 0x72}})
+			So(GenericVendor[0].Request.Transit, ShouldBeNil)
+		})
+
+		Convey("ipmitool options are generated for up to two hops", func() {
+			options, err := bridgeOptions(path)
+			So(err, ShouldBeNil)
+			So(options, ShouldResemble, []string{"-B", "7", "-T", "0x72", "-b", "6", "-t", "0x2c"})
+			_, err = bridgeOptions(append(path, BridgeHop{0, 0x30}))
+			So(err, ShouldNotBeNil)
+		})
+
+		Convey("transit hops are wrapped in Send Message", func() {
+			data := sendMessage(path, []byte{0x2e, 0xc8, 0x57})
+			So(data, ShouldResemble, []byte{0x06, 0x34, 0x46, 0x2c, 0xb8, 0x1c, 0x72, 0x00, 0xc8, 0x57, 0x6f})
+			response := []byte{0x00, 0x72, 0x1c, 0x72, 0x2c, 0x00, 0xc8, 0x00, 0x57, 0x01, 0x00, 0x00}
+			So(receiveMessage(response, 1), ShouldResemble, []byte{0x00, 0x57, 0x01, 0x00})
+			So(receiveMessage([]byte{0x83}, 1), ShouldResemble, []byte{0x83})
+		})
+	})
+}
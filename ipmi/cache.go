@@ -0,0 +1,349 @@
+// +build linux
+
+/*
+http://www.apache.org/licenses/LICENSE-2.0.txt
+
+
+Copyright 2016 Intel Corporation
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package ipmi
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// BMCIdentity identifies firmware and sensor population of BMC.
+// Data cached for host is valid only while its identity does not change.
+// SdrAddition and SdrErase are SDR repository timestamps, or sensor
+// population change indicator for BMCs with device SDRs.
+type BMCIdentity struct {
+	DeviceID       uint8  `json:"device_id"`
+	DeviceRevision uint8  `json:"device_revision"`
+	FirmwareMajor  uint8  `json:"firmware_major"`
+	FirmwareMinor  uint8  `json:"firmware_minor"`
+	ManufacturerID uint32 `json:"manufacturer_id"`
+	ProductID      uint16 `json:"product_id"`
+	SdrAddition    uint32 `json:"sdr_addition"`
+	SdrErase       uint32 `json:"sdr_erase"`
+}
+
+// GetBMCIdentity reads identity of BMC with Get Device ID and Get SDR
+// Repository Info (Get Device SDR Info when BMC has no repository).
+func GetBMCIdentity(layer IpmiAL, host string) (*BMCIdentity, error) {
+	resp, err := layer.ExecRaw(CmdGetDeviceId, host)
+	if err != nil {
+		return nil, err
+	}
+	if len(resp.Data) < 12 {
+		return nil, errShortResponse
+	}
+	data := resp.Data
+	id := &BMCIdentity{
+		DeviceID:       data[1],
+		DeviceRevision: data[2],
+		FirmwareMajor:  data[3] & 0x7f,
+		FirmwareMinor:  data[4],
+		ManufacturerID: uint32(data[7]) | uint32(data[8])<<8 | uint32(data[9]&0x0f)<<16,
+		ProductID:      binary.LittleEndian.Uint16(data[10:12]),
+	}
+	if resp, err := layer.ExecRaw(CmdStorageSdrInfo, host); err == nil && len(resp.Data) >= 14 {
+		id.SdrAddition = binary.LittleEndian.Uint32(resp.Data[6:10])
+		id.SdrErase = binary.LittleEndian.Uint32(resp.Data[10:14])
+	} else if resp, err := layer.ExecRaw(CmdDeviceSdrInfo, host); err == nil && len(resp.Data) >= 7 {
+		id.SdrAddition = binary.LittleEndian.Uint32(resp.Data[3:7])
+	}
+	return id, nil
+}
+
+// CacheEntry is data cached for single host. Capabilities are indexed
+// by fingerprint of checked requests.
+type CacheEntry struct {
+	Identity     BMCIdentity                      `json:"identity"`
+	Capabilities map[string][]RecordedDescription `json:"capabilities,omitempty"`
+	Sdr          []SdrInfo                        `json:"sdr,omitempty"`
+}
+
+// Cache is IpmiAL which keeps capabilities and SDR records found by Layer
+// in directory Dir, one JSON file per host, so they are not discovered
+// again after restart. Entries are discarded when BMC identity changes.
+// Hosts which identity cannot be read are not cached. Layer must allow
+// concurrent requests to different hosts.
+type Cache struct {
+	Layer IpmiAL
+	Dir   string
+	mutex sync.Mutex
+}
+
+// BatchExecRaw performs batch using underlying layer.
+func (c *Cache) BatchExecRaw(requests []IpmiRequest, host string) ([]IpmiResponse, error) {
+	return c.BatchExecRawContext(context.Background(), requests, host)
+}
+
+// BatchExecRawContext performs batch using underlying layer within context.
+func (c *Cache) BatchExecRawContext(ctx context.Context, requests []IpmiRequest, host string) ([]IpmiResponse, error) {
+	if layer, ok := c.Layer.(IpmiALContext); ok {
+		return layer.BatchExecRawContext(ctx, requests, host)
+	}
+	return c.Layer.BatchExecRaw(requests, host)
+}
+
+// ExecRaw performs single request using underlying layer.
+func (c *Cache) ExecRaw(request IpmiRequest, host string) (*IpmiResponse, error) {
+	return c.ExecRawContext(context.Background(), request, host)
+}
+
+// ExecRawContext performs single request using underlying layer within context.
+func (c *Cache) ExecRawContext(ctx context.Context, request IpmiRequest, host string) (*IpmiResponse, error) {
+	if layer, ok := c.Layer.(IpmiALContext); ok {
+		return layer.ExecRawContext(ctx, request, host)
+	}
+	return c.Layer.ExecRaw(request, host)
+}
+
+// GetPlatformCapabilities returns cached capabilities of hosts, the others
+// are checked with underlying layer and stored, unless their probing failed
+// with transient errors. Node Manager policies are not stored, as they may
+// be created or removed any time; they are enumerated for every call.
+func (c *Cache) GetPlatformCapabilities(requests []RequestDescription, host []string) map[string][]RequestDescription {
+	key := fingerprint(requests)
+	known := append(append([]RequestDescription{}, requests...), DcmiThermal)
+	validRequests := make(map[string][]RequestDescription, len(host))
+	identities, entries := c.lookupHosts(host)
+	var missing, cached []string
+	for _, addr := range host {
+		if recorded, ok := entries[addr].Capabilities[key]; ok {
+			validRequests[addr] = make([]RequestDescription, 0, len(recorded))
+			for _, rec := range recorded {
+				if desc, ok := matchDescription(known, rec); ok && !IsPolicyRequest(desc.Request) {
+					validRequests[addr] = append(validRequests[addr], desc)
+				}
+			}
+			cached = append(cached, addr)
+			continue
+		}
+		missing = append(missing, addr)
+	}
+	var templates []RequestDescription
+	for _, desc := range requests {
+		if IsPolicyRequest(desc.Request) {
+			templates = append(templates, desc)
+		}
+	}
+	if len(templates) > 0 && len(cached) > 0 {
+		for addr, policies := range c.Layer.GetPlatformCapabilities(templates, cached) {
+			validRequests[addr] = append(validRequests[addr], policies...)
+		}
+	}
+	if len(missing) == 0 {
+		return validRequests
+	}
+	for addr, requests := range c.Layer.GetPlatformCapabilities(requests, missing) {
+		validRequests[addr] = requests
+		if probeIncomplete(addr) {
+			log.WithFields(log.Fields{
+				"host": addr,
+			}).Info("Capabilities probed incompletely, cache not used")
+			continue
+		}
+		var kept []RequestDescription
+		for _, desc := range requests {
+			if !IsPolicyRequest(desc.Request) {
+				kept = append(kept, desc)
+			}
+		}
+		if id := identities[addr]; id != nil {
+			c.update(addr, *id, func(e *CacheEntry) {
+				e.Capabilities[key] = recordDescriptions(kept)
+			})
+		}
+	}
+	return validRequests
+}
+
+// Sdr returns cached SDR records of host, when they are missing or outdated
+// records are read with scan and stored.
+func (c *Cache) Sdr(host string, scan func() ([]SdrInfo, error)) ([]SdrInfo, error) {
+	id, entry := c.lookup(host)
+	if entry.Sdr != nil {
+		return entry.Sdr, nil
+	}
+	sdrs, err := scan()
+	if err != nil {
+		return nil, err
+	}
+	if id != nil {
+		c.update(host, *id, func(e *CacheEntry) {
+			e.Sdr = sdrs
+		})
+	}
+	return sdrs, nil
+}
+
+// Close closes underlying layer when it supports it.
+func (c *Cache) Close() error {
+	if closer, ok := c.Layer.(io.Closer); ok {
+		return closer.Close()
+	}
+	return nil
+}
+
+// lookupHosts reads identities and cache entries of hosts concurrently,
+// so unreachable hosts do not delay the others.
+func (c *Cache) lookupHosts(host []string) (map[string]*BMCIdentity, map[string]CacheEntry) {
+	identities := make(map[string]*BMCIdentity, len(host))
+	entries := make(map[string]CacheEntry, len(host))
+	var wg sync.WaitGroup
+	var mutex sync.Mutex
+	for _, addr := range host {
+		wg.Add(1)
+		go func(addr string) {
+			defer wg.Done()
+			id, entry := c.lookup(addr)
+			mutex.Lock()
+			defer mutex.Unlock()
+			identities[addr] = id
+			entries[addr] = entry
+		}(addr)
+	}
+	wg.Wait()
+	return identities, entries
+}
+
+// lookup reads identity of host and its cache entry. Entry is empty
+// when it is missing or was stored for another identity.
+func (c *Cache) lookup(host string) (*BMCIdentity, CacheEntry) {
+	id, err := GetBMCIdentity(c.Layer, host)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"host":  host,
+			"error": err,
+		}).Debug("Unable to read BMC identity, cache not used")
+		return nil, CacheEntry{}
+	}
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	entry, err := c.load(host)
+	if err != nil || entry.Identity != *id {
+		if err == nil {
+			log.WithFields(log.Fields{
+				"host": host,
+			}).Info("BMC identity changed, cache invalidated")
+		}
+		return id, CacheEntry{}
+	}
+	return id, *entry
+}
+
+// update applies change to entry of host and stores it. Entry of
+// different identity is replaced.
+func (c *Cache) update(host string, id BMCIdentity, change func(*CacheEntry)) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	entry, err := c.load(host)
+	if err != nil || entry.Identity != id {
+		entry = &CacheEntry{Identity: id}
+	}
+	if entry.Capabilities == nil {
+		entry.Capabilities = make(map[string][]RecordedDescription)
+	}
+	change(entry)
+	if err := c.save(host, entry); err != nil {
+		log.WithFields(log.Fields{
+			"host":  host,
+			"error": err,
+		}).Warn("Unable to store cache")
+	}
+}
+
+func (c *Cache) path(host string) string {
+	name := strings.Map(func(r rune) rune {
+		if r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '.' || r == '-' {
+			return r
+		}
+		return '_'
+	}, host)
+	return filepath.Join(c.Dir, name+".json")
+}
+
+func (c *Cache) load(host string) (*CacheEntry, error) {
+	data, err := ioutil.ReadFile(c.path(host))
+	if err != nil {
+		return nil, err
+	}
+	var entry CacheEntry
+	if err := json.Unmarshal(data, &entry); err != nil {
+		return nil, fmt.Errorf("Invalid cache of %s: %v", host, err)
+	}
+	return &entry, nil
+}
+
+// save writes entry to temporary file renamed over previous one,
+// so interrupted writes do not leave broken cache.
+func (c *Cache) save(host string, entry *CacheEntry) error {
+	if err := os.MkdirAll(c.Dir, 0755); err != nil {
+		return err
+	}
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	f, err := ioutil.TempFile(c.Dir, ".cache")
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return err
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+	return os.Rename(f.Name(), c.path(host))
+}
+
+// fingerprint identifies list of requests checked for capabilities.
+func fingerprint(requests []RequestDescription) string {
+	h := fnv.New64a()
+	for _, desc := range requests {
+		fmt.Fprintf(h, "%s %s\n", desc.MetricsRoot, replayKey("", desc.Request))
+	}
+	return fmt.Sprintf("%016x", h.Sum64())
+}
+
+// recordDescriptions converts supported requests to form stored in transcripts and cache.
+func recordDescriptions(requests []RequestDescription) []RecordedDescription {
+	recorded := make([]RecordedDescription, len(requests))
+	for i, desc := range requests {
+		recorded[i] = RecordedDescription{MetricsRoot: desc.MetricsRoot,
+			Channel: desc.Request.Channel, Slave: desc.Request.Slave, Transit: desc.Request.Transit, Request: desc.Request.Data,
+			Conversion: conversionOf(desc.Format)}
+	}
+	return recorded
+}
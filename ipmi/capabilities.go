@@ -0,0 +1,532 @@
+// +build linux
+
+/*
+http://www.apache.org/licenses/LICENSE-2.0.txt
+
+
+Copyright 2016 Intel Corporation
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package ipmi
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// Node Manager versions as reported by Get Node Manager Version.
+const (
+	NMVersion10 = 0x01
+	NMVersion15 = 0x02
+	NMVersion20 = 0x03
+	NMVersion25 = 0x04
+	NMVersion30 = 0x05
+)
+
+// Node Manager policy trigger types queried with Get Node Manager Capabilities.
+const (
+	triggerNone             = 0x00
+	triggerInletTemperature = 0x01
+)
+
+// Supported DCMI capabilities bits (parameter 1 of Get DCMI Capabilities Info).
+const (
+	dcmiTemperatureMonitoring = 0x08 // mandatory platform capabilities
+	dcmiPowerManagement       = 0x01 // optional platform capabilities
+)
+
+const (
+	netFnDCMI = 0x2c
+	netFnNM   = 0x2e
+)
+
+// bmcAddress is slave address of BMC, owner of its own sensors.
+const bmcAddress = 0x20
+
+var errShortResponse = errors.New("Response too short")
+
+// CmdNMVersion is Get Node Manager Version.
+var CmdNMVersion = []byte{0x2e, 0xca, 0x57, 0x01, 0x00}
+
+// CmdDCMICapabilities is Get DCMI Capabilities Info of supported capabilities.
+var CmdDCMICapabilities = []byte{0x2c, 0x01, 0xdc, 0x01}
+
+// nmCapabilitiesCmd returns Get Node Manager Capabilities of power control
+// policies in domain limited by trigger.
+func nmCapabilitiesCmd(domain, trigger byte) []byte {
+	return []byte{0x2e, 0xc9, 0x57, 0x01, 0x00, domain, trigger, 0x10}
+}
+
+// nmRequirement is Node Manager feature request depends on.
+// Requests which are not covered by discovery commands are executed.
+type nmRequirement struct {
+	version byte
+	caps    bool
+	domain  byte
+	trigger byte
+	execute bool
+}
+
+func nmRequirementOf(data []byte) nmRequirement {
+	if len(data) < 2 {
+		return nmRequirement{execute: true}
+	}
+	switch data[1] {
+	case 0xc8:
+		// Get Node Manager Statistics, mode followed by domain
+		if len(data) < 7 {
+			break
+		}
+		domain := data[6] & 0x0f
+		switch data[5] & 0x1f {
+		case 0x01:
+			return nmRequirement{version: NMVersion10, caps: true, domain: domain, trigger: triggerNone}
+		case 0x02:
+			return nmRequirement{version: NMVersion15, caps: true, domain: domain, trigger: triggerInletTemperature}
+		}
+		// airflow and outlet temperature depend on sensors of platform
+		return nmRequirement{version: NMVersion20, execute: true}
+	case 0x65:
+		return nmRequirement{version: NMVersion30, execute: true}
+	case 0x4b, 0x40:
+		return nmRequirement{version: NMVersion20, execute: true}
+	case 0xc2:
+		// policies may be read only when power control policies are supported in domain
+		if len(data) < 6 {
+			break
+		}
+		return nmRequirement{version: NMVersion10, caps: true, domain: data[5] & 0x0f, trigger: triggerNone, execute: true}
+	case 0xc6:
+		return nmRequirement{version: NMVersion20, execute: true}
+	}
+	return nmRequirement{execute: true}
+}
+
+// prober runs discovery commands of single host, results are queried once.
+type prober struct {
+	layer IpmiAL
+	host  string
+
+	nmProbed   bool
+	nmVersion  byte
+	nmErr      error
+	nmCaps     map[[2]byte]error
+	nmMax      map[byte]int
+	dcmiProbed bool
+	dcmiCaps   []byte
+	dcmiErr    error
+	sdrProbed  bool
+	sdrs       []SdrInfo
+	sdrErr     error
+
+	policiesProbed bool
+	policies       map[byte][]uint8
+	policiesErr    map[byte]error
+
+	// transient is set when discovery failed with transient error,
+	// supported requests may be missing from results
+	transient bool
+}
+
+// incompleteProbes are hosts whose last probing failed with transient errors.
+var incompleteProbes = struct {
+	sync.Mutex
+	hosts map[string]bool
+}{hosts: make(map[string]bool)}
+
+// probeIncomplete tells whether capabilities of host found by last probing
+// may lack supported requests, they should not be kept.
+func probeIncomplete(host string) bool {
+	incompleteProbes.Lock()
+	defer incompleteProbes.Unlock()
+	return incompleteProbes.hosts[host]
+}
+
+func setProbeIncomplete(host string, incomplete bool) {
+	incompleteProbes.Lock()
+	defer incompleteProbes.Unlock()
+	if incomplete {
+		incompleteProbes.hosts[host] = true
+	} else {
+		delete(incompleteProbes.hosts, host)
+	}
+}
+
+// failed records transient discovery errors and returns err.
+func (p *prober) failed(err error) error {
+	if IsTransient(err) {
+		p.transient = true
+	}
+	return err
+}
+
+// exec performs discovery command, sent to the same controller as request.
+func (p *prober) exec(request IpmiRequest, data []byte) (*IpmiResponse, error) {
+	cmd := request.Clone()
+	cmd.Data = data
+	resp, err := p.layer.ExecRaw(cmd, p.host)
+	if err != nil {
+		return nil, p.failed(err)
+	}
+	if resp == nil || len(resp.Data) == 0 {
+		return nil, p.failed(ErrNoResponse)
+	}
+	return resp, nil
+}
+
+// nodeManager checks whether Node Manager of version at least required is present.
+// Version is asked again by next request when BMC is busy or does not answer.
+func (p *prober) nodeManager(request IpmiRequest, version byte) error {
+	if !p.nmProbed {
+		resp, err := p.exec(request, CmdNMVersion)
+		if IsTransient(err) {
+			return fmt.Errorf("Node Manager version not available: %v", err)
+		}
+		p.nmProbed = true
+		p.nmCaps = make(map[[2]byte]error)
+		p.nmMax = make(map[byte]int)
+		switch {
+		case err != nil:
+			p.nmErr = fmt.Errorf("Node Manager not present: %v", err)
+		case len(resp.Data) < 5:
+			p.nmErr = fmt.Errorf("Node Manager not present: %v", errShortResponse)
+		default:
+			p.nmVersion = resp.Data[4]
+		}
+	}
+	if p.nmErr != nil {
+		return p.nmErr
+	}
+	if p.nmVersion < version {
+		return fmt.Errorf("Node Manager version 0x%02x does not support it, 0x%02x required", p.nmVersion, version)
+	}
+	return nil
+}
+
+// nmCapabilities checks whether power control policies are supported in domain with trigger.
+func (p *prober) nmCapabilities(request IpmiRequest, domain, trigger byte) error {
+	key := [2]byte{domain, trigger}
+	if err, ok := p.nmCaps[key]; ok {
+		return err
+	}
+	resp, err := p.exec(request, nmCapabilitiesCmd(domain, trigger))
+	if err != nil {
+		transient := IsTransient(err)
+		err = fmt.Errorf("Node Manager capabilities of domain %d with trigger %d not available: %v", domain, trigger, err)
+		if transient {
+			return err
+		}
+	} else if len(resp.Data) > 4 && trigger == triggerNone {
+		// maximum concurrent settings, number of policies domain supports
+		p.nmMax[domain] = int(resp.Data[4])
+	}
+	p.nmCaps[key] = err
+	return err
+}
+
+// dcmi checks whether DCMI platform capability is supported, index
+// selects byte of parameter data.
+func (p *prober) dcmi(index int, mask byte) error {
+	if !p.dcmiProbed {
+		resp, err := p.exec(IpmiRequest{}, CmdDCMICapabilities)
+		if IsTransient(err) {
+			return fmt.Errorf("DCMI capabilities not available: %v", err)
+		}
+		p.dcmiProbed = true
+		switch {
+		case err != nil:
+			p.dcmiErr = fmt.Errorf("DCMI not supported: %v", err)
+		case len(resp.Data) < 9:
+			p.dcmiErr = fmt.Errorf("DCMI not supported: %v", errShortResponse)
+		default:
+			p.dcmiCaps = resp.Data[5:]
+		}
+	}
+	if p.dcmiErr != nil {
+		return p.dcmiErr
+	}
+	if p.dcmiCaps[index]&mask == 0 {
+		return fmt.Errorf("DCMI capability 0x%02x of byte %d not supported", mask, index+1)
+	}
+	return nil
+}
+
+// execute checks that request completes and its response is valid.
+func (p *prober) execute(req RequestDescription) error {
+	resp, err := p.layer.ExecRaw(req.Request, p.host)
+	if resp == nil {
+		if err == nil {
+			err = ErrNoResponse
+		}
+		return p.failed(err)
+	}
+	if _, ok := err.(*CompletionCodeError); err != nil && !ok {
+		return p.failed(err)
+	}
+	return p.failed(ValidateResponse(req.Request, *resp, req.Format))
+}
+
+// check returns reason of request being unsupported, nil when it is supported.
+func (p *prober) check(req RequestDescription) error {
+	data := req.Request.Data
+	if len(data) > 1 && data[0] == netFnNM {
+		need := nmRequirementOf(data)
+		if err := p.nodeManager(req.Request, need.version); err != nil {
+			return err
+		}
+		if need.caps {
+			if err := p.nmCapabilities(req.Request, need.domain, need.trigger); err != nil {
+				return err
+			}
+		}
+		if !need.execute {
+			return nil
+		}
+	}
+	if len(data) > 1 && data[0] == netFnDCMI && (data[1] == 0x02 || data[1] == 0x03) {
+		// Get Power Reading, Get Power Limit
+		return p.dcmi(2, dcmiPowerManagement)
+	}
+	return p.execute(req)
+}
+
+// sensorConversion finds conversion of sensor read by Get Sensor Reading request
+// in SDR of host. Sensor is matched by number and owner, which is controller
+// request is sent to.
+func (p *prober) sensorConversion(request IpmiRequest) (*SensorConversion, error) {
+	if !p.sdrProbed {
+		p.sdrProbed = true
+		sp := &SdrParser{IpmiLayer: p.layer}
+		deviceId, err := sp.GetDeviceId(p.host)
+		if err == nil {
+			p.sdrs, err = sp.ScanSdr(deviceId.IsDeviceSdr, p.host)
+		}
+		if err != nil {
+			p.sdrErr = fmt.Errorf("SDR not available: %v", p.failed(err))
+		}
+	}
+	if p.sdrErr != nil {
+		return nil, p.sdrErr
+	}
+	owner := request.Slave
+	if owner == 0 {
+		owner = bmcAddress
+	}
+	sensor := request.Data[2]
+	for _, sdr := range p.sdrs {
+		if uint8(sdr.OwnerId) != owner || uint8(sdr.SensorNumber) != sensor {
+			continue
+		}
+		if sdr.Conversion == nil {
+			return nil, fmt.Errorf("Sensor 0x%02x has no analog reading", sensor)
+		}
+		conv := *sdr.Conversion
+		if conv.NonLinear() {
+			ranges, err := LoadFactorRanges(p.layer, request, p.host, sensor)
+			if err != nil {
+				return nil, fmt.Errorf("Reading factors of sensor 0x%02x not available: %v", sensor, err)
+			}
+			conv.Ranges = ranges
+		}
+		return &conv, nil
+	}
+	return nil, fmt.Errorf("Sensor 0x%02x of controller 0x%02x not found in SDR", sensor, owner)
+}
+
+// convert returns format of request converting sensor readings to engineering
+// units, when conversion cannot be found raw readings are kept.
+func (p *prober) convert(req RequestDescription) ParserFormat {
+	data := req.Request.Data
+	if len(data) < 3 || data[0] != 0x04 || data[1] != 0x2d {
+		return req.Format
+	}
+	conv, err := p.sensorConversion(req.Request)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"host":   p.host,
+			"metric": req.MetricsRoot,
+			"reason": err,
+		}).Info("Raw sensor readings reported")
+		return req.Format
+	}
+	return withConversion(req.Format, conv)
+}
+
+// dcmiThermal finds inlet temperature sensor: record ID is taken from
+// DCMI sensor info and sensor number from its SDR.
+func (p *prober) dcmiThermal() (RequestDescription, error) {
+	if err := p.dcmi(1, dcmiTemperatureMonitoring); err != nil {
+		return RequestDescription{}, err
+	}
+	resp, err := p.exec(IpmiRequest{}, CmdDCMIThermalCap)
+	if err != nil {
+		return RequestDescription{}, err
+	}
+	if len(resp.Data) < 6 {
+		return RequestDescription{}, fmt.Errorf("Inlet temperature sensor not found")
+	}
+	cmdSDR := make([]byte, len(CmdSDR))
+	copy(cmdSDR, CmdSDR)
+	cmdSDR[4] = resp.Data[4]
+	cmdSDR[5] = resp.Data[5]
+	resp, err = p.exec(IpmiRequest{}, cmdSDR)
+	if err != nil {
+		return RequestDescription{}, err
+	}
+	if len(resp.Data) < 11 {
+		return RequestDescription{}, errShortResponse
+	}
+	thermal := DcmiThermal
+	thermal.Request = DcmiThermal.Request.Clone()
+	thermal.Request.Data[2] = resp.Data[10]
+	thermal.Format = p.convert(thermal)
+	return thermal, nil
+}
+
+// nmPolicies enumerates policies of Node Manager domains supporting power
+// control policies, policies are enumerated once for all policy requests.
+// Domains which policies could not be enumerated are returned with errors,
+// policies found in them before error are kept.
+func (p *prober) nmPolicies(request IpmiRequest) (map[byte][]uint8, map[byte]error) {
+	if !p.policiesProbed {
+		p.policiesProbed = true
+		p.policies = make(map[byte][]uint8)
+		p.policiesErr = make(map[byte]error)
+		for domain := range PolicyDomains {
+			if p.nmCapabilities(request, byte(domain), triggerNone) != nil {
+				continue
+			}
+			ids, err := EnumeratePolicies(p.layer, request, p.host, byte(domain), p.nmMax[byte(domain)])
+			if err != nil {
+				p.policiesErr[byte(domain)] = fmt.Errorf("Node Manager policies of domain %d not available: %v", domain, p.failed(err))
+			}
+			p.policies[byte(domain)] = ids
+		}
+	}
+	return p.policies, p.policiesErr
+}
+
+// policyRequests returns copies of policy request for every policy found on host.
+func (p *prober) policyRequests(template RequestDescription) ([]RequestDescription, error) {
+	if err := p.nodeManager(template.Request, nmRequirementOf(template.Request.Data).version); err != nil {
+		return nil, err
+	}
+	policies, errs := p.nmPolicies(template.Request)
+	var requests []RequestDescription
+	var err error
+	for domain := range PolicyDomains {
+		for _, id := range policies[byte(domain)] {
+			requests = append(requests, policyRequest(template, byte(domain), id))
+		}
+		if e := errs[byte(domain)]; e != nil && err == nil {
+			err = e
+		}
+	}
+	if len(requests) == 0 {
+		if err != nil {
+			return nil, err
+		}
+		return nil, fmt.Errorf("No Node Manager policies found")
+	}
+	if err != nil {
+		log.WithFields(log.Fields{
+			"host":  p.host,
+			"error": err,
+		}).Warn("Node Manager policies enumerated incompletely")
+	}
+	// command is the same for all policies, it is checked once
+	if err := p.check(requests[0]); err != nil {
+		return nil, err
+	}
+	return requests, nil
+}
+
+// ProbeCapabilities returns requests supported by host. Node Manager requests
+// are checked with Get Node Manager Version and Get Node Manager Capabilities
+// of their domain and policy trigger, DCMI ones with Get DCMI Capabilities Info.
+// Requests not covered by discovery commands are executed once. When protocol
+// is "dcmi", DCMI inlet temperature sensor is looked up as well. Sensor readings
+// are converted with factors of their SDR records. Policy requests are repeated
+// for every Node Manager policy of host, with metrics root extended by policy
+// domain and ID.
+// Reasons of requests being unsupported are logged. Hosts whose discovery
+// failed with transient errors are remembered as probed incompletely.
+func ProbeCapabilities(layer IpmiAL, requests []RequestDescription, host, protocol string) []RequestDescription {
+	p := &prober{layer: layer, host: host}
+	validRequests := make([]RequestDescription, 0, len(requests))
+	unsupported := func(metric string, err error) {
+		log.WithFields(log.Fields{
+			"host":   host,
+			"metric": metric,
+			"reason": err,
+		}).Info("Metric not available")
+	}
+	for _, req := range requests {
+		if IsPolicyRequest(req.Request) {
+			policies, err := p.policyRequests(req)
+			if err != nil {
+				unsupported(req.MetricsRoot, err)
+			}
+			validRequests = append(validRequests, policies...)
+			continue
+		}
+		if err := p.check(req); err != nil {
+			unsupported(req.MetricsRoot, err)
+			continue
+		}
+		req.Format = p.convert(req)
+		validRequests = append(validRequests, req)
+	}
+	if protocol == "dcmi" {
+		thermal, err := p.dcmiThermal()
+		if err != nil {
+			unsupported(DcmiThermal.MetricsRoot, err)
+		} else {
+			validRequests = append(validRequests, thermal)
+		}
+	}
+	setProbeIncomplete(host, p.transient)
+	return validRequests
+}
+
+// ProbeHosts probes capabilities of hosts concurrently with ProbeCapabilities.
+// Layer must allow concurrent requests to different hosts.
+func ProbeHosts(layer IpmiAL, requests []RequestDescription, host []string, protocol string) map[string][]RequestDescription {
+	return probeHosts(host, func(addr string) []RequestDescription {
+		return ProbeCapabilities(layer, requests, addr, protocol)
+	})
+}
+
+// probeHosts runs probe of every host in own goroutine and collects results by host.
+func probeHosts(host []string, probe func(addr string) []RequestDescription) map[string][]RequestDescription {
+	validRequests := make(map[string][]RequestDescription, len(host))
+	var wg sync.WaitGroup
+	var mutex sync.Mutex
+	for _, addr := range host {
+		wg.Add(1)
+		go func(addr string) {
+			defer wg.Done()
+			capabilities := probe(addr)
+			mutex.Lock()
+			defer mutex.Unlock()
+			validRequests[addr] = capabilities
+		}(addr)
+	}
+	wg.Wait()
+	return validRequests
+}
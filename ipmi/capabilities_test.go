@@ -0,0 +1,109 @@
+// +build unit
+
+/*
+http://www.apache.org/licenses/LICENSE-2.0.txt
+
+
+Copyright 2016 Intel Corporation
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package ipmi
+
+import (
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+// dcmiLayer answers DCMI discovery with inlet sensor numbered by host.
+type dcmiLayer struct {
+	sensors map[string]byte
+}
+
+func (l *dcmiLayer) ExecRaw(request IpmiRequest, host string) (*IpmiResponse, error) {
+	var data []byte
+	switch request.Data[1] {
+	case 0x01:
+		data = []byte{0x00, 0xdc, 0x01, 0x05, 0x02, 0x00, 0x0f, 0x01, 0x08}
+	case 0x02:
+		data = []byte{0x00, 0xdc, 0xd7, 0x00}
+	case 0x07:
+		data = []byte{0x00, 0xdc, 0x01, 0x01, 0x05, 0x00}
+	case 0x23:
+		data = []byte{0x00, 0x06, 0x00, 0x05, 0x00, 0x51, 0x01, 0x3b, 0x20, 0x00, l.sensors[host]}
+	default:
+		return &IpmiResponse{[]byte{0xc1}, 1}, &CompletionCodeError{Code: 0xc1}
+	}
+	return &IpmiResponse{data, 1}, nil
+}
+
+func (l *dcmiLayer) BatchExecRaw(requests []IpmiRequest, host string) ([]IpmiResponse, error) {
+	return nil, ErrNoResponse
+}
+
+func (l *dcmiLayer) GetPlatformCapabilities(requests []RequestDescription, host []string) map[string][]RequestDescription {
+	return ProbeHosts(l, requests, host, "dcmi")
+}
+
+func TestCapabilities(t *testing.T) {
+	Convey("Check capability probing", t, func() {
+		Convey("hosts are probed concurrently", func() {
+			layer := newGatedLayer()
+			done := make(chan map[string][]RequestDescription)
+			go func() {
+				done <- ProbeHosts(layer, GenericVendor[2:3], []string{"a", "b", "c", "d"}, "node_manager")
+			}()
+			layer.wait(4)
+			close(layer.release)
+			caps := <-done
+			So(len(caps), ShouldEqual, 4)
+			So(caps["a"], ShouldBeEmpty)
+			_, maxTotal := layer.limits()
+			So(maxTotal, ShouldEqual, 4)
+		})
+
+		Convey("cache reads identities of hosts concurrently", func() {
+			layer := newGatedLayer()
+			done := make(chan map[string][]RequestDescription)
+			go func() {
+				cache := &Cache{Layer: layer}
+				done <- cache.GetPlatformCapabilities(GenericVendor[2:3], []string{"a", "b", "c", "d"})
+			}()
+			layer.wait(4)
+			close(layer.release)
+			<-done
+			_, maxTotal := layer.limits()
+			So(maxTotal, ShouldEqual, 4)
+		})
+
+		Convey("per host results do not change templates", func() {
+			layer := &dcmiLayer{sensors: map[string]byte{"a": 0x30, "b": 0x31}}
+			router := &HostRouter{Layers: map[string]IpmiAL{"a": layer, "b": layer}}
+			caps := router.GetPlatformCapabilities(DCMIVendor, []string{"a", "b", "c"})
+			So(len(caps["a"]), ShouldEqual, 3)
+			So(caps["a"][2].Request.Data, ShouldResemble, []byte{0x04, 0x2d, 0x30})
+			So(caps["b"][2].Request.Data, ShouldResemble, []byte{0x04, 0x2d, 0x31})
+			So(caps["c"], ShouldBeEmpty)
+			So(DcmiThermal.Request.Data, ShouldResemble, []byte{0x04, 0x2d, 0x00})
+			So(CmdSDR, ShouldResemble, []byte{0xa, 0x23, 0x00, 0x00, 0x00, 0x00, 0x00, 0x08})
+		})
+
+		Convey("Node Manager requirements follow request", func() {
+			So(nmRequirementOf(GenericVendor[3].Request.Data), ShouldResemble, nmRequirement{version: NMVersion10, caps: true, domain: 1})
+			So(nmRequirementOf(GenericVendor[5].Request.Data), ShouldResemble, nmRequirement{version: NMVersion15, caps: true, trigger: triggerInletTemperature})
+			So(nmRequirementOf(GenericVendor[0].Request.Data), ShouldResemble, nmRequirement{version: NMVersion30, execute: true})
+		})
+	})
+}
@@ -0,0 +1,334 @@
+// +build linux
+
+/*
+http://www.apache.org/licenses/LICENSE-2.0.txt
+
+
+Copyright 2016 Intel Corporation
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package ipmi
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// Kinds of audit log entries
+const (
+	AuditDryRun   = "dry_run"
+	AuditRequest  = "request"
+	AuditResponse = "response"
+)
+
+// Scopes of Enable/Disable Node Manager Policy Control.
+const (
+	PolicyControlGlobal = 0x00
+	PolicyControlDomain = 0x02
+	PolicyControlPolicy = 0x04
+)
+
+// Policy exception actions of Set Node Manager Policy.
+const (
+	PolicyActionAlert    = 0x01
+	PolicyActionShutdown = 0x02
+)
+
+// MaxAlertThresholds is number of alert thresholds of single policy.
+const MaxAlertThresholds = 3
+
+var errNoAudit = errors.New("Audit log is required to change settings")
+
+// controlErrors are meanings of command specific completion codes of Node
+// Manager policy and DCMI power limit commands, by network function.
+var controlErrors = map[byte]map[byte]string{
+	netFnNM: {
+		0x80: "policy ID invalid",
+		0x81: "domain ID invalid",
+		0x82: "unknown policy trigger type",
+		0x84: "power limit out of range",
+		0x85: "correction time out of range",
+		0x86: "policy trigger value out of range",
+		0x89: "statistics reporting period out of range",
+	},
+	netFnDCMI: {
+		0x80: "no power limit set",
+		0x84: "power limit out of range",
+		0x85: "correction time out of range",
+		0x89: "statistics reporting period out of range",
+	},
+}
+
+// AuditEntry is single line of audit log. Change which is sent is logged
+// as request before and as response after it completes, dry runs once.
+type AuditEntry struct {
+	Kind      string      `json:"kind"`
+	Time      time.Time   `json:"time"`
+	User      string      `json:"user,omitempty"`
+	Host      string      `json:"host"`
+	Operation string      `json:"operation"`
+	Channel   int16       `json:"channel,omitempty"`
+	Slave     uint8       `json:"slave,omitempty"`
+	Transit   []BridgeHop `json:"transit,omitempty"`
+	Request   hexBytes    `json:"request"`
+	Response  hexBytes    `json:"response,omitempty"`
+	Error     string      `json:"error,omitempty"`
+}
+
+// PolicyConfig is Node Manager power control policy set with Set Node
+// Manager Policy. PowerLimit is in watts, CorrectionTime in milliseconds,
+// ReportingPeriod in seconds, TriggerLimit in units of Trigger. Actions are
+// taken when limit cannot be kept within correction time. Volatile policy
+// is lost after Node Manager reset.
+type PolicyConfig struct {
+	Domain          uint8
+	ID              uint8
+	Enabled         bool
+	Trigger         uint8
+	TriggerLimit    uint16
+	PowerLimit      uint16
+	CorrectionTime  uint32
+	ReportingPeriod uint16
+	Actions         uint8
+	Volatile        bool
+}
+
+// validate checks fields of policy which cannot be accepted by any platform.
+func (p PolicyConfig) validate() error {
+	switch {
+	case p.Domain > 0x0f:
+		return fmt.Errorf("Invalid domain %d", p.Domain)
+	case p.Trigger > PolicyTriggerBootTime:
+		return fmt.Errorf("Unknown policy trigger %d", p.Trigger)
+	case p.PowerLimit == 0 && p.Trigger != PolicyTriggerBootTime:
+		return errors.New("Power limit is required")
+	case p.CorrectionTime == 0:
+		return errors.New("Correction time is required")
+	case p.ReportingPeriod == 0:
+		return errors.New("Statistics reporting period is required")
+	case p.Actions&^(PolicyActionAlert|PolicyActionShutdown) != 0:
+		return fmt.Errorf("Unknown policy actions 0x%02x", p.Actions)
+	}
+	return nil
+}
+
+// DCMIPowerLimit is power limit set with Set DCMI Power Limit. Limit is in watts,
+// CorrectionTime in milliseconds, SamplingPeriod in seconds. Action
+// (DCMIAction*) is taken when limit cannot be kept within correction time.
+type DCMIPowerLimit struct {
+	Action         uint8
+	Limit          uint16
+	CorrectionTime uint32
+	SamplingPeriod uint16
+}
+
+// validate checks fields of power limit which cannot be accepted by any platform.
+func (l DCMIPowerLimit) validate() error {
+	switch {
+	case l.Action > 0x11:
+		return fmt.Errorf("Unknown exception action 0x%02x", l.Action)
+	case l.Limit == 0:
+		return errors.New("Power limit is required")
+	case l.CorrectionTime == 0:
+		return errors.New("Correction time is required")
+	case l.SamplingPeriod == 0:
+		return errors.New("Sampling period is required")
+	}
+	return nil
+}
+
+// PowerControl changes power limiting settings of hosts through Layer.
+// Requests are sent only when Confirm is set, otherwise they are just
+// validated and logged (dry run). Every change is written to Audit,
+// changes are refused when audit log is missing or cannot be written.
+// Node Manager is addressed by Path, nil means path of GenericVendor
+// requests; DCMI requests are sent to BMC. Layer may be any backend.
+type PowerControl struct {
+	Layer   IpmiAL
+	Path    []BridgeHop
+	Confirm bool
+	Audit   io.Writer
+	User    string
+	mutex   sync.Mutex
+}
+
+func (c *PowerControl) audit(e AuditEntry) error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return json.NewEncoder(c.Audit).Encode(e)
+}
+
+// nmRequest returns Node Manager request addressed along path of control.
+func (c *PowerControl) nmRequest(data []byte) IpmiRequest {
+	path := c.Path
+	if path == nil {
+		path = GenericVendor[0].Request.Path()
+	}
+	req := IpmiRequest{Data: data}
+	req.SetPath(path)
+	return req
+}
+
+// exec sends change to host unless it is dry run. Request is returned
+// in both cases.
+func (c *PowerControl) exec(host, operation string, request IpmiRequest) (IpmiRequest, error) {
+	if c.Audit == nil {
+		return request, errNoAudit
+	}
+	entry := AuditEntry{Kind: AuditDryRun, Time: time.Now(), User: c.User, Host: host, Operation: operation,
+		Channel: request.Channel, Slave: request.Slave, Transit: request.Transit, Request: request.Data}
+	if c.Confirm {
+		entry.Kind = AuditRequest
+	}
+	if err := c.audit(entry); err != nil {
+		return request, fmt.Errorf("Unable to write audit log: %v", err)
+	}
+	logger := log.WithFields(log.Fields{
+		"host":      host,
+		"operation": operation,
+		"request":   request.Data,
+	})
+	if !c.Confirm {
+		logger.Info("Dry run, request not sent")
+		return request, nil
+	}
+
+	resp, err := c.Layer.ExecRaw(request, host)
+	if err == nil && resp == nil {
+		err = ErrNoResponse
+	}
+	entry.Kind, entry.Time = AuditResponse, time.Now()
+	if resp != nil {
+		entry.Response = resp.Data
+	}
+	if err == nil {
+		err = CheckResponse(request, *resp)
+	}
+	if e, ok := err.(*CompletionCodeError); ok {
+		if meaning, ok := controlErrors[request.Data[0]][e.Code]; ok {
+			err = fmt.Errorf("%v (%s)", err, meaning)
+		}
+	}
+	if err != nil {
+		entry.Error = err.Error()
+	}
+	if aerr := c.audit(entry); aerr != nil {
+		logger.WithField("error", aerr).Error("Unable to write audit log")
+	}
+	if err != nil {
+		logger.WithField("error", err).Warn("Request failed")
+		return request, err
+	}
+	logger.Info("Request completed")
+	return request, nil
+}
+
+// SetPolicy creates or replaces Node Manager power control policy with Set
+// Node Manager Policy.
+func (c *PowerControl) SetPolicy(host string, policy PolicyConfig) (IpmiRequest, error) {
+	if err := policy.validate(); err != nil {
+		return IpmiRequest{}, err
+	}
+	data := []byte{0x2e, 0xc1, 0x57, 0x01, 0x00, policy.Domain, policy.ID, policy.Trigger | 0x10, policy.Actions}
+	if policy.Enabled {
+		data[5] |= 0x10
+	}
+	if policy.Volatile {
+		data[7] |= 0x80
+	}
+	data = append(data, byte(policy.PowerLimit), byte(policy.PowerLimit>>8))
+	data = append(data, byte(policy.CorrectionTime), byte(policy.CorrectionTime>>8),
+		byte(policy.CorrectionTime>>16), byte(policy.CorrectionTime>>24))
+	data = append(data, byte(policy.TriggerLimit), byte(policy.TriggerLimit>>8))
+	data = append(data, byte(policy.ReportingPeriod), byte(policy.ReportingPeriod>>8))
+	return c.exec(host, "set_policy", c.nmRequest(data))
+}
+
+// RemovePolicy removes Node Manager policy with Set Node Manager Policy.
+func (c *PowerControl) RemovePolicy(host string, domain, policy uint8) (IpmiRequest, error) {
+	if domain > 0x0f {
+		return IpmiRequest{}, fmt.Errorf("Invalid domain %d", domain)
+	}
+	data := []byte{0x2e, 0xc1, 0x57, 0x01, 0x00, domain, policy, 0x00, 0x00}
+	return c.exec(host, "remove_policy", c.nmRequest(data))
+}
+
+// SetPolicyControl enables or disables policies globally, in domain or single
+// policy with Enable/Disable Node Manager Policy Control. Domain and policy
+// are ignored by wider scopes.
+func (c *PowerControl) SetPolicyControl(host string, scope, domain, policy uint8, enable bool) (IpmiRequest, error) {
+	if scope != PolicyControlGlobal && scope != PolicyControlDomain && scope != PolicyControlPolicy {
+		return IpmiRequest{}, fmt.Errorf("Invalid policy control scope %d", scope)
+	}
+	if domain > 0x0f {
+		return IpmiRequest{}, fmt.Errorf("Invalid domain %d", domain)
+	}
+	flags := scope
+	operation := "disable_policy_control"
+	if enable {
+		flags |= 0x01
+		operation = "enable_policy_control"
+	}
+	data := []byte{0x2e, 0xc0, 0x57, 0x01, 0x00, flags, domain, policy}
+	return c.exec(host, operation, c.nmRequest(data))
+}
+
+// SetAlertThresholds sets up to MaxAlertThresholds alert thresholds of policy,
+// in units of policy trigger (watts for policies without trigger), with Set
+// Node Manager Policy Alert Thresholds. No thresholds clear them.
+func (c *PowerControl) SetAlertThresholds(host string, domain, policy uint8, thresholds []uint16) (IpmiRequest, error) {
+	if len(thresholds) > MaxAlertThresholds {
+		return IpmiRequest{}, fmt.Errorf("At most %d alert thresholds are supported, got %d", MaxAlertThresholds, len(thresholds))
+	}
+	if domain > 0x0f {
+		return IpmiRequest{}, fmt.Errorf("Invalid domain %d", domain)
+	}
+	data := []byte{0x2e, 0xc3, 0x57, 0x01, 0x00, domain, policy, byte(len(thresholds))}
+	for _, t := range thresholds {
+		data = append(data, byte(t), byte(t>>8))
+	}
+	return c.exec(host, "set_alert_thresholds", c.nmRequest(data))
+}
+
+// SetPowerLimit sets DCMI power limit with Set Power Limit. Limit is applied
+// once activated.
+func (c *PowerControl) SetPowerLimit(host string, limit DCMIPowerLimit) (IpmiRequest, error) {
+	if err := limit.validate(); err != nil {
+		return IpmiRequest{}, err
+	}
+	data := []byte{0x2c, 0x04, 0xdc, 0x00, 0x00, 0x00, limit.Action}
+	data = append(data, byte(limit.Limit), byte(limit.Limit>>8))
+	data = append(data, byte(limit.CorrectionTime), byte(limit.CorrectionTime>>8),
+		byte(limit.CorrectionTime>>16), byte(limit.CorrectionTime>>24))
+	data = append(data, 0x00, 0x00, byte(limit.SamplingPeriod), byte(limit.SamplingPeriod>>8))
+	return c.exec(host, "set_power_limit", IpmiRequest{Data: data})
+}
+
+// ActivatePowerLimit activates or deactivates DCMI power limit with Activate/Deactivate Power Limit.
+func (c *PowerControl) ActivatePowerLimit(host string, activate bool) (IpmiRequest, error) {
+	data := []byte{0x2c, 0x05, 0xdc, 0x00, 0x00, 0x00}
+	operation := "deactivate_power_limit"
+	if activate {
+		data[3] = 0x01
+		operation = "activate_power_limit"
+	}
+	return c.exec(host, operation, IpmiRequest{Data: data})
+}
@@ -0,0 +1,191 @@
+// +build linux
+
+/*
+http://www.apache.org/licenses/LICENSE-2.0.txt
+
+
+Copyright 2016 Intel Corporation
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package ipmi
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+)
+
+// ErrNoResponse is returned when no valid response was received from device,
+// i.e. request failed before BMC could return completion code.
+var ErrNoResponse = errors.New("No valid response received")
+
+// Completion codes as defined by IPMI specification (table 5-2).
+var completionCodes = map[byte]string{
+	0xc0: "node busy",
+	0xc1: "invalid command",
+	0xc2: "command invalid for given LUN",
+	0xc3: "timeout while processing command",
+	0xc4: "out of space",
+	0xc5: "reservation canceled or invalid reservation ID",
+	0xc6: "request data truncated",
+	0xc7: "request data length invalid",
+	0xc8: "request data field length limit exceeded",
+	0xc9: "parameter out of range",
+	0xca: "cannot return number of requested data bytes",
+	0xcb: "requested sensor, data, or record not present",
+	0xcc: "invalid data field in request",
+	0xcd: "command illegal for specified sensor or record type",
+	0xce: "command response could not be provided",
+	0xcf: "cannot execute duplicated request",
+	0xd0: "SDR repository in update mode",
+	0xd1: "device in firmware update mode",
+	0xd2: "BMC initialization or initialization agent in progress",
+	0xd3: "destination unavailable",
+	0xd4: "insufficient privilege level",
+	0xd5: "command not supported in present state",
+	0xd6: "command sub-function has been disabled or is unavailable",
+	0xff: "unspecified error",
+}
+
+// CompletionCodeError is returned when device completed request
+// with non-zero completion code.
+type CompletionCodeError struct {
+	NetFn byte
+	Cmd   byte
+	Code  byte
+}
+
+// Meaning returns description of completion code.
+func (e *CompletionCodeError) Meaning() string {
+	if meaning, ok := completionCodes[e.Code]; ok {
+		return meaning
+	}
+	switch {
+	case e.Code >= 0x01 && e.Code <= 0x7e:
+		return "device specific (OEM) error"
+	case e.Code >= 0x80 && e.Code <= 0xbe:
+		return "command specific error"
+	}
+	return "reserved completion code"
+}
+
+func (e *CompletionCodeError) Error() string {
+	return fmt.Sprintf("Request netfn 0x%02x cmd 0x%02x failed with completion code 0x%02x : %s",
+		e.NetFn, e.Cmd, e.Code, e.Meaning())
+}
+
+// Transient reports whether the same request may succeed when repeated later.
+func (e *CompletionCodeError) Transient() bool {
+	switch e.Code {
+	case 0xc0, 0xc3, 0xc5, 0xce, 0xcf, 0xd0, 0xd1, 0xd2:
+		return true
+	}
+	return false
+}
+
+// Unsupported reports whether device does not implement requested command or data.
+func (e *CompletionCodeError) Unsupported() bool {
+	switch e.Code {
+	case 0xc1, 0xc2, 0xcb, 0xd5, 0xd6:
+		return true
+	}
+	return false
+}
+
+// IsTransient reports whether err is temporary failure worth retrying.
+func IsTransient(err error) bool {
+	if e, ok := err.(*CompletionCodeError); ok {
+		return e.Transient()
+	}
+	return err == ErrNoResponse
+}
+
+// IsUnsupported reports whether err means that request is not supported by device.
+func IsUnsupported(err error) bool {
+	if e, ok := err.(*CompletionCodeError); ok {
+		return e.Unsupported()
+	}
+	return false
+}
+
+// CheckResponse verifies response received for request.
+// ErrNoResponse is returned when response is not valid, *CompletionCodeError
+// when first byte of response data (completion code) is not zero.
+func CheckResponse(request IpmiRequest, response IpmiResponse) error {
+	if response.IsValid != 1 || len(response.Data) == 0 {
+		return ErrNoResponse
+	}
+	if response.Data[0] == 0 {
+		return nil
+	}
+	e := &CompletionCodeError{Code: response.Data[0]}
+	if len(request.Data) > 1 {
+		e.NetFn = request.Data[0]
+		e.Cmd = request.Data[1]
+	}
+	return e
+}
+
+// ValidateResponse verifies response received for request with CheckResponse
+// and validation of format. Completion codes accepted by format (e.g. DCMI
+// power limit not active) are not errors.
+func ValidateResponse(request IpmiRequest, response IpmiResponse, format ParserFormat) error {
+	err := CheckResponse(request, response)
+	if _, ok := err.(*CompletionCodeError); ok && format.Validate(response) == nil {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	return format.Validate(response)
+}
+
+// checkedResponse returns response and result of its check as returned by ExecRaw.
+// Response is dropped when nothing valid was received.
+func checkedResponse(request IpmiRequest, response *IpmiResponse) (*IpmiResponse, error) {
+	err := CheckResponse(request, *response)
+	if err == ErrNoResponse {
+		return nil, err
+	}
+	return response, err
+}
+
+// BatchError is returned by BatchExecRaw when some of requests failed.
+// Errors are indexed by request position in batch, responses of
+// remaining requests are still returned.
+type BatchError map[int]error
+
+func (e BatchError) Error() string {
+	indexes := make([]int, 0, len(e))
+	for i := range e {
+		indexes = append(indexes, i)
+	}
+	sort.Ints(indexes)
+	return fmt.Sprintf("%d request(s) in batch failed, first (%d) : %v", len(e), indexes[0], e[indexes[0]])
+}
+
+// checkBatch returns BatchError for failed requests or nil when all succeeded.
+func checkBatch(requests []IpmiRequest, responses []IpmiResponse) error {
+	failed := BatchError{}
+	for i, resp := range responses {
+		if err := CheckResponse(requests[i], resp); err != nil {
+			failed[i] = err
+		}
+	}
+	if len(failed) == 0 {
+		return nil
+	}
+	return failed
+}
@@ -0,0 +1,78 @@
+// +build unit
+
+/*
+http://www.apache.org/licenses/LICENSE-2.0.txt
+
+
+Copyright 2016 Intel Corporation
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package ipmi
+
+import (
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestCompletionCodeError(t *testing.T) {
+	Convey("Check completion code errors", t, func() {
+		request := IpmiRequest{[]byte{0x2e, 0xc8, 0x57, 0x01, 0x00, 0x01, 0x00, 0x00}, 0, 0, nil}
+
+		err := CheckResponse(request, IpmiResponse{[]byte{0x00, 0x57, 0x01, 0x00}, 1})
+		So(err, ShouldBeNil)
+
+		err = CheckResponse(request, IpmiResponse{[]byte{0xc1}, 1})
+		So(err, ShouldResemble, &CompletionCodeError{NetFn: 0x2e, Cmd: 0xc8, Code: 0xc1})
+		So(err.Error(), ShouldContainSubstring, "invalid command")
+		So(IsUnsupported(err), ShouldBeTrue)
+		So(IsTransient(err), ShouldBeFalse)
+
+		err = CheckResponse(request, IpmiResponse{[]byte{0xc3}, 1})
+		So(IsTransient(err), ShouldBeTrue)
+		So(IsUnsupported(err), ShouldBeFalse)
+
+		err = CheckResponse(request, IpmiResponse{[]byte{0xd5}, 1})
+		So(IsUnsupported(err), ShouldBeTrue)
+
+		err = CheckResponse(request, IpmiResponse{[]byte{0x81}, 1})
+		So(err.(*CompletionCodeError).Meaning(), ShouldEqual, "command specific error")
+
+		err = CheckResponse(request, IpmiResponse{nil, 0})
+		So(err, ShouldEqual, ErrNoResponse)
+		So(IsTransient(err), ShouldBeTrue)
+
+		Convey("batch reports failed requests only", func() {
+			requests := []IpmiRequest{request, request, request}
+			err := checkBatch(requests, []IpmiResponse{{[]byte{0x00, 0x01}, 1}, {[]byte{0xd5}, 1}, {nil, 0}})
+			batch, ok := err.(BatchError)
+			So(ok, ShouldBeTrue)
+			So(len(batch), ShouldEqual, 2)
+			So(IsUnsupported(batch[1]), ShouldBeTrue)
+			So(batch[2], ShouldEqual, ErrNoResponse)
+			So(checkBatch(requests[:1], []IpmiResponse{{[]byte{0x00, 0x01}, 1}}), ShouldBeNil)
+		})
+
+		Convey("completion code is recovered from ipmitool output", func() {
+			out := []byte("Unable to send RAW command (channel=0x0 netfn=0x2e lun=0x0 cmd=0xc8 rsp=0xd5): Command not supported in present state\n")
+			code, ok := completionCodeFromOutput(out)
+			So(ok, ShouldBeTrue)
+			So(code, ShouldEqual, 0xd5)
+			data, err := parseShellOutput(out)
+			So(err, ShouldBeNil)
+			So(data, ShouldResemble, []byte{0xd5})
+		})
+	})
+}
@@ -22,8 +22,11 @@ limitations under the License.
 package ipmi
 
 import (
+	"encoding/binary"
 	"errors"
 	"fmt"
+	"strings"
+	"time"
 )
 
 // GenericValidator performs basic response validation. Checks response code ensures response
@@ -38,12 +41,25 @@ func (gv *GenericValidator) Validate(response IpmiResponse) error {
 			if response.Data[0] == 0 {
 				return nil
 			}
-			return fmt.Errorf("Unexpected error code : %d", response.Data[0])
+			return &CompletionCodeError{Code: response.Data[0]}
 		}
 		return errors.New("Zero length response")
 	}
-	fmt.Println("Response is not valid")
-	return nil
+	return ErrNoResponse
+}
+
+// wordValues reads little-endian words of response at given offsets.
+// Words not present in response are invalid.
+func wordValues(response IpmiResponse, offsets map[string]uint, unit string) map[string]Value {
+	m := map[string]Value{}
+	for metricName, startIndex := range offsets {
+		if response.IsValid == 1 && int(startIndex)+2 <= len(response.Data) {
+			m[metricName] = IntValue(int(GetUint16FromByteArray(response.Data, startIndex)), unit)
+		} else {
+			m[metricName] = InvalidValue(unit)
+		}
+	}
+	return m
 }
 
 // ParserCUPS extracts data from CUPS specific response format.
@@ -65,24 +81,15 @@ func (p *ParserCUPS) GetMetrics() []string {
 }
 
 // Parse method returns data in human readable format
-func (p *ParserCUPS) Parse(response IpmiResponse) map[string]uint16 {
-	m := map[string]uint16{}
+func (p *ParserCUPS) Parse(response IpmiResponse) map[string]Value {
 	// Parsing is based on command Get CUPS Data (65h). Bytes 5:6 contains CPU CUPS dynamic load factor
 	// Bytes 7:8 contains memory CUPS dynamic load factor
 	// Bytes 9:10 contains IO CUPS dynamic load factor
-	var names = map[string]uint{
+	return wordValues(response, map[string]uint{
 		"cpu_bandwith":    4,
 		"memory_bandwith": 6,
 		"io_bandwith":     8,
-	}
-	for metricName, startIndex := range names {
-		if response.IsValid == 1 {
-			m[metricName] = GetUint16FromByteArray(response.Data, startIndex)
-		} else {
-			m[metricName] = 0xFFFF
-		}
-	}
-	return m
+	}, "")
 }
 
 // ParserCUPSIndex extracts CUPS Index from Node Manager
@@ -99,49 +106,94 @@ func (p *ParserCUPSIndex) GetMetrics() []string {
 }
 
 // Parse method returns data in human readable format
-func (p *ParserCUPSIndex) Parse(response IpmiResponse) map[string]uint16 {
-	m := map[string]uint16{}
-	m["index"] = GetUint16FromByteArray(response.Data, 4)
-	return m
+func (p *ParserCUPSIndex) Parse(response IpmiResponse) map[string]Value {
+	return wordValues(response, map[string]uint{"index": 4}, "")
 }
 
 // ParserNodeManager extracts data from Node manager response format.
-// Data contains current, min, max and average value.
+// Data contains current, min, max and average value, Unit depends on
+// statistics mode of request.
 type ParserNodeManager struct {
 	*GenericValidator
+	Unit string
 }
 
-// Instance of ParserNodeManager
-var FormatNodeManager = &ParserNodeManager{}
+// Instances of ParserNodeManager for power, temperature and airflow statistics.
+var (
+	FormatNodeManager        = &ParserNodeManager{Unit: UnitWatt}
+	FormatNodeManagerTemp    = &ParserNodeManager{Unit: UnitCelsius}
+	FormatNodeManagerAirflow = &ParserNodeManager{Unit: UnitAirflow}
+)
 
-// GetMetrics method returns metric for CUPS parser: "current_value", "min", "max", "avg"
+// GetMetrics method returns metric for CUPS parser: "current_value", "min", "max", "avg",
+// sample time, statistics reporting period and policy state
 func (p *ParserNodeManager) GetMetrics() []string {
-	return []string{"cur", "min", "max", "avg"}
+	return []string{"cur", "min", "max", "avg", "timestamp", "reporting_period", "policy_operational", "policy_active",
+		"measurements_in_progress"}
 }
 
+// Node Manager statistics state bits (byte 21 of Get Node Manager Statistics):
+// policy is operational when it monitors its trigger and activated when it
+// was triggered and actively limits power.
+const (
+	nmPolicyOperational     = 0x20
+	nmMeasurementInProgress = 0x40
+	nmPolicyActivated       = 0x80
+)
+
+// Timestamps up to nmRelativeTimestamp count seconds since initialization
+// instead of seconds since epoch, timestamp 0xFFFFFFFF is unspecified.
+const (
+	nmRelativeTimestamp    = 0x20000000
+	nmUnspecifiedTimestamp = 0xffffffff
+)
+
 // Parse method returns data in human readable format
-func (p *ParserNodeManager) Parse(response IpmiResponse) map[string]uint16 {
-	m := map[string]uint16{}
+func (p *ParserNodeManager) Parse(response IpmiResponse) map[string]Value {
 	// Parsing is based on command Get Node Manager Statistics (C8h). Bytes 5:6 contains current value
 	// Bytes 7:8 contains minimum value
 	// Bytes 9:10 contains maximum value
 	// Bytes 11:12 contains average value
-	var names = map[string]uint{
+	m := wordValues(response, map[string]uint{
 		"cur": 4,
 		"min": 6,
 		"max": 8,
 		"avg": 10,
+	}, p.Unit)
+	// Bytes 13:16 contains timestamp, 17:20 statistics reporting period (seconds)
+	// Byte 21 contains domain and policy, measurement state
+	m["timestamp"] = InvalidValue("s")
+	m["reporting_period"] = InvalidValue("s")
+	m["policy_operational"] = InvalidValue("")
+	m["policy_active"] = InvalidValue("")
+	m["measurements_in_progress"] = InvalidValue("")
+	if response.IsValid != 1 || len(response.Data) < 21 {
+		return m
 	}
-	for metricName, startIndex := range names {
-		if response.IsValid == 1 {
-			m[metricName] = GetUint16FromByteArray(response.Data, startIndex)
-		} else {
-			m[metricName] = 0xFFFF
-		}
+	if timestamp := binary.LittleEndian.Uint32(response.Data[12:16]); timestamp != nmUnspecifiedTimestamp {
+		m["timestamp"] = IntValue(int(timestamp), "s")
 	}
+	m["reporting_period"] = IntValue(int(binary.LittleEndian.Uint32(response.Data[16:20])), "s")
+	m["policy_operational"] = BoolValue(response.Data[20]&nmPolicyOperational != 0)
+	m["policy_active"] = BoolValue(response.Data[20]&nmPolicyActivated != 0)
+	m["measurements_in_progress"] = BoolValue(response.Data[20]&nmMeasurementInProgress != 0)
 	return m
 }
 
+// SampleTime returns time of sample reported by device in parsed values,
+// false when device did not report absolute time.
+func SampleTime(values map[string]Value) (time.Time, bool) {
+	timestamp, ok := values["timestamp"]
+	if !ok || !timestamp.Valid {
+		return time.Time{}, false
+	}
+	seconds, ok := timestamp.Data.(int)
+	if !ok || seconds <= nmRelativeTimestamp {
+		return time.Time{}, false
+	}
+	return time.Unix(int64(seconds), 0), true
+}
+
 // ParserTemp extracts temperature data.
 // Data contains info about temperatures for first 4 cpus
 // and 64 dimms.
@@ -152,6 +204,9 @@ type ParserTemp struct {
 // Instance of ParserTempMargin.
 var FormatTemp = &ParserTemp{}
 
+// tempNotPresent marks CPU or DIMM which temperature is not reported.
+const tempNotPresent = 0xff
+
 // GetMetrics method returns metric for temperature parser: temperature of each cpu (up to 4),
 // temperature of each dimm (up to 64)
 func (p *ParserTemp) GetMetrics() []string {
@@ -164,27 +219,16 @@ func (p *ParserTemp) GetMetrics() []string {
 }
 
 // Parse method returns data in human readable format
-func (p *ParserTemp) Parse(response IpmiResponse) map[string]uint16 {
-	m := map[string]uint16{}
+func (p *ParserTemp) Parse(response IpmiResponse) map[string]Value {
+	m := map[string]Value{}
 	// Parsing is based on Get CPU and Memory Temperature (4Bh). Bytes 5:8 contains temperatures of each socket (up to 4)
-	if response.IsValid == 1 {
-		m["cpu/0"] = uint16(response.Data[4])
-		m["cpu/1"] = uint16(response.Data[5])
-		m["cpu/2"] = uint16(response.Data[6])
-		m["cpu/3"] = uint16(response.Data[7])
-		// Bytes 9:72 contains temperatures of each dimm (up to 64)
-		for i := 8; i < len(response.Data); i++ {
-			a := fmt.Sprintf("memory/dimm/%d", i-8)
-			m[a] = uint16(response.Data[i])
-		}
-	} else {
-		m["cpu/0"] = 0xFFFF
-		m["cpu/1"] = 0xFFFF
-		m["cpu/2"] = 0xFFFF
-		m["cpu/3"] = 0xFFFF
-		for i := 8; i < len(response.Data); i++ {
-			a := fmt.Sprintf("memory/dimm/%d", i-8)
-			m[a] = 0xFFFF
+	// Bytes 9:72 contains temperatures of each dimm (up to 64)
+	for i, metricName := range p.GetMetrics() {
+		index := i + 4
+		if response.IsValid == 1 && index < len(response.Data) && response.Data[index] != tempNotPresent {
+			m[metricName] = IntValue(int(response.Data[index]), UnitCelsius)
+		} else {
+			m[metricName] = InvalidValue(UnitCelsius)
 		}
 	}
 	return m
@@ -207,21 +251,20 @@ func (p *ParserPECI) GetMetrics() []string {
 }
 
 // Parse method returns data in human readable format
-func (p *ParserPECI) Parse(response IpmiResponse) map[string]uint16 {
-	m := map[string]uint16{}
+func (p *ParserPECI) Parse(response IpmiResponse) map[string]Value {
 	// Based on Send raw PECI command (40h). Byte 7 returns margin offset
 	// Bytes 8:9 returns TJmax
-	if response.IsValid == 1 {
-		m["margin_offset"] = uint16(response.Data[6])
-		m[""] = GetUint16FromByteArray(response.Data, 7)
+	m := wordValues(response, map[string]uint{"": 7}, UnitCelsius)
+	if response.IsValid == 1 && len(response.Data) > 6 {
+		m["margin_offset"] = IntValue(int(response.Data[6]), UnitCelsius)
 	} else {
-		m["margin_offset"] = 0xFFFF
-		m[""] = 0xFFFF
+		m["margin_offset"] = InvalidValue(UnitCelsius)
 	}
 	return m
 }
 
 // ParserPMBus extracts temperatures of voltage regulators.
+// Values are raw PMBus words.
 type ParserPMBus struct {
 	*GenericValidator
 }
@@ -235,25 +278,10 @@ func (p *ParserPMBus) GetMetrics() []string {
 }
 
 // Parse method returns data in human readable format
-func (p *ParserPMBus) Parse(response IpmiResponse) map[string]uint16 {
-	m := map[string]uint16{}
-	var names = map[string]uint{"VR0": 4, "VR1": 6, "VR2": 8, "VR3": 10, "VR4": 12, "VR5": 14}
-	//if not all VRs are present on platform return 0xFFFE
-	if len(response.Data) < 14 {
-		for metricName := range names {
-			m[metricName] = 0xFFFE
-		}
-		return m
-	}
-	// Based on Send Raw PMBus Command (D9h). Bytes 9:N contains data received from PSU
-	for metricName, startIndex := range names {
-		if response.IsValid == 1 {
-			m[metricName] = GetUint16FromByteArray(response.Data, startIndex)
-		} else {
-			m[metricName] = 0xFFFF
-		}
-	}
-	return m
+func (p *ParserPMBus) Parse(response IpmiResponse) map[string]Value {
+	// Based on Send Raw PMBus Command (D9h). Bytes 9:N contains data received from PSU,
+	// VRs not present on platform are missing in response
+	return wordValues(response, map[string]uint{"VR0": 4, "VR1": 6, "VR2": 8, "VR3": 10, "VR4": 12, "VR5": 14}, "")
 }
 
 // ParserPSU extracts temperatures of PSU.
@@ -270,16 +298,37 @@ func (p *ParserPSU) GetMetrics() []string {
 }
 
 // Parse method returns data in human readable format
-func (p *ParserPSU) Parse(response IpmiResponse) map[string]uint16 {
-	m := map[string]uint16{}
-	m["0"] = GetUint16FromByteArray(response.Data, 4)
-	m["1"] = GetUint16FromByteArray(response.Data, 6)
-	return m
+func (p *ParserPSU) Parse(response IpmiResponse) map[string]Value {
+	return wordValues(response, map[string]uint{"0": 4, "1": 6}, UnitCelsius)
+}
+
+// sensorValue reads reading of Get Sensor Reading (2Dh) response, converted
+// when conversion of sensor is known and raw otherwise. It is invalid when
+// sensor marks reading unavailable.
+func sensorValue(response IpmiResponse, conv *SensorConversion) Value {
+	unit := ""
+	if conv != nil {
+		unit = conv.Unit()
+	}
+	if response.IsValid != 1 || len(response.Data) < 2 {
+		return InvalidValue(unit)
+	}
+	if len(response.Data) > 2 && response.Data[2]&0x20 != 0 {
+		return InvalidValue(unit)
+	}
+	if conv != nil {
+		if v, ok := conv.Convert(response.Data[1]); ok {
+			return FloatValue(v, unit)
+		}
+	}
+	return IntValue(int(response.Data[1]), "")
 }
 
 // ParserSR extracts sensor value from response to Get Sensor Record.
+// Readings are converted with Conversion when it is set.
 type ParserSR struct {
 	*GenericValidator
+	Conversion *SensorConversion
 }
 
 // Instance of ParserSR.
@@ -291,14 +340,13 @@ func (p *ParserSR) GetMetrics() []string {
 }
 
 // Parse method returns data in human readable format
-func (p *ParserSR) Parse(response IpmiResponse) map[string]uint16 {
-	m := map[string]uint16{}
+func (p *ParserSR) Parse(response IpmiResponse) map[string]Value {
 	// Based on Get Sensor Reading (2Dh)
-	m[""] = uint16(response.Data[1])
-	return m
+	return map[string]Value{"": sensorValue(response, p.Conversion)}
 }
 
-// ParserPolicy extracts sensor value from response to Get Power Policy.
+// ParserPolicy extracts configuration of policy from response to Get Node
+// Manager Policy.
 type ParserPolicy struct {
 	*GenericValidator
 }
@@ -306,15 +354,96 @@ type ParserPolicy struct {
 // Instance of Power Policy parser
 var FormatPolicy = &ParserPolicy{}
 
-// GetMetrics returns metrics for power limit
+// GetMetrics returns metrics of policy: enabled state, trigger type and limit,
+// power limit, correction time and statistics reporting period.
 func (p *ParserPolicy) GetMetrics() []string {
-	return []string{"power_limit"}
+	return []string{"enabled", "trigger_type", "trigger_limit", "power_limit", "correction_time", "reporting_period"}
 }
 
 // Parse method returns data in human readable format
-func (p *ParserPolicy) Parse(response IpmiResponse) map[string]uint16 {
-	m := map[string]uint16{}
-	m["power_limit"] = GetUint16FromByteArray(response.Data, 13)
+func (p *ParserPolicy) Parse(response IpmiResponse) map[string]Value {
+	// Parsing is based on command Get Node Manager Policy (C2h).
+	// Byte 5 contains domain and policy enabled bit 4
+	// Byte 6 contains policy trigger type in bits 0:3
+	// Bytes 8:9 contains power limit
+	// Bytes 10:13 contains correction time limit (ms)
+	// Bytes 14:15 contains policy trigger limit
+	// Bytes 16:17 contains statistics reporting period (s)
+	m := map[string]Value{
+		"enabled":          InvalidValue(""),
+		"trigger_type":     InvalidValue(""),
+		"trigger_limit":    InvalidValue(""),
+		"power_limit":      InvalidValue(UnitWatt),
+		"correction_time":  InvalidValue("ms"),
+		"reporting_period": InvalidValue("s"),
+	}
+	if response.IsValid != 1 || len(response.Data) < 17 {
+		return m
+	}
+	data := response.Data
+	trigger := data[5] & 0x0f
+	m["enabled"] = BoolValue(data[4]&0x10 != 0)
+	m["trigger_type"] = StringValue(policyTriggerName(trigger))
+	if unit, ok := policyTriggerUnits[trigger]; ok {
+		m["trigger_limit"] = IntValue(int(GetUint16FromByteArray(data, 13)), unit)
+	}
+	if trigger != PolicyTriggerBootTime {
+		// power limit of boot time policy encodes processor performance settings
+		m["power_limit"] = IntValue(int(GetUint16FromByteArray(data, 7)), UnitWatt)
+	}
+	m["correction_time"] = IntValue(int(binary.LittleEndian.Uint32(data[9:13])), "ms")
+	m["reporting_period"] = IntValue(int(GetUint16FromByteArray(data, 15)), "s")
+	return m
+}
+
+// ParserPolicySuspend extracts suspend periods from response to Get Node
+// Manager Policy Suspend Periods.
+type ParserPolicySuspend struct {
+	*GenericValidator
+}
+
+// Instance of policy suspend periods parser
+var FormatPolicySuspend = &ParserPolicySuspend{}
+
+// GetMetrics returns number of suspend periods and their schedule.
+func (p *ParserPolicySuspend) GetMetrics() []string {
+	return []string{"suspend_periods", "suspend_schedule"}
+}
+
+var weekDays = []string{"mon", "tue", "wed", "thu", "fri", "sat", "sun"}
+
+// suspendTime formats time of day given in 6 minute units.
+func suspendTime(t byte) string {
+	return fmt.Sprintf("%02d:%02d", int(t)/10, int(t)%10*6)
+}
+
+// Parse method returns data in human readable format
+func (p *ParserPolicySuspend) Parse(response IpmiResponse) map[string]Value {
+	// Parsing is based on command Get Node Manager Policy Suspend Periods (C6h).
+	// Byte 5 contains number of periods, each of them is described by
+	// start and stop time (in 6 minute units since midnight) and days
+	// of week it recurs on (bit 0 is Monday).
+	m := map[string]Value{"suspend_periods": InvalidValue(""), "suspend_schedule": InvalidValue("")}
+	if response.IsValid != 1 || len(response.Data) < 5 {
+		return m
+	}
+	count := int(response.Data[4])
+	if len(response.Data) < 5+3*count {
+		return m
+	}
+	periods := make([]string, count)
+	for i := range periods {
+		period := response.Data[5+3*i : 8+3*i]
+		var days []string
+		for d, day := range weekDays {
+			if period[2]&(1<<uint(d)) != 0 {
+				days = append(days, day)
+			}
+		}
+		periods[i] = fmt.Sprintf("%s-%s %s", suspendTime(period[0]), suspendTime(period[1]), strings.Join(days, ","))
+	}
+	m["suspend_periods"] = IntValue(count, "")
+	m["suspend_schedule"] = StringValue(strings.Join(periods, "; "))
 	return m
 }
 
@@ -324,34 +453,105 @@ type ParserDCMIPower struct {
 
 var FormatDCMIPower = &ParserDCMIPower{}
 
+// dcmiPowerActive is reading state bit set while power measurement is active.
+const dcmiPowerActive = 0x40
+
 func (p *ParserDCMIPower) GetMetrics() []string {
 	return []string{"cur", "min", "max", "avg"}
 }
 
-func (p *ParserDCMIPower) Parse(response IpmiResponse) map[string]uint16 {
-	m := map[string]uint16{}
+func (p *ParserDCMIPower) Parse(response IpmiResponse) map[string]Value {
 	// Parsing is based on command Get DCMI Power Reading. Bytes 3:4 contains current value
 	// Bytes 5:6 contains minimum value
 	// Bytes 7:8 contains maximum value
 	// Bytes 9:10 contains average value
+	// Byte 19 contains reading state, values are meaningless when measurement is not active
 	var names = map[string]uint{
 		"cur": 2,
 		"min": 4,
 		"max": 6,
 		"avg": 8,
 	}
-	for metricName, startIndex := range names {
-		if response.IsValid == 1 {
-			m[metricName] = GetUint16FromByteArray(response.Data, startIndex)
-		} else {
-			m[metricName] = 0xFFFF
+	if len(response.Data) > 18 && response.Data[18]&dcmiPowerActive == 0 {
+		names = nil
+	}
+	m := wordValues(response, names, UnitWatt)
+	for _, metricName := range p.GetMetrics() {
+		if _, ok := m[metricName]; !ok {
+			m[metricName] = InvalidValue(UnitWatt)
 		}
 	}
 	return m
 }
 
+// ParserDCMIPowerLimit extracts power limit from response to Get DCMI Power Limit.
+// Limit which is set but not active is reported with completion code 80h.
+type ParserDCMIPowerLimit struct {
+	*GenericValidator
+}
+
+var FormatDCMIPowerLimit = &ParserDCMIPowerLimit{}
+
+// dcmiLimitNotActive is completion code of Get Power Limit when limit is not active.
+const dcmiLimitNotActive = 0x80
+
+// DCMI power limit exception actions.
+const (
+	DCMIActionNone     = 0x00
+	DCMIActionPowerOff = 0x01
+	DCMIActionLogSEL   = 0x11
+)
+
+var dcmiActions = map[byte]string{
+	DCMIActionNone:     "none",
+	DCMIActionPowerOff: "power_off",
+	DCMIActionLogSEL:   "log_sel",
+}
+
+// Validate accepts responses of active and inactive power limit.
+func (p *ParserDCMIPowerLimit) Validate(response IpmiResponse) error {
+	if response.IsValid == 1 && len(response.Data) > 0 && response.Data[0] == dcmiLimitNotActive {
+		return nil
+	}
+	return p.GenericValidator.Validate(response)
+}
+
+// GetMetrics returns activation state, exception action, limit, correction time and sampling period.
+func (p *ParserDCMIPowerLimit) GetMetrics() []string {
+	return []string{"active", "exception_action", "limit", "correction_time", "sampling_period"}
+}
+
+func (p *ParserDCMIPowerLimit) Parse(response IpmiResponse) map[string]Value {
+	// Parsing is based on command Get Power Limit. Byte 5 contains exception action
+	// Bytes 6:7 contains power limit
+	// Bytes 8:11 contains correction time limit (ms)
+	// Bytes 14:15 contains statistics sampling period (s)
+	m := map[string]Value{
+		"active":           InvalidValue(""),
+		"exception_action": InvalidValue(""),
+		"limit":            InvalidValue(UnitWatt),
+		"correction_time":  InvalidValue("ms"),
+		"sampling_period":  InvalidValue("s"),
+	}
+	if response.IsValid != 1 || len(response.Data) < 15 {
+		return m
+	}
+	data := response.Data
+	m["active"] = BoolValue(data[0] == 0)
+	if action, ok := dcmiActions[data[4]]; ok {
+		m["exception_action"] = StringValue(action)
+	} else {
+		m["exception_action"] = StringValue(fmt.Sprintf("oem_%d", data[4]))
+	}
+	m["limit"] = IntValue(int(GetUint16FromByteArray(data, 5)), UnitWatt)
+	m["correction_time"] = IntValue(int(binary.LittleEndian.Uint32(data[7:11])), "ms")
+	m["sampling_period"] = IntValue(int(GetUint16FromByteArray(data, 13)), "s")
+	return m
+}
+
 type ParserSensor struct {
 	*GenericValidator
+	Conversion *SensorConversion
 }
 
 var FormatSensorReading = &ParserSensor{}
@@ -360,9 +560,6 @@ func (p *ParserSensor) GetMetrics() []string {
 	return []string{"cur"}
 }
 
-func (p *ParserSensor) Parse(response IpmiResponse) map[string]uint16 {
-	m := map[string]uint16{}
-	m["cur"] = uint16(response.Data[1])
-
-	return m
+func (p *ParserSensor) Parse(response IpmiResponse) map[string]Value {
+	return map[string]Value{"cur": sensorValue(response, p.Conversion)}
 }
@@ -27,6 +27,7 @@ import (
 	"errors"
 	"fmt"
 	"testing"
+	"time"
 
 	. "github.com/smartystreets/goconvey/convey"
 )
@@ -42,9 +43,11 @@ func TestValidator(t *testing.T) {
 		validator = a.Validate(validResponse)
 		So(validator.Error(), ShouldEqual, err.Error())
 		validResponse = IpmiResponse{[]byte{0x88, 0x57, 0x01, 0x00, 0x64, 0x00, 0x50, 0x00, 0x00, 0x01}, 1}
-		err = fmt.Errorf("Unexpected error code : %d", validResponse.Data[0])
 		validator = a.Validate(validResponse)
-		So(validator.Error(), ShouldEqual, err.Error())
+		So(validator, ShouldResemble, &CompletionCodeError{Code: 0x88})
+		validResponse = IpmiResponse{[]byte{0x00, 0x57}, 0}
+		validator = a.Validate(validResponse)
+		So(validator, ShouldEqual, ErrNoResponse)
 	})
 }
 
@@ -59,9 +62,9 @@ func TestCUPSParsing(t *testing.T) {
 		for i := 0; i < len(expects); i++ {
 			So(metrics[i], ShouldEqual, expects[i])
 		}
-		So(parserOut["cpu_bandwith"], ShouldEqual, 100)
-		So(parserOut["memory_bandwith"], ShouldEqual, 80)
-		So(parserOut["io_bandwith"], ShouldEqual, 256)
+		So(parserOut["cpu_bandwith"].Data, ShouldEqual, 100)
+		So(parserOut["memory_bandwith"].Data, ShouldEqual, 80)
+		So(parserOut["io_bandwith"].Data, ShouldEqual, 256)
 	})
 }
 
@@ -69,18 +72,50 @@ func TestNodeManagerParsing(t *testing.T) {
 	Convey("Check NodeManager parser", t, func() {
 
 		validResponse := IpmiResponse{[]byte{0x00, 0x57, 0x01, 0x00, 0x69, 0x00, 0x03, 0x00, 0x7d, 0x01, 0x6E, 0x00, 0xC7, 0x3F, 0x05, 0x56, 0xB9, 0xAD, 0x0C, 0x00, 0x50}, 1}
-		a := &ParserNodeManager{}
+		a := FormatNodeManager
 		metrics := a.GetMetrics()
 		parserOut := a.Parse(validResponse)
-		expects := []string{"", "min", "max", "avg"}
+		expects := []string{"cur", "min", "max", "avg", "timestamp", "reporting_period", "policy_operational", "policy_active",
+			"measurements_in_progress"}
 		So(len(metrics), ShouldEqual, len(expects))
 		for i := 0; i < len(expects); i++ {
 			So(metrics[i], ShouldEqual, expects[i])
 		}
-		So(parserOut[""], ShouldEqual, 105)
-		So(parserOut["min"], ShouldEqual, 3)
-		So(parserOut["max"], ShouldEqual, 381)
-		So(parserOut["avg"], ShouldEqual, 110)
+		So(parserOut["cur"], ShouldResemble, Value{Data: 105, Unit: UnitWatt, Valid: true})
+		So(parserOut["min"].Data, ShouldEqual, 3)
+		So(parserOut["max"].Data, ShouldEqual, 381)
+		So(parserOut["avg"].Data, ShouldEqual, 110)
+		So(parserOut["timestamp"].Data, ShouldEqual, 0x56053FC7)
+		So(parserOut["reporting_period"], ShouldResemble, IntValue(0x000CADB9, "s"))
+		So(parserOut["policy_operational"], ShouldResemble, BoolValue(false))
+		So(parserOut["policy_active"], ShouldResemble, BoolValue(false))
+		So(parserOut["measurements_in_progress"], ShouldResemble, BoolValue(true))
+
+		// policy monitoring its trigger, then triggered and limiting
+		state := validResponse.Data[20]
+		validResponse.Data[20] = 0x30
+		parserOut = a.Parse(validResponse)
+		So(parserOut["policy_operational"], ShouldResemble, BoolValue(true))
+		So(parserOut["policy_active"], ShouldResemble, BoolValue(false))
+		validResponse.Data[20] = 0xb0
+		parserOut = a.Parse(validResponse)
+		So(parserOut["policy_operational"], ShouldResemble, BoolValue(true))
+		So(parserOut["policy_active"], ShouldResemble, BoolValue(true))
+		validResponse.Data[20] = state
+		parserOut = a.Parse(validResponse)
+		sampleTime, ok := SampleTime(parserOut)
+		So(ok, ShouldBeTrue)
+		So(sampleTime, ShouldResemble, time.Unix(0x56053FC7, 0))
+
+		// time since initialization is not sample time
+		validResponse.Data[15] = 0x00
+		_, ok = SampleTime(a.Parse(validResponse))
+		So(ok, ShouldBeFalse)
+
+		parserOut = FormatNodeManagerTemp.Parse(IpmiResponse{validResponse.Data[:8], 1})
+		So(parserOut["min"], ShouldResemble, Value{Data: 3, Unit: UnitCelsius, Valid: true})
+		So(parserOut["max"].Valid, ShouldBeFalse)
+		So(parserOut["avg"].Valid, ShouldBeFalse)
 	})
 }
 
@@ -95,8 +130,8 @@ func TestPECIParsing(t *testing.T) {
 		for i := 0; i < len(expects); i++ {
 			So(metrics[i], ShouldEqual, expects[i])
 		}
-		So(parserOut[""], ShouldEqual, 89)
-		So(parserOut["margin_offset"], ShouldEqual, 10)
+		So(parserOut[""].Data, ShouldEqual, 89)
+		So(parserOut["margin_offset"].Data, ShouldEqual, 10)
 	})
 }
 
@@ -111,12 +146,12 @@ func TestPMBusParsing(t *testing.T) {
 		for i := 0; i < len(expects); i++ {
 			So(metrics[i], ShouldEqual, expects[i])
 		}
-		So(parserOut["VR0"], ShouldEqual, 37)
-		So(parserOut["VR1"], ShouldEqual, 42)
-		So(parserOut["VR2"], ShouldEqual, 31)
-		So(parserOut["VR3"], ShouldEqual, 33)
-		So(parserOut["VR4"], ShouldEqual, 32)
-		So(parserOut["VR5"], ShouldEqual, 31)
+		So(parserOut["VR0"].Data, ShouldEqual, 37)
+		So(parserOut["VR1"].Data, ShouldEqual, 42)
+		So(parserOut["VR2"].Data, ShouldEqual, 31)
+		So(parserOut["VR3"].Data, ShouldEqual, 33)
+		So(parserOut["VR4"].Data, ShouldEqual, 32)
+		So(parserOut["VR5"].Data, ShouldEqual, 31)
 	})
 }
 
@@ -155,7 +190,82 @@ func TestTemperatureParsing(t *testing.T) {
 			So(metrics[i], ShouldEqual, expects[i])
 		}
 		for i := 0; i < len(metrics); i++ {
-			So(parserOut[metrics[i]], ShouldEqual, validResponse.Data[i+4])
+			if validResponse.Data[i+4] == 0xFF {
+				So(parserOut[metrics[i]].Valid, ShouldBeFalse)
+			} else {
+				So(parserOut[metrics[i]].Data, ShouldEqual, validResponse.Data[i+4])
+			}
 		}
 	})
 }
+
+func TestDCMIPowerParsing(t *testing.T) {
+	Convey("Check DCMI power parser", t, func() {
+		response := IpmiResponse{[]byte{0x00, 0xdc, 0xd7, 0x00, 0x64, 0x00, 0x36, 0x01, 0xdc, 0x00,
+			0x00, 0x00, 0x00, 0x00, 0xe8, 0x03, 0x00, 0x00, 0x40}, 1}
+		parserOut := FormatDCMIPower.Parse(response)
+		So(parserOut["cur"], ShouldResemble, Value{Data: 215, Unit: UnitWatt, Valid: true})
+		So(parserOut["max"].Data, ShouldEqual, 310)
+
+		// power measurement not active
+		response.Data[18] = 0x00
+		parserOut = FormatDCMIPower.Parse(response)
+		So(len(parserOut), ShouldEqual, 4)
+		So(parserOut["cur"], ShouldResemble, InvalidValue(UnitWatt))
+	})
+}
+
+func TestDCMIPowerLimitParsing(t *testing.T) {
+	Convey("Check DCMI power limit parser", t, func() {
+		response := IpmiResponse{[]byte{0x00, 0xdc, 0x00, 0x00, 0x11, 0x90, 0x01, 0x70, 0x17, 0x00, 0x00,
+			0x00, 0x00, 0x0a, 0x00}, 1}
+		parserOut := FormatDCMIPowerLimit.Parse(response)
+		So(len(parserOut), ShouldEqual, len(FormatDCMIPowerLimit.GetMetrics()))
+		So(parserOut["active"], ShouldResemble, BoolValue(true))
+		So(parserOut["exception_action"], ShouldResemble, StringValue("log_sel"))
+		So(parserOut["limit"], ShouldResemble, IntValue(400, UnitWatt))
+		So(parserOut["correction_time"], ShouldResemble, IntValue(6000, "ms"))
+		So(parserOut["sampling_period"], ShouldResemble, IntValue(10, "s"))
+
+		// limit set, but not active
+		response.Data[0] = 0x80
+		So(ValidateResponse(IpmiRequest{Data: []byte{0x2c, 0x03, 0xdc, 0x00, 0x00}}, response, FormatDCMIPowerLimit), ShouldBeNil)
+		parserOut = FormatDCMIPowerLimit.Parse(response)
+		So(parserOut["active"], ShouldResemble, BoolValue(false))
+		So(parserOut["limit"], ShouldResemble, IntValue(400, UnitWatt))
+
+		response.Data[0] = 0xc1
+		So(ValidateResponse(IpmiRequest{Data: []byte{0x2c, 0x03, 0xdc, 0x00, 0x00}}, response, FormatDCMIPowerLimit), ShouldNotBeNil)
+		So(FormatDCMIPowerLimit.Parse(IpmiResponse{response.Data[:9], 1})["limit"].Valid, ShouldBeFalse)
+	})
+}
+
+func TestPolicyParsing(t *testing.T) {
+	Convey("Check policy parsers", t, func() {
+		validResponse := IpmiResponse{[]byte{0x00, 0x57, 0x01, 0x00, 0x70, 0x10, 0x00, 0x5e, 0x01, 0x70, 0x17, 0x00, 0x00,
+			0x00, 0x00, 0x0a, 0x00}, 1}
+		a := &ParserPolicy{}
+		parserOut := a.Parse(validResponse)
+		So(len(parserOut), ShouldEqual, len(a.GetMetrics()))
+		So(parserOut["enabled"], ShouldResemble, BoolValue(true))
+		So(parserOut["trigger_type"], ShouldResemble, StringValue("none"))
+		So(parserOut["trigger_limit"].Valid, ShouldBeFalse)
+		So(parserOut["power_limit"], ShouldResemble, IntValue(350, UnitWatt))
+		So(parserOut["correction_time"], ShouldResemble, IntValue(6000, "ms"))
+		So(parserOut["reporting_period"], ShouldResemble, IntValue(10, "s"))
+
+		// inlet temperature trigger
+		validResponse.Data[5], validResponse.Data[13] = 0x11, 0x23
+		parserOut = a.Parse(validResponse)
+		So(parserOut["trigger_type"], ShouldResemble, StringValue("inlet_temperature"))
+		So(parserOut["trigger_limit"], ShouldResemble, IntValue(35, UnitCelsius))
+
+		parserOut = a.Parse(IpmiResponse{validResponse.Data[:9], 1})
+		So(parserOut["power_limit"].Valid, ShouldBeFalse)
+
+		suspend := FormatPolicySuspend.Parse(IpmiResponse{[]byte{0x00, 0x57, 0x01, 0x00, 0x02, 0x50, 0x5f, 0x1f, 0x00, 0xef, 0x60}, 1})
+		So(suspend["suspend_periods"], ShouldResemble, IntValue(2, ""))
+		So(suspend["suspend_schedule"], ShouldResemble, StringValue("08:00-09:30 mon,tue,wed,thu,fri; 00:00-23:54 sat,sun"))
+		So(FormatPolicySuspend.Parse(IpmiResponse{[]byte{0x00, 0x57, 0x01, 0x00, 0x01, 0x50}, 1})["suspend_periods"].Valid, ShouldBeFalse)
+	})
+}
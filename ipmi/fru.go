@@ -11,10 +11,10 @@ type FruParser struct {
 
 var FruProcessor = &FruParser{}
 
-var CmdFruHeader = IpmiRequest{[]byte{0xa, 0x10, 0x0}, 0x0, 0x0}
-var CmdFruData = IpmiRequest{[]byte{0xa, 0x11, 0x0, 0x0, 0x0, 0x0}, 0x0, 0x0}
-var CmdDeviceId = IpmiRequest{[]byte{0x6, 0x1}, 0x0, 0x0}
-var CmdBMCMac = IpmiRequest{[]byte{0xc, 0x2, 0x1, 0x5, 0x0, 0x0}, 0x0, 0x0}
+var CmdFruHeader = IpmiRequest{[]byte{0xa, 0x10, 0x0}, 0x0, 0x0, nil}
+var CmdFruData = IpmiRequest{[]byte{0xa, 0x11, 0x0, 0x0, 0x0, 0x0}, 0x0, 0x0, nil}
+var CmdDeviceId = IpmiRequest{[]byte{0x6, 0x1}, 0x0, 0x0, nil}
+var CmdBMCMac = IpmiRequest{[]byte{0xc, 0x2, 0x1, 0x5, 0x0, 0x0}, 0x0, 0x0, nil}
 
 func (fp *FruParser) GetInventoryInfo(host string) (map[string]string, error) {
 
@@ -35,8 +35,8 @@ func (fp *FruParser) GetInventoryInfo(host string) (map[string]string, error) {
 	}
 	areaAccessedLength = uint16((data[2] & 0x1) + 1)
 
-	// first read 8 bytes
-	CmdFruData.Data[5] = 8
+	// first read 8 bytes of common header
+	GenerateFruData(0, 8)
 	response, err = fp.IpmiLayer.ExecRaw(CmdFruData, host)
 	if err != nil {
 		return nil, err
@@ -22,18 +22,25 @@ limitations under the License.
 package ipmi
 
 import (
+	"context"
 	"fmt"
 	"sync"
+	"time"
 	"unsafe"
 )
 
 // #include "linux_inband.h"
 import "C"
 
+// openipmiTimeout is default time limit of waiting for response from driver
+const openipmiTimeout = 5 * time.Second
+
 // LinuxInband Implements communication with openipmi driver on linux
+// Retry specifies time limit of waiting for every response and repetition of failed requests.
 type LinuxInband struct {
 	Device   string
 	Protocol string
+	Retry    RetryPolicy
 	mutex    sync.Mutex
 }
 
@@ -41,31 +48,97 @@ type LinuxInband struct {
 // Returns array of responses in order corresponding to requests.
 // Error is returned when any of requests failed.
 func (al *LinuxInband) BatchExecRaw(requests []IpmiRequest, host string) ([]IpmiResponse, error) {
+	return al.BatchExecRawContext(context.Background(), requests, host)
+}
+
+// BatchExecRawContext Performs batch of requests to given device within context.
+func (al *LinuxInband) BatchExecRawContext(ctx context.Context, requests []IpmiRequest, host string) ([]IpmiResponse, error) {
+	return al.Retry.batchExecRaw(ctx, requests, al.batchExec)
+}
+
+// timeoutMs returns driver response timeout, error is returned when context is already done.
+func (al *LinuxInband) timeoutMs(ctx context.Context) (C.int, error) {
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+	timeout := al.Retry.requestTimeout(ctx, openipmiTimeout)
+	if timeout < time.Millisecond {
+		return 0, context.DeadlineExceeded
+	}
+	return C.int(timeout / time.Millisecond), nil
+}
+
+func (al *LinuxInband) batchExec(ctx context.Context, requests []IpmiRequest) ([]IpmiResponse, error) {
 	al.mutex.Lock()
 	defer al.mutex.Unlock()
 
+	// bridged requests are sent to IPMB address, the others to system interface
+	var bridged, system []int
+	for i, r := range requests {
+		if r.Path() != nil {
+			bridged = append(bridged, i)
+		} else {
+			system = append(system, i)
+		}
+	}
+
+	results := make([]IpmiResponse, len(requests))
+	for _, group := range []struct {
+		indexes []int
+		bridged bool
+	}{{bridged, true}, {system, false}} {
+		if len(group.indexes) == 0 {
+			continue
+		}
+		batch := make([]IpmiRequest, len(group.indexes))
+		for j, i := range group.indexes {
+			batch[j] = requests[i]
+		}
+		responses, err := al.run(ctx, batch, group.bridged)
+		if err != nil {
+			return nil, err
+		}
+		for j, i := range group.indexes {
+			results[i] = responses[j]
+		}
+	}
+
+	return results, checkBatch(requests, results)
+}
+
+// run passes requests to driver. Bridged requests with transit hops are
+// wrapped in Send Message addressed to the first hop.
+func (al *LinuxInband) run(ctx context.Context, requests []IpmiRequest, bridged bool) ([]IpmiResponse, error) {
+	timeout, err := al.timeoutMs(ctx)
+	if err != nil {
+		return nil, err
+	}
+
 	n := len(requests)
 	info := C.struct_IpmiStatusInfo{}
 	inputs := make([]C.struct_IpmiCommandInput, n)
 	outputs := make([]C.struct_IpmiCommandOutput, n)
 
 	for i, r := range requests {
-		for j, b := range r.Data {
+		data := r.Data
+		if path := r.Path(); path != nil {
+			data = sendMessage(path, r.Data)
+			inputs[i].channel = C.short(path[0].Channel)
+			inputs[i].slave = C.uchar(path[0].Address)
+		}
+		for j, b := range data {
 			inputs[i].data[j] = C.char(b)
 		}
-		inputs[i].data_len = C.int(len(r.Data))
-		inputs[i].channel = C.short(r.Channel)
-		inputs[i].slave = C.uchar(r.Slave)
+		inputs[i].data_len = C.int(len(data))
 	}
 
-	protocol := al.Protocol
 	var errcode C.int
-	if protocol == "node_manager" {
+	if bridged {
 		errcode = C.IPMI_BatchCommands(C.CString(al.Device), &inputs[0], &outputs[0],
-			C.int(n), C.int(3), &info)
+			C.int(n), C.int(3), timeout, &info)
 	} else {
 		errcode = C.IPMI_System_BatchCommands(C.CString(al.Device), &inputs[0], &outputs[0],
-			C.int(n), C.int(3), &info)
+			C.int(n), C.int(3), timeout, &info)
 	}
 
 	switch {
@@ -79,91 +152,39 @@ func (al *LinuxInband) BatchExecRaw(requests []IpmiRequest, host string) ([]Ipmi
 	results := make([]IpmiResponse, n)
 
 	for i, r := range outputs {
-		results[i].Data = C.GoBytes(unsafe.Pointer(&r.data[0]), r.data_len)
+		results[i].Data = receiveMessage(C.GoBytes(unsafe.Pointer(&r.data[0]), r.data_len), len(requests[i].Transit))
 		results[i].IsValid = uint(r.is_valid)
 	}
 
 	return results, nil
 }
 
-// GetPlatformCapabilities returns host NM capabilities
+// GetPlatformCapabilities returns host capabilities
 func (al *LinuxInband) GetPlatformCapabilities(requests []RequestDescription, hostlist []string) map[string][]RequestDescription {
-
 	host := hostlist[0]
 
 	validRequests := make(map[string][]RequestDescription, 0)
-	validRequests[host] = make([]RequestDescription, 0)
-
-	requestCmds := make([]IpmiRequest, len(requests))
-	for i, _ := range requests {
-		requestCmds[i] = requests[i].Request
-	}
-
-	response, e := al.BatchExecRaw(requestCmds, host)
-	if e == nil {
-
-		for i, r := range response {
-			if r.IsValid == 1 {
-				validRequests[host] = append(validRequests[host], requests[i])
-			}
-		}
-
-	}
-
-	if al.Protocol == "dcmi" {
-		// check thermal capability
-		dcmiRequest := IpmiRequest{Data: CmdDCMIThermalCap, Channel: 0x0, Slave: 0x0}
-		resp, e := al.ExecRaw(dcmiRequest, host)
-		if e == nil && len(resp.Data) > 5 {
-			data := resp.Data[1:]
-			//sdrId := data[4] + uint16(data[5])<<8
-			dcmiRequest.Data = make([]byte, len(CmdSDR))
-			copy(dcmiRequest.Data, CmdSDR)
-			dcmiRequest.Data[4] = data[3]
-			dcmiRequest.Data[5] = data[4]
-			resp, e = al.ExecRaw(dcmiRequest, host)
-
-			if e == nil && len(resp.Data) > 10 {
-				data = resp.Data[1:]
-				DcmiThermal.Request.Data[2] = data[9]
-				validRequests[host] = append(validRequests[host], DcmiThermal)
-			}
-		}
-	}
+	validRequests[host] = ProbeCapabilities(al, requests, host, al.Protocol)
 	return validRequests
 }
 
+// ExecRaw performs single request to given device.
 func (al *LinuxInband) ExecRaw(request IpmiRequest, host string) (*IpmiResponse, error) {
-	n := 1
-	info := C.struct_IpmiStatusInfo{}
-	inputs := make([]C.struct_IpmiCommandInput, 1)
-	outputs := make([]C.struct_IpmiCommandOutput, 1)
-
-	for j, b := range request.Data {
-		inputs[0].data[j] = C.char(b)
-	}
-
-	inputs[0].data_len = C.int(len(request.Data))
-	inputs[0].channel = C.short(request.Channel)
-	inputs[0].slave = C.uchar(request.Slave)
-
-	errcode := C.IPMI_System_BatchCommands(C.CString(al.Device), &inputs[0], &outputs[0],
-		C.int(n), C.int(3), &info)
+	return al.ExecRawContext(context.Background(), request, host)
+}
 
-	switch {
-	case errcode < 0:
-		return nil, fmt.Errorf("%d : Invalid call", errcode)
-	case errcode > 0:
-		return nil, fmt.Errorf("%d : System error [%d : %s]", errcode,
-			info.system_error, C.GoString(&info.error_str[0]))
-	}
+// ExecRawContext performs single request to given device within context.
+func (al *LinuxInband) ExecRawContext(ctx context.Context, request IpmiRequest, host string) (*IpmiResponse, error) {
+	return al.Retry.execRaw(ctx, request, al.exec)
+}
 
-	results := make([]IpmiResponse, n)
+func (al *LinuxInband) exec(ctx context.Context, request IpmiRequest) (*IpmiResponse, error) {
+	al.mutex.Lock()
+	defer al.mutex.Unlock()
 
-	for i, r := range outputs {
-		results[i].Data = C.GoBytes(unsafe.Pointer(&r.data[0]), r.data_len)
-		results[i].IsValid = uint(r.is_valid)
+	results, err := al.run(ctx, []IpmiRequest{request}, request.Path() != nil)
+	if err != nil {
+		return nil, err
 	}
-
-	return &results[0], nil
+	return checkedResponse(request, &results[0])
 }
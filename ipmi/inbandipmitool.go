@@ -22,80 +22,84 @@ limitations under the License.
 package ipmi
 
 import (
+	"context"
 	"os"
 	"sync"
 )
 
 // LinuxInBandIpmitool implements communication with ipmitool on linux
+// When Persistent is set requests are sent through long running "ipmitool shell"
+// instead of starting new ipmitool process for every request.
+// Retry specifies time limit and repetition of requests.
 type LinuxInBandIpmitool struct {
-	Device   string
-	Channel  string
-	Slave    string
-	Protocol string
-	mutex    sync.Mutex
+	Device     string
+	Protocol   string
+	Persistent bool
+	Retry      RetryPolicy
+	shells     ipmitoolShells
+	mutex      sync.Mutex
+}
+
+// Close terminates ipmitool shells started by backend.
+func (al *LinuxInBandIpmitool) Close() error {
+	return al.shells.Close()
 }
 
 // BatchExecRaw performs batch of requests to given device.
 // Returns array of responses in order corresponding to requests.
 // Error is returned when any of requests failed.
 func (al *LinuxInBandIpmitool) BatchExecRaw(requests []IpmiRequest, host string) ([]IpmiResponse, error) {
+	return al.BatchExecRawContext(context.Background(), requests, host)
+}
+
+// BatchExecRawContext performs batch of requests to given device within context.
+func (al *LinuxInBandIpmitool) BatchExecRawContext(ctx context.Context, requests []IpmiRequest, host string) ([]IpmiResponse, error) {
+	return al.Retry.batchExecRaw(ctx, requests, al.batchExec)
+}
+
+func (al *LinuxInBandIpmitool) batchExec(ctx context.Context, requests []IpmiRequest) ([]IpmiResponse, error) {
+	if al.Persistent {
+		results := batchExecShell(ctx, &al.shells, localOptions, requests, al.Retry.Timeout)
+		return results, checkBatch(requests, results)
+	}
 
 	results := make([]IpmiResponse, len(requests))
 
 	for i, r := range requests {
-		results[i].Data = ExecIpmiToolLocal(r.Data, al, true)
-		results[i].IsValid = 1
+		rctx, cancel := al.Retry.requestContext(ctx, ipmitoolTimeout)
+		results[i] = toResponse(ExecIpmiToolLocalContext(rctx, r, al))
+		cancel()
 	}
 
-	return results, nil
+	return results, checkBatch(requests, results)
 
 }
 
+// ExecRaw performs single request to given device.
+// *CompletionCodeError is returned together with response when request failed on BMC.
 func (al *LinuxInBandIpmitool) ExecRaw(request IpmiRequest, host string) (*IpmiResponse, error) {
+	return al.ExecRawContext(context.Background(), request, host)
+}
 
-	results := make([]IpmiResponse, 1)
+// ExecRawContext performs single request to given device within context.
+func (al *LinuxInBandIpmitool) ExecRawContext(ctx context.Context, request IpmiRequest, host string) (*IpmiResponse, error) {
+	return al.Retry.execRaw(ctx, request, al.exec)
+}
 
-	results[0].Data = ExecIpmiToolLocal(request.Data, al, false)
-	results[0].IsValid = 1
+func (al *LinuxInBandIpmitool) exec(ctx context.Context, request IpmiRequest) (*IpmiResponse, error) {
+	rctx, cancel := al.Retry.requestContext(ctx, ipmitoolTimeout)
+	defer cancel()
+
+	results := make([]IpmiResponse, 1)
 
-	return &results[0], nil
+	results[0] = toResponse(ExecIpmiToolLocalContext(rctx, request, al))
+	return checkedResponse(request, &results[0])
 }
 
-// GetPlatformCapabilities returns host NM capabilities
+// GetPlatformCapabilities returns host capabilities
 func (al *LinuxInBandIpmitool) GetPlatformCapabilities(requests []RequestDescription, _ []string) map[string][]RequestDescription {
 	host, _ := os.Hostname()
 	validRequests := make(map[string][]RequestDescription, 0)
-	validRequests[host] = make([]RequestDescription, 0)
-
-	for _, request := range requests {
-		response := ExecIpmiToolLocal(request.Request.Data, al, true)
-		j := 0
-
-		for i := range response {
-			if response[i] == 0 {
-				j++
-			}
-		}
-		if j != len(response) {
-			validRequests[host] = append(validRequests[host], request)
-		}
-	}
-	if al.Protocol == "dcmi" {
-		// check thermal capability
-		resp := ExecIpmiToolLocal(CmdDCMIThermalCap, al, false)
-		if len(resp) > 5 {
-			data := resp[1:]
-			//sdrId := data[4] + uint16(data[5])<<8
-			CmdSDR[4] = data[3]
-			CmdSDR[5] = data[4]
-			resp := ExecIpmiToolLocal(CmdSDR, al, false)
-			if len(resp) > 10 {
-				data = resp[1:]
-				DcmiThermal.Request.Data[2] = data[9]
-				validRequests[host] = append(validRequests[host], DcmiThermal)
-			}
-		}
-	}
+	validRequests[host] = ProbeCapabilities(al, requests, host, al.Protocol)
 	return validRequests
-
 }
@@ -21,18 +21,36 @@ limitations under the License.
 
 package ipmi
 
+import "context"
+
 // IpmiAL Abstract type for ipmi backend.
+// First byte of response data is always completion code.
+// BatchExecRaw returns BatchError when any of requests failed, ExecRaw returns
+// *CompletionCodeError (with response) when request was rejected by device.
 type IpmiAL interface {
 	BatchExecRaw(requests []IpmiRequest, host string) ([]IpmiResponse, error)
 	ExecRaw(request IpmiRequest, host string) (*IpmiResponse, error)
 	GetPlatformCapabilities(requests []RequestDescription, host []string) map[string][]RequestDescription
 }
 
+// IpmiALContext Abstract type for ipmi backend which calls are bound to context.
+// Cancelling context or reaching its deadline stops waiting for responses.
+// Time limits and retries of single requests are defined by backend RetryPolicy.
+type IpmiALContext interface {
+	IpmiAL
+	BatchExecRawContext(ctx context.Context, requests []IpmiRequest, host string) ([]IpmiResponse, error)
+	ExecRawContext(ctx context.Context, request IpmiRequest, host string) (*IpmiResponse, error)
+}
+
 // IpmiRequest Defines request parameter passed to abstraction layer.
+// Non-zero Slave addresses controller bridged from BMC on Channel (ipmitool -b/-t),
+// Transit lists controllers passed on the way to it (ipmitool -B/-T).
+// Requests with zero Slave are handled by BMC itself.
 type IpmiRequest struct {
 	Data    []byte
 	Channel int16
 	Slave   uint8
+	Transit []BridgeHop
 }
 
 // IpmiResponse Defines response data.
@@ -55,11 +73,52 @@ type RequestDescription struct {
 // Main metric value should have label "" (empty string).
 // Validate() should check response correctness. Nil is returned when response
 // is correct.
-// Parse() extracts submetrics from binary data.
+// Parse() extracts typed submetrics from binary data, submetrics which
+// device did not report are marked invalid.
 type ParserFormat interface {
 	GetMetrics() []string
 	Validate(response IpmiResponse) error
-	Parse(response IpmiResponse) map[string]uint16
+	Parse(response IpmiResponse) map[string]Value
+}
+
+// Units of parsed values.
+const (
+	UnitWatt    = "W"
+	UnitCelsius = "C"
+	UnitAirflow = "0.1 CFM"
+)
+
+// Value is submetric parsed from response. Data holds float64, int, string
+// or bool. Valid is false (and Data nil) when device did not report the value.
+type Value struct {
+	Data  interface{}
+	Unit  string
+	Valid bool
+}
+
+// IntValue returns valid integer value.
+func IntValue(v int, unit string) Value {
+	return Value{Data: v, Unit: unit, Valid: true}
+}
+
+// FloatValue returns valid floating point value.
+func FloatValue(v float64, unit string) Value {
+	return Value{Data: v, Unit: unit, Valid: true}
+}
+
+// StringValue returns valid string value.
+func StringValue(v string) Value {
+	return Value{Data: v, Valid: true}
+}
+
+// BoolValue returns valid boolean value.
+func BoolValue(v bool) Value {
+	return Value{Data: v, Valid: true}
+}
+
+// InvalidValue returns value which was not reported by device.
+func InvalidValue(unit string) Value {
+	return Value{Unit: unit}
 }
 
 type InventoryInfo struct {
@@ -76,6 +135,9 @@ func (req *IpmiRequest ) Clone()(clonedReq IpmiRequest){
 	copy(clonedData,req.Data)
 	cReq.Data = clonedData
 	cReq.Channel = req.Channel
-	cReq.Slave = req.Slave 
+	cReq.Slave = req.Slave
+	if req.Transit != nil {
+		cReq.Transit = append([]BridgeHop{}, req.Transit...)
+	}
 	return cReq
 }
@@ -22,35 +22,89 @@ limitations under the License.
 package ipmi
 
 import (
+	"context"
 	"fmt"
 	"os/exec"
+	"regexp"
 	"strconv"
 	"strings"
+	"time"
 
 	log "github.com/Sirupsen/logrus"
 )
 
-// ExecIpmiToolLocal method runs ipmitool command on a local system
-func ExecIpmiToolLocal(request []byte, strct *LinuxInBandIpmitool, isBridged bool) []byte {
+// ipmitoolTimeout is default time limit of single ipmitool request
+const ipmitoolTimeout = 10 * time.Second
+
+// rspPattern matches completion code in ipmitool error message, e.g.
+// "Unable to send RAW command (channel=0x0 netfn=0x6 lun=0x0 cmd=0x1 rsp=0xc1): Invalid command"
+var rspPattern = regexp.MustCompile(`rsp=0x([0-9a-fA-F]{1,2})`)
+
+// completionCodeFromOutput returns completion code reported by failed ipmitool raw command.
+func completionCodeFromOutput(out []byte) (byte, bool) {
+	match := rspPattern.FindSubmatch(out)
+	if match == nil {
+		return 0, false
+	}
+	value, err := strconv.ParseUint(string(match[1]), 16, 8)
+	if err != nil {
+		return 0, false
+	}
+	return byte(value), true
+}
+
+// localOptions returns ipmitool options preceding raw command on a local system
+func localOptions(request IpmiRequest) ([]string, error) {
+	return bridgeOptions(request.Path())
+}
+
+// remoteOptions returns ipmitool options preceding raw command on a remote system
+func remoteOptions(strct *LinuxOutOfBand, addr string, request IpmiRequest) ([]string, error) {
+	bridge, err := bridgeOptions(request.Path())
+	if err != nil {
+		return nil, err
+	}
+	iface := selectInterface(strct.Interface, strct.Interfaces, addr)
+	a := []string{"-I", iface, "-H", addr, "-U", strct.User, "-P", strct.Pass}
+	return append(a, bridge...), nil
+}
+
+// ExecIpmiToolLocal method runs ipmitool command on a local system.
+// Request is bridged along its path.
+func ExecIpmiToolLocal(request IpmiRequest, strct *LinuxInBandIpmitool) []byte {
+	return ExecIpmiToolLocalContext(context.Background(), request, strct)
+}
+
+// ExecIpmiToolLocalContext method runs ipmitool command on a local system.
+// ipmitool is killed when context is done before command completes.
+func ExecIpmiToolLocalContext(ctx context.Context, request IpmiRequest, strct *LinuxInBandIpmitool) []byte {
 	c, err := exec.LookPath("ipmitool")
 	if err != nil {
 		log.Debug("Unable to find ipmitool")
 		return nil
 	}
 
-	var stringRequest []string
-	if isBridged && strct.Slave != "0" {
-		stringRequest = []string{"-b", strct.Channel, "-t", strct.Slave, "raw"}
-	} else {
-		stringRequest = []string{"raw"}
+	stringRequest, err := localOptions(request)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"error": err,
+		}).Debug("ExecIpmiToolLocal")
+		return nil
 	}
+	if strct.Persistent {
+		return strct.shells.exec(ctx, c, stringRequest, [][]byte{request.Data}, 0)[0]
+	}
+	stringRequest = append(stringRequest, "raw")
 
-	for i := range request {
-		stringRequest = append(stringRequest, fmt.Sprintf("0x%02x", request[i]))
+	for i := range request.Data {
+		stringRequest = append(stringRequest, fmt.Sprintf("0x%02x", request.Data[i]))
 	}
 	
-	ret, err := exec.Command(c, stringRequest...).CombinedOutput()
+	ret, err := exec.CommandContext(ctx, c, stringRequest...).CombinedOutput()
 	if err != nil {
+		if code, ok := completionCodeFromOutput(ret); ok {
+			return []byte{code}
+		}
 		log.WithFields(log.Fields{
 			"error": err,
 		}).Debug("ExecIpmiToolLocal")
@@ -68,8 +122,15 @@ func ExecIpmiToolLocal(request []byte, strct *LinuxInBandIpmitool, isBridged boo
 	return rets
 }
 
-// ExecIpmiToolRemote method runs ipmitool command on a remote system
-func ExecIpmiToolRemote(request []byte, strct *LinuxOutOfBand, addr string, isBridged bool) []byte {
+// ExecIpmiToolRemote method runs ipmitool command on a remote system.
+// Request is bridged along its path.
+func ExecIpmiToolRemote(request IpmiRequest, strct *LinuxOutOfBand, addr string) []byte {
+	return ExecIpmiToolRemoteContext(context.Background(), request, strct, addr)
+}
+
+// ExecIpmiToolRemoteContext method runs ipmitool command on a remote system.
+// ipmitool is killed when context is done before command completes.
+func ExecIpmiToolRemoteContext(ctx context.Context, request IpmiRequest, strct *LinuxOutOfBand, addr string) []byte {
 	c, err := exec.LookPath("ipmitool")
 	if err != nil {
 		log.WithFields(log.Fields{
@@ -79,18 +140,26 @@ func ExecIpmiToolRemote(request []byte, strct *LinuxOutOfBand, addr string, isBr
 		return nil
 	}
 
-	var a []string
-	if isBridged && strct.Slave != "0" {
-		a = []string{"-I", "lanplus", "-H", addr, "-U", strct.User, "-P", strct.Pass, "-b", strct.Channel, "-t", strct.Slave, "raw"}
-	} else {
-		a = []string{"-I", "lanplus", "-H", addr, "-U", strct.User, "-P", strct.Pass, "raw"}
+	a, err := remoteOptions(strct, addr, request)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"error": err,
+		}).Debug("ExecIpmiToolRemote")
+		return nil
 	}
-	for i := range request {
-		a = append(a, fmt.Sprintf("0x%02x", request[i]))
+	if strct.Persistent {
+		return strct.shells.exec(ctx, c, a, [][]byte{request.Data}, 0)[0]
+	}
+	a = append(a, "raw")
+	for i := range request.Data {
+		a = append(a, fmt.Sprintf("0x%02x", request.Data[i]))
 	}
 
-	ret, err := exec.Command(c, a...).CombinedOutput()
+	ret, err := exec.CommandContext(ctx, c, a...).CombinedOutput()
 	if err != nil {
+		if code, ok := completionCodeFromOutput(ret); ok {
+			return []byte{code}
+		}
 		log.WithFields(log.Fields{
 			"c":     c,
 			"a":     a,
@@ -112,3 +181,11 @@ func ExecIpmiToolRemote(request []byte, strct *LinuxOutOfBand, addr string, isBr
 	return rets
 
 }
+
+// toResponse wraps ipmitool output, nil output means that request failed.
+func toResponse(data []byte) IpmiResponse {
+	if data == nil {
+		return IpmiResponse{}
+	}
+	return IpmiResponse{Data: data, IsValid: 1}
+}
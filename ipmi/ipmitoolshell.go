@@ -0,0 +1,308 @@
+// +build linux
+
+/*
+http://www.apache.org/licenses/LICENSE-2.0.txt
+
+
+Copyright 2016 Intel Corporation
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package ipmi
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+const ipmitoolPrompt = "ipmitool> "
+
+// ipmitoolShell is long running "ipmitool shell" process.
+// Commands are written to its standard input, outputs of consecutive
+// commands are separated by shell prompt. Standard output and error
+// share one pipe, so error messages end up in output of failed command.
+type ipmitoolShell struct {
+	cmd    *exec.Cmd
+	stdin  io.WriteCloser
+	pipe   *os.File
+	output *bufio.Reader
+	mutex  sync.Mutex
+}
+
+func startIpmitoolShell(path string, options []string) (*ipmitoolShell, error) {
+	cmd := exec.Command(path, append(append([]string{}, options...), "shell")...)
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, err
+	}
+	r, w, err := os.Pipe()
+	if err != nil {
+		stdin.Close()
+		return nil, err
+	}
+	cmd.Stdout = w
+	cmd.Stderr = w
+	if err := cmd.Start(); err != nil {
+		stdin.Close()
+		r.Close()
+		w.Close()
+		return nil, err
+	}
+	w.Close()
+
+	sh := &ipmitoolShell{cmd: cmd, stdin: stdin, pipe: r, output: bufio.NewReader(r)}
+	r.SetReadDeadline(time.Now().Add(ipmitoolTimeout))
+	if _, err := sh.readUntilPrompt(); err != nil {
+		sh.close()
+		return nil, err
+	}
+	return sh, nil
+}
+
+func (sh *ipmitoolShell) readUntilPrompt() ([]byte, error) {
+	var out []byte
+	for !bytes.HasSuffix(out, []byte(ipmitoolPrompt)) {
+		chunk, err := sh.output.ReadBytes(' ')
+		out = append(out, chunk...)
+		if err != nil {
+			if err == io.EOF {
+				return nil, errors.New("ipmitool shell exited: " + strings.TrimSpace(string(out)))
+			}
+			return nil, err
+		}
+	}
+	return out[:len(out)-len(ipmitoolPrompt)], nil
+}
+
+// run streams raw requests to shell and returns unparsed output of each of them.
+// All requests are written at once, so BMC round trips are not delayed by
+// waiting for previous responses to be read. Every request may take up to
+// timeout, reading is interrupted when context is done.
+func (sh *ipmitoolShell) run(ctx context.Context, requests [][]byte, timeout time.Duration) ([][]byte, error) {
+	sh.mutex.Lock()
+	defer sh.mutex.Unlock()
+
+	deadline := time.Now().Add(time.Duration(len(requests)) * timeout)
+	if d, ok := ctx.Deadline(); ok && d.Before(deadline) {
+		deadline = d
+	}
+	sh.pipe.SetReadDeadline(deadline)
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			sh.pipe.SetReadDeadline(time.Now())
+		case <-done:
+		}
+	}()
+
+	var commands bytes.Buffer
+	for _, request := range requests {
+		commands.WriteString("raw")
+		for _, b := range request {
+			fmt.Fprintf(&commands, " 0x%02x", b)
+		}
+		commands.WriteString("\n")
+	}
+	written := make(chan error, 1)
+	go func() {
+		_, err := sh.stdin.Write(commands.Bytes())
+		written <- err
+	}()
+
+	outputs := make([][]byte, len(requests))
+	for i := range requests {
+		out, err := sh.readUntilPrompt()
+		if err != nil {
+			return nil, err
+		}
+		outputs[i] = out
+	}
+	return outputs, <-written
+}
+
+func (sh *ipmitoolShell) close() {
+	sh.stdin.Close()
+	sh.cmd.Process.Kill()
+	sh.cmd.Wait()
+	sh.pipe.Close()
+}
+
+// parseShellOutput converts output of single raw command to the format
+// returned by ExecIpmiToolLocal (first byte is completion code).
+// Output which is not a list of hex bytes is an error message from ipmitool.
+func parseShellOutput(out []byte) ([]byte, error) {
+	if code, ok := completionCodeFromOutput(out); ok {
+		return []byte{code}, nil
+	}
+	rets := []byte{0}
+	for _, line := range strings.Split(string(out), "\n") {
+		if strings.HasPrefix(strings.TrimSpace(line), "raw") {
+			continue //command echoed by readline
+		}
+		for _, field := range strings.Fields(line) {
+			value, err := strconv.ParseUint(field, 16, 8)
+			if err != nil {
+				return nil, errors.New(strings.TrimSpace(string(out)))
+			}
+			rets = append(rets, byte(value))
+		}
+	}
+	return rets, nil
+}
+
+// ipmitoolShells keeps one ipmitool shell per set of ipmitool options,
+// that is per host and bridging parameters.
+type ipmitoolShells struct {
+	shells map[string]*ipmitoolShell
+	mutex  sync.Mutex
+}
+
+func (p *ipmitoolShells) get(path string, options []string) (*ipmitoolShell, error) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	if p.shells == nil {
+		p.shells = make(map[string]*ipmitoolShell)
+	}
+	key := strings.Join(options, " ")
+	if sh, ok := p.shells[key]; ok {
+		return sh, nil
+	}
+	sh, err := startIpmitoolShell(path, options)
+	if err != nil {
+		return nil, err
+	}
+	p.shells[key] = sh
+	return sh, nil
+}
+
+func (p *ipmitoolShells) drop(options []string, sh *ipmitoolShell) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	key := strings.Join(options, " ")
+	if p.shells[key] == sh {
+		delete(p.shells, key)
+	}
+	sh.close()
+}
+
+// exec runs raw requests through shell started with given options.
+// timeout limits every request, default is used when it is zero.
+// Broken shell is restarted once. Responses of failed requests are nil.
+func (p *ipmitoolShells) exec(ctx context.Context, path string, options []string, requests [][]byte, timeout time.Duration) [][]byte {
+	if timeout <= 0 {
+		timeout = ipmitoolTimeout
+	}
+	var outputs [][]byte
+	var err error
+	for attempt := 0; attempt < 2 && ctx.Err() == nil; attempt++ {
+		var sh *ipmitoolShell
+		if sh, err = p.get(path, options); err != nil {
+			continue
+		}
+		if outputs, err = sh.run(ctx, requests, timeout); err == nil {
+			break
+		}
+		p.drop(options, sh)
+	}
+
+	results := make([][]byte, len(requests))
+	if err == nil && outputs == nil {
+		err = ctx.Err()
+	}
+	if err != nil {
+		log.WithFields(log.Fields{
+			"error": err,
+		}).Debug("ipmitool shell")
+		return results
+	}
+	for i, out := range outputs {
+		if results[i], err = parseShellOutput(out); err != nil {
+			log.WithFields(log.Fields{
+				"request": requests[i],
+				"error":   err,
+			}).Debug("ipmitool shell")
+		}
+	}
+	return results
+}
+
+// Close terminates all shells.
+func (p *ipmitoolShells) Close() error {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	for key, sh := range p.shells {
+		sh.close()
+		delete(p.shells, key)
+	}
+	return nil
+}
+
+// batchExecShell performs batch of requests through shells, requests sharing
+// ipmitool options (that is bridging parameters) are sent through the same shell.
+func batchExecShell(ctx context.Context, shells *ipmitoolShells, options func(IpmiRequest) ([]string, error),
+	requests []IpmiRequest, timeout time.Duration) []IpmiResponse {
+	results := make([]IpmiResponse, len(requests))
+	c, err := exec.LookPath("ipmitool")
+	if err != nil {
+		log.Debug("Unable to find ipmitool")
+		return results
+	}
+
+	var keys []string
+	groups := make(map[string][]int)
+	groupOptions := make(map[string][]string)
+	for i, r := range requests {
+		opts, err := options(r)
+		if err != nil {
+			log.WithFields(log.Fields{
+				"request": r.Data,
+				"error":   err,
+			}).Debug("ipmitool shell")
+			continue
+		}
+		key := strings.Join(opts, " ")
+		if _, ok := groups[key]; !ok {
+			keys = append(keys, key)
+			groupOptions[key] = opts
+		}
+		groups[key] = append(groups[key], i)
+	}
+
+	for _, key := range keys {
+		data := make([][]byte, len(groups[key]))
+		for j, i := range groups[key] {
+			data[j] = requests[i].Data
+		}
+		for j, resp := range shells.exec(ctx, c, groupOptions[key], data, timeout) {
+			results[groups[key][j]] = toResponse(resp)
+		}
+	}
+	return results
+}
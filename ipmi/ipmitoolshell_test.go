@@ -0,0 +1,82 @@
+// +build unit
+
+/*
+http://www.apache.org/licenses/LICENSE-2.0.txt
+
+
+Copyright 2016 Intel Corporation
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package ipmi
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+// fakeShell mimics "ipmitool shell": answers Get Device ID,
+// reports error for other commands and exits on 0xff.
+const fakeShell = `#!/bin/sh
+printf 'ipmitool> '
+while read cmd args; do
+	case "$args" in
+	"0x06 0x01") echo " 20 81 02 10 02 bf 57 01 00 4b 00 00 00 00 00 00"; echo " 01";;
+	"0xff") exit 1;;
+	*) echo "Unable to send RAW command (channel=0x0 netfn=0x2e lun=0x0 cmd=0xc8 rsp=0xc1): Invalid command" >&2;;
+	esac
+	printf 'ipmitool> '
+done
+`
+
+func TestIpmitoolShell(t *testing.T) {
+	Convey("Check persistent ipmitool shell", t, func() {
+		dir, err := ioutil.TempDir("", "ipmitool")
+		So(err, ShouldBeNil)
+		defer os.RemoveAll(dir)
+		path := filepath.Join(dir, "ipmitool")
+		So(ioutil.WriteFile(path, []byte(fakeShell), 0755), ShouldBeNil)
+
+		shells := &ipmitoolShells{}
+		defer shells.Close()
+
+		Convey("batch is streamed through single process", func() {
+			resp := shells.exec(context.Background(), path, []string{"-H", "host"}, [][]byte{{0x06, 0x01}, {0x2e, 0xc8}, {0x06, 0x01}}, 0)
+			So(len(resp), ShouldEqual, 3)
+			So(resp[0], ShouldResemble, []byte{0x00, 0x20, 0x81, 0x02, 0x10, 0x02, 0xbf, 0x57, 0x01, 0x00, 0x4b,
+				0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x01})
+			So(resp[1], ShouldResemble, []byte{0xc1})
+			So(resp[2], ShouldResemble, resp[0])
+			So(len(shells.shells), ShouldEqual, 1)
+
+			shells.exec(context.Background(), path, []string{"-H", "host", "-b", "0x06", "-t", "0x2c"}, [][]byte{{0x06, 0x01}}, 0)
+			So(len(shells.shells), ShouldEqual, 2)
+		})
+
+		Convey("shell is restarted after it exits", func() {
+			resp := shells.exec(context.Background(), path, []string{"-H", "host"}, [][]byte{{0xff}}, 0)
+			So(resp[0], ShouldBeNil)
+			So(len(shells.shells), ShouldEqual, 0)
+
+			resp = shells.exec(context.Background(), path, []string{"-H", "host"}, [][]byte{{0x06, 0x01}}, 0)
+			So(resp[0][0], ShouldEqual, 0)
+			So(len(resp[0]), ShouldEqual, 18)
+		})
+	})
+}
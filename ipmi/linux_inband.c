@@ -47,12 +47,13 @@ void IPMI_Syserr(struct IpmiStatusInfo *out) {
 }
 
 
+// timeout_ms - time limit of waiting for each response (TIMEOUT seconds when <= 0)
 // error codes:
 // 0 - ok
 // <0 - invalid call
 // >0 - errors from OS
 int IPMI_BatchCommands(char *device, struct IpmiCommandInput *inputs,
-	struct IpmiCommandOutput *outputs, int n, int n_sim, struct IpmiStatusInfo *info) {
+	struct IpmiCommandOutput *outputs, int n, int n_sim, int timeout_ms, struct IpmiStatusInfo *info) {
 	    ipmi_error_codes_t status = IPMI_OK;
 		int fd, i, sent = 0, recvd = 0, readyFds;
 		struct ipmi_ipmb_addr sendAddr={0}, recvAddr={0};
@@ -62,11 +63,11 @@ int IPMI_BatchCommands(char *device, struct IpmiCommandInput *inputs,
 		fd_set fdset;
 		unsigned char outData[1024] = {0xFF};
 
-		timeoutSend.tv_sec = TIMEOUT;
-		timeoutSend.tv_usec = 0;
+		if (timeout_ms <= 0)
+			timeout_ms = TIMEOUT * 1000;
 
-		timeoutRecv.tv_sec = TIMEOUT;
-		timeoutRecv.tv_usec = 0;
+		timeoutSend.tv_sec = timeout_ms / 1000;
+		timeoutSend.tv_usec = (timeout_ms % 1000) * 1000;
 
 
 		if (!info) {
@@ -124,6 +125,8 @@ int IPMI_BatchCommands(char *device, struct IpmiCommandInput *inputs,
 			FD_ZERO(&fdset);
 			FD_SET(fd, &fdset);
 
+			// timeout applies to every response awaited
+			timeoutRecv = timeoutSend;
 			if ( (readyFds = select(fd+1, &fdset, NULL, NULL, &timeoutRecv)) < 0) {
 				IPMI_Syserr(info);
 				close(fd);
@@ -164,7 +167,7 @@ int IPMI_BatchCommands(char *device, struct IpmiCommandInput *inputs,
 	}
 
 int IPMI_System_BatchCommands(char *device, struct IpmiCommandInput *inputs,
-	struct IpmiCommandOutput *outputs, int n, int n_sim, struct IpmiStatusInfo *info) {
+	struct IpmiCommandOutput *outputs, int n, int n_sim, int timeout_ms, struct IpmiStatusInfo *info) {
 	    ipmi_error_codes_t status = IPMI_OK;
 		int fd, i, sent = 0, recvd = 0, readyFds;
 		struct ipmi_system_interface_addr sendAddr={0}, recvAddr={0};
@@ -174,11 +177,11 @@ int IPMI_System_BatchCommands(char *device, struct IpmiCommandInput *inputs,
 		fd_set fdset;
 		unsigned char outData[1024] = {0xFF};
 
-		timeoutSend.tv_sec = TIMEOUT;
-		timeoutSend.tv_usec = 0;
+		if (timeout_ms <= 0)
+			timeout_ms = TIMEOUT * 1000;
 
-		timeoutRecv.tv_sec = TIMEOUT;
-		timeoutRecv.tv_usec = 0;
+		timeoutSend.tv_sec = timeout_ms / 1000;
+		timeoutSend.tv_usec = (timeout_ms % 1000) * 1000;
 
 
 		if (!info) {
@@ -235,6 +238,8 @@ int IPMI_System_BatchCommands(char *device, struct IpmiCommandInput *inputs,
 			FD_ZERO(&fdset);
 			FD_SET(fd, &fdset);
 
+			// timeout applies to every response awaited
+			timeoutRecv = timeoutSend;
 			if ( (readyFds = select(fd+1, &fdset, NULL, NULL, &timeoutRecv)) < 0) {
 				IPMI_Syserr(info);
 				close(fd);
@@ -36,9 +36,9 @@ struct IpmiCommandOutput {
 };
 
 int IPMI_BatchCommands(char *device, struct IpmiCommandInput *inputs,
-	struct IpmiCommandOutput *outputs, int n, int n_sim,
+	struct IpmiCommandOutput *outputs, int n, int n_sim, int timeout_ms,
 	struct IpmiStatusInfo *info);
 
 int IPMI_System_BatchCommands(char *device, struct IpmiCommandInput *inputs,
-	struct IpmiCommandOutput *outputs, int n, int n_sim, 
+	struct IpmiCommandOutput *outputs, int n, int n_sim, int timeout_ms,
 	struct IpmiStatusInfo *info);
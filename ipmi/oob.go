@@ -22,150 +22,97 @@ limitations under the License.
 package ipmi
 
 import (
+	"context"
 	log "github.com/Sirupsen/logrus"
-	"sync"
 	"time"
 )
 
 // LinuxOutOfBand implements communication with openipmi driver on linux
+// Interface is passed to ipmitool -I option, Interfaces overrides it per host.
+// When Persistent is set one "ipmitool shell" per host is kept running
+// and requests are streamed through it.
+// Retry specifies time limit and repetition of requests.
+// Requests of batch are performed one by one, use Scheduler
+// to query multiple hosts or run parts of batch concurrently.
 type LinuxOutOfBand struct {
-	Device   string
-	Channel  string
-	Slave    string
-	Addr     []string
-	User     string
-	Pass     string
-	Protocol string
-	mutex    sync.Mutex
+	Device     string
+	Addr       []string
+	User       string
+	Pass       string
+	Protocol   string
+	Interface  string
+	Interfaces map[string]string
+	Persistent bool
+	Retry      RetryPolicy
+	shells     ipmitoolShells
+}
+
+// Close terminates ipmitool shells started by backend.
+func (al *LinuxOutOfBand) Close() error {
+	return al.shells.Close()
 }
 
 // BatchExecRaw Performs batch of requests to given device.
 // Returns array of responses in order corresponding to requests.
 // Error is returned when any of requests failed.
 func (al *LinuxOutOfBand) BatchExecRaw(requests []IpmiRequest, host string) ([]IpmiResponse, error) {
-	var wg sync.WaitGroup
-	wg.Add(len(requests))
+	return al.BatchExecRawContext(context.Background(), requests, host)
+}
+
+// BatchExecRawContext Performs batch of requests to given device within context.
+func (al *LinuxOutOfBand) BatchExecRawContext(ctx context.Context, requests []IpmiRequest, host string) ([]IpmiResponse, error) {
+	return al.Retry.batchExecRaw(ctx, requests, func(ctx context.Context, requests []IpmiRequest) ([]IpmiResponse, error) {
+		return al.batchExec(ctx, requests, host)
+	})
+}
+
+func (al *LinuxOutOfBand) batchExec(ctx context.Context, requests []IpmiRequest, host string) ([]IpmiResponse, error) {
+	if al.Persistent {
+		options := func(r IpmiRequest) ([]string, error) {
+			return remoteOptions(al, host, r)
+		}
+		results := batchExecShell(ctx, &al.shells, options, requests, al.Retry.Timeout)
+		return results, checkBatch(requests, results)
+	}
 	results := make([]IpmiResponse, len(requests))
 
 	a := time.Now()
 	for i, r := range requests {
-		go func(i int, r IpmiRequest) {
-			defer wg.Done()
-			al.mutex.Lock()
-			defer al.mutex.Unlock()
-
-			results[i] = fillStruct(r.Data, al, host, true)
-
-		}(i, r)
+		results[i] = fillStruct(ctx, r, al, host)
 	}
-	wg.Wait()
-	b := time.Now()
-	c := (b.Second() - a.Second())
-	log.Debug("[COLLECTION] Collection took: ", c)
-
-	return results, nil
+	log.Debug("[COLLECTION] Collection took: ", time.Since(a))
 
+	return results, checkBatch(requests, results)
 }
 
+// ExecRaw performs single request to given device.
 func (al *LinuxOutOfBand) ExecRaw(request IpmiRequest, host string) (*IpmiResponse, error) {
-	var wg sync.WaitGroup
-	wg.Add(1)
-	results := make([]IpmiResponse, 1)
-
-	a := time.Now()
-	go func(r IpmiRequest) {
-		defer wg.Done()
-		al.mutex.Lock()
-		defer al.mutex.Unlock()
-
-		results[0] = fillStruct(r.Data, al, host, false)
-
-	}(request)
-	wg.Wait()
-	b := time.Now()
-	c := (b.Second() - a.Second())
-	log.Debug("[COLLECTION] Collection took: ", c)
+	return al.ExecRawContext(context.Background(), request, host)
+}
 
-	return &results[0], nil
+// ExecRawContext performs single request to given device within context.
+func (al *LinuxOutOfBand) ExecRawContext(ctx context.Context, request IpmiRequest, host string) (*IpmiResponse, error) {
+	return al.Retry.execRaw(ctx, request, func(ctx context.Context, request IpmiRequest) (*IpmiResponse, error) {
+		return al.exec(ctx, request, host)
+	})
+}
 
+func (al *LinuxOutOfBand) exec(ctx context.Context, request IpmiRequest, host string) (*IpmiResponse, error) {
+	result := fillStruct(ctx, request, al, host)
+	return checkedResponse(request, &result)
 }
 
-func fillStruct(request []byte, strct *LinuxOutOfBand, addr string, isBridged bool) IpmiResponse {
-	var res IpmiResponse
-	res.Data = ExecIpmiToolRemote(request, strct, addr, isBridged)
-	res.IsValid = 1
-	return res
+func fillStruct(ctx context.Context, request IpmiRequest, strct *LinuxOutOfBand, addr string) IpmiResponse {
+	ctx, cancel := strct.Retry.requestContext(ctx, ipmitoolTimeout)
+	defer cancel()
+	return toResponse(ExecIpmiToolRemoteContext(ctx, request, strct, addr))
 }
 
 // GetPlatformCapabilities returns host capabilities
 func (al *LinuxOutOfBand) GetPlatformCapabilities(requests []RequestDescription, host []string) map[string][]RequestDescription {
-	validRequests := make(map[string][]RequestDescription, 0)
-	var wg sync.WaitGroup
-
 	a := time.Now()
-	for _, addr := range host {
-		validRequests[addr] = make([]RequestDescription, 0)
-		wg.Add(len(requests))
-
-		for _, req := range requests {
-			go func(req RequestDescription, addr string) {
-				al.mutex.Lock()
-				defer al.mutex.Unlock()
-				defer wg.Done()
-
-				var a []byte
-				if al.Protocol == "node_manager" {
-					a = ExecIpmiToolRemote(req.Request.Data, al, addr, true)
-				} else {
-					a = ExecIpmiToolRemote(req.Request.Data, al, addr, false)
-				}
-
-				j := 0
-
-				for i := range a {
-					if a[i] == 0 {
-						j++
-					}
-				}
-				if j != len(a) {
-					validRequests[addr] = append(validRequests[addr], req)
-				}
-
-			}(req, addr)
-		}
-
-		if al.Protocol == "dcmi" {
-			wg.Add(1)
-			// check thermal capability
-			go func(req []byte, addr string) {
-				al.mutex.Lock()
-				defer al.mutex.Lock()
-				defer wg.Done()
-				a := ExecIpmiToolRemote(CmdDCMIThermalCap, al, addr, false)
-
-				if len(a) > 5 {
-					data := a[1:]
-					//sdrId := data[4] + uint16(data[5])<<8
-					CmdSDR[4] = data[3]
-					CmdSDR[5] = data[4]
-					resp := ExecIpmiToolRemote(CmdSDR, al, addr, false)
-
-					if len(resp) > 10 {
-						data = resp[1:]
-						DcmiThermal.Request.Data[2] = data[9]
-						validRequests[addr] = append(validRequests[addr], DcmiThermal)
-					}
-				}
-
-			}(CmdDCMIThermalCap, addr)
-		}
-
-		wg.Wait()
-		b := time.Now()
-		c := (b.Second() - a.Second())
-		log.Debug("[INIT] Initialization took: ", c)
-	}
+	validRequests := ProbeHosts(al, requests, host, al.Protocol)
+	log.Debug("[INIT] Initialization took: ", time.Since(a))
 
 	return validRequests
-
 }
@@ -0,0 +1,236 @@
+// +build linux
+
+/*
+http://www.apache.org/licenses/LICENSE-2.0.txt
+
+
+Copyright 2016 Intel Corporation
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package ipmi
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/intelsdi-x/snap-plugin-collector-intel-dcm-platform/ipmi/rmcp"
+)
+
+// LinuxOutOfBandNative implements out of band communication with BMC
+// using built-in RMCP+ (IPMI v2.0 lanplus) or IPMI v1.5 (lan) client.
+// Interface selects session type for all hosts, Interfaces overrides it per host.
+// One session per host is kept open and reused between requests.
+// Requests are bridged along their paths, including transit hops.
+// Retry specifies time limit and repetition of requests, its timeout
+// is also used as response timeout of session packets.
+// Session is not opened again with host for DialBackoff (30 seconds
+// by default) after it failed.
+type LinuxOutOfBandNative struct {
+	User        string
+	Pass        string
+	Protocol    string
+	CipherSuite int
+	Interface   string
+	Interfaces  map[string]string
+	Retry       RetryPolicy
+	DialBackoff time.Duration
+	sessions    map[string]*nativeSession
+	mutex       sync.Mutex
+}
+
+// defaultDialBackoff is time for which failed session setup is not repeated.
+const defaultDialBackoff = 30 * time.Second
+
+// nativeSession holds session with single host. Its mutex serializes
+// session setup, so that hosts are dialed independently and only once.
+type nativeSession struct {
+	session  *rmcp.Session
+	err      error
+	failedAt time.Time
+	mutex    sync.Mutex
+}
+
+// session returns open session with given host, creating it when needed.
+// Error of failed session setup is returned again until backoff passes.
+func (al *LinuxOutOfBandNative) session(ctx context.Context, host string) (*rmcp.Session, error) {
+	al.mutex.Lock()
+	if al.sessions == nil {
+		al.sessions = make(map[string]*nativeSession)
+	}
+	ns, ok := al.sessions[host]
+	if !ok {
+		ns = &nativeSession{}
+		al.sessions[host] = ns
+	}
+	al.mutex.Unlock()
+
+	ns.mutex.Lock()
+	defer ns.mutex.Unlock()
+	if ns.session != nil {
+		return ns.session, nil
+	}
+	backoff := al.DialBackoff
+	if backoff == 0 {
+		backoff = defaultDialBackoff
+	}
+	if ns.err != nil && time.Since(ns.failedAt) < backoff {
+		return nil, ns.err
+	}
+	cipherSuite := al.CipherSuite
+	if cipherSuite == 0 {
+		cipherSuite = rmcp.DefaultCipherSuite
+	}
+	iface := selectInterface(al.Interface, al.Interfaces, host)
+	s, err := rmcp.DialContext(ctx, host, rmcp.Config{Interface: iface, User: al.User, Password: al.Pass, CipherSuite: cipherSuite,
+		Timeout: al.Retry.Timeout})
+	if err != nil {
+		// abandoned setup says nothing about host
+		if ctx.Err() == nil {
+			ns.err = err
+			ns.failedAt = time.Now()
+		}
+		return nil, err
+	}
+	ns.session = s
+	ns.err = nil
+	return s, nil
+}
+
+// Close closes all sessions opened by backend.
+func (al *LinuxOutOfBandNative) Close() error {
+	al.mutex.Lock()
+	defer al.mutex.Unlock()
+	for host, ns := range al.sessions {
+		ns.mutex.Lock()
+		if ns.session != nil {
+			ns.session.Close()
+		}
+		ns.mutex.Unlock()
+		delete(al.sessions, host)
+	}
+	return nil
+}
+
+// selectInterface returns IPMI LAN interface configured for host.
+// Defaults to lanplus when nothing is configured.
+func selectInterface(def string, perHost map[string]string, host string) string {
+	if iface, ok := perHost[host]; ok && iface != "" {
+		return iface
+	}
+	if def != "" {
+		return def
+	}
+	return rmcp.InterfaceLanPlus
+}
+
+func (al *LinuxOutOfBandNative) exec(ctx context.Context, request IpmiRequest, host string) ([]byte, error) {
+	if len(request.Data) < 2 {
+		return nil, fmt.Errorf("Request too short: %v", request.Data)
+	}
+	s, err := al.session(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+	req := rmcp.Request{NetFn: request.Data[0], Cmd: request.Data[1], Data: request.Data[2:]}
+	if path := request.Path(); path != nil {
+		target := path[len(path)-1]
+		req.Bridged = true
+		req.Channel = target.Channel
+		req.Target = target.Address
+		for _, hop := range path[:len(path)-1] {
+			req.Transit = append(req.Transit, rmcp.Hop{Channel: hop.Channel, Address: hop.Address})
+		}
+	}
+	return s.ExecContext(ctx, req)
+}
+
+func (al *LinuxOutOfBandNative) fillStruct(ctx context.Context, request IpmiRequest, host string) IpmiResponse {
+	var res IpmiResponse
+	data, err := al.exec(ctx, request, host)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"host":    host,
+			"request": request.Data,
+			"error":   err,
+		}).Debug("LinuxOutOfBandNative")
+		return res
+	}
+	res.Data = data
+	res.IsValid = 1
+	return res
+}
+
+// BatchExecRaw Performs batch of requests to given device.
+// Returns array of responses in order corresponding to requests.
+// Requests are sent one by one over the same session.
+func (al *LinuxOutOfBandNative) BatchExecRaw(requests []IpmiRequest, host string) ([]IpmiResponse, error) {
+	return al.BatchExecRawContext(context.Background(), requests, host)
+}
+
+// BatchExecRawContext performs batch of requests to given device within context.
+func (al *LinuxOutOfBandNative) BatchExecRawContext(ctx context.Context, requests []IpmiRequest, host string) ([]IpmiResponse, error) {
+	return al.Retry.batchExecRaw(ctx, requests, func(ctx context.Context, requests []IpmiRequest) ([]IpmiResponse, error) {
+		return al.batchExec(ctx, requests, host)
+	})
+}
+
+func (al *LinuxOutOfBandNative) batchExec(ctx context.Context, requests []IpmiRequest, host string) ([]IpmiResponse, error) {
+	results := make([]IpmiResponse, len(requests))
+
+	a := time.Now()
+	for i, r := range requests {
+		results[i] = al.fillStruct(ctx, r, host)
+	}
+	log.Debug("[COLLECTION] Collection took: ", time.Since(a))
+
+	return results, checkBatch(requests, results)
+}
+
+// ExecRaw performs single request to given device.
+// *CompletionCodeError is returned together with response when request failed on BMC.
+func (al *LinuxOutOfBandNative) ExecRaw(request IpmiRequest, host string) (*IpmiResponse, error) {
+	return al.ExecRawContext(context.Background(), request, host)
+}
+
+// ExecRawContext performs single request to given device within context.
+func (al *LinuxOutOfBandNative) ExecRawContext(ctx context.Context, request IpmiRequest, host string) (*IpmiResponse, error) {
+	return al.Retry.execRaw(ctx, request, func(ctx context.Context, request IpmiRequest) (*IpmiResponse, error) {
+		return al.execRequest(ctx, request, host)
+	})
+}
+
+func (al *LinuxOutOfBandNative) execRequest(ctx context.Context, request IpmiRequest, host string) (*IpmiResponse, error) {
+	data, err := al.exec(ctx, request, host)
+	if err == rmcp.ErrTimeout || err == context.DeadlineExceeded {
+		// unanswered like failed requests of batch, so that it is retried
+		return nil, ErrNoResponse
+	}
+	if err != nil {
+		return nil, err
+	}
+	return checkedResponse(request, &IpmiResponse{Data: data, IsValid: 1})
+}
+
+// GetPlatformCapabilities returns host capabilities
+func (al *LinuxOutOfBandNative) GetPlatformCapabilities(requests []RequestDescription, host []string) map[string][]RequestDescription {
+	a := time.Now()
+	validRequests := ProbeHosts(al, requests, host, al.Protocol)
+	log.Debug("[INIT] Initialization took: ", time.Since(a))
+
+	return validRequests
+}
@@ -0,0 +1,171 @@
+// +build linux
+
+/*
+http://www.apache.org/licenses/LICENSE-2.0.txt
+
+
+Copyright 2016 Intel Corporation
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package ipmi
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"time"
+)
+
+// PolicyDomains are names of Node Manager domains, indexed by domain ID,
+// used in metrics of their policies.
+var PolicyDomains = []string{"platform", "cpu", "memory", "hw_protection", "io"}
+
+// Policy trigger types of Get Node Manager Policy.
+const (
+	PolicyTriggerNone           = 0x00
+	PolicyTriggerInletTemp      = 0x01
+	PolicyTriggerMissingReading = 0x02
+	PolicyTriggerTimeAfterReset = 0x03
+	PolicyTriggerBootTime       = 0x04
+)
+
+var policyTriggers = map[byte]string{
+	PolicyTriggerNone:           "none",
+	PolicyTriggerInletTemp:      "inlet_temperature",
+	PolicyTriggerMissingReading: "missing_power_reading_timeout",
+	PolicyTriggerTimeAfterReset: "time_after_platform_reset",
+	PolicyTriggerBootTime:       "boot_time",
+}
+
+// policyTriggerUnits are units of trigger limit, limit of policies without
+// trigger is not meaningful.
+var policyTriggerUnits = map[byte]string{
+	PolicyTriggerInletTemp:      UnitCelsius,
+	PolicyTriggerMissingReading: "0.1 s",
+	PolicyTriggerTimeAfterReset: "0.1 s",
+}
+
+// Completion codes of Get Node Manager Policy.
+const (
+	ccInvalidPolicyID = 0x80
+	ccInvalidDomainID = 0x81
+)
+
+// policyCmds are Node Manager commands addressing single policy, domain
+// and policy ID are bytes 6 and 7 of request.
+var policyCmds = map[byte]bool{
+	0xc2: true, // Get Node Manager Policy
+	0xc6: true, // Get Node Manager Policy Suspend Periods
+}
+
+// policyTriggerName returns name of policy trigger type.
+func policyTriggerName(trigger byte) string {
+	if name, ok := policyTriggers[trigger]; ok {
+		return name
+	}
+	return fmt.Sprintf("trigger_%d", trigger)
+}
+
+// ParsePolicyTrigger returns policy trigger type of name used in metrics.
+func ParsePolicyTrigger(name string) (uint8, error) {
+	for trigger, n := range policyTriggers {
+		if n == name {
+			return trigger, nil
+		}
+	}
+	return 0, fmt.Errorf("Unknown policy trigger %q", name)
+}
+
+// ParsePolicyDomain returns Node Manager domain ID of name used in metrics
+// or of domain number.
+func ParsePolicyDomain(name string) (uint8, error) {
+	for domain, n := range PolicyDomains {
+		if n == name {
+			return uint8(domain), nil
+		}
+	}
+	domain, err := strconv.ParseUint(name, 0, 4)
+	if err != nil {
+		return 0, fmt.Errorf("Unknown domain %q", name)
+	}
+	return uint8(domain), nil
+}
+
+// IsPolicyRequest tells whether request reads single Node Manager policy.
+func IsPolicyRequest(request IpmiRequest) bool {
+	data := request.Data
+	return len(data) > 6 && data[0] == netFnNM && policyCmds[data[1]]
+}
+
+// PolicyMetricsRoot returns metrics root of policy in domain.
+func PolicyMetricsRoot(root string, domain, policy uint8) string {
+	name := fmt.Sprintf("domain_%d", domain)
+	if int(domain) < len(PolicyDomains) {
+		name = PolicyDomains[domain]
+	}
+	return fmt.Sprintf("%s/%s/%d", root, name, policy)
+}
+
+// policyRequest returns copy of policy request description addressing
+// given policy.
+func policyRequest(template RequestDescription, domain, policy uint8) RequestDescription {
+	desc := template
+	desc.Request = template.Request.Clone()
+	desc.Request.Data[5] = template.Request.Data[5]&0xf0 | domain
+	desc.Request.Data[6] = policy
+	desc.MetricsRoot = PolicyMetricsRoot(template.MetricsRoot, domain, policy)
+	return desc
+}
+
+// policyRetry repeats Get Node Manager Policy requests failed with transient
+// errors while policies are enumerated.
+var policyRetry = RetryPolicy{Retries: 3, Backoff: 100 * time.Millisecond}
+
+// EnumeratePolicies returns IDs of policies of domain, read with Get Node
+// Manager Policy sent to Node Manager addressed like target. Policy IDs are
+// tried in order, as policies may be created with arbitrary IDs by other
+// tools, until max policies are found (every ID is tried when max is 0).
+// Requests failed with transient errors are repeated, policies found
+// before error are returned with it.
+func EnumeratePolicies(layer IpmiAL, target IpmiRequest, host string, domain uint8, max int) ([]uint8, error) {
+	var policies []uint8
+	for id := 0; id <= 0xff && (max <= 0 || len(policies) < max); id++ {
+		cmd := target.Clone()
+		cmd.Data = []byte{0x2e, 0xc2, 0x57, 0x01, 0x00, domain, uint8(id)}
+		_, err := policyRetry.execRaw(context.Background(), cmd, func(ctx context.Context, cmd IpmiRequest) (*IpmiResponse, error) {
+			resp, err := layer.ExecRaw(cmd, host)
+			if err == nil && resp == nil {
+				err = ErrNoResponse
+			}
+			if err == nil {
+				err = CheckResponse(cmd, *resp)
+			}
+			return resp, err
+		})
+		if e, ok := err.(*CompletionCodeError); ok {
+			switch e.Code {
+			case ccInvalidPolicyID:
+				continue
+			case ccInvalidDomainID:
+				return nil, nil
+			}
+		}
+		if err != nil {
+			return policies, err
+		}
+		policies = append(policies, uint8(id))
+	}
+	return policies, nil
+}
@@ -0,0 +1,131 @@
+// +build linux
+
+/*
+http://www.apache.org/licenses/LICENSE-2.0.txt
+
+
+Copyright 2016 Intel Corporation
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package ipmi
+
+import (
+	"context"
+	"sort"
+	"time"
+)
+
+// RetryPolicy controls time limits and repetition of requests.
+// Timeout limits single attempt of every request, zero means backend default.
+// Requests failed with transient error (see IsTransient) are repeated up to
+// Retries times. Backoff is waited before first retry and doubled before
+// every next one.
+type RetryPolicy struct {
+	Timeout time.Duration
+	Retries int
+	Backoff time.Duration
+}
+
+// requestTimeout returns time limit of single request attempt:
+// policy timeout (def when not set) shortened to context deadline.
+func (p RetryPolicy) requestTimeout(ctx context.Context, def time.Duration) time.Duration {
+	timeout := p.Timeout
+	if timeout <= 0 {
+		timeout = def
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		if left := time.Until(deadline); left < timeout {
+			timeout = left
+		}
+	}
+	return timeout
+}
+
+// requestContext returns context of single request attempt
+// limited by policy timeout (def when not set).
+func (p RetryPolicy) requestContext(ctx context.Context, def time.Duration) (context.Context, context.CancelFunc) {
+	timeout := p.Timeout
+	if timeout <= 0 {
+		timeout = def
+	}
+	return context.WithTimeout(ctx, timeout)
+}
+
+// wait sleeps before given retry (starting from 1).
+// Error is returned when context is done first.
+func (p RetryPolicy) wait(ctx context.Context, retry int) error {
+	delay := p.Backoff << uint(retry-1)
+	if delay <= 0 {
+		return ctx.Err()
+	}
+	t := time.NewTimer(delay)
+	defer t.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-t.C:
+		return nil
+	}
+}
+
+// execRaw performs single request using exec, repeating it according to policy.
+func (p RetryPolicy) execRaw(ctx context.Context, request IpmiRequest,
+	exec func(context.Context, IpmiRequest) (*IpmiResponse, error)) (*IpmiResponse, error) {
+	for retry := 0; ; retry++ {
+		resp, err := exec(ctx, request)
+		if err == nil || !IsTransient(err) || retry >= p.Retries {
+			return resp, err
+		}
+		if werr := p.wait(ctx, retry+1); werr != nil {
+			return resp, err
+		}
+	}
+}
+
+// batchExecRaw performs batch of requests using exec. Requests failed with
+// transient errors are collected and repeated in smaller batches.
+func (p RetryPolicy) batchExecRaw(ctx context.Context, requests []IpmiRequest,
+	exec func(context.Context, []IpmiRequest) ([]IpmiResponse, error)) ([]IpmiResponse, error) {
+	results, err := exec(ctx, requests)
+	for retry := 1; retry <= p.Retries && err != nil; retry++ {
+		failed, ok := err.(BatchError)
+		if !ok {
+			break
+		}
+		indexes := make([]int, 0, len(failed))
+		for i, e := range failed {
+			if IsTransient(e) {
+				indexes = append(indexes, i)
+			}
+		}
+		if len(indexes) == 0 || p.wait(ctx, retry) != nil {
+			break
+		}
+		sort.Ints(indexes)
+		repeated := make([]IpmiRequest, len(indexes))
+		for j, i := range indexes {
+			repeated[j] = requests[i]
+		}
+		responses, _ := exec(ctx, repeated)
+		if len(responses) != len(repeated) {
+			continue
+		}
+		for j, i := range indexes {
+			results[i] = responses[j]
+		}
+		err = checkBatch(requests, results)
+	}
+	return results, err
+}
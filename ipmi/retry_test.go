@@ -0,0 +1,95 @@
+// +build unit
+
+/*
+http://www.apache.org/licenses/LICENSE-2.0.txt
+
+
+Copyright 2016 Intel Corporation
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package ipmi
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestRetryPolicy(t *testing.T) {
+	Convey("Check retry policy", t, func() {
+		policy := RetryPolicy{Retries: 2, Backoff: time.Millisecond}
+		request := IpmiRequest{[]byte{0x06, 0x01}, 0, 0, nil}
+
+		Convey("transient errors are retried", func() {
+			calls := 0
+			resp, err := policy.execRaw(context.Background(), request, func(ctx context.Context, r IpmiRequest) (*IpmiResponse, error) {
+				calls++
+				if calls < 3 {
+					return checkedResponse(r, &IpmiResponse{[]byte{0xc0}, 1})
+				}
+				return checkedResponse(r, &IpmiResponse{[]byte{0x00, 0x20}, 1})
+			})
+			So(err, ShouldBeNil)
+			So(resp.Data, ShouldResemble, []byte{0x00, 0x20})
+			So(calls, ShouldEqual, 3)
+		})
+
+		Convey("unsupported requests are not retried", func() {
+			calls := 0
+			_, err := policy.execRaw(context.Background(), request, func(ctx context.Context, r IpmiRequest) (*IpmiResponse, error) {
+				calls++
+				return checkedResponse(r, &IpmiResponse{[]byte{0xc1}, 1})
+			})
+			So(IsUnsupported(err), ShouldBeTrue)
+			So(calls, ShouldEqual, 1)
+		})
+
+		Convey("only failed transient requests of batch are repeated", func() {
+			requests := []IpmiRequest{request, {[]byte{0x2e, 0xc8}, 0, 0, nil}, {[]byte{0x2c, 0x02}, 0, 0, nil}}
+			var batches [][]IpmiRequest
+			results, err := policy.batchExecRaw(context.Background(), requests, func(ctx context.Context, reqs []IpmiRequest) ([]IpmiResponse, error) {
+				batches = append(batches, reqs)
+				responses := make([]IpmiResponse, len(reqs))
+				for i, r := range reqs {
+					switch {
+					case r.Data[0] == 0x2e && len(batches) == 1:
+						responses[i] = IpmiResponse{nil, 0}
+					case r.Data[0] == 0x2c:
+						responses[i] = IpmiResponse{[]byte{0xd5}, 1}
+					default:
+						responses[i] = IpmiResponse{[]byte{0x00, r.Data[1]}, 1}
+					}
+				}
+				return responses, checkBatch(reqs, responses)
+			})
+			So(len(batches), ShouldEqual, 2)
+			So(batches[1], ShouldResemble, requests[1:2])
+			So(results[1].Data, ShouldResemble, []byte{0x00, 0xc8})
+			So(IsUnsupported(err.(BatchError)[2]), ShouldBeTrue)
+			So(len(err.(BatchError)), ShouldEqual, 1)
+		})
+
+		Convey("request timeout is limited by context deadline", func() {
+			ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+			defer cancel()
+			So(policy.requestTimeout(ctx, 5*time.Second), ShouldBeLessThanOrEqualTo, time.Second)
+			So(policy.requestTimeout(context.Background(), 5*time.Second), ShouldEqual, 5*time.Second)
+			policy.Timeout = 100 * time.Millisecond
+			So(policy.requestTimeout(ctx, 5*time.Second), ShouldEqual, 100*time.Millisecond)
+		})
+	})
+}
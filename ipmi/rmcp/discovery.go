@@ -0,0 +1,303 @@
+// +build linux
+
+/*
+http://www.apache.org/licenses/LICENSE-2.0.txt
+
+
+Copyright 2016 Intel Corporation
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package rmcp
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// minSweepPrefix is the shortest IPv4 prefix accepted by Sweep (65536 addresses).
+const minSweepPrefix = 16
+
+// Pong is answer to ASF presence ping.
+// IPMI is set when responder supports IPMI over LAN.
+type Pong struct {
+	IANA       uint32
+	OEM        uint32
+	IPMI       bool
+	ASFVersion byte
+}
+
+// AuthCapabilities is response to Get Channel Authentication Capabilities
+// sent outside of session. AuthTypes is bit mask of supported IPMI v1.5
+// authentication types, LanPlus is set when BMC supports IPMI v2.0 sessions.
+type AuthCapabilities struct {
+	Channel   byte
+	AuthTypes byte
+	Lan       bool
+	LanPlus   bool
+}
+
+// Interface returns the best session type supported by BMC.
+func (c *AuthCapabilities) Interface() string {
+	if c.LanPlus {
+		return InterfaceLanPlus
+	}
+	return InterfaceLan
+}
+
+// BMC is controller found by Sweep.
+// Addr is IP address, followed by port when it is not DefaultPort.
+type BMC struct {
+	Addr string
+	Pong Pong
+	Auth AuthCapabilities
+}
+
+// SweepConfig holds sweep parameters. Port defaults to DefaultPort,
+// Timeout (default 2s) limits waiting for pongs and every authentication
+// capabilities request, Workers (default 16) limits concurrent requests.
+type SweepConfig struct {
+	Port    int
+	Timeout time.Duration
+	Workers int
+}
+
+func (cfg *SweepConfig) setDefaults() {
+	if cfg.Port == 0 {
+		cfg.Port = DefaultPort
+	}
+	if cfg.Timeout == 0 {
+		cfg.Timeout = 2 * time.Second
+	}
+	if cfg.Workers == 0 {
+		cfg.Workers = 16
+	}
+}
+
+func pingPacket(tag byte) []byte {
+	packet := append(rmcpHeader(classASF), asfIANA...)
+	return append(packet, asfPresencePing, tag, 0x00, 0x00)
+}
+
+func parsePong(packet []byte) (*Pong, error) {
+	if len(packet) < 24 || packet[3] != classASF || !bytes.Equal(packet[4:8], asfIANA) || packet[8] != asfPresencePong {
+		return nil, fmt.Errorf("rmcp: invalid presence pong")
+	}
+	return &Pong{
+		IANA:       binary.BigEndian.Uint32(packet[12:16]),
+		OEM:        binary.BigEndian.Uint32(packet[16:20]),
+		IPMI:       packet[20]&0x80 != 0,
+		ASFVersion: packet[20] & 0x0f,
+	}, nil
+}
+
+// Ping sends ASF presence ping to addr and waits for pong.
+func Ping(ctx context.Context, addr string, timeout time.Duration) (*Pong, error) {
+	conn, err := net.Dial("udp", JoinHostPort(addr))
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	deadline := time.Now().Add(timeout)
+	if d, ok := ctx.Deadline(); ok && d.Before(deadline) {
+		deadline = d
+	}
+	conn.SetDeadline(deadline)
+	if _, err := conn.Write(pingPacket(0)); err != nil {
+		return nil, err
+	}
+	buf := make([]byte, 512)
+	for {
+		n, err := conn.Read(buf)
+		if err != nil {
+			if ne, ok := err.(net.Error); ok && ne.Timeout() {
+				return nil, ErrTimeout
+			}
+			return nil, err
+		}
+		if pong, err := parsePong(buf[:n]); err == nil {
+			return pong, nil
+		}
+	}
+}
+
+// GetAuthCapabilities asks BMC at addr for authentication capabilities
+// outside of session, including IPMI v2.0 extended data.
+func GetAuthCapabilities(ctx context.Context, addr string, timeout time.Duration) (*AuthCapabilities, error) {
+	conn, err := net.Dial("udp", JoinHostPort(addr))
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	cfg := Config{Timeout: timeout, Retries: 1}
+	cfg.setDefaults()
+	s := &Session{addr: JoinHostPort(addr), cfg: cfg, conn: conn, channel: &legacyChannel{}}
+	resp, err := s.exec(ctx, Request{NetFn: netFnApp, Cmd: cmdGetChannelAuthCaps,
+		Data: []byte{0x80 | currentChannel, PrivilegeAdministrator}})
+	if err != nil {
+		return nil, err
+	}
+	if len(resp) > 0 && resp[0] != 0 {
+		return nil, fmt.Errorf("rmcp: get channel authentication capabilities failed with completion code 0x%02x", resp[0])
+	}
+	if len(resp) < 5 {
+		return nil, ErrShortPacket
+	}
+	caps := &AuthCapabilities{Channel: resp[1], AuthTypes: resp[2] & 0x3f, Lan: true}
+	if resp[2]&0x80 != 0 {
+		// extended capabilities: bit 0 IPMI v1.5, bit 1 IPMI v2.0
+		caps.Lan = resp[4]&0x01 != 0
+		caps.LanPlus = resp[4]&0x02 != 0
+	}
+	return caps, nil
+}
+
+// ipList sorts IPv4 addresses in ascending order.
+type ipList []net.IP
+
+func (l ipList) Len() int           { return len(l) }
+func (l ipList) Less(i, j int) bool { return bytes.Compare(l[i], l[j]) < 0 }
+func (l ipList) Swap(i, j int)      { l[i], l[j] = l[j], l[i] }
+
+// sweepAddresses lists host addresses of IPv4 networks given in CIDR
+// notation. Plain addresses are accepted as single hosts.
+func sweepAddresses(networks []string) ([]net.IP, error) {
+	var addrs []net.IP
+	for _, network := range networks {
+		if ip := net.ParseIP(network); ip != nil && ip.To4() != nil {
+			addrs = append(addrs, ip.To4())
+			continue
+		}
+		ip, ipnet, err := net.ParseCIDR(network)
+		if err != nil {
+			return nil, err
+		}
+		if ip.To4() == nil {
+			return nil, fmt.Errorf("rmcp: only IPv4 networks can be swept, got %s", network)
+		}
+		ones, bits := ipnet.Mask.Size()
+		if ones < minSweepPrefix {
+			return nil, fmt.Errorf("rmcp: network %s too large to sweep, prefix must be at least /%d", network, minSweepPrefix)
+		}
+		first := binary.BigEndian.Uint32(ipnet.IP.To4())
+		count := uint32(1) << uint(bits-ones)
+		for i := uint32(0); i < count; i++ {
+			if count > 2 && (i == 0 || i == count-1) {
+				continue //network and broadcast address
+			}
+			addr := make(net.IP, 4)
+			binary.BigEndian.PutUint32(addr, first+i)
+			addrs = append(addrs, addr)
+		}
+	}
+	return addrs, nil
+}
+
+// Sweep sends ASF presence ping to every address of networks and asks
+// IPMI capable responders for authentication capabilities. Found BMCs
+// are returned ordered by address.
+func Sweep(ctx context.Context, networks []string, cfg SweepConfig) ([]BMC, error) {
+	cfg.setDefaults()
+	addrs, err := sweepAddresses(networks)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := net.ListenPacket("udp4", ":0")
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	pongs := make(map[string]*Pong)
+	received := make(chan struct{})
+	go func() {
+		defer close(received)
+		buf := make([]byte, 512)
+		for {
+			n, from, err := conn.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			udp, ok := from.(*net.UDPAddr)
+			if !ok || udp.Port != cfg.Port {
+				continue
+			}
+			if pong, err := parsePong(buf[:n]); err == nil && pong.IPMI {
+				pongs[udp.IP.String()] = pong
+			}
+		}
+	}()
+
+	for i, ip := range addrs {
+		if ctx.Err() != nil {
+			break
+		}
+		conn.WriteTo(pingPacket(byte(i)), &net.UDPAddr{IP: ip, Port: cfg.Port})
+	}
+	deadline := time.Now().Add(cfg.Timeout)
+	if d, ok := ctx.Deadline(); ok && d.Before(deadline) {
+		deadline = d
+	}
+	conn.SetReadDeadline(deadline)
+	<-received
+
+	responders := make(ipList, 0, len(pongs))
+	for ip := range pongs {
+		responders = append(responders, net.ParseIP(ip).To4())
+	}
+	sort.Sort(responders)
+	ips := make([]string, len(responders))
+	for i, ip := range responders {
+		ips[i] = ip.String()
+	}
+
+	bmcs := make([]BMC, len(ips))
+	found := make([]bool, len(ips))
+	workers := make(chan struct{}, cfg.Workers)
+	var wg sync.WaitGroup
+	for i, ip := range ips {
+		addr := ip
+		if cfg.Port != DefaultPort {
+			addr = net.JoinHostPort(ip, strconv.Itoa(cfg.Port))
+		}
+		wg.Add(1)
+		go func(i int, addr string) {
+			defer wg.Done()
+			workers <- struct{}{}
+			defer func() { <-workers }()
+			caps, err := GetAuthCapabilities(ctx, addr, cfg.Timeout)
+			if err != nil {
+				return
+			}
+			bmcs[i] = BMC{Addr: addr, Pong: *pongs[ips[i]], Auth: *caps}
+			found[i] = true
+		}(i, addr)
+	}
+	wg.Wait()
+
+	result := make([]BMC, 0, len(bmcs))
+	for i, bmc := range bmcs {
+		if found[i] {
+			result = append(result, bmc)
+		}
+	}
+	return result, ctx.Err()
+}
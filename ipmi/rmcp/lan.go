@@ -0,0 +1,205 @@
+// +build linux
+
+/*
+http://www.apache.org/licenses/LICENSE-2.0.txt
+
+
+Copyright 2016 Intel Corporation
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package rmcp
+
+import (
+	"context"
+	"crypto/md5"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+)
+
+// IPMI v1.5 session authentication types
+const (
+	authTypeNone     = 0x00
+	authTypeMD5      = 0x02
+	authTypePassword = 0x04
+
+	legacyPasswordSize = 16
+	currentChannel     = 0x0e
+)
+
+// legacyChannel seals and opens IPMI v1.5 session packets.
+// Before activation packets are sent outside of session (no authentication),
+// Activate Session itself uses temporary session ID and sequence number 0.
+type legacyChannel struct {
+	authType  byte
+	password  []byte
+	sessionID uint32
+	seq       uint32
+	recv      seqWindow
+	active    bool
+}
+
+func (c *legacyChannel) session() (uint32, bool) {
+	return c.sessionID, c.active
+}
+
+func (c *legacyChannel) authCode(sessionID uint32, seq uint32, payload []byte) []byte {
+	switch c.authType {
+	case authTypeMD5:
+		h := md5.New()
+		h.Write(c.password)
+		h.Write(appendUint32(nil, sessionID))
+		h.Write(payload)
+		h.Write(appendUint32(nil, seq))
+		h.Write(c.password)
+		return h.Sum(nil)
+	case authTypePassword:
+		return c.password
+	}
+	return nil
+}
+
+func (c *legacyChannel) seal(_ byte, payload []byte) ([]byte, error) {
+	seq := c.seq
+	if c.active {
+		c.seq++
+		if c.seq == 0 {
+			c.seq = 1
+		}
+	}
+	b := append(rmcpHeader(classIPMI), c.authType)
+	b = appendUint32(b, seq)
+	b = appendUint32(b, c.sessionID)
+	b = append(b, c.authCode(c.sessionID, seq, payload)...)
+	b = append(b, byte(len(payload)))
+	return append(b, payload...), nil
+}
+
+func (c *legacyChannel) open(b []byte) (byte, []byte, error) {
+	if len(b) < 14 || b[0] != rmcpVersion1 || b[3] != classIPMI {
+		return 0, nil, ErrShortPacket
+	}
+	authType := b[4]
+	seq := getUint32(b[5:9])
+	sessionID := getUint32(b[9:13])
+	offset := 13
+	if authType != authTypeNone {
+		offset += legacyPasswordSize
+	}
+	if len(b) < offset+1 || len(b) < offset+1+int(b[offset]) {
+		return 0, nil, ErrShortPacket
+	}
+	payload := b[offset+1 : offset+1+int(b[offset])]
+
+	if c.active {
+		if sessionID != c.sessionID {
+			return 0, nil, fmt.Errorf("rmcp: packet for unknown session 0x%08x", sessionID)
+		}
+		// packets of active session are authenticated like the session,
+		// unauthenticated ones are accepted only by sessions without authentication
+		if authType != c.authType {
+			return 0, nil, fmt.Errorf("rmcp: unexpected authentication type 0x%02x", authType)
+		}
+		if authType != authTypeNone &&
+			subtle.ConstantTimeCompare(c.authCode(sessionID, seq, payload), b[13:13+legacyPasswordSize]) != 1 {
+			return 0, nil, errors.New("rmcp: packet authentication code mismatch")
+		}
+		if !c.recv.accept(seq, legacySeqBehind, legacySeqAhead) {
+			return 0, nil, fmt.Errorf("rmcp: session sequence number %d replayed or out of window", seq)
+		}
+	}
+	return payloadIPMI, payload, nil
+}
+
+// chooseAuthType selects strongest supported authentication type
+// reported by Get Channel Authentication Capabilities.
+func chooseAuthType(supported byte) (byte, error) {
+	switch {
+	case supported&(1<<authTypeMD5) != 0:
+		return authTypeMD5, nil
+	case supported&(1<<authTypePassword) != 0:
+		return authTypePassword, nil
+	case supported&(1<<authTypeNone) != 0:
+		return authTypeNone, nil
+	}
+	return 0, fmt.Errorf("rmcp: no supported authentication type (0x%02x)", supported)
+}
+
+func (s *Session) legacyCommand(ctx context.Context, cmd byte, data []byte, minLen int) ([]byte, error) {
+	resp, err := s.exec(ctx, Request{NetFn: netFnApp, Cmd: cmd, Data: data})
+	if err != nil {
+		return nil, err
+	}
+	if len(resp) > 0 && resp[0] != 0 {
+		return nil, fmt.Errorf("rmcp: command 0x%02x failed with completion code 0x%02x", cmd, resp[0])
+	}
+	if len(resp) < minLen {
+		return nil, ErrShortPacket
+	}
+	return resp, nil
+}
+
+// openLan performs IPMI v1.5 session establishment:
+// Get Channel Authentication Capabilities, Get Session Challenge and Activate Session.
+func (s *Session) openLan(ctx context.Context) error {
+	if len(s.cfg.User) > 16 || len(s.cfg.Password) > legacyPasswordSize {
+		return errors.New("rmcp: user name or password too long for IPMI v1.5 session")
+	}
+	c := &legacyChannel{password: make([]byte, legacyPasswordSize)}
+	copy(c.password, s.cfg.Password)
+	s.channel = c
+
+	resp, err := s.legacyCommand(ctx, cmdGetChannelAuthCaps, []byte{currentChannel, s.cfg.Privilege}, 3)
+	if err != nil {
+		return err
+	}
+	authType, err := chooseAuthType(resp[2])
+	if err != nil {
+		return err
+	}
+
+	user := make([]byte, 16)
+	copy(user, s.cfg.User)
+	resp, err = s.legacyCommand(ctx, cmdGetSessionChallenge, append([]byte{authType}, user...), 21)
+	if err != nil {
+		return err
+	}
+	challenge := resp[5:21]
+
+	// Activate Session is authenticated with temporary session ID
+	c.authType = authType
+	c.sessionID = getUint32(resp[1:5])
+	outSeq, err := randomSessionID()
+	if err != nil {
+		return err
+	}
+	data := append([]byte{authType, s.cfg.Privilege}, challenge...)
+	data = appendUint32(data, outSeq)
+	resp, err = s.legacyCommand(ctx, cmdActivateSession, data, 10)
+	if err != nil {
+		return err
+	}
+
+	c.authType = resp[1] & 0x0f
+	c.sessionID = getUint32(resp[2:6])
+	c.seq = getUint32(resp[6:10])
+	if c.seq == 0 {
+		c.seq = 1
+	}
+	// BMC numbers its packets from outbound sequence number we asked for
+	c.recv = seqWindow{last: outSeq - 1}
+	c.active = true
+	return nil
+}
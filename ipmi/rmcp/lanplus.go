@@ -0,0 +1,519 @@
+// +build linux
+
+/*
+http://www.apache.org/licenses/LICENSE-2.0.txt
+
+
+Copyright 2016 Intel Corporation
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package rmcp
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+)
+
+// RMCP+ session header constants
+const (
+	authTypeRMCPPlus = 0x06
+
+	payloadIPMI                = 0x00
+	payloadOpenSessionRequest  = 0x10
+	payloadOpenSessionResponse = 0x11
+	payloadRAKP1               = 0x12
+	payloadRAKP2               = 0x13
+	payloadRAKP3               = 0x14
+	payloadRAKP4               = 0x15
+
+	payloadEncrypted     = 0x80
+	payloadAuthenticated = 0x40
+
+	nextHeader      = 0x07
+	nameOnlyLookup  = 0x10
+	maxPasswordSize = 20
+)
+
+// Authentication, integrity and confidentiality algorithm numbers.
+const (
+	authNone       = 0x00
+	authHMACSHA1   = 0x01
+	authHMACMD5    = 0x02
+	authHMACSHA256 = 0x03
+
+	integrityNone          = 0x00
+	integrityHMACSHA196    = 0x01
+	integrityHMACMD5128    = 0x02
+	integrityHMACSHA256128 = 0x04
+
+	confidentialityNone      = 0x00
+	confidentialityAESCBC128 = 0x01
+)
+
+type cipherSuite struct {
+	auth            byte
+	integrity       byte
+	confidentiality byte
+}
+
+// cipherSuites lists supported cipher suite IDs (IPMI 2.0 table 22-20).
+var cipherSuites = map[int]cipherSuite{
+	0:  {authNone, integrityNone, confidentialityNone},
+	1:  {authHMACSHA1, integrityNone, confidentialityNone},
+	2:  {authHMACSHA1, integrityHMACSHA196, confidentialityNone},
+	3:  {authHMACSHA1, integrityHMACSHA196, confidentialityAESCBC128},
+	6:  {authHMACMD5, integrityNone, confidentialityNone},
+	7:  {authHMACMD5, integrityHMACMD5128, confidentialityNone},
+	8:  {authHMACMD5, integrityHMACMD5128, confidentialityAESCBC128},
+	15: {authHMACSHA256, integrityNone, confidentialityNone},
+	16: {authHMACSHA256, integrityHMACSHA256128, confidentialityNone},
+	17: {authHMACSHA256, integrityHMACSHA256128, confidentialityAESCBC128},
+}
+
+// ivSource provides initialization vectors of encrypted payloads.
+var ivSource io.Reader = rand.Reader
+
+// DefaultCipherSuite is used when none is configured (HMAC-SHA1, HMAC-SHA1-96, AES-CBC-128).
+const DefaultCipherSuite = 3
+
+var rakpStatusCodes = map[byte]string{
+	0x01: "insufficient resources to create a session",
+	0x02: "invalid session ID",
+	0x03: "invalid payload type",
+	0x04: "invalid authentication algorithm",
+	0x05: "invalid integrity algorithm",
+	0x06: "no matching authentication payload",
+	0x07: "no matching integrity payload",
+	0x08: "inactive session ID",
+	0x09: "invalid role",
+	0x0a: "unauthorized role or privilege level requested",
+	0x0b: "insufficient resources to create a session at the requested role",
+	0x0c: "invalid name length",
+	0x0d: "unauthorized name",
+	0x0e: "unauthorized GUID",
+	0x0f: "invalid integrity check value",
+	0x10: "invalid confidentiality algorithm",
+	0x11: "no cipher suite match with proposed security algorithms",
+	0x12: "illegal or unrecognized parameter",
+}
+
+func rakpError(stage string, status byte) error {
+	desc, ok := rakpStatusCodes[status]
+	if !ok {
+		desc = "unknown status"
+	}
+	return fmt.Errorf("rmcp: %s failed with status 0x%02x (%s)", stage, status, desc)
+}
+
+func authHash(algorithm byte) func() hash.Hash {
+	switch algorithm {
+	case authHMACSHA1:
+		return sha1.New
+	case authHMACMD5:
+		return md5.New
+	case authHMACSHA256:
+		return sha256.New
+	}
+	return nil
+}
+
+func hmacSum(h func() hash.Hash, key []byte, parts ...[]byte) []byte {
+	mac := hmac.New(h, key)
+	for _, p := range parts {
+		mac.Write(p)
+	}
+	return mac.Sum(nil)
+}
+
+// icvLength returns length of integrity check value in RAKP message 4.
+func icvLength(algorithm byte) int {
+	switch algorithm {
+	case authHMACSHA1:
+		return 12
+	case authHMACMD5, authHMACSHA256:
+		return 16
+	}
+	return 0
+}
+
+func passwordKey(password string) []byte {
+	key := make([]byte, maxPasswordSize)
+	copy(key, password)
+	return key
+}
+
+// sessionKeys holds keys derived from session integrity key during RAKP.
+type sessionKeys struct {
+	sik []byte
+	k1  []byte
+	k2  []byte
+}
+
+func deriveKeys(suite cipherSuite, kg, rm, rc []byte, role byte, user string) sessionKeys {
+	h := authHash(suite.auth)
+	if h == nil {
+		return sessionKeys{}
+	}
+	sik := hmacSum(h, kg, rm, rc, []byte{role, byte(len(user))}, []byte(user))
+	size := h().Size()
+	const1 := make([]byte, size)
+	const2 := make([]byte, size)
+	for i := range const1 {
+		const1[i] = 0x01
+		const2[i] = 0x02
+	}
+	return sessionKeys{sik: sik, k1: hmacSum(h, sik, const1), k2: hmacSum(h, sik, const2)}
+}
+
+// secureChannel seals and opens RMCP+ packets of an established session.
+// The same code is used by both sides of the session, so sendID is the ID
+// of the remote party and recvID is the ID assigned by the local one.
+type secureChannel struct {
+	suite  cipherSuite
+	keys   sessionKeys
+	active bool
+	sendID uint32
+	recvID uint32
+	seq    uint32
+	recv   seqWindow
+}
+
+// Inbound session sequence numbers are accepted up to seqBehind below
+// the highest one received and up to seqAhead above it, each only once
+// (IPMI 2.0 section 6.12.13). IPMI v1.5 sessions use window of 8 numbers
+// on both sides.
+const (
+	seqBehind       = 15
+	seqAhead        = 32
+	legacySeqBehind = 8
+	legacySeqAhead  = 8
+)
+
+// seqWindow tracks inbound session sequence numbers: last is highest
+// number received in session, bit i of seen is set when number last-i
+// was received.
+type seqWindow struct {
+	last uint32
+	seen uint32
+}
+
+// accept records inbound session sequence number, it returns false
+// for replayed numbers and numbers outside of window. Numbers are
+// compared modulo 2^32, so window follows sequence wrapping around.
+func (w *seqWindow) accept(seq uint32, behind, ahead int) bool {
+	diff := int(int32(seq - w.last))
+	switch {
+	case seq == 0 || diff > ahead || diff < -behind:
+		return false
+	case diff > 0:
+		w.seen = w.seen<<uint(diff) | 1
+		w.last = seq
+		return true
+	}
+	bit := uint32(1) << uint(-diff)
+	if w.seen&bit != 0 {
+		return false
+	}
+	w.seen |= bit
+	return true
+}
+
+func (c *secureChannel) session() (uint32, bool) {
+	return c.sendID, c.active
+}
+
+func (c *secureChannel) authCodeLength() int {
+	switch c.suite.integrity {
+	case integrityHMACSHA196:
+		return 12
+	case integrityHMACMD5128, integrityHMACSHA256128:
+		return 16
+	}
+	return 0
+}
+
+func (c *secureChannel) authCode(data []byte) []byte {
+	switch c.suite.integrity {
+	case integrityHMACSHA196:
+		return hmacSum(sha1.New, c.keys.k1, data)[:12]
+	case integrityHMACMD5128:
+		return hmacSum(md5.New, c.keys.k1, data)[:16]
+	case integrityHMACSHA256128:
+		return hmacSum(sha256.New, c.keys.k1, data)[:16]
+	}
+	return nil
+}
+
+func (c *secureChannel) encrypt(payload []byte) ([]byte, error) {
+	block, err := aes.NewCipher(c.keys.k2[:aes.BlockSize])
+	if err != nil {
+		return nil, err
+	}
+	padLen := (aes.BlockSize - (len(payload)+1)%aes.BlockSize) % aes.BlockSize
+	plain := append([]byte{}, payload...)
+	for i := 1; i <= padLen; i++ {
+		plain = append(plain, byte(i))
+	}
+	plain = append(plain, byte(padLen))
+
+	out := make([]byte, aes.BlockSize+len(plain))
+	iv := out[:aes.BlockSize]
+	if _, err := io.ReadFull(ivSource, iv); err != nil {
+		return nil, err
+	}
+	cipher.NewCBCEncrypter(block, iv).CryptBlocks(out[aes.BlockSize:], plain)
+	return out, nil
+}
+
+func (c *secureChannel) decrypt(payload []byte) ([]byte, error) {
+	if len(payload) < 2*aes.BlockSize || len(payload)%aes.BlockSize != 0 {
+		return nil, errors.New("rmcp: invalid encrypted payload length")
+	}
+	block, err := aes.NewCipher(c.keys.k2[:aes.BlockSize])
+	if err != nil {
+		return nil, err
+	}
+	plain := make([]byte, len(payload)-aes.BlockSize)
+	cipher.NewCBCDecrypter(block, payload[:aes.BlockSize]).CryptBlocks(plain, payload[aes.BlockSize:])
+	padLen := int(plain[len(plain)-1])
+	if padLen >= aes.BlockSize || padLen+1 > len(plain) {
+		return nil, errors.New("rmcp: invalid confidentiality pad")
+	}
+	return plain[:len(plain)-padLen-1], nil
+}
+
+// seal builds RMCP+ packet carrying given payload.
+// Payloads are authenticated and encrypted only after session is activated.
+func (c *secureChannel) seal(payloadType byte, payload []byte) ([]byte, error) {
+	authenticated := c.active && c.suite.integrity != integrityNone
+	encrypted := c.active && c.suite.confidentiality != confidentialityNone
+
+	if encrypted {
+		var err error
+		if payload, err = c.encrypt(payload); err != nil {
+			return nil, err
+		}
+		payloadType |= payloadEncrypted
+	}
+	if authenticated {
+		payloadType |= payloadAuthenticated
+	}
+
+	var sessionID, seq uint32
+	if c.active {
+		c.seq++
+		sessionID, seq = c.sendID, c.seq
+	}
+
+	b := append(rmcpHeader(classIPMI), authTypeRMCPPlus, payloadType)
+	b = appendUint32(b, sessionID)
+	b = appendUint32(b, seq)
+	b = appendUint16(b, uint16(len(payload)))
+	b = append(b, payload...)
+	if authenticated {
+		// integrity pad aligns authenticated area (auth type .. next header) to 4 bytes
+		padLen := (4 - (len(b)-4+2)%4) % 4
+		for i := 0; i < padLen; i++ {
+			b = append(b, 0xff)
+		}
+		b = append(b, byte(padLen), nextHeader)
+		b = append(b, c.authCode(b[4:])...)
+	}
+	return b, nil
+}
+
+// open verifies and decodes received RMCP+ packet.
+func (c *secureChannel) open(b []byte) (byte, []byte, error) {
+	if len(b) < 16 || b[0] != rmcpVersion1 || b[3] != classIPMI {
+		return 0, nil, ErrShortPacket
+	}
+	if b[4] != authTypeRMCPPlus {
+		return 0, nil, fmt.Errorf("rmcp: unexpected authentication type 0x%02x", b[4])
+	}
+	payloadType := b[5]
+	length := int(getUint16(b[14:16]))
+	if len(b) < 16+length {
+		return 0, nil, ErrShortPacket
+	}
+	payload := b[16 : 16+length]
+
+	if payloadType&payloadAuthenticated != 0 {
+		n := c.authCodeLength()
+		if !c.active || n == 0 || len(b) < 16+length+2+n {
+			return 0, nil, errors.New("rmcp: unexpected authenticated packet")
+		}
+		end := len(b) - n
+		if !hmac.Equal(c.authCode(b[4:end]), b[end:]) {
+			return 0, nil, errors.New("rmcp: packet integrity check failed")
+		}
+	} else if c.active && c.suite.integrity != integrityNone {
+		return 0, nil, errors.New("rmcp: unauthenticated packet in authenticated session")
+	}
+
+	if c.active && getUint32(b[6:10]) != c.recvID {
+		return 0, nil, fmt.Errorf("rmcp: packet for unknown session 0x%08x", getUint32(b[6:10]))
+	}
+
+	if payloadType&payloadEncrypted != 0 {
+		if !c.active || c.suite.confidentiality == confidentialityNone {
+			return 0, nil, errors.New("rmcp: unexpected encrypted packet")
+		}
+		var err error
+		if payload, err = c.decrypt(payload); err != nil {
+			return 0, nil, err
+		}
+	}
+	if c.active && !c.recv.accept(getUint32(b[10:14]), seqBehind, seqAhead) {
+		return 0, nil, fmt.Errorf("rmcp: session sequence number %d replayed or out of window", getUint32(b[10:14]))
+	}
+	return payloadType & 0x3f, payload, nil
+}
+
+func openSessionRequest(tag byte, privilege byte, consoleID uint32, suite cipherSuite) []byte {
+	b := []byte{tag, privilege, 0x00, 0x00}
+	b = appendUint32(b, consoleID)
+	b = append(b, 0x00, 0x00, 0x00, 0x08, suite.auth, 0x00, 0x00, 0x00)
+	b = append(b, 0x01, 0x00, 0x00, 0x08, suite.integrity, 0x00, 0x00, 0x00)
+	b = append(b, 0x02, 0x00, 0x00, 0x08, suite.confidentiality, 0x00, 0x00, 0x00)
+	return b
+}
+
+// openLanPlus performs RMCP+ session establishment:
+// Open Session, RAKP 1-4 and Set Session Privilege Level.
+func (s *Session) openLanPlus(ctx context.Context) error {
+	suite, ok := cipherSuites[s.cfg.CipherSuite]
+	if !ok {
+		return fmt.Errorf("rmcp: unsupported cipher suite %d", s.cfg.CipherSuite)
+	}
+	c := &secureChannel{suite: suite}
+	s.channel = c
+
+	consoleID, err := randomSessionID()
+	if err != nil {
+		return err
+	}
+	c.recvID = consoleID
+
+	s.tag++
+	resp, err := s.handshake(ctx, payloadOpenSessionRequest,
+		openSessionRequest(s.tag, s.cfg.Privilege, consoleID, suite), payloadOpenSessionResponse)
+	if err != nil {
+		return err
+	}
+	if len(resp) < 2 {
+		return ErrShortPacket
+	}
+	if resp[1] != 0 {
+		return rakpError("open session", resp[1])
+	}
+	if len(resp) < 36 || getUint32(resp[4:8]) != consoleID {
+		return errors.New("rmcp: invalid open session response")
+	}
+	c.sendID = getUint32(resp[8:12])
+
+	// RAKP 1/2
+	rm := make([]byte, 16)
+	if _, err := rand.Read(rm); err != nil {
+		return err
+	}
+	role := s.cfg.Privilege | nameOnlyLookup
+	user := s.cfg.User
+	if len(user) > 16 {
+		return errors.New("rmcp: user name too long")
+	}
+	s.tag++
+	rakp1 := []byte{s.tag, 0x00, 0x00, 0x00}
+	rakp1 = appendUint32(rakp1, c.sendID)
+	rakp1 = append(rakp1, rm...)
+	rakp1 = append(rakp1, role, 0x00, 0x00, byte(len(user)))
+	rakp1 = append(rakp1, user...)
+	resp, err = s.handshake(ctx, payloadRAKP1, rakp1, payloadRAKP2)
+	if err != nil {
+		return err
+	}
+	if len(resp) < 2 {
+		return ErrShortPacket
+	}
+	if resp[1] != 0 {
+		return rakpError("RAKP 2", resp[1])
+	}
+	if len(resp) < 40 || getUint32(resp[4:8]) != consoleID {
+		return errors.New("rmcp: invalid RAKP 2 message")
+	}
+	rc := resp[8:24]
+	guid := resp[24:40]
+	kuid := passwordKey(s.cfg.Password)
+	ids := appendUint32(appendUint32(nil, consoleID), c.sendID)
+	if h := authHash(suite.auth); h != nil {
+		expected := hmacSum(h, kuid, ids, rm, rc, guid, []byte{role, byte(len(user))}, []byte(user))
+		if !hmac.Equal(expected, resp[40:]) {
+			return errors.New("rmcp: RAKP 2 authentication code mismatch (invalid password?)")
+		}
+	}
+	c.keys = deriveKeys(suite, kuid, rm, rc, role, user)
+
+	// RAKP 3/4
+	s.tag++
+	rakp3 := []byte{s.tag, 0x00, 0x00, 0x00}
+	rakp3 = appendUint32(rakp3, c.sendID)
+	if h := authHash(suite.auth); h != nil {
+		rakp3 = append(rakp3, hmacSum(h, kuid, rc, appendUint32(nil, consoleID), []byte{role, byte(len(user))}, []byte(user))...)
+	}
+	resp, err = s.handshake(ctx, payloadRAKP3, rakp3, payloadRAKP4)
+	if err != nil {
+		return err
+	}
+	if len(resp) < 2 {
+		return ErrShortPacket
+	}
+	if resp[1] != 0 {
+		return rakpError("RAKP 4", resp[1])
+	}
+	if len(resp) < 8 || getUint32(resp[4:8]) != consoleID {
+		return errors.New("rmcp: invalid RAKP 4 message")
+	}
+	if h := authHash(suite.auth); h != nil {
+		n := icvLength(suite.auth)
+		expected := hmacSum(h, c.keys.sik, rm, appendUint32(nil, c.sendID), guid)[:n]
+		if len(resp) < 8+n || !hmac.Equal(expected, resp[8:8+n]) {
+			return errors.New("rmcp: RAKP 4 integrity check value mismatch")
+		}
+	}
+
+	c.active = true
+	return nil
+}
+
+func randomSessionID() (uint32, error) {
+	b := make([]byte, 4)
+	for {
+		if _, err := rand.Read(b); err != nil {
+			return 0, err
+		}
+		if id := getUint32(b); id != 0 {
+			return id, nil
+		}
+	}
+}
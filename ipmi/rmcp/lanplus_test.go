@@ -0,0 +1,114 @@
+// +build unit
+
+/*
+http://www.apache.org/licenses/LICENSE-2.0.txt
+
+
+Copyright 2016 Intel Corporation
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Known-answer tests of RMCP+ key derivation and packet protection,
+// expected values are computed independently from IPMI 2.0 specification.
+
+package rmcp
+
+import (
+	"bytes"
+	"encoding/hex"
+	"io"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func unhex(s string) []byte {
+	b, err := hex.DecodeString(s)
+	if err != nil {
+		panic(err)
+	}
+	return b
+}
+
+func TestSecureChannel(t *testing.T) {
+	Convey("Check RMCP+ keys and packets", t, func() {
+		rm := unhex("000102030405060708090a0b0c0d0e0f")
+		rc := unhex("101112131415161718191a1b1c1d1e1f")
+		kuid := passwordKey("secret")
+
+		Convey("session keys are derived from SIK", func() {
+			keys := deriveKeys(cipherSuites[3], kuid, rm, rc, 0x14, "admin")
+			So(keys.sik, ShouldResemble, unhex("a39ae2b160a1e5efe017ffd6ec1a4ff8eeac6f54"))
+			So(keys.k1, ShouldResemble, unhex("58dbc1afa00eb3f9487c9eaef0dc7892cc43e496"))
+			So(keys.k2, ShouldResemble, unhex("8bd9b8ce0674b5d745ced91e728ac1a51464fcaf"))
+
+			keys = deriveKeys(cipherSuites[17], kuid, rm, rc, 0x14, "admin")
+			So(keys.sik, ShouldResemble, unhex("0c4b7464110cf18fd94ec46aa0242c66ab06157709c02ea7db1653aac04b1023"))
+			So(keys.k1, ShouldResemble, unhex("6156285b8edfe6df8bb994483a8a76c26b587a3fc6c0b5ec6b2d7ad1fb4f5d35"))
+			So(keys.k2, ShouldResemble, unhex("af7f7d6eea3e7abc029e14501226c23db32ca4c78ac2f2c384a28680b6648503"))
+		})
+
+		// Get Device ID sealed with HMAC-SHA1-96 and AES-CBC-128 (cipher suite 3)
+		message := unhex("2018c88104017a")
+		packet := unhex("0600ff0706c044332211010000002000a0a1a2a3a4a5a6a7a8a9aaabacadaeaf" +
+			"ca505e4a74a0a114557f7f19266bb49fffff0207ea03fa72486fd8828460efb7")
+		keys := deriveKeys(cipherSuites[3], kuid, rm, rc, 0x14, "admin")
+
+		Convey("payload is encrypted, padded and authenticated", func() {
+			defer func(r io.Reader) { ivSource = r }(ivSource)
+			ivSource = bytes.NewReader(unhex("a0a1a2a3a4a5a6a7a8a9aaabacadaeaf"))
+			c := &secureChannel{suite: cipherSuites[3], keys: keys, active: true, sendID: 0x11223344}
+			sealed, err := c.seal(payloadIPMI, message)
+			So(err, ShouldBeNil)
+			So(sealed, ShouldResemble, packet)
+		})
+
+		Convey("packet is verified, decrypted and replays are rejected", func() {
+			c := &secureChannel{suite: cipherSuites[3], keys: keys, active: true, recvID: 0x11223344}
+			payloadType, payload, err := c.open(packet)
+			So(err, ShouldBeNil)
+			So(payloadType, ShouldEqual, payloadIPMI)
+			So(payload, ShouldResemble, message)
+			_, _, err = c.open(packet)
+			So(err, ShouldNotBeNil)
+
+			damaged := append([]byte{}, packet...)
+			damaged[20] ^= 0x01
+			_, _, err = (&secureChannel{suite: cipherSuites[3], keys: keys, active: true, recvID: 0x11223344}).open(damaged)
+			So(err, ShouldNotBeNil)
+		})
+
+		Convey("sequence numbers are accepted once within window", func() {
+			w := &seqWindow{}
+			accept := func(seq uint32) bool { return w.accept(seq, seqBehind, seqAhead) }
+			So(accept(0), ShouldBeFalse)
+			So(accept(3), ShouldBeTrue)
+			So(accept(1), ShouldBeTrue)
+			So(accept(1), ShouldBeFalse)
+			So(accept(3), ShouldBeFalse)
+			So(accept(36), ShouldBeFalse)
+			So(accept(20), ShouldBeTrue)
+			So(accept(4), ShouldBeFalse)
+			So(accept(5), ShouldBeTrue)
+
+			// window follows sequence wrapping around
+			w = &seqWindow{last: 0xfffffffe}
+			So(accept(0xffffffff), ShouldBeTrue)
+			So(accept(1), ShouldBeTrue)
+			So(accept(0xffffffff), ShouldBeFalse)
+			So(accept(0xfffffffd), ShouldBeTrue)
+			So(w.accept(20, legacySeqBehind, legacySeqAhead), ShouldBeFalse)
+		})
+	})
+}
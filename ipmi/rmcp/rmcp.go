@@ -0,0 +1,278 @@
+// +build linux
+
+/*
+http://www.apache.org/licenses/LICENSE-2.0.txt
+
+
+Copyright 2016 Intel Corporation
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package rmcp implements IPMI over LAN (RMCP / RMCP+) sessions,
+// so that BMCs can be queried without spawning ipmitool for every request.
+package rmcp
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"time"
+)
+
+// DefaultPort is the standard RMCP port (ASF-RMCP primary port).
+const DefaultPort = 623
+
+// RMCP header constants
+const (
+	rmcpVersion1 = 0x06
+	rmcpNoAck    = 0xff
+	classASF     = 0x06
+	classIPMI    = 0x07
+)
+
+// IPMB addresses used in LAN messages
+const (
+	bmcSlaveAddr = 0x20
+	remoteSWID   = 0x81
+)
+
+// Privilege levels as defined by IPMI specification.
+const (
+	PrivilegeCallback      = 0x01
+	PrivilegeUser          = 0x02
+	PrivilegeOperator      = 0x03
+	PrivilegeAdministrator = 0x04
+)
+
+// Interface names, same as used by ipmitool -I option.
+const (
+	InterfaceLan     = "lan"
+	InterfaceLanPlus = "lanplus"
+)
+
+// Commands used internally for session management.
+const (
+	netFnApp                = 0x06
+	cmdSendMessage          = 0x34
+	cmdGetChannelAuthCaps   = 0x38
+	cmdGetSessionChallenge  = 0x39
+	cmdActivateSession      = 0x3a
+	cmdSetSessionPrivilege  = 0x3b
+	cmdCloseSession         = 0x3c
+	sendMessageTrackRequest = 0x40
+)
+
+var (
+	// ErrTimeout is returned when BMC did not answer in configured time.
+	ErrTimeout = errors.New("rmcp: timeout waiting for response")
+	// ErrChecksum is returned when received message has invalid checksum.
+	ErrChecksum = errors.New("rmcp: invalid message checksum")
+	// ErrShortPacket is returned when received packet is too short to be parsed.
+	ErrShortPacket = errors.New("rmcp: packet too short")
+)
+
+// Hop is single level of bridging, message is forwarded
+// on Channel to controller at Address.
+type Hop struct {
+	Channel byte
+	Address byte
+}
+
+// Request is a single IPMI command sent over session.
+// When Bridged is set command is encapsulated in Send Message
+// and forwarded to Target on Channel (equivalent of ipmitool -b/-t).
+// Transit lists controllers the command passes on its way to Target,
+// each of them gets own Send Message (ipmitool -B/-T for single hop).
+type Request struct {
+	NetFn   byte
+	Cmd     byte
+	Data    []byte
+	Bridged bool
+	Channel byte
+	Target  byte
+	Transit []Hop
+}
+
+// path returns all hops of bridged request, the last one is Target.
+func (req *Request) path() []Hop {
+	return append(append([]Hop{}, req.Transit...), Hop{Channel: req.Channel, Address: req.Target})
+}
+
+// Config holds session parameters.
+// Interface selects IPMI v2.0 (lanplus) or v1.5 (lan) session.
+// CipherSuite is used by lanplus sessions only.
+// Timeout is applied to every packet exchange, Retries specifies
+// how many times packet is resent before giving up.
+type Config struct {
+	Interface   string
+	User        string
+	Password    string
+	Privilege   byte
+	CipherSuite int
+	Timeout     time.Duration
+	Retries     int
+}
+
+func (cfg *Config) setDefaults() {
+	if cfg.Privilege == 0 {
+		cfg.Privilege = PrivilegeAdministrator
+	}
+	if cfg.Timeout == 0 {
+		cfg.Timeout = 2 * time.Second
+	}
+	if cfg.Retries == 0 {
+		cfg.Retries = 2
+	}
+}
+
+// JoinHostPort appends default RMCP port to addr when it has no port specified.
+func JoinHostPort(addr string) string {
+	if _, _, err := net.SplitHostPort(addr); err == nil {
+		return addr
+	}
+	return net.JoinHostPort(addr, strconv.Itoa(DefaultPort))
+}
+
+func checksum(data []byte) byte {
+	var sum byte
+	for _, b := range data {
+		sum += b
+	}
+	return -sum
+}
+
+func appendUint16(b []byte, v uint16) []byte {
+	return append(b, byte(v), byte(v>>8))
+}
+
+func appendUint32(b []byte, v uint32) []byte {
+	return append(b, byte(v), byte(v>>8), byte(v>>16), byte(v>>24))
+}
+
+func rmcpHeader(class byte) []byte {
+	return []byte{rmcpVersion1, 0x00, rmcpNoAck, class}
+}
+
+// message is IPMB formatted LAN message.
+// For requests rsAddr is the responder (BMC) and rqAddr the remote console,
+// for responses their meaning is swapped.
+type message struct {
+	rsAddr byte
+	netFn  byte
+	rsLUN  byte
+	rqAddr byte
+	rqSeq  byte
+	rqLUN  byte
+	cmd    byte
+	data   []byte
+}
+
+func (m *message) marshal() []byte {
+	b := []byte{m.rsAddr, m.netFn<<2 | m.rsLUN&0x3}
+	b = append(b, checksum(b))
+	body := []byte{m.rqAddr, m.rqSeq<<2 | m.rqLUN&0x3, m.cmd}
+	body = append(body, m.data...)
+	b = append(b, body...)
+	return append(b, checksum(body))
+}
+
+func unmarshalMessage(b []byte) (*message, error) {
+	if len(b) < 7 {
+		return nil, ErrShortPacket
+	}
+	if checksum(b[:2]) != b[2] || checksum(b[3:len(b)-1]) != b[len(b)-1] {
+		return nil, ErrChecksum
+	}
+	m := &message{
+		rsAddr: b[0],
+		netFn:  b[1] >> 2,
+		rsLUN:  b[1] & 0x3,
+		rqAddr: b[3],
+		rqSeq:  b[4] >> 2,
+		rqLUN:  b[4] & 0x3,
+		cmd:    b[5],
+	}
+	m.data = append([]byte{}, b[6:len(b)-1]...)
+	return m, nil
+}
+
+// encapsulate wraps request in Send Message command addressed to BMC,
+// nested in one more Send Message for every transit hop. Every embedded
+// message is sent by controller of previous hop. Response to embedded
+// request is tracked by forwarding controllers (track request bit).
+func encapsulate(req Request, seq byte) *message {
+	hops := req.path()
+	sender := func(i int) byte {
+		if i == 0 {
+			return bmcSlaveAddr
+		}
+		return hops[i-1].Address
+	}
+	last := len(hops) - 1
+	m := &message{
+		rsAddr: hops[last].Address,
+		netFn:  req.NetFn,
+		rqAddr: sender(last),
+		rqSeq:  seq,
+		cmd:    req.Cmd,
+		data:   req.Data,
+	}
+	for i := last; i >= 0; i-- {
+		rsAddr, rqAddr := byte(bmcSlaveAddr), byte(remoteSWID)
+		if i > 0 {
+			rsAddr, rqAddr = hops[i-1].Address, sender(i-1)
+		}
+		data := append([]byte{hops[i].Channel&0x0f | sendMessageTrackRequest}, m.marshal()...)
+		m = &message{
+			rsAddr: rsAddr,
+			netFn:  netFnApp,
+			rqAddr: rqAddr,
+			rqSeq:  seq,
+			cmd:    cmdSendMessage,
+			data:   data,
+		}
+	}
+	return m
+}
+
+// decapsulate extracts embedded response from depth nested Send Message responses.
+// Returns nil when response contains only successful completion code of Send Message,
+// in which case BMC delivers bridged response in a separate packet.
+// Failed Send Message completion code is returned as response.
+func decapsulate(m *message, depth int) ([]byte, error) {
+	for ; depth > 0; depth-- {
+		switch {
+		case len(m.data) == 0 || len(m.data) == 1 && m.data[0] == 0:
+			return nil, nil
+		case m.data[0] != 0:
+			return m.data[:1], nil
+		}
+		inner, err := unmarshalMessage(m.data[1:])
+		if err != nil {
+			return nil, fmt.Errorf("rmcp: invalid bridged response: %v", err)
+		}
+		m = inner
+	}
+	return m.data, nil
+}
+
+func getUint32(b []byte) uint32 {
+	return binary.LittleEndian.Uint32(b)
+}
+
+func getUint16(b []byte) uint16 {
+	return binary.LittleEndian.Uint16(b)
+}
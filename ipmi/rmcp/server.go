@@ -0,0 +1,540 @@
+// +build linux
+
+/*
+http://www.apache.org/licenses/LICENSE-2.0.txt
+
+
+Copyright 2016 Intel Corporation
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package rmcp
+
+import (
+	"crypto/hmac"
+	"net"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Handler answers IPMI requests received by Server.
+// Request starts with network function and command followed by data,
+// returned response starts with completion code.
+type Handler interface {
+	Handle(request []byte) []byte
+}
+
+// AddressHandler is Handler answering requests of controllers other
+// than BMC, it is given slave address request is sent to.
+type AddressHandler interface {
+	HandleAddress(address byte, request []byte) []byte
+}
+
+// HandlerFunc allows use of ordinary function as Handler.
+type HandlerFunc func(request []byte) []byte
+
+// Handle calls f(request).
+func (f HandlerFunc) Handle(request []byte) []byte {
+	return f(request)
+}
+
+// serverSessionTimeout is time after which idle sessions are dropped.
+const serverSessionTimeout = time.Minute
+
+// ASF presence ping and pong message types
+const (
+	asfPresencePing = 0x80
+	asfPresencePong = 0x40
+)
+
+var asfIANA = []byte{0x00, 0x00, 0x11, 0xbe}
+
+// Commands answered by Server outside of session.
+const cmdGetChannelCipherSuites = 0x54
+
+// Server is BMC side of IPMI LAN: it answers ASF presence ping, IPMI v1.5
+// (lan) and RMCP+ (lanplus) sessions authenticated with User and Password,
+// and passes session requests to Handler. Requests bridged with Send Message
+// are unwrapped and answered by Handler as well. Server allows testing LAN
+// code paths (native sessions or ipmitool) against local UDP port.
+type Server struct {
+	User     string
+	Password string
+	Handler  Handler
+
+	conn       net.PacketConn
+	mutex      sync.Mutex
+	sessions   map[uint32]*serverSession
+	handshakes int
+}
+
+// serverSession holds state of single session, activated or in setup.
+type serverSession struct {
+	channel  framer
+	lastSeen time.Time
+
+	// IPMI v1.5 Get Session Challenge state
+	challenge []byte
+
+	// RAKP state
+	rm, rc []byte
+	role   byte
+}
+
+// ListenAndServe listens on UDP addr and serves incoming packets.
+func (srv *Server) ListenAndServe(addr string) error {
+	conn, err := net.ListenPacket("udp", addr)
+	if err != nil {
+		return err
+	}
+	return srv.Serve(conn)
+}
+
+// Serve answers packets received on conn until it is closed.
+func (srv *Server) Serve(conn net.PacketConn) error {
+	srv.mutex.Lock()
+	srv.conn = conn
+	if srv.sessions == nil {
+		srv.sessions = map[uint32]*serverSession{}
+	}
+	srv.mutex.Unlock()
+
+	buf := make([]byte, 1024)
+	for {
+		n, addr, err := conn.ReadFrom(buf)
+		if err != nil {
+			return err
+		}
+		if n < 5 || buf[0] != rmcpVersion1 {
+			continue
+		}
+		srv.mutex.Lock()
+		switch {
+		case buf[3] == classASF:
+			srv.handlePing(addr, buf[:n])
+		case buf[3] == classIPMI && buf[4] == authTypeRMCPPlus:
+			srv.handleLanPlus(addr, buf[:n])
+		case buf[3] == classIPMI:
+			srv.handleLan(addr, buf[:n])
+		}
+		srv.mutex.Unlock()
+	}
+}
+
+// Close stops serving and closes listening connection.
+func (srv *Server) Close() error {
+	srv.mutex.Lock()
+	defer srv.mutex.Unlock()
+	if srv.conn == nil {
+		return nil
+	}
+	return srv.conn.Close()
+}
+
+// Addr returns address server is listening on.
+func (srv *Server) Addr() net.Addr {
+	srv.mutex.Lock()
+	defer srv.mutex.Unlock()
+	if srv.conn == nil {
+		return nil
+	}
+	return srv.conn.LocalAddr()
+}
+
+func (srv *Server) send(addr net.Addr, channel framer, payloadType byte, payload []byte) {
+	if packet, err := channel.seal(payloadType, payload); err == nil {
+		srv.conn.WriteTo(packet, addr)
+	}
+}
+
+// newSession registers session setup with channel and returns its ID.
+// Idle sessions are dropped on occasion.
+func (srv *Server) newSession(channel framer) (uint32, *serverSession, error) {
+	now := time.Now()
+	for id, s := range srv.sessions {
+		if now.Sub(s.lastSeen) > serverSessionTimeout {
+			delete(srv.sessions, id)
+		}
+	}
+	id, err := randomSessionID()
+	if err != nil {
+		return 0, nil, err
+	}
+	s := &serverSession{channel: channel, lastSeen: now}
+	srv.sessions[id] = s
+	return id, s, nil
+}
+
+func (srv *Server) handlePing(addr net.Addr, packet []byte) {
+	if len(packet) < 12 || packet[8] != asfPresencePing {
+		return
+	}
+	pong := append(rmcpHeader(classASF), asfIANA...)
+	pong = append(pong, asfPresencePong, packet[9], 0x00, 0x10)
+	pong = append(pong, asfIANA...)
+	pong = append(pong, 0x00, 0x00, 0x00, 0x00, 0x81, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00)
+	srv.conn.WriteTo(pong, addr)
+}
+
+// handleLan serves IPMI v1.5 packets: session setup outside of session
+// and requests within activated sessions.
+func (srv *Server) handleLan(addr net.Addr, packet []byte) {
+	if len(packet) < 14 {
+		return
+	}
+	sessionID := getUint32(packet[9:13])
+	s := srv.sessions[sessionID]
+	channel := &legacyChannel{}
+	if s != nil {
+		channel = s.channel.(*legacyChannel)
+	} else if sessionID != 0 {
+		return
+	}
+	_, p, err := channel.open(packet)
+	if err != nil {
+		return
+	}
+	m, err := unmarshalMessage(p)
+	if err != nil {
+		return
+	}
+	send := func(r *message) {
+		srv.send(addr, channel, payloadIPMI, r.marshal())
+	}
+
+	switch {
+	case s == nil && m.netFn == netFnApp && m.cmd == cmdGetChannelAuthCaps:
+		// MD5 and straight password (none only without password),
+		// non-null user names, both IPMI v1.5 and v2.0 connections
+		supported := byte(1<<authTypeMD5 | 1<<authTypePassword)
+		if srv.Password == "" {
+			supported |= 1 << authTypeNone
+		}
+		if len(m.data) > 0 && m.data[0]&0x80 != 0 {
+			supported |= 0x80
+		}
+		respond(m, []byte{0x00, 0x01, supported, 0x04, 0x03, 0x00, 0x00, 0x00, 0x00}, send)
+	case s == nil && m.netFn == netFnApp && m.cmd == cmdGetChannelCipherSuites:
+		respond(m, channelCipherSuites(m.data), send)
+	case s == nil && m.netFn == netFnApp && m.cmd == cmdGetSessionChallenge:
+		if len(m.data) < 17 || trimUser(m.data[1:17]) != srv.User {
+			respond(m, []byte{0x81}, send)
+			return
+		}
+		if !srv.legacyAuthType(m.data[0]) {
+			respond(m, []byte{0xcc}, send)
+			return
+		}
+		legacy := &legacyChannel{authType: m.data[0], password: make([]byte, legacyPasswordSize)}
+		copy(legacy.password, srv.Password)
+		id, ns, err := srv.newSession(legacy)
+		if err != nil {
+			respond(m, []byte{0xff}, send)
+			return
+		}
+		ns.challenge = make([]byte, 16)
+		if rnd, err := randomSessionID(); err == nil {
+			copy(ns.challenge, appendUint32(appendUint32(nil, rnd), id))
+		}
+		respond(m, append(appendUint32([]byte{0x00}, id), ns.challenge...), send)
+	case s != nil && !channel.active:
+		s.lastSeen = time.Now()
+		if m.netFn != netFnApp || m.cmd != cmdActivateSession || len(m.data) < 22 {
+			return
+		}
+		// Activate Session is authenticated with temporary session ID and sequence 0,
+		// using authentication type requested with Get Session Challenge
+		code := channel.authCode(sessionID, 0, p)
+		if packet[4] != channel.authType || m.data[0] != channel.authType || len(packet) < 13+len(code) || !hmac.Equal(code, packet[13:13+len(code)]) || !hmac.Equal(m.data[2:18], s.challenge) {
+			respond(m, []byte{0x86}, send)
+			return
+		}
+		resp := appendUint32([]byte{0x00, channel.authType}, sessionID)
+		resp = appendUint32(resp, 1)
+		respond(m, append(resp, m.data[1]), send)
+		channel.sessionID = sessionID
+		channel.seq = getUint32(m.data[18:22])
+		channel.active = true
+		srv.handshakes++
+	case s != nil:
+		s.lastSeen = time.Now()
+		srv.dispatch(m, send)
+		if m.netFn == netFnApp && m.cmd == cmdCloseSession {
+			delete(srv.sessions, sessionID)
+		}
+	}
+}
+
+// legacyAuthType tells whether IPMI v1.5 session may use authentication type,
+// sessions without authentication are allowed only when Password is empty.
+func (srv *Server) legacyAuthType(authType byte) bool {
+	switch authType {
+	case authTypeMD5, authTypePassword:
+		return true
+	case authTypeNone:
+		return srv.Password == ""
+	}
+	return false
+}
+
+// handleLanPlus serves RMCP+ session setup (Open Session and RAKP)
+// and requests within activated sessions.
+func (srv *Server) handleLanPlus(addr net.Addr, packet []byte) {
+	if len(packet) < 16 {
+		return
+	}
+	if sessionID := getUint32(packet[6:10]); sessionID != 0 {
+		s := srv.sessions[sessionID]
+		if s == nil {
+			return
+		}
+		channel, ok := s.channel.(*secureChannel)
+		if !ok || !channel.active {
+			return
+		}
+		payloadType, p, err := channel.open(packet)
+		if err != nil || payloadType != payloadIPMI {
+			return
+		}
+		m, err := unmarshalMessage(p)
+		if err != nil {
+			return
+		}
+		s.lastSeen = time.Now()
+		srv.dispatch(m, func(r *message) {
+			srv.send(addr, channel, payloadIPMI, r.marshal())
+		})
+		if m.netFn == netFnApp && m.cmd == cmdCloseSession {
+			delete(srv.sessions, sessionID)
+		}
+		return
+	}
+
+	payloadType, p, err := (&secureChannel{}).open(packet)
+	if err != nil || len(p) < 8 {
+		return
+	}
+	switch payloadType {
+	case payloadOpenSessionRequest:
+		srv.openSession(addr, p)
+	case payloadRAKP1:
+		srv.rakp1(addr, p)
+	case payloadRAKP3:
+		srv.rakp3(addr, p)
+	}
+}
+
+func (srv *Server) openSession(addr net.Addr, p []byte) {
+	if len(p) < 32 {
+		return
+	}
+	consoleID := getUint32(p[4:8])
+	suite := cipherSuite{p[12], p[20], p[28]}
+	supported := false
+	for _, s := range cipherSuites {
+		supported = supported || s == suite
+	}
+	if !supported {
+		srv.send(addr, &secureChannel{}, payloadOpenSessionResponse, []byte{p[0], 0x11, 0x00, 0x00})
+		return
+	}
+	channel := &secureChannel{suite: suite, sendID: consoleID}
+	id, _, err := srv.newSession(channel)
+	if err != nil {
+		srv.send(addr, &secureChannel{}, payloadOpenSessionResponse, []byte{p[0], 0x01, 0x00, 0x00})
+		return
+	}
+	channel.recvID = id
+	privilege := p[1]
+	if privilege == 0 {
+		privilege = PrivilegeAdministrator
+	}
+	resp := []byte{p[0], 0x00, privilege, 0x00}
+	resp = appendUint32(resp, consoleID)
+	resp = appendUint32(resp, id)
+	resp = append(resp, p[8:32]...)
+	srv.send(addr, channel, payloadOpenSessionResponse, resp)
+}
+
+func (srv *Server) rakp1(addr net.Addr, p []byte) {
+	s := srv.sessions[getUint32(p[4:8])]
+	if s == nil || len(p) < 28 || len(p) < 28+int(p[27]) {
+		srv.send(addr, &secureChannel{}, payloadRAKP2, []byte{p[0], 0x02, 0x00, 0x00})
+		return
+	}
+	channel, ok := s.channel.(*secureChannel)
+	if !ok || channel.active {
+		return
+	}
+	s.lastSeen = time.Now()
+	s.rm = append([]byte{}, p[8:24]...)
+	s.role = p[24]
+	user := string(p[28 : 28+int(p[27])])
+	if user != srv.User {
+		srv.send(addr, channel, payloadRAKP2, []byte{p[0], 0x0d, 0x00, 0x00})
+		return
+	}
+	s.rc = make([]byte, 16)
+	if rnd, err := randomSessionID(); err == nil {
+		copy(s.rc, appendUint32(appendUint32(nil, rnd), channel.recvID))
+	}
+	resp := []byte{p[0], 0x00, 0x00, 0x00}
+	resp = appendUint32(resp, channel.sendID)
+	resp = append(resp, s.rc...)
+	resp = append(resp, serverGUID...)
+	if h := authHash(channel.suite.auth); h != nil {
+		ids := appendUint32(appendUint32(nil, channel.sendID), channel.recvID)
+		resp = append(resp, hmacSum(h, passwordKey(srv.Password), ids, s.rm, s.rc, serverGUID,
+			[]byte{s.role, byte(len(user))}, []byte(user))...)
+	}
+	srv.send(addr, channel, payloadRAKP2, resp)
+}
+
+func (srv *Server) rakp3(addr net.Addr, p []byte) {
+	s := srv.sessions[getUint32(p[4:8])]
+	if s == nil || s.rc == nil {
+		srv.send(addr, &secureChannel{}, payloadRAKP4, []byte{p[0], 0x02, 0x00, 0x00})
+		return
+	}
+	channel, ok := s.channel.(*secureChannel)
+	if !ok || channel.active {
+		return
+	}
+	s.lastSeen = time.Now()
+	suite := channel.suite
+	kuid := passwordKey(srv.Password)
+	if h := authHash(suite.auth); h != nil {
+		expected := hmacSum(h, kuid, s.rc, appendUint32(nil, channel.sendID), []byte{s.role, byte(len(srv.User))}, []byte(srv.User))
+		if !hmac.Equal(expected, p[8:]) {
+			srv.send(addr, channel, payloadRAKP4, []byte{p[0], 0x0f, 0x00, 0x00})
+			return
+		}
+	}
+	channel.keys = deriveKeys(suite, kuid, s.rm, s.rc, s.role, srv.User)
+	resp := []byte{p[0], 0x00, 0x00, 0x00}
+	resp = appendUint32(resp, channel.sendID)
+	if h := authHash(suite.auth); h != nil {
+		resp = append(resp, hmacSum(h, channel.keys.sik, s.rm, appendUint32(nil, channel.recvID), serverGUID)[:icvLength(suite.auth)]...)
+	}
+	srv.send(addr, channel, payloadRAKP4, resp)
+	channel.active = true
+	srv.handshakes++
+}
+
+// serverGUID is system GUID reported in RAKP 2.
+var serverGUID = []byte{0x49, 0x6e, 0x74, 0x65, 0x6c, 0x20, 0x44, 0x43, 0x4d, 0x20, 0x42, 0x4d, 0x43, 0x00, 0x00, 0x01}
+
+// respond sends response to request m with given data.
+func respond(m *message, data []byte, send func(*message)) {
+	send(&message{rsAddr: m.rqAddr, netFn: m.netFn + 1, rqAddr: m.rsAddr, rqSeq: m.rqSeq, rqLUN: m.rsLUN,
+		rsLUN: m.rqLUN, cmd: m.cmd, data: data})
+}
+
+// dispatch answers session management commands and passes
+// other requests, including bridged ones, to Handler.
+func (srv *Server) dispatch(m *message, send func(*message)) {
+	switch {
+	case m.netFn == netFnApp && m.cmd == cmdSetSessionPrivilege:
+		privilege := byte(PrivilegeAdministrator)
+		if len(m.data) > 0 && m.data[0]&0x0f != 0 {
+			privilege = m.data[0] & 0x0f
+		}
+		respond(m, []byte{0x00, privilege}, send)
+	case m.netFn == netFnApp && m.cmd == cmdCloseSession:
+		respond(m, []byte{0x00}, send)
+	case m.netFn == netFnApp && m.cmd == cmdSendMessage:
+		resp := srv.bridge(m)
+		if resp[0] == 0 {
+			respond(m, []byte{0x00}, send)
+		}
+		respond(m, resp, send)
+	default:
+		respond(m, srv.handle(m), send)
+	}
+}
+
+// bridge returns Send Message response with embedded response of bridged request.
+// Nested Send Message requests are bridged recursively.
+func (srv *Server) bridge(m *message) []byte {
+	if len(m.data) < 2 {
+		return []byte{0xc7}
+	}
+	inner, err := unmarshalMessage(m.data[1:])
+	if err != nil {
+		return []byte{0xcc}
+	}
+	var data []byte
+	if inner.netFn == netFnApp && inner.cmd == cmdSendMessage {
+		data = srv.bridge(inner)
+	} else {
+		data = srv.handle(inner)
+	}
+	embedded := &message{rsAddr: inner.rqAddr, netFn: inner.netFn + 1, rqAddr: inner.rsAddr,
+		rqSeq: inner.rqSeq, rqLUN: inner.rsLUN, rsLUN: inner.rqLUN, cmd: inner.cmd, data: data}
+	return append([]byte{0x00}, embedded.marshal()...)
+}
+
+func (srv *Server) handle(m *message) []byte {
+	if srv.Handler == nil {
+		return []byte{0xc1}
+	}
+	var resp []byte
+	if h, ok := srv.Handler.(AddressHandler); ok {
+		resp = h.HandleAddress(m.rsAddr, append([]byte{m.netFn, m.cmd}, m.data...))
+	} else {
+		resp = srv.Handler.Handle(append([]byte{m.netFn, m.cmd}, m.data...))
+	}
+	if len(resp) == 0 {
+		return []byte{0xff}
+	}
+	return resp
+}
+
+// channelCipherSuites answers Get Channel Cipher Suites with records
+// of all supported suites, 16 bytes per list index.
+func channelCipherSuites(data []byte) []byte {
+	if len(data) < 3 {
+		return []byte{0xc7}
+	}
+	ids := make([]int, 0, len(cipherSuites))
+	for id := range cipherSuites {
+		ids = append(ids, id)
+	}
+	sort.Ints(ids)
+	var records []byte
+	for _, id := range ids {
+		s := cipherSuites[id]
+		records = append(records, 0xc0, byte(id), s.auth, 0x40|s.integrity, 0x80|s.confidentiality)
+	}
+	start := int(data[2]&0x3f) * 16
+	if start > len(records) {
+		start = len(records)
+	}
+	end := start + 16
+	if end > len(records) {
+		end = len(records)
+	}
+	return append([]byte{0x00, 0x01}, records[start:end]...)
+}
+
+// trimUser returns user name from zero padded field.
+func trimUser(b []byte) string {
+	for i, c := range b {
+		if c == 0 {
+			return string(b[:i])
+		}
+	}
+	return string(b)
+}
@@ -0,0 +1,279 @@
+// +build linux
+
+/*
+http://www.apache.org/licenses/LICENSE-2.0.txt
+
+
+Copyright 2016 Intel Corporation
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package rmcp
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+)
+
+// framer builds and parses session packets of given IPMI LAN version.
+// session returns ID of established session used in Close Session command.
+type framer interface {
+	seal(payloadType byte, payload []byte) ([]byte, error)
+	open(packet []byte) (byte, []byte, error)
+	session() (uint32, bool)
+}
+
+// Session is an authenticated IPMI LAN session with single BMC.
+// Session is safe for concurrent use, requests are serialized.
+// Session left unanswered is dropped and opened again by next request.
+type Session struct {
+	addr    string
+	cfg     Config
+	conn    net.Conn
+	channel framer
+	tag     byte
+	rqSeq   byte
+	mutex   sync.Mutex
+}
+
+// Dial opens session with BMC at addr. Depending on cfg.Interface
+// RMCP+ (IPMI v2.0 lanplus, default) or IPMI v1.5 lan session is used.
+func Dial(addr string, cfg Config) (*Session, error) {
+	return DialContext(context.Background(), addr, cfg)
+}
+
+// DialContext opens session with BMC at addr, session setup is
+// abandoned when context is done.
+func DialContext(ctx context.Context, addr string, cfg Config) (*Session, error) {
+	cfg.setDefaults()
+	s := &Session{addr: JoinHostPort(addr), cfg: cfg}
+	if err := s.open(ctx); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *Session) open(ctx context.Context) error {
+	conn, err := net.Dial("udp", s.addr)
+	if err != nil {
+		return err
+	}
+	s.conn = conn
+	if s.cfg.Interface == InterfaceLan {
+		err = s.openLan(ctx)
+	} else {
+		err = s.openLanPlus(ctx)
+	}
+	if err != nil {
+		s.conn.Close()
+		s.conn = nil
+		return err
+	}
+	resp, err := s.exec(ctx, Request{NetFn: netFnApp, Cmd: cmdSetSessionPrivilege, Data: []byte{s.cfg.Privilege}})
+	if err == nil && len(resp) > 0 && resp[0] != 0 {
+		err = fmt.Errorf("rmcp: set session privilege level failed with completion code 0x%02x", resp[0])
+	}
+	if err != nil {
+		s.conn.Close()
+		s.conn = nil
+		return err
+	}
+	return nil
+}
+
+// Exec sends request and returns response data.
+// First byte of returned data is completion code.
+func (s *Session) Exec(req Request) ([]byte, error) {
+	return s.ExecContext(context.Background(), req)
+}
+
+// ExecContext sends request and returns response data. Waiting for response
+// is limited by context deadline, context error is returned when it is done.
+// ErrTimeout is returned when request is left unanswered, it is not sent
+// again in new session as BMC could have executed it already.
+func (s *Session) ExecContext(ctx context.Context, req Request) ([]byte, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.conn == nil {
+		if err := s.open(ctx); err != nil {
+			return nil, err
+		}
+	}
+	resp, err := s.exec(ctx, req)
+	if err == ErrTimeout {
+		// BMC could have closed idle session or be gone, session
+		// is not closed on BMC and next request opens new one
+		s.release()
+	}
+	return resp, err
+}
+
+// Close closes session on BMC and releases connection.
+func (s *Session) Close() error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.close()
+}
+
+func (s *Session) close() error {
+	if s.conn == nil {
+		return nil
+	}
+	if s.channel != nil {
+		if id, ok := s.channel.session(); ok {
+			s.exec(context.Background(), Request{NetFn: netFnApp, Cmd: cmdCloseSession, Data: appendUint32(nil, id)})
+		}
+	}
+	return s.release()
+}
+
+// release closes connection without closing session on BMC.
+func (s *Session) release() error {
+	err := s.conn.Close()
+	s.conn = nil
+	s.channel = nil
+	return err
+}
+
+func (s *Session) exec(ctx context.Context, req Request) ([]byte, error) {
+	s.rqSeq = (s.rqSeq + 1) & 0x3f
+	seq := s.rqSeq
+
+	var m *message
+	if req.Bridged {
+		m = encapsulate(req, seq)
+	} else {
+		m = &message{rsAddr: bmcSlaveAddr, netFn: req.NetFn, rqAddr: remoteSWID, rqSeq: seq, cmd: req.Cmd, data: req.Data}
+	}
+	body := m.marshal()
+
+	for attempt := 0; attempt <= s.cfg.Retries; attempt++ {
+		if err := contextErr(ctx); err != nil {
+			return nil, err
+		}
+		packet, err := s.channel.seal(payloadIPMI, body)
+		if err != nil {
+			return nil, err
+		}
+		if _, err := s.conn.Write(packet); err != nil {
+			return nil, err
+		}
+		resp, err := s.readResponse(ctx, req, seq)
+		if err == ErrTimeout {
+			continue
+		}
+		return resp, err
+	}
+	if err := contextErr(ctx); err != nil {
+		return nil, err
+	}
+	return nil, ErrTimeout
+}
+
+// contextErr returns context error. context.DeadlineExceeded is returned
+// as soon as deadline passes, even before context is cancelled.
+func contextErr(ctx context.Context) error {
+	if d, ok := ctx.Deadline(); ok && !time.Now().Before(d) {
+		return context.DeadlineExceeded
+	}
+	return ctx.Err()
+}
+
+// readResponse waits for response matching request sequence number.
+// Bridged responses may arrive in second packet following Send Message response.
+func (s *Session) readResponse(ctx context.Context, req Request, seq byte) ([]byte, error) {
+	deadline := time.Now().Add(s.cfg.Timeout)
+	if d, ok := ctx.Deadline(); ok && d.Before(deadline) {
+		deadline = d
+	}
+	buf := make([]byte, 1024)
+	for {
+		s.conn.SetReadDeadline(deadline)
+		n, err := s.conn.Read(buf)
+		if err != nil {
+			if ne, ok := err.(net.Error); ok && ne.Timeout() {
+				return nil, ErrTimeout
+			}
+			return nil, err
+		}
+		payloadType, payload, err := s.channel.open(buf[:n])
+		if err != nil || payloadType != payloadIPMI {
+			continue
+		}
+		m, err := unmarshalMessage(payload)
+		if err != nil || m.rqSeq != seq {
+			continue
+		}
+		if req.Bridged && m.cmd == cmdSendMessage {
+			data, err := decapsulate(m, len(req.path()))
+			if err != nil {
+				return nil, err
+			}
+			if data == nil {
+				continue
+			}
+			return data, nil
+		}
+		if m.cmd != req.Cmd {
+			continue
+		}
+		return m.data, nil
+	}
+}
+
+// handshake exchanges session setup payloads, retrying on timeout.
+// Context error is returned when it is done.
+func (s *Session) handshake(ctx context.Context, reqType byte, payload []byte, respType byte) ([]byte, error) {
+	buf := make([]byte, 1024)
+	for attempt := 0; attempt <= s.cfg.Retries; attempt++ {
+		if err := contextErr(ctx); err != nil {
+			return nil, err
+		}
+		packet, err := s.channel.seal(reqType, payload)
+		if err != nil {
+			return nil, err
+		}
+		if _, err := s.conn.Write(packet); err != nil {
+			return nil, err
+		}
+		deadline := time.Now().Add(s.cfg.Timeout)
+		if d, ok := ctx.Deadline(); ok && d.Before(deadline) {
+			deadline = d
+		}
+		for {
+			s.conn.SetReadDeadline(deadline)
+			n, err := s.conn.Read(buf)
+			if err != nil {
+				if ne, ok := err.(net.Error); ok && ne.Timeout() {
+					break
+				}
+				return nil, err
+			}
+			payloadType, resp, err := s.channel.open(buf[:n])
+			if err != nil || payloadType != respType || len(resp) < 1 || resp[0] != payload[0] {
+				continue
+			}
+			return append([]byte{}, resp...), nil
+		}
+	}
+	if err := contextErr(ctx); err != nil {
+		return nil, err
+	}
+	return nil, errors.New("rmcp: no response from BMC during session setup")
+}
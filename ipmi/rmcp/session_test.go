@@ -0,0 +1,250 @@
+// +build unit
+
+/*
+http://www.apache.org/licenses/LICENSE-2.0.txt
+
+
+Copyright 2016 Intel Corporation
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Tests for RMCP+ and IPMI v1.5 sessions against local Server
+
+package rmcp
+
+import (
+	"context"
+	"net"
+	"strconv"
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+// newTestServer starts Server on local UDP port. Handler answers Get Device ID
+// and echoes fourth byte of Node Manager requests.
+func newTestServer(user, password string) *Server {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		panic(err)
+	}
+	srv := &Server{User: user, Password: password, Handler: HandlerFunc(func(r []byte) []byte {
+		switch {
+		case r[0] == 0x06 && r[1] == 0x01:
+			return []byte{0x00, 0x20, 0x81, 0x02, 0x10, 0x02, 0xbf, 0x57, 0x01, 0x00, 0x4b, 0x00}
+		case r[0] == 0x2e && len(r) > 5:
+			return []byte{0x00, 0x57, 0x01, 0x00, r[5]}
+		}
+		return []byte{0xc1}
+	})}
+	go srv.Serve(conn)
+	for srv.Addr() == nil {
+		time.Sleep(time.Millisecond)
+	}
+	return srv
+}
+
+func (srv *Server) handshakeCount() int {
+	srv.mutex.Lock()
+	defer srv.mutex.Unlock()
+	return srv.handshakes
+}
+
+func TestSession(t *testing.T) {
+	Convey("Check RMCP+ session against local Server", t, func() {
+		bmc := newTestServer("admin", "secret")
+		defer bmc.Close()
+		addr := bmc.Addr().String()
+		cfg := Config{User: "admin", Password: "secret", Timeout: 200 * time.Millisecond, Retries: 1}
+
+		Convey("session is established and reused for multiple requests", func() {
+			for _, suite := range []int{0, 2, 3, 17} {
+				cfg.CipherSuite = suite
+				s, err := Dial(addr, cfg)
+				So(err, ShouldBeNil)
+				for i := 0; i < 3; i++ {
+					resp, err := s.Exec(Request{NetFn: 0x06, Cmd: 0x01})
+					So(err, ShouldBeNil)
+					So(len(resp), ShouldEqual, 12)
+					So(resp[0], ShouldEqual, 0)
+					So(resp[1], ShouldEqual, 0x20)
+				}
+				So(s.Close(), ShouldBeNil)
+			}
+			So(bmc.handshakeCount(), ShouldEqual, 4)
+		})
+
+		Convey("completion code is returned as first byte", func() {
+			cfg.CipherSuite = 3
+			s, err := Dial(addr, cfg)
+			So(err, ShouldBeNil)
+			defer s.Close()
+			resp, err := s.Exec(Request{NetFn: 0x2e, Cmd: 0xc8})
+			So(err, ShouldBeNil)
+			So(resp, ShouldResemble, []byte{0xc1})
+		})
+
+		Convey("bridged request is encapsulated in Send Message", func() {
+			cfg.CipherSuite = 3
+			s, err := Dial(addr, cfg)
+			So(err, ShouldBeNil)
+			defer s.Close()
+			resp, err := s.Exec(Request{NetFn: 0x2e, Cmd: 0xc8, Data: []byte{0x57, 0x01, 0x00, 0x01}, Bridged: true, Channel: 6, Target: 0x2c})
+			So(err, ShouldBeNil)
+			So(resp, ShouldResemble, []byte{0x00, 0x57, 0x01, 0x00, 0x01})
+
+			resp, err = s.Exec(Request{NetFn: 0x2e, Cmd: 0xc8, Data: []byte{0x57, 0x01, 0x00, 0x03}, Bridged: true, Channel: 0, Target: 0x2c,
+				Transit: []Hop{{Channel: 7, Address: 0x72}}})
+			So(err, ShouldBeNil)
+			So(resp, ShouldResemble, []byte{0x00, 0x57, 0x01, 0x00, 0x03})
+		})
+
+		Convey("invalid credentials are rejected", func() {
+			cfg.CipherSuite = 3
+			cfg.Password = "wrong"
+			_, err := Dial(addr, cfg)
+			So(err, ShouldNotBeNil)
+			cfg.User = "nobody"
+			_, err = Dial(addr, cfg)
+			So(err, ShouldNotBeNil)
+		})
+
+		Convey("IPMI v1.5 session is established with MD5 authentication", func() {
+			cfg.Interface = InterfaceLan
+			s, err := Dial(addr, cfg)
+			So(err, ShouldBeNil)
+			So(s.channel.(*legacyChannel).authType, ShouldEqual, authTypeMD5)
+			for i := 0; i < 3; i++ {
+				resp, err := s.Exec(Request{NetFn: 0x06, Cmd: 0x01})
+				So(err, ShouldBeNil)
+				So(resp[0], ShouldEqual, 0)
+			}
+			So(s.channel.(*legacyChannel).seq, ShouldEqual, 5)
+			resp, err := s.Exec(Request{NetFn: 0x2e, Cmd: 0xc8, Data: []byte{0x57, 0x01, 0x00, 0x02}, Bridged: true, Channel: 6, Target: 0x2c})
+			So(err, ShouldBeNil)
+			So(resp, ShouldResemble, []byte{0x00, 0x57, 0x01, 0x00, 0x02})
+			So(s.Close(), ShouldBeNil)
+			So(bmc.handshakeCount(), ShouldEqual, 1)
+
+			// unauthenticated packet with session ID is rejected by MD5 session
+			c := &legacyChannel{authType: authTypeMD5, password: make([]byte, legacyPasswordSize), sessionID: 0x1234, active: true}
+			spoofed, _ := (&legacyChannel{sessionID: 0x1234, seq: 1, active: true}).seal(payloadIPMI, []byte{0x81, 0x1c, 0x63})
+			_, _, err = c.open(spoofed)
+			So(err, ShouldNotBeNil)
+
+			// replayed packet is rejected
+			sender := &legacyChannel{authType: authTypeMD5, password: c.password, sessionID: 0x1234, seq: 1, active: true}
+			packet, _ := sender.seal(payloadIPMI, []byte{0x81, 0x1c, 0x63})
+			_, _, err = c.open(packet)
+			So(err, ShouldBeNil)
+			_, _, err = c.open(packet)
+			So(err, ShouldNotBeNil)
+
+			cfg.Password = "wrong"
+			_, err = Dial(addr, cfg)
+			So(err, ShouldNotBeNil)
+		})
+
+		Convey("IPMI v1.5 session without authentication is refused when password is set", func() {
+			cfg.setDefaults()
+			conn, err := net.Dial("udp", addr)
+			So(err, ShouldBeNil)
+			defer conn.Close()
+			c := &legacyChannel{password: make([]byte, legacyPasswordSize)}
+			s := &Session{addr: addr, cfg: cfg, conn: conn, channel: c}
+			ctx := context.Background()
+			resp, err := s.legacyCommand(ctx, cmdGetChannelAuthCaps, []byte{currentChannel, cfg.Privilege}, 3)
+			So(err, ShouldBeNil)
+			So(resp[2]&(1<<authTypeNone), ShouldEqual, 0)
+			user := make([]byte, 16)
+			copy(user, cfg.User)
+			_, err = s.legacyCommand(ctx, cmdGetSessionChallenge, append([]byte{authTypeNone}, user...), 21)
+			So(err, ShouldNotBeNil)
+
+			// challenge for MD5 does not allow activation without authentication
+			resp, err = s.legacyCommand(ctx, cmdGetSessionChallenge, append([]byte{authTypeMD5}, user...), 21)
+			So(err, ShouldBeNil)
+			c.sessionID = getUint32(resp[1:5])
+			data := appendUint32(append([]byte{authTypeNone, cfg.Privilege}, resp[5:21]...), 1)
+			_, err = s.legacyCommand(ctx, cmdActivateSession, data, 10)
+			So(err, ShouldNotBeNil)
+			So(bmc.handshakeCount(), ShouldEqual, 0)
+		})
+
+		Convey("session is reopened by next request when BMC drops it", func() {
+			cfg.CipherSuite = 3
+			s, err := Dial(addr, cfg)
+			So(err, ShouldBeNil)
+			defer s.Close()
+			bmc.mutex.Lock()
+			bmc.sessions = map[uint32]*serverSession{}
+			bmc.mutex.Unlock()
+			// unanswered request is not sent again
+			_, err = s.Exec(Request{NetFn: 0x06, Cmd: 0x01})
+			So(err, ShouldEqual, ErrTimeout)
+			So(bmc.handshakeCount(), ShouldEqual, 1)
+			resp, err := s.Exec(Request{NetFn: 0x06, Cmd: 0x01})
+			So(err, ShouldBeNil)
+			So(resp[0], ShouldEqual, 0)
+			So(bmc.handshakeCount(), ShouldEqual, 2)
+		})
+
+		Convey("session setup is abandoned at context deadline", func() {
+			silent, err := net.ListenPacket("udp", "127.0.0.1:0")
+			So(err, ShouldBeNil)
+			defer silent.Close()
+			cfg.Timeout = time.Second
+			ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+			defer cancel()
+			start := time.Now()
+			_, err = DialContext(ctx, silent.LocalAddr().String(), cfg)
+			So(err, ShouldResemble, context.DeadlineExceeded)
+			So(time.Since(start), ShouldBeLessThan, 500*time.Millisecond)
+		})
+	})
+}
+
+func TestDiscovery(t *testing.T) {
+	Convey("Check BMC discovery", t, func() {
+		bmc := newTestServer("admin", "secret")
+		defer bmc.Close()
+		_, port, _ := net.SplitHostPort(bmc.Addr().String())
+		p, _ := strconv.Atoi(port)
+
+		Convey("BMC answers presence ping", func() {
+			pong, err := Ping(context.Background(), bmc.Addr().String(), time.Second)
+			So(err, ShouldBeNil)
+			So(pong.IPMI, ShouldBeTrue)
+			So(pong.IANA, ShouldEqual, 4542)
+		})
+
+		Convey("sweep finds BMC and its capabilities", func() {
+			bmcs, err := Sweep(context.Background(), []string{"127.0.0.0/30"}, SweepConfig{Port: p, Timeout: 200 * time.Millisecond})
+			So(err, ShouldBeNil)
+			So(len(bmcs), ShouldEqual, 1)
+			So(bmcs[0].Addr, ShouldEqual, bmc.Addr().String())
+			So(bmcs[0].Auth.LanPlus, ShouldBeTrue)
+			So(bmcs[0].Auth.Interface(), ShouldEqual, InterfaceLanPlus)
+			So(bmcs[0].Auth.AuthTypes&(1<<authTypeMD5), ShouldNotEqual, 0)
+		})
+
+		Convey("large and IPv6 networks are rejected", func() {
+			_, err := Sweep(context.Background(), []string{"10.0.0.0/8"}, SweepConfig{})
+			So(err, ShouldNotBeNil)
+			_, err = Sweep(context.Background(), []string{"fe80::/120"}, SweepConfig{})
+			So(err, ShouldNotBeNil)
+		})
+	})
+}
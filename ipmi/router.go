@@ -0,0 +1,105 @@
+// +build linux
+
+/*
+http://www.apache.org/licenses/LICENSE-2.0.txt
+
+
+Copyright 2016 Intel Corporation
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package ipmi
+
+import (
+	"context"
+	"fmt"
+	"io"
+)
+
+// HostRouter is IpmiAL which passes calls to layer assigned to host,
+// so every host may be reached with own mode, credentials and protocol.
+// Layers may be shared by multiple hosts.
+type HostRouter struct {
+	Layers map[string]IpmiAL
+}
+
+func (r *HostRouter) layer(host string) (IpmiAL, error) {
+	if layer, ok := r.Layers[host]; ok {
+		return layer, nil
+	}
+	return nil, fmt.Errorf("No IPMI layer configured for host %q", host)
+}
+
+// BatchExecRaw performs batch using layer of host.
+func (r *HostRouter) BatchExecRaw(requests []IpmiRequest, host string) ([]IpmiResponse, error) {
+	return r.BatchExecRawContext(context.Background(), requests, host)
+}
+
+// BatchExecRawContext performs batch using layer of host within context.
+func (r *HostRouter) BatchExecRawContext(ctx context.Context, requests []IpmiRequest, host string) ([]IpmiResponse, error) {
+	layer, err := r.layer(host)
+	if err != nil {
+		return make([]IpmiResponse, len(requests)), err
+	}
+	if l, ok := layer.(IpmiALContext); ok {
+		return l.BatchExecRawContext(ctx, requests, host)
+	}
+	return layer.BatchExecRaw(requests, host)
+}
+
+// ExecRaw performs single request using layer of host.
+func (r *HostRouter) ExecRaw(request IpmiRequest, host string) (*IpmiResponse, error) {
+	return r.ExecRawContext(context.Background(), request, host)
+}
+
+// ExecRawContext performs single request using layer of host within context.
+func (r *HostRouter) ExecRawContext(ctx context.Context, request IpmiRequest, host string) (*IpmiResponse, error) {
+	layer, err := r.layer(host)
+	if err != nil {
+		return nil, err
+	}
+	if l, ok := layer.(IpmiALContext); ok {
+		return l.ExecRawContext(ctx, request, host)
+	}
+	return layer.ExecRaw(request, host)
+}
+
+// GetPlatformCapabilities checks capabilities of hosts concurrently, every host
+// with its layer. Hosts without layer have no capabilities.
+func (r *HostRouter) GetPlatformCapabilities(requests []RequestDescription, host []string) map[string][]RequestDescription {
+	return probeHosts(host, func(addr string) []RequestDescription {
+		layer, err := r.layer(addr)
+		if err != nil {
+			return []RequestDescription{}
+		}
+		return layer.GetPlatformCapabilities(requests, []string{addr})[addr]
+	})
+}
+
+// Close closes layers which support it, every layer is closed once.
+func (r *HostRouter) Close() error {
+	closed := make(map[io.Closer]bool)
+	var err error
+	for _, layer := range r.Layers {
+		closer, ok := layer.(io.Closer)
+		if !ok || closed[closer] {
+			continue
+		}
+		closed[closer] = true
+		if e := closer.Close(); e != nil {
+			err = e
+		}
+	}
+	return err
+}
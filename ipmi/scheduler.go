@@ -0,0 +1,242 @@
+// +build linux
+
+/*
+http://www.apache.org/licenses/LICENSE-2.0.txt
+
+
+Copyright 2016 Intel Corporation
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package ipmi
+
+import (
+	"context"
+	"io"
+	"sync"
+	"time"
+)
+
+// Default limits of Scheduler.
+const (
+	DefaultHostLimit = 4
+	DefaultWorkers   = 64
+)
+
+// Scheduler is IpmiAL which passes calls to Layer running them concurrently.
+// Batches are split into up to HostLimit parts performed in parallel, at most
+// HostLimit calls are in flight to single host and at most Workers calls
+// across all hosts. Deadline limits single CollectAll, zero means no limit.
+type Scheduler struct {
+	Layer     IpmiAL
+	HostLimit int
+	Workers   int
+	Deadline  time.Duration
+	workers   chan struct{}
+	hosts     map[string]chan struct{}
+	mutex     sync.Mutex
+}
+
+// NewScheduler creates scheduler with default limits and no deadline.
+func NewScheduler(layer IpmiAL) *Scheduler {
+	return &Scheduler{Layer: layer, HostLimit: DefaultHostLimit, Workers: DefaultWorkers}
+}
+
+// slots returns semaphores limiting calls to host and across hosts.
+// Nil workers semaphore means no global limit.
+func (s *Scheduler) slots(host string) (chan struct{}, chan struct{}) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.hosts == nil {
+		s.hosts = map[string]chan struct{}{}
+	}
+	if s.workers == nil && s.Workers > 0 {
+		s.workers = make(chan struct{}, s.Workers)
+	}
+	sem, ok := s.hosts[host]
+	if !ok {
+		sem = make(chan struct{}, s.hostLimit())
+		s.hosts[host] = sem
+	}
+	return sem, s.workers
+}
+
+func (s *Scheduler) hostLimit() int {
+	if s.HostLimit <= 0 {
+		return 1
+	}
+	return s.HostLimit
+}
+
+// run calls f holding slot of host and of worker pool.
+// Context error is returned when slots were not acquired before ctx is done.
+func (s *Scheduler) run(ctx context.Context, host string, f func()) error {
+	hostSem, workerSem := s.slots(host)
+	select {
+	case hostSem <- struct{}{}:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	defer func() { <-hostSem }()
+	if workerSem != nil {
+		select {
+		case workerSem <- struct{}{}:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+		defer func() { <-workerSem }()
+	}
+	f()
+	return nil
+}
+
+// BatchExecRaw performs batch using underlying layer.
+func (s *Scheduler) BatchExecRaw(requests []IpmiRequest, host string) ([]IpmiResponse, error) {
+	return s.BatchExecRawContext(context.Background(), requests, host)
+}
+
+// BatchExecRawContext splits batch into parts performed concurrently
+// by underlying layer. Responses are returned in order of requests.
+func (s *Scheduler) BatchExecRawContext(ctx context.Context, requests []IpmiRequest, host string) ([]IpmiResponse, error) {
+	results := make([]IpmiResponse, len(requests))
+	failed := BatchError{}
+	parts := s.hostLimit()
+	if parts > len(requests) {
+		parts = len(requests)
+	}
+
+	var wg sync.WaitGroup
+	var mutex sync.Mutex
+	for p := 0; p < parts; p++ {
+		begin, end := p*len(requests)/parts, (p+1)*len(requests)/parts
+		wg.Add(1)
+		go func(begin, end int) {
+			defer wg.Done()
+			part := requests[begin:end]
+			var responses []IpmiResponse
+			var err error
+			if rerr := s.run(ctx, host, func() {
+				responses, err = s.batchExec(ctx, part, host)
+			}); rerr != nil {
+				err = rerr
+			}
+
+			mutex.Lock()
+			defer mutex.Unlock()
+			copy(results[begin:end], responses)
+			for i := range part {
+				if e, ok := err.(BatchError); ok {
+					if e[i] != nil {
+						failed[begin+i] = e[i]
+					}
+				} else if err != nil {
+					failed[begin+i] = err
+				}
+			}
+		}(begin, end)
+	}
+	wg.Wait()
+
+	if len(failed) == 0 {
+		return results, nil
+	}
+	return results, failed
+}
+
+func (s *Scheduler) batchExec(ctx context.Context, requests []IpmiRequest, host string) ([]IpmiResponse, error) {
+	if layer, ok := s.Layer.(IpmiALContext); ok {
+		return layer.BatchExecRawContext(ctx, requests, host)
+	}
+	return s.Layer.BatchExecRaw(requests, host)
+}
+
+// ExecRaw performs single request using underlying layer.
+func (s *Scheduler) ExecRaw(request IpmiRequest, host string) (*IpmiResponse, error) {
+	return s.ExecRawContext(context.Background(), request, host)
+}
+
+// ExecRawContext performs single request using underlying layer
+// once slots of host and worker pool are available.
+func (s *Scheduler) ExecRawContext(ctx context.Context, request IpmiRequest, host string) (*IpmiResponse, error) {
+	var response *IpmiResponse
+	var err error
+	if rerr := s.run(ctx, host, func() {
+		if layer, ok := s.Layer.(IpmiALContext); ok {
+			response, err = layer.ExecRawContext(ctx, request, host)
+		} else {
+			response, err = s.Layer.ExecRaw(request, host)
+		}
+	}); rerr != nil {
+		return nil, rerr
+	}
+	return response, err
+}
+
+// GetPlatformCapabilities checks capabilities of hosts concurrently.
+func (s *Scheduler) GetPlatformCapabilities(requests []RequestDescription, host []string) map[string][]RequestDescription {
+	validRequests := make(map[string][]RequestDescription, len(host))
+	var wg sync.WaitGroup
+	var mutex sync.Mutex
+	for _, addr := range host {
+		wg.Add(1)
+		go func(addr string) {
+			defer wg.Done()
+			s.run(context.Background(), addr, func() {
+				capabilities := s.Layer.GetPlatformCapabilities(requests, []string{addr})
+				mutex.Lock()
+				defer mutex.Unlock()
+				validRequests[addr] = capabilities[addr]
+			})
+		}(addr)
+	}
+	wg.Wait()
+	return validRequests
+}
+
+// CollectAll performs batches of all hosts concurrently within Deadline.
+// Responses and errors (as returned by BatchExecRaw) are indexed by host.
+func (s *Scheduler) CollectAll(ctx context.Context, requests map[string][]IpmiRequest) (map[string][]IpmiResponse, map[string]error) {
+	if s.Deadline > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, s.Deadline)
+		defer cancel()
+	}
+	responses := make(map[string][]IpmiResponse, len(requests))
+	errs := map[string]error{}
+	var wg sync.WaitGroup
+	var mutex sync.Mutex
+	for host, batch := range requests {
+		wg.Add(1)
+		go func(host string, batch []IpmiRequest) {
+			defer wg.Done()
+			results, err := s.BatchExecRawContext(ctx, batch, host)
+			mutex.Lock()
+			defer mutex.Unlock()
+			responses[host] = results
+			if err != nil {
+				errs[host] = err
+			}
+		}(host, batch)
+	}
+	wg.Wait()
+	return responses, errs
+}
+
+// Close closes underlying layer when it supports it.
+func (s *Scheduler) Close() error {
+	if closer, ok := s.Layer.(io.Closer); ok {
+		return closer.Close()
+	}
+	return nil
+}
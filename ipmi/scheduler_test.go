@@ -0,0 +1,192 @@
+// +build unit
+
+/*
+http://www.apache.org/licenses/LICENSE-2.0.txt
+
+
+Copyright 2016 Intel Corporation
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package ipmi
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+// gatedLayer answers every request, echoing its command, once release
+// is closed. Every call is announced on entered, so tests can wait until
+// given number of calls is in flight. Maximal numbers of calls in flight
+// are tracked.
+type gatedLayer struct {
+	release  chan struct{}
+	entered  chan string
+	mutex    sync.Mutex
+	inFlight map[string]int
+	total    int
+	maxHost  int
+	maxTotal int
+}
+
+func newGatedLayer() *gatedLayer {
+	return &gatedLayer{release: make(chan struct{}), entered: make(chan string, 64), inFlight: map[string]int{}}
+}
+
+func (l *gatedLayer) enter(host string) {
+	l.mutex.Lock()
+	l.inFlight[host]++
+	l.total++
+	if l.inFlight[host] > l.maxHost {
+		l.maxHost = l.inFlight[host]
+	}
+	if l.total > l.maxTotal {
+		l.maxTotal = l.total
+	}
+	l.mutex.Unlock()
+	l.entered <- host
+}
+
+func (l *gatedLayer) leave(host string) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	l.inFlight[host]--
+	l.total--
+}
+
+// wait returns once n calls entered layer.
+func (l *gatedLayer) wait(n int) {
+	for i := 0; i < n; i++ {
+		<-l.entered
+	}
+}
+
+// limits returns maximal numbers of calls in flight to single host and in total.
+func (l *gatedLayer) limits() (int, int) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	return l.maxHost, l.maxTotal
+}
+
+func (l *gatedLayer) ExecRaw(request IpmiRequest, host string) (*IpmiResponse, error) {
+	return l.ExecRawContext(context.Background(), request, host)
+}
+
+func (l *gatedLayer) ExecRawContext(ctx context.Context, request IpmiRequest, host string) (*IpmiResponse, error) {
+	l.enter(host)
+	defer l.leave(host)
+	select {
+	case <-l.release:
+		return &IpmiResponse{[]byte{0x00, request.Data[1]}, 1}, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+func (l *gatedLayer) BatchExecRaw(requests []IpmiRequest, host string) ([]IpmiResponse, error) {
+	return l.BatchExecRawContext(context.Background(), requests, host)
+}
+
+func (l *gatedLayer) BatchExecRawContext(ctx context.Context, requests []IpmiRequest, host string) ([]IpmiResponse, error) {
+	results := make([]IpmiResponse, len(requests))
+	failed := BatchError{}
+	for i, r := range requests {
+		if resp, err := l.ExecRawContext(ctx, r, host); err != nil {
+			failed[i] = err
+		} else {
+			results[i] = *resp
+		}
+	}
+	if len(failed) == 0 {
+		return results, nil
+	}
+	return results, failed
+}
+
+func (l *gatedLayer) GetPlatformCapabilities(requests []RequestDescription, host []string) map[string][]RequestDescription {
+	l.enter(host[0])
+	defer l.leave(host[0])
+	<-l.release
+	return map[string][]RequestDescription{host[0]: requests}
+}
+
+func TestScheduler(t *testing.T) {
+	Convey("Check scheduler", t, func() {
+		layer := newGatedLayer()
+		scheduler := &Scheduler{Layer: layer, HostLimit: 2, Workers: 3}
+		requests := map[string][]IpmiRequest{}
+		for h := 0; h < 4; h++ {
+			for i := 0; i < 8; i++ {
+				host := fmt.Sprintf("bmc%d", h)
+				requests[host] = append(requests[host], IpmiRequest{Data: []byte{0x2e, byte(i)}})
+			}
+		}
+
+		Convey("requests in flight are limited per host and in total", func() {
+			done := make(chan struct{})
+			var responses map[string][]IpmiResponse
+			var errs map[string]error
+			go func() {
+				responses, errs = scheduler.CollectAll(context.Background(), requests)
+				close(done)
+			}()
+			layer.wait(3)
+			close(layer.release)
+			<-done
+			So(len(errs), ShouldEqual, 0)
+			So(len(responses), ShouldEqual, 4)
+			for _, results := range responses {
+				for i, resp := range results {
+					So(resp.Data, ShouldResemble, []byte{0x00, byte(i)})
+				}
+			}
+			maxHost, maxTotal := layer.limits()
+			So(maxHost, ShouldBeLessThanOrEqualTo, 2)
+			So(maxTotal, ShouldEqual, 3)
+
+			caps := scheduler.GetPlatformCapabilities(GenericVendor, []string{"bmc0", "bmc1", "bmc2", "bmc3"})
+			So(len(caps), ShouldEqual, 4)
+			So(len(caps["bmc3"]), ShouldEqual, len(GenericVendor))
+		})
+
+		Convey("batch of single host is split up to host limit", func() {
+			done := make(chan error)
+			go func() {
+				_, err := scheduler.BatchExecRaw(requests["bmc0"], "bmc0")
+				done <- err
+			}()
+			layer.wait(2)
+			close(layer.release)
+			So(<-done, ShouldBeNil)
+			maxHost, maxTotal := layer.limits()
+			So(maxHost, ShouldEqual, 2)
+			So(maxTotal, ShouldEqual, 2)
+		})
+
+		Convey("collection is stopped at deadline", func() {
+			scheduler.Deadline = 20 * time.Millisecond
+			start := time.Now()
+			responses, errs := scheduler.CollectAll(context.Background(), requests)
+			So(time.Since(start), ShouldBeLessThan, 500*time.Millisecond)
+			So(len(errs), ShouldEqual, 4)
+			So(len(responses["bmc0"]), ShouldEqual, 8)
+			So(len(errs["bmc0"].(BatchError)), ShouldEqual, 8)
+		})
+	})
+}
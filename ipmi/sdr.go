@@ -1,12 +1,33 @@
 package ipmi
 
 import (
+	"encoding/binary"
+	"errors"
 	"fmt"
+	"strings"
+	"sync"
+
 	log "github.com/Sirupsen/logrus"
 )
 
+// SdrParser reads SDR records and sensor states of hosts.
+// SDR records of every host are kept until repository timestamps change.
+// When Cache is set, SDR records are kept in it between restarts.
 type SdrParser struct {
 	IpmiLayer IpmiAL
+	Cache     *Cache
+	mutex     sync.Mutex
+	hosts     map[string]*sdrState
+}
+
+// sdrState is SDR of single host with repository timestamps it was read at.
+type sdrState struct {
+	mutex       sync.Mutex
+	isDeviceSdr bool
+	addition    uint32
+	erase       uint32
+	sdrs        []SdrInfo
+	limits      map[string]map[string]Value
 }
 
 type ComponentHealth struct {
@@ -36,30 +57,34 @@ type SdrHeader struct {
 
 type SdrInfo struct {
 	Header      SdrHeader
+	Name        string
+	OwnerId     uint16
+	OwnerLun    uint16
 	SensorNumber uint16
 	SensorType uint16
 	EventReadingType uint16
+	Conversion  *SensorConversion
+	Characteristics map[string]uint8
 }
 
 type SensorStatus struct {
 	SensorNumber   uint16
+	Reading uint8
 	Status uint16
 	StateUnavailable bool
 	SensorType uint16
 	ReadingType uint16
 }
 
-var CmdGetDeviceId = IpmiRequest{[]byte{0x6, 0x1}, 0x0, 0x0}
-
-var CmdStorageSdrInfo = IpmiRequest{[]byte{0xa, 0x20}, 0x0, 0x0}
-var CmdDeviceSdrInfo = IpmiRequest{[]byte{0x4, 0x20}, 0x0, 0x0}
+var CmdGetDeviceId = IpmiRequest{[]byte{0x6, 0x1}, 0x0, 0x0, nil}
 
-var CmdReserveStorageSdr = IpmiRequest{[]byte{0xa, 0x22}, 0x0, 0x0}
-var CmdReserveDeviceSdr = IpmiRequest{[]byte{0x4, 0x22}, 0x0, 0x0}
+var CmdStorageSdrInfo = IpmiRequest{[]byte{0xa, 0x20}, 0x0, 0x0, nil}
+var CmdDeviceSdrInfo = IpmiRequest{[]byte{0x4, 0x20}, 0x0, 0x0, nil}
 
-var CmdGetSdrRepositoryAllocationInfo = IpmiRequest{[]byte{0xa, 0x21}, 0x0, 0x0}
+var CmdReserveStorageSdr = IpmiRequest{[]byte{0xa, 0x22}, 0x0, 0x0, nil}
+var CmdReserveDeviceSdr = IpmiRequest{[]byte{0x4, 0x22}, 0x0, 0x0, nil}
 
-var sdrInfos []SdrInfo
+var CmdGetSdrRepositoryAllocationInfo = IpmiRequest{[]byte{0xa, 0x21}, 0x0, 0x0, nil}
 
 //AddData byte[6]: 
 //byte[0] =reservationId[0]
@@ -67,10 +92,20 @@ var sdrInfos []SdrInfo
 //byte[2,3] = recordId
 //byte[4] = offsetIntoRecord
 //byte[5] = bytesToRead
-var CmdGetStorageSdr = IpmiRequest{[]byte{0xa, 0x23,0x0,0x0,0x0,0x0,0x0,0x0}, 0x0, 0x0}
-var CmdGetDeviceSdr = IpmiRequest{[]byte{0x4, 0x21,0x0,0x0,0x0,0x0,0x0,0x0}, 0x0, 0x0}
+var CmdGetStorageSdr = IpmiRequest{[]byte{0xa, 0x23,0x0,0x0,0x0,0x0,0x0,0x0}, 0x0, 0x0, nil}
+var CmdGetDeviceSdr = IpmiRequest{[]byte{0x4, 0x21,0x0,0x0,0x0,0x0,0x0,0x0}, 0x0, 0x0, nil}
+
+var CmdGetSensorReading = IpmiRequest{[]byte{0x4, 0x2D,0x0}, 0x0, 0x0, nil}
+
+var CmdGetSensorThresholds = IpmiRequest{[]byte{0x4, 0x27, 0x0}, 0x0, 0x0, nil}
+
+// CmdGetSensorHysteresis is Get Sensor Hysteresis, sensor number and hysteresis mask (0xff) follow.
+var CmdGetSensorHysteresis = IpmiRequest{[]byte{0x4, 0x25, 0x0, 0xff}, 0x0, 0x0, nil}
 
-var CmdGetSensorReading = IpmiRequest{[]byte{0x4, 0x2D,0x0}, 0x0, 0x0}
+// thresholdNames are names of thresholds in order of Get Sensor Thresholds
+// response and bits of readable thresholds mask.
+var thresholdNames = []string{"lower_non_critical", "lower_critical", "lower_non_recoverable",
+	"upper_non_critical", "upper_critical", "upper_non_recoverable"}
 
 type SensorHealthSetting struct{
 	SensorType uint16
@@ -120,16 +155,9 @@ var SensorTypeComponentMap = map[uint16]ComponentDescription{
 
 func (sp *SdrParser) GetComponentHealth(host string)(map[string]string,error){
 	ret := map[string]string{}
-	deviceId,err := sp.GetDeviceId(host)
-	if err != nil{
-		return nil,err
-	}
-    if sdrInfos == nil {
-        var err error
-        sdrInfos,err = sp.ScanSdr(deviceId.IsDeviceSdr,host)
-        if err != nil{
-	        return nil,err
-        }
+	sdrInfos, err := sp.sdr(host)
+	if err != nil {
+		return nil, err
 	}
 	sdrStatus,err := sp.GetSdrData(sdrInfos,host)
 	if err != nil{
@@ -142,23 +170,8 @@ func (sp *SdrParser) GetComponentHealth(host string)(map[string]string,error){
 		}
 	
 		var componentType ComponentDescription= SensorTypeComponentMap[sdrStat.SensorType]
-		if &componentType != nil{
-			//threshold sensor
-			if sdrStat.ReadingType == 1{
-				var sensorInfo = GetSensorInfo(sdrStat.Status)
-				ret[componentType.Metrics] =  sensorInfo.Severity
-			}else{
-				var configKey = fmt.Sprintf("%v:%v", sdrStat.SensorType, sdrStat.ReadingType)
-				var sensorHealthSetting =SensorHealthConfig[configKey]
-				if &sensorHealthSetting != nil{
-					for unexpectedStat := range sensorHealthSetting.Status {
-						var offset uint16= 1 << uint16(unexpectedStat)
-						if (sdrStat.Status & offset) > 0 {
-							ret[componentType.Metrics] = "SEV_UNKNOWN"
-						}
-					}
-				}
-			}
+		if severity := sensorSeverity(sdrStat); severity != "" {
+			ret[componentType.Metrics] = severity
 		}
 
 	}
@@ -166,6 +179,381 @@ func (sp *SdrParser) GetComponentHealth(host string)(map[string]string,error){
 	return ret,nil
 }
 
+// sensorSeverity returns severity of sensor state. Threshold sensors are judged
+// by crossed thresholds, discrete ones are "SEV_UNKNOWN" when unexpected state
+// is asserted and "" otherwise.
+func sensorSeverity(sdrStat SensorStatus) string {
+	//threshold sensor
+	if sdrStat.ReadingType == 1 {
+		return GetSensorInfo(sdrStat.Status).Severity
+	}
+	severity := ""
+	var configKey = fmt.Sprintf("%v:%v", sdrStat.SensorType, sdrStat.ReadingType)
+	for unexpectedStat := range SensorHealthConfig[configKey].Status {
+		var offset uint16 = 1 << uint16(unexpectedStat)
+		if (sdrStat.Status & offset) > 0 {
+			severity = "SEV_UNKNOWN"
+		}
+	}
+	return severity
+}
+
+// SensorReading is reading and status of sensor described in SDR. Value is
+// converted to engineering units for analog threshold sensors, raw for other
+// threshold sensors and holds asserted states of discrete ones.
+// Value and Status are invalid when reading is unavailable.
+type SensorReading struct {
+	Name   string
+	Value  Value
+	Status Value
+}
+
+// GetSensorNames returns metric names of host sensors, see GetSensorReadings.
+func (sp *SdrParser) GetSensorNames(host string) ([]string, error) {
+	sdrInfos, err := sp.sdr(host)
+	if err != nil {
+		return nil, err
+	}
+	return sensorNames(sdrInfos), nil
+}
+
+// GetSensorReadings reads all sensors of host described in SDR. Sensors are
+// named by SDR ID strings reduced to letters, digits, "-" and "_".
+func (sp *SdrParser) GetSensorReadings(host string) ([]SensorReading, error) {
+	sdrInfos, err := sp.sdr(host)
+	if err != nil {
+		return nil, err
+	}
+	sdrStatus, err := sp.GetSdrData(sdrInfos, host)
+	if err != nil {
+		return nil, err
+	}
+	names := sensorNames(sdrInfos)
+	readings := make([]SensorReading, len(sdrInfos))
+	for i, sdr := range sdrInfos {
+		readings[i].Name = names[i]
+		unit := ""
+		if sdr.Conversion != nil {
+			unit = sdr.Conversion.Unit()
+		}
+		if sdrStatus[i].StateUnavailable {
+			readings[i].Value = InvalidValue(unit)
+			continue
+		}
+		severity := sensorSeverity(sdrStatus[i])
+		if severity == "" {
+			severity = "OK"
+		}
+		readings[i].Status = StringValue(severity)
+		if sdr.EventReadingType != 0x01 {
+			readings[i].Value = IntValue(int(sdrStatus[i].Status), "")
+		} else {
+			readings[i].Value = convertReading(sdr.Conversion, sdrStatus[i].Reading, false)
+		}
+	}
+	return readings, nil
+}
+
+// convertReading returns raw reading (or hysteresis when delta is set) of sensor
+// converted with conv, raw value is returned when it cannot be converted.
+func convertReading(conv *SensorConversion, raw uint8, delta bool) Value {
+	if conv != nil {
+		convert := conv.Convert
+		if delta {
+			convert = conv.ConvertDelta
+		}
+		if v, ok := convert(raw); ok {
+			return FloatValue(v, conv.Unit())
+		}
+	}
+	return IntValue(int(raw), "")
+}
+
+// GetSensorMetrics returns paths of metrics of host sensors: value and status
+// of every sensor and limits of threshold sensors.
+func (sp *SdrParser) GetSensorMetrics(host string) ([]string, error) {
+	sdrInfos, err := sp.sdr(host)
+	if err != nil {
+		return nil, err
+	}
+	var metrics []string
+	for i, name := range sensorNames(sdrInfos) {
+		submetrics := SensorMetrics
+		if sdrInfos[i].EventReadingType == 0x01 {
+			submetrics = append(append([]string{}, SensorMetrics...), SensorLimitMetrics...)
+		}
+		for _, submetric := range submetrics {
+			metrics = append(metrics, SensorMetric(name, submetric))
+		}
+	}
+	return metrics, nil
+}
+
+// GetSensorLimits returns thresholds, hysteresis and characteristic readings
+// of threshold sensors by sensor name, converted to engineering units.
+// Limits which sensor does not report are missing. Limits are read again
+// only when SDR repository changes, or when some sensor failed transiently.
+func (sp *SdrParser) GetSensorLimits(host string) (map[string]map[string]Value, error) {
+	state, err := sp.state(host)
+	if err != nil {
+		return nil, err
+	}
+	defer state.mutex.Unlock()
+	if state.limits != nil {
+		return state.limits, nil
+	}
+	sdrInfos := state.sdrs
+	names := sensorNames(sdrInfos)
+	limits := make(map[string]map[string]Value)
+	complete := true
+	for i, sdr := range sdrInfos {
+		if sdr.EventReadingType != 0x01 {
+			continue
+		}
+		values := make(map[string]Value)
+		for name, raw := range sdr.Characteristics {
+			values[name] = convertReading(sdr.Conversion, raw, false)
+		}
+		thresholds, err := sp.GetSensorThresholds(sdr, host)
+		if err == ErrNoResponse {
+			return nil, err
+		}
+		complete = complete && !IsTransient(err)
+		for name, raw := range thresholds {
+			values[name] = convertReading(sdr.Conversion, raw, false)
+		}
+		positive, negative, err := sp.GetSensorHysteresis(sdr, host)
+		if err == ErrNoResponse {
+			return nil, err
+		}
+		complete = complete && !IsTransient(err)
+		if err == nil {
+			values["positive_hysteresis"] = convertReading(sdr.Conversion, positive, true)
+			values["negative_hysteresis"] = convertReading(sdr.Conversion, negative, true)
+		}
+		limits[names[i]] = values
+	}
+	if complete {
+		state.limits = limits
+	}
+	return limits, nil
+}
+
+// sensorRequest returns sensor command addressed to controller owning sensor,
+// commands to controllers other than BMC are bridged to channel of owner.
+// False is returned for sensors owned by system software or behind LUN
+// other than 0, which commands cannot be addressed.
+func (sdr SdrInfo) sensorRequest(cmd IpmiRequest) (IpmiRequest, bool) {
+	if sdr.OwnerId&0x01 != 0 || sdr.OwnerLun&0x03 != 0 {
+		return cmd, false
+	}
+	if sdr.OwnerId != bmcAddress {
+		cmd.SetPath([]BridgeHop{{Channel: uint8(sdr.OwnerLun >> 4), Address: uint8(sdr.OwnerId)}})
+	}
+	return cmd, true
+}
+
+// addressableSdrs returns records of sensors which commands can be addressed.
+func addressableSdrs(sdrs []SdrInfo, host string) []SdrInfo {
+	var addressable []SdrInfo
+	for _, sdr := range sdrs {
+		if _, ok := sdr.sensorRequest(IpmiRequest{}); !ok {
+			log.WithFields(log.Fields{
+				"host":   host,
+				"sensor": sdr.SensorNumber,
+				"owner":  sdr.OwnerId,
+				"lun":    sdr.OwnerLun,
+			}).Debug("Sensor cannot be addressed, skipped")
+			continue
+		}
+		addressable = append(addressable, sdr)
+	}
+	return addressable
+}
+
+// errSensorNotAddressable is returned for commands of sensors
+// which owner cannot be addressed.
+var errSensorNotAddressable = errors.New("Sensor owner cannot be addressed")
+
+// GetSensorThresholds returns readable raw thresholds of sensor.
+func (sp *SdrParser) GetSensorThresholds(sdr SdrInfo, host string) (map[string]uint8, error) {
+	cmd := CmdGetSensorThresholds.Clone()
+	cmd.Data[2] = byte(sdr.SensorNumber)
+	cmd, ok := sdr.sensorRequest(cmd)
+	if !ok {
+		return nil, errSensorNotAddressable
+	}
+	response, err := sp.IpmiLayer.ExecRaw(cmd, host)
+	if err != nil {
+		return nil, err
+	}
+	if err := (&GenericValidator{}).Validate(*response); err != nil {
+		return nil, err
+	}
+	if len(response.Data) < 8 {
+		return nil, errShortResponse
+	}
+	thresholds := make(map[string]uint8)
+	for i, name := range thresholdNames {
+		if response.Data[1]&(1<<uint(i)) != 0 {
+			thresholds[name] = response.Data[2+i]
+		}
+	}
+	return thresholds, nil
+}
+
+// GetSensorHysteresis returns raw positive and negative going hysteresis of sensor.
+func (sp *SdrParser) GetSensorHysteresis(sdr SdrInfo, host string) (uint8, uint8, error) {
+	cmd := CmdGetSensorHysteresis.Clone()
+	cmd.Data[2] = byte(sdr.SensorNumber)
+	cmd, ok := sdr.sensorRequest(cmd)
+	if !ok {
+		return 0, 0, errSensorNotAddressable
+	}
+	response, err := sp.IpmiLayer.ExecRaw(cmd, host)
+	if err != nil {
+		return 0, 0, err
+	}
+	if err := (&GenericValidator{}).Validate(*response); err != nil {
+		return 0, 0, err
+	}
+	if len(response.Data) < 3 {
+		return 0, 0, errShortResponse
+	}
+	return response.Data[1], response.Data[2], nil
+}
+
+// sensorNames returns names of sensors usable as metric namespace elements.
+// Sensors without ID string are named by number, duplicated names are
+// suffixed with sensor number.
+func sensorNames(sdrInfos []SdrInfo) []string {
+	names := make([]string, len(sdrInfos))
+	count := make(map[string]int)
+	for i, sdr := range sdrInfos {
+		names[i] = strings.Join(strings.FieldsFunc(sdr.Name, func(r rune) bool {
+			return !(r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '-' || r == '_')
+		}), "_")
+		if names[i] == "" {
+			names[i] = fmt.Sprintf("sensor_%d", sdr.SensorNumber)
+		}
+		count[names[i]]++
+	}
+	for i, sdr := range sdrInfos {
+		if count[names[i]] > 1 {
+			names[i] = fmt.Sprintf("%s_%d", names[i], sdr.SensorNumber)
+		}
+	}
+	return names
+}
+
+// sdr returns SDR records of host, read again when repository
+// timestamps differ from ones seen at previous read.
+func (sp *SdrParser) sdr(host string) ([]SdrInfo, error) {
+	state, err := sp.state(host)
+	if err != nil {
+		return nil, err
+	}
+	defer state.mutex.Unlock()
+	return state.sdrs, nil
+}
+
+// state returns locked SDR state of host, which records are read again
+// and limits dropped when repository timestamps changed.
+func (sp *SdrParser) state(host string) (*sdrState, error) {
+	sp.mutex.Lock()
+	if sp.hosts == nil {
+		sp.hosts = make(map[string]*sdrState)
+	}
+	state, ok := sp.hosts[host]
+	if !ok {
+		state = &sdrState{}
+		sp.hosts[host] = state
+	}
+	sp.mutex.Unlock()
+
+	state.mutex.Lock()
+	deviceId, err := sp.GetDeviceId(host)
+	if err != nil {
+		state.mutex.Unlock()
+		return nil, err
+	}
+	addition, erase, err := sp.GetSdrTimestamps(deviceId.IsDeviceSdr, host)
+	if err != nil {
+		state.mutex.Unlock()
+		return nil, err
+	}
+	if state.sdrs != nil && state.isDeviceSdr == deviceId.IsDeviceSdr && state.addition == addition && state.erase == erase {
+		return state, nil
+	}
+	scan := func() ([]SdrInfo, error) {
+		sdrs, err := sp.ScanSdr(deviceId.IsDeviceSdr, host)
+		if err != nil {
+			return nil, err
+		}
+		sdrs = addressableSdrs(sdrs, host)
+		sp.loadFactorRanges(sdrs, host)
+		return sdrs, nil
+	}
+	var sdrs []SdrInfo
+	if sp.Cache != nil {
+		sdrs, err = sp.Cache.Sdr(host, scan)
+	} else {
+		sdrs, err = scan()
+	}
+	if err != nil {
+		state.mutex.Unlock()
+		return nil, err
+	}
+	state.isDeviceSdr, state.addition, state.erase, state.sdrs = deviceId.IsDeviceSdr, addition, erase, sdrs
+	state.limits = nil
+	return state, nil
+}
+
+// loadFactorRanges reads reading factors of non-linear sensors. Readings
+// of sensors which factors cannot be read are reported raw.
+func (sp *SdrParser) loadFactorRanges(sdrs []SdrInfo, host string) {
+	for _, sdr := range sdrs {
+		if sdr.Conversion == nil || !sdr.Conversion.NonLinear() {
+			continue
+		}
+		target, _ := sdr.sensorRequest(IpmiRequest{})
+		ranges, err := LoadFactorRanges(sp.IpmiLayer, target, host, uint8(sdr.SensorNumber))
+		if err != nil {
+			log.WithFields(log.Fields{
+				"host":   host,
+				"sensor": sdr.SensorNumber,
+				"error":  err,
+			}).Warn("Unable to read sensor reading factors")
+			continue
+		}
+		sdr.Conversion.Ranges = ranges
+	}
+}
+
+// GetSdrTimestamps returns most recent addition and erase timestamps of SDR
+// repository. For device SDRs addition is sensor population change indicator.
+func (sp *SdrParser) GetSdrTimestamps(isDeviceSdr bool, host string) (uint32, uint32, error) {
+	if isDeviceSdr {
+		response, err := sp.IpmiLayer.ExecRaw(CmdDeviceSdrInfo, host)
+		if err != nil {
+			return 0, 0, err
+		}
+		if len(response.Data) < 7 {
+			// static sensor population
+			return 0, 0, nil
+		}
+		return binary.LittleEndian.Uint32(response.Data[3:7]), 0, nil
+	}
+	response, err := sp.IpmiLayer.ExecRaw(CmdStorageSdrInfo, host)
+	if err != nil {
+		return 0, 0, err
+	}
+	if len(response.Data) < 14 {
+		return 0, 0, fmt.Errorf("Unexpected response data: SDR repository info too short")
+	}
+	return binary.LittleEndian.Uint32(response.Data[6:10]), binary.LittleEndian.Uint32(response.Data[10:14]), nil
+}
+
 func (sp *SdrParser) GetDeviceId(host string) (*DeviceId, error) {
 	var deviceId DeviceId
 	response, err := sp.IpmiLayer.ExecRaw(CmdGetDeviceId, host)
@@ -293,199 +681,279 @@ func (sp *SdrParser) GetSensorReading(sensorNum int,host string)([]byte,error){
 	return data,nil
 }
 
-func (sp *SdrParser) ScanSdr(isDeviceSdr bool,host string) ([]SdrInfo, error){
-	err := sp.GetSdrInfo(isDeviceSdr,host)
-	if (err != nil){		
-		return nil,err
+// Limits of SDR reading: attempts of single read after reservation was
+// canceled or read size rejected, and the smallest read size tried.
+const (
+	sdrReadAttempts = 8
+	sdrMinReadLen   = 1
+)
+
+// ScanSdr reads full and compact sensor records of host.
+func (sp *SdrParser) ScanSdr(isDeviceSdr bool, host string) ([]SdrInfo, error) {
+	err := sp.GetSdrInfo(isDeviceSdr, host)
+	if err != nil {
+		return nil, err
 	}
-	reservationId,err := sp.ReserveSdr(isDeviceSdr,host)
-	if err != nil{
+	reservationId, err := sp.ReserveSdr(isDeviceSdr, host)
+	if err != nil {
 		log.WithFields(log.Fields{
-				"host": host,
-				"isDeviceSdr":isDeviceSdr,
-				"error":err,
-		}).Debug("ScanSdr ReserveSdr exit with error")			
-		return nil,err
+			"host":        host,
+			"isDeviceSdr": isDeviceSdr,
+			"error":       err,
+		}).Debug("ScanSdr ReserveSdr exit with error")
+		return nil, err
 	}
-/*	log.WithFields(log.Fields{
-			"host": host,
-			"isDeviceSdr":isDeviceSdr,
-			"reservationId":reservationId,
-		}).Debug("ScanSdr reservationId")	*/
 	var sdrMaxReadLen = uint16(16)
 	if !isDeviceSdr {
-		sdrMaxRead,err := sp.GetSdrRepositoryAllocationInfo(host)
-		if (err != nil){
+		sdrMaxRead, err := sp.GetSdrRepositoryAllocationInfo(host)
+		if err != nil {
 			log.WithFields(log.Fields{
-					"host": host,
-					"isDeviceSdr":isDeviceSdr,
-					"error":err,
-			}).Debug("ScanSdr GetSdrRepositoryAllocationInfo exit with error")				
-			return nil,err
+				"host":        host,
+				"isDeviceSdr": isDeviceSdr,
+				"error":       err,
+			}).Debug("ScanSdr GetSdrRepositoryAllocationInfo exit with error")
+			return nil, err
 		}
 		sdrMaxReadLen = sdrMaxRead
-	}	
-/*	log.WithFields(log.Fields{
-			"reservationId":reservationId,
-			"host": host,
-			"isDeviceSdr":isDeviceSdr,
-			"sdrMaxRead":sdrMaxReadLen,
-		}).Debug("ScanSdr sdrMaxRead")		*/
-	return sp.ScanSdrLoop(reservationId,0,sdrMaxReadLen,isDeviceSdr,host)
+	}
+	return sp.ScanSdrLoop(reservationId, 0, sdrMaxReadLen, isDeviceSdr, host)
 }
 
+// sdrReader reads SDR records of single host. When BMC cancels reservation
+// repository is reserved again, when it rejects read size smaller parts are read.
+type sdrReader struct {
+	sp          *SdrParser
+	host        string
+	isDeviceSdr bool
+	reservation []byte
+	readLen     uint16
+}
 
-func (sp *SdrParser) ScanSdrLoop(reservationId []byte,recordId uint16,sdrMaxReadLen uint16,isDeviceSdr bool,host string) ([]SdrInfo, error){
-	var recId  = recordId
-	var sdrSet []SdrInfo = []SdrInfo{}
+// read returns count bytes of record preceded by next record ID.
+func (r *sdrReader) read(recordId uint16, count uint16) ([]byte, error) {
+	for attempt := 1; ; attempt++ {
+		data, err := r.sp.GetSdrBytes(r.reservation, recordId, count, r.readLen, r.isDeviceSdr, r.host)
+		if err == nil {
+			return data, nil
+		}
+		e, ok := err.(*CompletionCodeError)
+		if !ok || attempt >= sdrReadAttempts {
+			return nil, err
+		}
+		switch {
+		case e.Code == 0xc5:
+			reservation, err := r.sp.ReserveSdr(r.isDeviceSdr, r.host)
+			if err != nil {
+				return nil, err
+			}
+			r.reservation = reservation
+		case (e.Code == 0xca || e.Code == 0xff) && r.readLen > sdrMinReadLen:
+			r.readLen /= 2
+			log.WithFields(log.Fields{
+				"host":    r.host,
+				"readLen": r.readLen,
+			}).Debug("SDR read size rejected, reading smaller parts")
+		default:
+			return nil, err
+		}
+	}
+}
+
+// ScanSdrLoop reads records starting from recordId (0 reads whole repository).
+// Records which cannot be read or parsed are skipped, scan fails only when
+// header, and so the next record, cannot be read.
+func (sp *SdrParser) ScanSdrLoop(reservationId []byte, recordId uint16, sdrMaxReadLen uint16, isDeviceSdr bool, host string) ([]SdrInfo, error) {
+	r := &sdrReader{sp: sp, host: host, isDeviceSdr: isDeviceSdr, reservation: reservationId, readLen: sdrMaxReadLen}
+	var recId = recordId
+	var sdrSet = []SdrInfo{}
+	visited := make(map[uint16]bool)
 	log.WithFields(log.Fields{
-		"host": host,
-		"isDeviceSdr":isDeviceSdr,
-		"reservationId":reservationId,
-		"recordId":recordId,
-		"sdrMaxReadLen":sdrMaxReadLen,
-		}).Debug("ScanSdrLoop")
-	for {
-		//reservationId []byte，recordId int,isDeviceSdr bool,host string
-		  sdrHeader,err:=sp.GetSdrHeader(reservationId,recId,isDeviceSdr,host)
-		  if err !=nil{	
-			  return nil,err
-		  }
-/*		 log.WithFields(log.Fields{
-			"host": host,
-			"isDeviceSdr":isDeviceSdr,
-			"reservationId":reservationId,
-			"recordId":recordId,
-			"sdrMaxReadLen":sdrMaxReadLen,
-			"sdrHeader.NextRecordId":sdrHeader.NextRecordId,		
-			"sdrHeader.RecordType":sdrHeader.RecordType,
-			"sdrHeader.RecordId":sdrHeader.RecordId,
-			"sdrHeader.RecordLength":sdrHeader.RecordLength,
-			}).Debug("ScanSdrLoop GetSdrHeader ")	*/		  
-		  var recordType  = sdrHeader.RecordType
-		  if (recordId == 0 || sdrHeader.RecordId == recordId )&& 
-			  //IpmiConstants.SDR_TYPE_FUL,IpmiConstants.SDR_TYPE_COMPACT
-			  (  recordType == 0x01 || recordType == 0x02){	
-				sdr,err := sp.GetSdrByHeader(reservationId,sdrHeader,sdrMaxReadLen,isDeviceSdr,host)
-				if err !=nil{
-					return nil,err
-				}
-/*				log.WithFields(log.Fields{
-					"host": host,
-					"isDeviceSdr":isDeviceSdr,
-					"reservationId":reservationId,
-					"recordId":recordId,
-					"sdrMaxReadLen":sdrMaxReadLen,
-					"sdr.Header.NextRecordId":sdr.Header.NextRecordId,		
-					"sdr.Header.RecordType":sdr.Header.RecordType,
-					"sdr.Header.RecordId":sdr.Header.RecordId,
-					"sdr.Header.RecordLength":sdr.Header.RecordLength,
-					"sdr.EventReadingType":sdr.EventReadingType,
-					"sdr.SensorNumber":sdr.SensorNumber,
-					"sdr.SensorType":sdr.SensorType,
-				}).Debug("ScanSdrLoop GetSdrByHeader ")	*/				
-				recordType = sdr.Header.RecordType
-				if recordType == uint16 (0x01) || recordType == uint16 (0x02) {
-					sdrSet = append(sdrSet,sdr)
-				  }										
-		 }
-		 recId = sdrHeader.NextRecordId 
-		 if recId == uint16(0xFFFF){
-			 break
-		 }	
-	}
-	return sdrSet,nil
-}
-
-func(sp * SdrParser) GetSdrBytes(reservationId []byte, recordId uint16,totalBytesToRead uint16, sdrMaxReadLen uint16,isDeviceSdr bool,host string)([]byte, error){
-	var data []byte = make([]byte, totalBytesToRead + uint16(2))
-	var bytesLeftToRead = totalBytesToRead
-	var currentBytesToRead uint16= 0	
-	for bytesRead := uint16(0);  bytesRead < bytesLeftToRead; bytesRead += currentBytesToRead {					
-		bytesLeftToRead = uint16 (totalBytesToRead - bytesRead)
-		if (bytesLeftToRead > sdrMaxReadLen) {
-			currentBytesToRead = sdrMaxReadLen;
-		} else {
-			currentBytesToRead = bytesLeftToRead;
-	    }			
-		var currentSdr []byte
-		currentSdr,err := sp.GetSdr(reservationId,recordId,bytesRead,currentBytesToRead,isDeviceSdr,host)
-		if err !=nil{
-			return nil,err
-		}		
-		// First copy the next-record-id data
-		data[0] = currentSdr[0];
-		data[1] = currentSdr[1];	
-		// Then the rest of the data
-		for i := uint16(0);i < currentBytesToRead; i++ {
-			data[uint16(2) + bytesRead + i] = currentSdr[uint16(2) + i]		
-		}		
-	} 
-/*	log.WithFields(log.Fields{
+		"host":          host,
+		"isDeviceSdr":   isDeviceSdr,
 		"reservationId": reservationId,
-		"recordId":recordId,
-		"totalBytesToRead":totalBytesToRead,
-		"sdrMaxReadLen":sdrMaxReadLen,
-		"isDeviceSdr":isDeviceSdr,
-		"host":host,
-		"data":data,
-	}).Debug("GetSdrBytes ")	*/
-	return data,nil
+		"recordId":      recordId,
+		"sdrMaxReadLen": sdrMaxReadLen,
+	}).Debug("ScanSdrLoop")
+	for {
+		sdrHeader, err := r.header(recId)
+		if err != nil {
+			return nil, err
+		}
+		visited[recId] = true
+		var recordType = sdrHeader.RecordType
+		//IpmiConstants.SDR_TYPE_FULL,IpmiConstants.SDR_TYPE_COMPACT
+		if (recordId == 0 || sdrHeader.RecordId == recordId) && (recordType == 0x01 || recordType == 0x02) {
+			sdr, err := r.record(sdrHeader)
+			if err != nil {
+				log.WithFields(log.Fields{
+					"host":     host,
+					"recordId": sdrHeader.RecordId,
+					"error":    err,
+				}).Warn("Skipping SDR record which cannot be read")
+			} else {
+				sdrSet = append(sdrSet, sdr)
+			}
+		}
+		recId = sdrHeader.NextRecordId
+		if recId == uint16(0xFFFF) {
+			break
+		}
+		if visited[recId] {
+			log.WithFields(log.Fields{
+				"host":     host,
+				"recordId": recId,
+			}).Warn("SDR records form a loop, scan stopped")
+			break
+		}
+	}
+	return sdrSet, nil
 }
 
-func (sp *SdrParser) GetSdrHeader(reservationId []byte,recordId uint16,isDeviceSdr bool,host string) (*SdrHeader, error){
-	var sdrHeaderByte []byte
-	var header *SdrHeader = &SdrHeader{}
-	sdrHeaderByte,err := sp.GetSdrBytes(reservationId,recordId,5,16,isDeviceSdr,host)
-	if err!=nil{
-		return nil,err
+// GetSdrBytes reads totalBytesToRead bytes of record in parts of sdrMaxReadLen.
+// Returned data is preceded by next record ID.
+func (sp *SdrParser) GetSdrBytes(reservationId []byte, recordId uint16, totalBytesToRead uint16, sdrMaxReadLen uint16, isDeviceSdr bool, host string) ([]byte, error) {
+	var data = make([]byte, totalBytesToRead+uint16(2))
+	var currentBytesToRead uint16
+	for bytesRead := uint16(0); bytesRead < totalBytesToRead; bytesRead += currentBytesToRead {
+		currentBytesToRead = totalBytesToRead - bytesRead
+		if currentBytesToRead > sdrMaxReadLen {
+			currentBytesToRead = sdrMaxReadLen
+		}
+		currentSdr, err := sp.GetSdr(reservationId, recordId, bytesRead, currentBytesToRead, isDeviceSdr, host)
+		if err != nil {
+			return nil, err
+		}
+		if len(currentSdr) < int(currentBytesToRead)+2 {
+			return nil, fmt.Errorf("Unexpected response data: %d of %d bytes of record %d returned", len(currentSdr)-2, currentBytesToRead, recordId)
+		}
+		// First copy the next-record-id data, then the rest of the data
+		copy(data[0:2], currentSdr[0:2])
+		copy(data[2+bytesRead:], currentSdr[2:2+currentBytesToRead])
+	}
+	return data, nil
+}
+
+// header reads header of record.
+func (r *sdrReader) header(recordId uint16) (*SdrHeader, error) {
+	sdrHeaderByte, err := r.read(recordId, 5)
+	if err != nil {
+		return nil, err
 	}
-	//NextRecordId 0-2
-	header.NextRecordId = uint16 (sdrHeaderByte[0]) | uint16 (sdrHeaderByte[1]) << 8
-	header.RecordId  = uint16 (sdrHeaderByte[2]) | uint16 (sdrHeaderByte[3]) << 8
-	header.SdrVersion = uint16 (sdrHeaderByte[4])
-	header.RecordType = uint16 (sdrHeaderByte[5])
-	header.RecordLength = uint16 (sdrHeaderByte[6]) 
-	return header,nil
+	return &SdrHeader{
+		NextRecordId: uint16(sdrHeaderByte[0]) | uint16(sdrHeaderByte[1])<<8,
+		RecordId:     uint16(sdrHeaderByte[2]) | uint16(sdrHeaderByte[3])<<8,
+		SdrVersion:   uint16(sdrHeaderByte[4]),
+		RecordType:   uint16(sdrHeaderByte[5]),
+		RecordLength: uint16(sdrHeaderByte[6]),
+	}, nil
+}
+
+// GetSdrHeader reads header of record.
+func (sp *SdrParser) GetSdrHeader(reservationId []byte, recordId uint16, isDeviceSdr bool, host string) (*SdrHeader, error) {
+	r := &sdrReader{sp: sp, host: host, isDeviceSdr: isDeviceSdr, reservation: reservationId, readLen: 16}
+	return r.header(recordId)
 }
 
-func (sp *SdrParser) GetSdrByHeader(reservationId []byte,header *SdrHeader,sdrMaxReadLen uint16,isDeviceSdr bool,host string) (SdrInfo, error){
+// record reads full or compact sensor record described by header.
+func (r *sdrReader) record(header *SdrHeader) (SdrInfo, error) {
 	var sdrInfo SdrInfo
-	var totalBytesToRead = header.RecordLength + uint16 (5)
-	sdrBytes,err :=	sp.GetSdrBytes(reservationId,header.RecordId,totalBytesToRead, sdrMaxReadLen,isDeviceSdr,host)
-	if err!=nil{
-		return sdrInfo,err
+	sdrBytes, err := r.read(header.RecordId, header.RecordLength+uint16(5))
+	if err != nil {
+		return sdrInfo, err
 	}
+	return parseSdr(sdrBytes)
+}
+
+// GetSdrByHeader reads full or compact sensor record described by header.
+func (sp *SdrParser) GetSdrByHeader(reservationId []byte, header *SdrHeader, sdrMaxReadLen uint16, isDeviceSdr bool, host string) (SdrInfo, error) {
+	r := &sdrReader{sp: sp, host: host, isDeviceSdr: isDeviceSdr, reservation: reservationId, readLen: sdrMaxReadLen}
+	return r.record(header)
+}
 
+// parseSdr extracts sensor from record preceded by next record ID.
+func parseSdr(sdrBytes []byte) (SdrInfo, error) {
+	var sdrInfo SdrInfo
+	if len(sdrBytes) < 16 {
+		return sdrInfo, fmt.Errorf("Corrupt SDR record: %d bytes long", len(sdrBytes)-2)
+	}
 	//Header: 6 bytes
-	sdrInfo.Header.NextRecordId =  uint16 (sdrBytes[0]) | uint16 (sdrBytes[1]) << 8
-	sdrInfo.Header.RecordId  = uint16 (sdrBytes[2]) | uint16 (sdrBytes[3]) << 8
-	sdrInfo.Header.SdrVersion = uint16 (sdrBytes[4])
-	sdrInfo.Header.RecordType = uint16 (sdrBytes[5]) 
-	sdrInfo.Header.RecordLength = uint16 (sdrBytes[6])
+	sdrInfo.Header.NextRecordId = uint16(sdrBytes[0]) | uint16(sdrBytes[1])<<8
+	sdrInfo.Header.RecordId = uint16(sdrBytes[2]) | uint16(sdrBytes[3])<<8
+	sdrInfo.Header.SdrVersion = uint16(sdrBytes[4])
+	sdrInfo.Header.RecordType = uint16(sdrBytes[5])
+	sdrInfo.Header.RecordLength = uint16(sdrBytes[6])
 
 	//SDR_TYPE_FULL,SDR_TYPE_COMPACT
-	if sdrInfo.Header.RecordType == uint16 (0x01) ||sdrInfo.Header.RecordType == uint16(0x02){
-		sdrInfo.SensorNumber = uint16 (sdrBytes[9]) 
-		sdrInfo.SensorType = uint16 (sdrBytes[14]) 
-		sdrInfo.EventReadingType = uint16 (sdrBytes[15]) 		
-	}else {
-		return sdrInfo,fmt.Errorf("Unexpected RecordType")
+	if sdrInfo.Header.RecordType != uint16(0x01) && sdrInfo.Header.RecordType != uint16(0x02) {
+		return sdrInfo, fmt.Errorf("Unexpected RecordType")
 	}
-	return sdrInfo,nil
+	sdrInfo.OwnerId = uint16(sdrBytes[7])
+	sdrInfo.OwnerLun = uint16(sdrBytes[8])
+	sdrInfo.SensorNumber = uint16(sdrBytes[9])
+	sdrInfo.SensorType = uint16(sdrBytes[14])
+	sdrInfo.EventReadingType = uint16(sdrBytes[15])
+	sdrInfo.Conversion = parseConversion(sdrBytes[2:])
+	sdrInfo.Name = parseSdrName(sdrBytes[2:])
+	sdrInfo.Characteristics = parseCharacteristics(sdrBytes[2:])
+	return sdrInfo, nil
+}
+
+// parseCharacteristics returns nominal, normal maximum and normal minimum raw
+// readings specified in full sensor record starting with record ID.
+func parseCharacteristics(record []byte) map[string]uint8 {
+	if record[3] != 0x01 || len(record) < 34 {
+		return nil
+	}
+	var characteristics map[string]uint8
+	for i, name := range []string{"nominal", "normal_max", "normal_min"} {
+		if record[30]&(1<<uint(i)) == 0 {
+			continue
+		}
+		if characteristics == nil {
+			characteristics = make(map[string]uint8)
+		}
+		characteristics[name] = record[31+i]
+	}
+	return characteristics
+}
+
+// parseSdrName returns ID string of full or compact sensor record starting with
+// record ID. Only 8-bit ASCII strings are decoded.
+func parseSdrName(record []byte) string {
+	offset := 31
+	if record[3] == 0x01 {
+		offset = 47
+	}
+	if len(record) <= offset || record[offset]>>6 != 0x03 {
+		return ""
+	}
+	end := offset + 1 + int(record[offset]&0x1f)
+	if end > len(record) {
+		end = len(record)
+	}
+	return strings.TrimRight(string(record[offset+1:end]), " \x00")
 }
 
 func (sp *SdrParser) GetSdrData(sdrs []SdrInfo,host string) ([]SensorStatus, error){
 	var sensorStatus []SensorStatus
 	sensorStatus = make([]SensorStatus,len(sdrs))
-	var cmd = CmdGetSensorReading.Clone()
 	for i,sdr := range sdrs{
+		cmd, ok := sdr.sensorRequest(CmdGetSensorReading.Clone())
+		if !ok {
+			sensorStatus[i].StateUnavailable = true
+			continue
+		}
 		cmd.Data[2] = byte(sdr.SensorNumber)
 		response, err := sp.IpmiLayer.ExecRaw(cmd, host)
+		if _, ok := err.(*CompletionCodeError); ok {
+			// absent sensor or busy BMC, sensor is skipped in this collection
+			sensorStatus[i].StateUnavailable = true
+			continue
+		}
 		if err != nil{
 			return nil,err
 		}
-		if len(response.Data) < 1{
+		if len(response.Data) < 4{
 			return nil, fmt.Errorf("Unexpected response data: No add data in response")
 		}		
 		var data = response.Data[1:]
@@ -516,6 +984,7 @@ func (sp *SdrParser) GetSdrData(sdrs []SdrInfo,host string) ([]SensorStatus, err
 		sensorStatus[i].ReadingType = sdr.EventReadingType
 		sensorStatus[i].SensorNumber =sdr.SensorNumber
 		sensorStatus[i].SensorType = sdr.SensorType
+		sensorStatus[i].Reading = data[0]
 		sensorStatus[i].Status = status
 	} 
 	return sensorStatus,nil
@@ -0,0 +1,287 @@
+// +build linux
+
+/*
+http://www.apache.org/licenses/LICENSE-2.0.txt
+
+
+Copyright 2016 Intel Corporation
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package ipmi
+
+import (
+	"fmt"
+	"math"
+)
+
+// Sensor base unit codes (IPMI 2.0 table 43-15) used by platforms.
+const (
+	UnitCodeUnspecified = 0
+	UnitCodeCelsius     = 1
+	UnitCodeVolts       = 4
+	UnitCodeAmps        = 5
+	UnitCodeWatts       = 6
+	UnitCodeCFM         = 17
+	UnitCodeRPM         = 18
+)
+
+var unitNames = map[byte]string{
+	UnitCodeUnspecified: "",
+	UnitCodeCelsius:     UnitCelsius,
+	2:                   "F",
+	3:                   "K",
+	UnitCodeVolts:       "V",
+	UnitCodeAmps:        "A",
+	UnitCodeWatts:       UnitWatt,
+	7:                   "J",
+	9:                   "VA",
+	UnitCodeCFM:         "CFM",
+	UnitCodeRPM:         "RPM",
+	19:                  "Hz",
+	20:                  "us",
+	21:                  "ms",
+	22:                  "s",
+}
+
+// UnitName returns symbol of sensor base unit code.
+func UnitName(code byte) string {
+	if name, ok := unitNames[code]; ok {
+		return name
+	}
+	return fmt.Sprintf("unit %d", code)
+}
+
+// Analog data formats of sensor readings (bits 7:6 of sensor units 1).
+const (
+	AnalogUnsigned       = 0x00
+	AnalogOnesComplement = 0x01
+	AnalogTwosComplement = 0x02
+	AnalogNone           = 0x03
+)
+
+// Linearization functions of full sensor records.
+const (
+	LinearizationLinear    = 0x00
+	LinearizationNonLinear = 0x70
+)
+
+var linearizations = []func(float64) float64{
+	func(x float64) float64 { return x },
+	math.Log,
+	math.Log10,
+	math.Log2,
+	math.Exp,
+	func(x float64) float64 { return math.Pow(10, x) },
+	math.Exp2,
+	func(x float64) float64 { return 1 / x },
+	func(x float64) float64 { return x * x },
+	func(x float64) float64 { return x * x * x },
+	math.Sqrt,
+	math.Cbrt,
+}
+
+// SensorFactors are reading conversion factors: y = (M*x + B*10^BExp) * 10^RExp
+// (K1 and K2 of specification are BExp and RExp).
+type SensorFactors struct {
+	M    int
+	B    int
+	BExp int
+	RExp int
+}
+
+// FactorRange are factors of non-linear sensor valid for raw readings
+// starting at From up to From of next range.
+type FactorRange struct {
+	From    uint8
+	Factors SensorFactors
+}
+
+// SensorConversion converts raw readings of sensor described by full SDR record
+// to engineering units. Factors of non-linear sensors are read from BMC with
+// Get Sensor Reading Factors and kept in Ranges.
+type SensorConversion struct {
+	AnalogFormat  byte
+	Linearization byte
+	Percentage    bool
+	UnitCode      byte
+	Factors       SensorFactors
+	Ranges        []FactorRange `json:",omitempty"`
+}
+
+// CmdGetSensorReadingFactors is Get Sensor Reading Factors, sensor number and reading follow.
+var CmdGetSensorReadingFactors = IpmiRequest{[]byte{0x04, 0x23, 0x00, 0x00}, 0x0, 0x0, nil}
+
+// signExtend interprets lowest bits of v as two's complement number.
+func signExtend(v uint, bits uint) int {
+	shift := 64 - bits
+	return int(int64(uint64(v)<<shift) >> shift)
+}
+
+// parseFactors decodes M, tolerance, B, accuracy and exponent bytes shared by
+// full sensor record and Get Sensor Reading Factors response.
+func parseFactors(data []byte) SensorFactors {
+	return SensorFactors{
+		M:    signExtend(uint(data[0])|uint(data[1]&0xc0)<<2, 10),
+		B:    signExtend(uint(data[2])|uint(data[3]&0xc0)<<2, 10),
+		RExp: signExtend(uint(data[5]>>4), 4),
+		BExp: signExtend(uint(data[5]&0x0f), 4),
+	}
+}
+
+// parseConversion reads conversion of full sensor record starting with record ID.
+// Nil is returned for sensors without analog reading.
+func parseConversion(record []byte) *SensorConversion {
+	if len(record) < 30 || record[3] != 0x01 || record[20]>>6 == AnalogNone {
+		return nil
+	}
+	return &SensorConversion{
+		AnalogFormat:  record[20] >> 6,
+		Percentage:    record[20]&0x01 != 0,
+		UnitCode:      record[21],
+		Linearization: record[23] & 0x7f,
+		Factors:       parseFactors(record[24:30]),
+	}
+}
+
+// NonLinear tells whether factors depend on reading.
+func (c *SensorConversion) NonLinear() bool {
+	return c.Linearization >= LinearizationNonLinear
+}
+
+// Unit returns symbol of converted values.
+func (c *SensorConversion) Unit() string {
+	if c.Percentage {
+		return "%"
+	}
+	return UnitName(c.UnitCode)
+}
+
+// factors returns factors valid for raw reading.
+func (c *SensorConversion) factors(raw uint8) (SensorFactors, bool) {
+	if !c.NonLinear() {
+		return c.Factors, true
+	}
+	found := false
+	var factors SensorFactors
+	for _, r := range c.Ranges {
+		if r.From > raw {
+			break
+		}
+		factors, found = r.Factors, true
+	}
+	return factors, found
+}
+
+// Convert returns value of raw reading in engineering units. False is returned
+// when sensor has no analog reading or factors of reading are not known.
+func (c *SensorConversion) Convert(raw uint8) (float64, bool) {
+	var x float64
+	switch c.AnalogFormat {
+	case AnalogUnsigned:
+		x = float64(raw)
+	case AnalogOnesComplement:
+		if raw&0x80 != 0 {
+			x = -float64(^raw)
+		} else {
+			x = float64(raw)
+		}
+	case AnalogTwosComplement:
+		x = float64(int8(raw))
+	default:
+		return 0, false
+	}
+	f, ok := c.factors(raw)
+	if !ok {
+		return 0, false
+	}
+	y := (float64(f.M)*x + float64(f.B)*math.Pow10(f.BExp)) * math.Pow10(f.RExp)
+	if int(c.Linearization) < len(linearizations) {
+		y = linearizations[c.Linearization](y)
+	}
+	// drop floating point noise of decimal exponents
+	return math.Round(y*1e6) / 1e6, true
+}
+
+// ConvertDelta returns difference of readings (e.g. hysteresis) given in raw
+// counts in engineering units. Offset and linearization are not applied.
+func (c *SensorConversion) ConvertDelta(raw uint8) (float64, bool) {
+	if c.AnalogFormat == AnalogNone {
+		return 0, false
+	}
+	f, ok := c.factors(raw)
+	if !ok {
+		return 0, false
+	}
+	return math.Round(math.Abs(float64(f.M)*float64(raw)*math.Pow10(f.RExp))*1e6) / 1e6, true
+}
+
+// GetSensorReadingFactors returns factors of raw reading of sensor on controller
+// addressed like target, together with next reading using different factors.
+func GetSensorReadingFactors(layer IpmiAL, target IpmiRequest, host string, sensor, reading uint8) (uint8, SensorFactors, error) {
+	cmd := target.Clone()
+	cmd.Data = append([]byte{}, CmdGetSensorReadingFactors.Data...)
+	cmd.Data[2], cmd.Data[3] = sensor, reading
+	resp, err := layer.ExecRaw(cmd, host)
+	if err != nil {
+		return 0, SensorFactors{}, err
+	}
+	if err := (&GenericValidator{}).Validate(*resp); err != nil {
+		return 0, SensorFactors{}, err
+	}
+	if len(resp.Data) < 8 {
+		return 0, SensorFactors{}, errShortResponse
+	}
+	return resp.Data[1], parseFactors(resp.Data[2:8]), nil
+}
+
+// LoadFactorRanges reads factors of all readings of non-linear sensor.
+func LoadFactorRanges(layer IpmiAL, target IpmiRequest, host string, sensor uint8) ([]FactorRange, error) {
+	var ranges []FactorRange
+	reading := uint8(0)
+	for {
+		next, factors, err := GetSensorReadingFactors(layer, target, host, sensor, reading)
+		if err != nil {
+			return nil, err
+		}
+		ranges = append(ranges, FactorRange{From: reading, Factors: factors})
+		if next <= reading {
+			return ranges, nil
+		}
+		reading = next
+	}
+}
+
+// withConversion returns copy of sensor reading format which converts readings.
+// Other formats are returned unchanged.
+func withConversion(format ParserFormat, conv *SensorConversion) ParserFormat {
+	switch format.(type) {
+	case *ParserSR:
+		return &ParserSR{Conversion: conv}
+	case *ParserSensor:
+		return &ParserSensor{Conversion: conv}
+	}
+	return format
+}
+
+// conversionOf returns conversion used by sensor reading format.
+func conversionOf(format ParserFormat) *SensorConversion {
+	switch f := format.(type) {
+	case *ParserSR:
+		return f.Conversion
+	case *ParserSensor:
+		return f.Conversion
+	}
+	return nil
+}
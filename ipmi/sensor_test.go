@@ -0,0 +1,79 @@
+// +build unit
+
+/*
+http://www.apache.org/licenses/LICENSE-2.0.txt
+
+
+Copyright 2016 Intel Corporation
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package ipmi
+
+import (
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestSensorConversion(t *testing.T) {
+	Convey("Check sensor reading conversion", t, func() {
+		Convey("factors are read from full record", func() {
+			record := make([]byte, 48)
+			record[3] = 0x01
+			record[20] = AnalogTwosComplement << 6
+			record[21] = UnitCodeVolts
+			// M = -2, B = 5, RExp = -2, BExp = 1
+			copy(record[24:30], []byte{0xfe, 0xc0, 0x05, 0x00, 0x00, 0xe1})
+			conv := parseConversion(record)
+			So(conv, ShouldNotBeNil)
+			So(conv.Factors, ShouldResemble, SensorFactors{M: -2, B: 5, BExp: 1, RExp: -2})
+			So(conv.Unit(), ShouldEqual, "V")
+			v, ok := conv.Convert(0xfb)
+			So(ok, ShouldBeTrue)
+			So(v, ShouldEqual, 0.6)
+
+			record[20] = AnalogNone << 6
+			So(parseConversion(record), ShouldBeNil)
+			record[3] = 0x02
+			So(parseConversion(record), ShouldBeNil)
+		})
+
+		Convey("linearization function is applied", func() {
+			conv := &SensorConversion{Linearization: 0x08, UnitCode: UnitCodeWatts, Factors: SensorFactors{M: 1}}
+			v, _ := conv.Convert(12)
+			So(v, ShouldEqual, 144)
+		})
+
+		Convey("non-linear sensor uses factors of reading range", func() {
+			conv := &SensorConversion{Linearization: LinearizationNonLinear, UnitCode: UnitCodeRPM}
+			_, ok := conv.Convert(10)
+			So(ok, ShouldBeFalse)
+			conv.Ranges = []FactorRange{{From: 0, Factors: SensorFactors{M: 10}}, {From: 100, Factors: SensorFactors{M: 20, B: -1, BExp: 3}}}
+			v, _ := conv.Convert(10)
+			So(v, ShouldEqual, 100)
+			v, _ = conv.Convert(150)
+			So(v, ShouldEqual, 2000)
+		})
+
+		Convey("formats convert readings", func() {
+			conv := &SensorConversion{UnitCode: UnitCodeCelsius, Factors: SensorFactors{M: 5, RExp: -1}}
+			format := withConversion(FormatSR, conv)
+			So(format.Parse(IpmiResponse{[]byte{0x00, 0x31, 0x40, 0xc0}, 1})[""], ShouldResemble, FloatValue(24.5, UnitCelsius))
+			So(format.Parse(IpmiResponse{[]byte{0x00, 0x31, 0x60, 0xc0}, 1})[""].Valid, ShouldBeFalse)
+			So(conversionOf(format), ShouldEqual, conv)
+			So(FormatSR.Parse(IpmiResponse{[]byte{0x00, 0x31, 0x40, 0xc0}, 1})[""], ShouldResemble, IntValue(0x31, ""))
+		})
+	})
+}
@@ -0,0 +1,409 @@
+// +build linux
+
+/*
+http://www.apache.org/licenses/LICENSE-2.0.txt
+
+
+Copyright 2016 Intel Corporation
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package ipmi
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Kinds of transcript entries
+const (
+	TranscriptExec         = "exec"
+	TranscriptBatch        = "batch"
+	TranscriptCapabilities = "capabilities"
+)
+
+// hexBytes is byte slice serialized as space separated hex string ("00 57 01").
+type hexBytes []byte
+
+func (h hexBytes) MarshalJSON() ([]byte, error) {
+	fields := make([]string, len(h))
+	for i, b := range h {
+		fields[i] = fmt.Sprintf("%02x", b)
+	}
+	return json.Marshal(strings.Join(fields, " "))
+}
+
+func (h *hexBytes) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		return err
+	}
+	fields := strings.Fields(s)
+	*h = make(hexBytes, len(fields))
+	for i, field := range fields {
+		value, err := strconv.ParseUint(field, 16, 8)
+		if err != nil {
+			return fmt.Errorf("Invalid hex byte %q", field)
+		}
+		(*h)[i] = byte(value)
+	}
+	return nil
+}
+
+// RecordedDescription is request supported by host as returned by GetPlatformCapabilities.
+type RecordedDescription struct {
+	MetricsRoot string            `json:"metrics_root"`
+	Channel     int16             `json:"channel"`
+	Slave       uint8             `json:"slave"`
+	Transit     []BridgeHop       `json:"transit,omitempty"`
+	Request     hexBytes          `json:"request"`
+	Conversion  *SensorConversion `json:"conversion,omitempty"`
+}
+
+// TranscriptEntry is single line of transcript file.
+// Requests executed in one batch share timestamp and latency of whole batch.
+type TranscriptEntry struct {
+	Kind         string                `json:"kind"`
+	Host         string                `json:"host"`
+	Time         time.Time             `json:"time"`
+	Latency      time.Duration         `json:"latency_ns"`
+	Channel      int16                 `json:"channel,omitempty"`
+	Slave        uint8                 `json:"slave,omitempty"`
+	Transit      []BridgeHop           `json:"transit,omitempty"`
+	Request      hexBytes              `json:"request,omitempty"`
+	Response     hexBytes              `json:"response,omitempty"`
+	Valid        bool                  `json:"valid"`
+	Error        string                `json:"error,omitempty"`
+	Capabilities []RecordedDescription `json:"capabilities,omitempty"`
+}
+
+func newEntry(kind, host string, start time.Time, request IpmiRequest, response *IpmiResponse, err error) TranscriptEntry {
+	e := TranscriptEntry{Kind: kind, Host: host, Time: start, Latency: time.Since(start),
+		Channel: request.Channel, Slave: request.Slave, Transit: request.Transit, Request: request.Data}
+	if response != nil {
+		e.Response = response.Data
+		e.Valid = response.IsValid == 1
+	}
+	if err != nil {
+		e.Error = err.Error()
+	}
+	return e
+}
+
+// Recorder is IpmiAL which passes calls to Layer and writes every
+// request and response (with host, timestamp and latency) to transcript.
+// Transcript is a stream of JSON encoded TranscriptEntry, one per line.
+type Recorder struct {
+	Layer  IpmiAL
+	output io.Writer
+	mutex  sync.Mutex
+}
+
+// NewRecorder creates recorder writing transcript to w.
+func NewRecorder(layer IpmiAL, w io.Writer) *Recorder {
+	return &Recorder{Layer: layer, output: w}
+}
+
+// OpenRecorder creates recorder appending transcript to file at path.
+func OpenRecorder(layer IpmiAL, path string) (*Recorder, error) {
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return nil, err
+	}
+	return NewRecorder(layer, f), nil
+}
+
+func (r *Recorder) write(entries ...TranscriptEntry) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	enc := json.NewEncoder(r.output)
+	for _, e := range entries {
+		enc.Encode(e)
+	}
+}
+
+// BatchExecRaw performs batch using underlying layer and records it.
+func (r *Recorder) BatchExecRaw(requests []IpmiRequest, host string) ([]IpmiResponse, error) {
+	return r.BatchExecRawContext(context.Background(), requests, host)
+}
+
+// BatchExecRawContext performs batch using underlying layer within context and records it.
+func (r *Recorder) BatchExecRawContext(ctx context.Context, requests []IpmiRequest, host string) ([]IpmiResponse, error) {
+	start := time.Now()
+	var results []IpmiResponse
+	var err error
+	if layer, ok := r.Layer.(IpmiALContext); ok {
+		results, err = layer.BatchExecRawContext(ctx, requests, host)
+	} else {
+		results, err = r.Layer.BatchExecRaw(requests, host)
+	}
+
+	entries := make([]TranscriptEntry, len(requests))
+	for i, request := range requests {
+		var response *IpmiResponse
+		if i < len(results) {
+			response = &results[i]
+		}
+		var reqErr error
+		if failed, ok := err.(BatchError); ok {
+			reqErr = failed[i]
+		} else {
+			reqErr = err
+		}
+		entries[i] = newEntry(TranscriptBatch, host, start, request, response, reqErr)
+	}
+	r.write(entries...)
+	return results, err
+}
+
+// ExecRaw performs single request using underlying layer and records it.
+func (r *Recorder) ExecRaw(request IpmiRequest, host string) (*IpmiResponse, error) {
+	return r.ExecRawContext(context.Background(), request, host)
+}
+
+// ExecRawContext performs single request using underlying layer within context and records it.
+func (r *Recorder) ExecRawContext(ctx context.Context, request IpmiRequest, host string) (*IpmiResponse, error) {
+	start := time.Now()
+	var response *IpmiResponse
+	var err error
+	if layer, ok := r.Layer.(IpmiALContext); ok {
+		response, err = layer.ExecRawContext(ctx, request, host)
+	} else {
+		response, err = r.Layer.ExecRaw(request, host)
+	}
+	r.write(newEntry(TranscriptExec, host, start, request, response, err))
+	return response, err
+}
+
+// GetPlatformCapabilities returns capabilities reported by underlying layer
+// and records supported requests of every host.
+func (r *Recorder) GetPlatformCapabilities(requests []RequestDescription, host []string) map[string][]RequestDescription {
+	start := time.Now()
+	capabilities := r.Layer.GetPlatformCapabilities(requests, host)
+
+	hosts := make([]string, 0, len(capabilities))
+	for h := range capabilities {
+		hosts = append(hosts, h)
+	}
+	sort.Strings(hosts)
+	entries := make([]TranscriptEntry, len(hosts))
+	for i, h := range hosts {
+		entries[i] = TranscriptEntry{Kind: TranscriptCapabilities, Host: h, Time: start, Latency: time.Since(start), Valid: true,
+			Capabilities: recordDescriptions(capabilities[h])}
+	}
+	r.write(entries...)
+	return capabilities
+}
+
+// Close closes transcript output and underlying layer when they support it.
+func (r *Recorder) Close() error {
+	if closer, ok := r.Layer.(io.Closer); ok {
+		closer.Close()
+	}
+	if closer, ok := r.output.(io.Closer); ok {
+		return closer.Close()
+	}
+	return nil
+}
+
+// Replayer is IpmiAL which serves responses from transcript.
+// Responses for the same host and request are served in recorded order,
+// the last one is repeated when all were used.
+type Replayer struct {
+	responses    map[string][]*TranscriptEntry
+	served       map[string]int
+	capabilities map[string][]RecordedDescription
+	hosts        []string
+	mutex        sync.Mutex
+}
+
+func replayKey(host string, request IpmiRequest) string {
+	if len(request.Transit) > 0 {
+		return fmt.Sprintf("%s/%d/%d/%v/% x", host, request.Channel, request.Slave, request.Transit, request.Data)
+	}
+	return fmt.Sprintf("%s/%d/%d/% x", host, request.Channel, request.Slave, request.Data)
+}
+
+// NewReplayer reads transcript from r.
+func NewReplayer(r io.Reader) (*Replayer, error) {
+	rp := &Replayer{
+		responses:    make(map[string][]*TranscriptEntry),
+		served:       make(map[string]int),
+		capabilities: make(map[string][]RecordedDescription),
+	}
+	seen := make(map[string]bool)
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for line := 1; scanner.Scan(); line++ {
+		if len(strings.TrimSpace(scanner.Text())) == 0 {
+			continue
+		}
+		e := &TranscriptEntry{}
+		if err := json.Unmarshal(scanner.Bytes(), e); err != nil {
+			return nil, fmt.Errorf("Invalid transcript entry in line %d : %v", line, err)
+		}
+		if !seen[e.Host] {
+			seen[e.Host] = true
+			rp.hosts = append(rp.hosts, e.Host)
+		}
+		if e.Kind == TranscriptCapabilities {
+			rp.capabilities[e.Host] = e.Capabilities
+			continue
+		}
+		key := replayKey(e.Host, IpmiRequest{e.Request, e.Channel, e.Slave, e.Transit})
+		rp.responses[key] = append(rp.responses[key], e)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return rp, nil
+}
+
+// LoadTranscript reads transcript file at path.
+func LoadTranscript(path string) (*Replayer, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return NewReplayer(f)
+}
+
+// Hosts returns hosts present in transcript in order of appearance.
+func (rp *Replayer) Hosts() []string {
+	return append([]string{}, rp.hosts...)
+}
+
+func (rp *Replayer) next(request IpmiRequest, host string) *TranscriptEntry {
+	rp.mutex.Lock()
+	defer rp.mutex.Unlock()
+
+	key := replayKey(host, request)
+	entries := rp.responses[key]
+	if len(entries) == 0 {
+		return nil
+	}
+	i := rp.served[key]
+	if i >= len(entries) {
+		return entries[len(entries)-1]
+	}
+	rp.served[key] = i + 1
+	return entries[i]
+}
+
+func (rp *Replayer) replay(request IpmiRequest, host string) (*IpmiResponse, error) {
+	e := rp.next(request, host)
+	if e == nil {
+		return nil, fmt.Errorf("No recorded response for host %s request % x", host, request.Data)
+	}
+	if !e.Valid {
+		if e.Error != "" {
+			return nil, errors.New(e.Error)
+		}
+		return nil, ErrNoResponse
+	}
+	return checkedResponse(request, &IpmiResponse{Data: append([]byte{}, e.Response...), IsValid: 1})
+}
+
+// BatchExecRaw returns recorded responses for batch of requests.
+func (rp *Replayer) BatchExecRaw(requests []IpmiRequest, host string) ([]IpmiResponse, error) {
+	results := make([]IpmiResponse, len(requests))
+	for i, request := range requests {
+		if resp, _ := rp.replay(request, host); resp != nil {
+			results[i] = *resp
+		}
+	}
+	return results, checkBatch(requests, results)
+}
+
+// ExecRaw returns recorded response for request.
+func (rp *Replayer) ExecRaw(request IpmiRequest, host string) (*IpmiResponse, error) {
+	return rp.replay(request, host)
+}
+
+// GetPlatformCapabilities returns recorded capabilities. For hosts without
+// recorded capabilities requests which recorded response passes ValidateResponse
+// are returned.
+func (rp *Replayer) GetPlatformCapabilities(requests []RequestDescription, host []string) map[string][]RequestDescription {
+	known := append(append([]RequestDescription{}, requests...), DcmiThermal)
+
+	validRequests := make(map[string][]RequestDescription, len(host))
+	for _, addr := range host {
+		validRequests[addr] = make([]RequestDescription, 0)
+		if recorded, ok := rp.capabilities[addr]; ok {
+			for _, rec := range recorded {
+				if desc, ok := matchDescription(known, rec); ok {
+					validRequests[addr] = append(validRequests[addr], desc)
+				}
+			}
+			continue
+		}
+		for _, desc := range requests {
+			rp.mutex.Lock()
+			entries := rp.responses[replayKey(addr, desc.Request)]
+			rp.mutex.Unlock()
+			if len(entries) > 0 && entries[0].Valid &&
+				ValidateResponse(desc.Request, IpmiResponse{entries[0].Response, 1}, desc.Format) == nil {
+				validRequests[addr] = append(validRequests[addr], desc)
+			}
+		}
+	}
+	return validRequests
+}
+
+// matchDescription finds description of recorded request. Requests which data
+// were adjusted during capabilities check (e.g. DCMI thermal) are matched by metrics root,
+// requests of enumerated policies by command and metrics root of policy request.
+// Recorded sensor conversion is restored.
+func matchDescription(known []RequestDescription, rec RecordedDescription) (RequestDescription, bool) {
+	request := IpmiRequest{append([]byte{}, rec.Request...), rec.Channel, rec.Slave, rec.Transit}
+	desc, ok := findDescription(known, rec.MetricsRoot, request)
+	if ok && rec.Conversion != nil {
+		desc.Format = withConversion(desc.Format, rec.Conversion)
+	}
+	return desc, ok
+}
+
+func findDescription(known []RequestDescription, metricsRoot string, request IpmiRequest) (RequestDescription, bool) {
+	for _, desc := range known {
+		if desc.MetricsRoot == metricsRoot && replayKey("", desc.Request) == replayKey("", request) {
+			return desc, true
+		}
+	}
+	for _, desc := range known {
+		if desc.MetricsRoot == metricsRoot {
+			desc.Request = request
+			return desc, true
+		}
+	}
+	for _, desc := range known {
+		if IsPolicyRequest(desc.Request) && IsPolicyRequest(request) && desc.Request.Data[1] == request.Data[1] &&
+			strings.HasPrefix(metricsRoot, desc.MetricsRoot+"/") {
+			desc.MetricsRoot = metricsRoot
+			desc.Request = request
+			return desc, true
+		}
+	}
+	return RequestDescription{}, false
+}
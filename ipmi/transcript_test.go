@@ -0,0 +1,122 @@
+// +build unit
+
+/*
+http://www.apache.org/licenses/LICENSE-2.0.txt
+
+
+Copyright 2016 Intel Corporation
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package ipmi
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+// fakeLayer answers requests with responses indexed by first two request bytes.
+type fakeLayer struct {
+	responses map[[2]byte][]byte
+}
+
+func (f *fakeLayer) ExecRaw(request IpmiRequest, host string) (*IpmiResponse, error) {
+	data, ok := f.responses[[2]byte{request.Data[0], request.Data[1]}]
+	if !ok {
+		return nil, ErrNoResponse
+	}
+	return checkedResponse(request, &IpmiResponse{data, 1})
+}
+
+func (f *fakeLayer) BatchExecRaw(requests []IpmiRequest, host string) ([]IpmiResponse, error) {
+	results := make([]IpmiResponse, len(requests))
+	for i, r := range requests {
+		if resp, _ := f.ExecRaw(r, host); resp != nil {
+			results[i] = *resp
+		}
+	}
+	return results, checkBatch(requests, results)
+}
+
+func (f *fakeLayer) GetPlatformCapabilities(requests []RequestDescription, host []string) map[string][]RequestDescription {
+	thermal := DcmiThermal
+	thermal.Request = DcmiThermal.Request.Clone()
+	thermal.Request.Data[2] = 0x30
+	return map[string][]RequestDescription{host[0]: {requests[0], thermal}}
+}
+
+func TestTranscript(t *testing.T) {
+	Convey("Check record and replay", t, func() {
+		layer := &fakeLayer{responses: map[[2]byte][]byte{
+			{0x2c, 0x02}: {0x00, 0xdc, 0x64, 0x00},
+			{0x06, 0x01}: {0x00, 0x20, 0x81, 0x02, 0x10, 0x02, 0xbf},
+			{0x2e, 0xc8}: {0xc1},
+			// DCMI power limit set, but not active
+			{0x2c, 0x03}: {0x80, 0xdc, 0x00, 0x00, 0x11, 0x90, 0x01, 0x70, 0x17, 0x00, 0x00, 0x00, 0x00, 0x0a, 0x00},
+		}}
+		var transcript bytes.Buffer
+		recorder := NewRecorder(layer, &transcript)
+
+		caps := recorder.GetPlatformCapabilities(DCMIVendor, []string{"bmc1"})
+		resp, err := recorder.ExecRaw(IpmiRequest{[]byte{0x06, 0x01}, 0, 0, nil}, "bmc1")
+		So(err, ShouldBeNil)
+		requests := []IpmiRequest{DCMIVendor[0].Request, {[]byte{0x2e, 0xc8}, 6, 0x2c, nil}, {[]byte{0x0a, 0x10}, 0, 0, nil}}
+		results, batchErr := recorder.BatchExecRaw(requests, "bmc1")
+		So(len(strings.Split(strings.TrimSpace(transcript.String()), "\n")), ShouldEqual, 5)
+		So(transcript.String(), ShouldContainSubstring, `"request":"06 01"`)
+		recorder.ExecRaw(DCMIVendor[1].Request, "bmc2")
+
+		replayer, err := NewReplayer(&transcript)
+		So(err, ShouldBeNil)
+		So(replayer.Hosts(), ShouldResemble, []string{"bmc1", "bmc2"})
+
+		Convey("capabilities are restored", func() {
+			replayed := replayer.GetPlatformCapabilities(DCMIVendor, []string{"bmc1"})
+			So(len(replayed["bmc1"]), ShouldEqual, 2)
+			So(replayed["bmc1"][0].Format, ShouldEqual, caps["bmc1"][0].Format)
+			So(replayed["bmc1"][1].MetricsRoot, ShouldEqual, DcmiThermal.MetricsRoot)
+			So(replayed["bmc1"][1].Request.Data, ShouldResemble, []byte{0x04, 0x2d, 0x30})
+		})
+
+		Convey("capabilities of hosts without recorded ones are validated by format", func() {
+			replayed := replayer.GetPlatformCapabilities(DCMIVendor, []string{"bmc2"})
+			So(len(replayed["bmc2"]), ShouldEqual, 1)
+			So(replayed["bmc2"][0].MetricsRoot, ShouldEqual, "power/limit")
+		})
+
+		Convey("responses and errors are served back", func() {
+			r, err := replayer.ExecRaw(IpmiRequest{[]byte{0x06, 0x01}, 0, 0, nil}, "bmc1")
+			So(err, ShouldBeNil)
+			So(r.Data, ShouldResemble, resp.Data)
+
+			replayedResults, replayedErr := replayer.BatchExecRaw(requests, "bmc1")
+			So(replayedResults, ShouldResemble, results)
+			So(replayedErr, ShouldResemble, batchErr)
+			So(IsUnsupported(replayedErr.(BatchError)[1]), ShouldBeTrue)
+
+			_, err = replayer.ExecRaw(IpmiRequest{[]byte{0x06, 0x01}, 0, 0, nil}, "bmc2")
+			So(err, ShouldNotBeNil)
+		})
+
+		Convey("inventory parser runs against transcript", func() {
+			sp := &SdrParser{IpmiLayer: replayer}
+			id, err := sp.GetDeviceId("bmc1")
+			So(err, ShouldBeNil)
+			So(id.IsDeviceSdr, ShouldBeFalse)
+		})
+	})
+}
@@ -23,30 +23,33 @@ package ipmi
 
 // GenericVendor Generic list of supported requests.
 var GenericVendor = []RequestDescription{
-	{IpmiRequest{[]byte{0x2e, 0x65, 0x57, 0x01, 0x00, 0x02}, 6, 0x2c}, "cups", FormatCUPS},
-	{IpmiRequest{[]byte{0x2e, 0x65, 0x57, 0x01, 0x00, 0x01}, 6, 0x2c}, "cups", FormatCUPSIndex},
+	{IpmiRequest{[]byte{0x2e, 0x65, 0x57, 0x01, 0x00, 0x02}, 6, 0x2c, nil}, "cups", FormatCUPS},
+	{IpmiRequest{[]byte{0x2e, 0x65, 0x57, 0x01, 0x00, 0x01}, 6, 0x2c, nil}, "cups", FormatCUPSIndex},
 
-	{IpmiRequest{[]byte{0x2e, 0xc8, 0x57, 0x01, 0x00, 0x01, 0x00, 0x00}, 6, 0x2c}, "power/system", FormatNodeManager},
-	{IpmiRequest{[]byte{0x2e, 0xc8, 0x57, 0x01, 0x00, 0x01, 0x01, 0x00}, 6, 0x2c}, "power/cpu", FormatNodeManager},
-	{IpmiRequest{[]byte{0x2e, 0xc8, 0x57, 0x01, 0x00, 0x01, 0x02, 0x00}, 6, 0x2c}, "power/memory", FormatNodeManager},
+	{IpmiRequest{[]byte{0x2e, 0xc8, 0x57, 0x01, 0x00, 0x01, 0x00, 0x00}, 6, 0x2c, nil}, "power/system", FormatNodeManager},
+	{IpmiRequest{[]byte{0x2e, 0xc8, 0x57, 0x01, 0x00, 0x01, 0x01, 0x00}, 6, 0x2c, nil}, "power/cpu", FormatNodeManager},
+	{IpmiRequest{[]byte{0x2e, 0xc8, 0x57, 0x01, 0x00, 0x01, 0x02, 0x00}, 6, 0x2c, nil}, "power/memory", FormatNodeManager},
 
-	{IpmiRequest{[]byte{0x2e, 0xc8, 0x57, 0x01, 0x00, 0x02, 0x00, 0x00}, 6, 0x2c}, "thermal/inlet", FormatNodeManager},
-	{IpmiRequest{[]byte{0x2e, 0xc8, 0x57, 0x01, 0x00, 0x05, 0x00, 0x00}, 6, 0x2c}, "thermal/outlet", FormatNodeManager},
-	{IpmiRequest{[]byte{0x2e, 0x4b, 0x57, 0x01, 0x00, 0x03, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff}, 6, 0x2c}, "thermal", FormatTemp},
+	{IpmiRequest{[]byte{0x2e, 0xc8, 0x57, 0x01, 0x00, 0x02, 0x00, 0x00}, 6, 0x2c, nil}, "thermal/inlet", FormatNodeManagerTemp},
+	{IpmiRequest{[]byte{0x2e, 0xc8, 0x57, 0x01, 0x00, 0x05, 0x00, 0x00}, 6, 0x2c, nil}, "thermal/outlet", FormatNodeManagerTemp},
+	{IpmiRequest{[]byte{0x2e, 0x4b, 0x57, 0x01, 0x00, 0x03, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff}, 6, 0x2c, nil}, "thermal", FormatTemp},
 	
-	{IpmiRequest{[]byte{0x2e, 0xc8, 0x57, 0x01, 0x00, 0x04, 0x00, 0x00}, 6, 0x2c}, "airflow", FormatNodeManager},
+	{IpmiRequest{[]byte{0x2e, 0xc8, 0x57, 0x01, 0x00, 0x04, 0x00, 0x00}, 6, 0x2c, nil}, "airflow", FormatNodeManagerAirflow},
 
-	{IpmiRequest{[]byte{0x2e, 0x40, 0x57, 0x01, 0x00, 0x30, 0x05, 0x05, 0xa1, 0x00, 0x10, 0x00, 0x00}, 6, 0x2c}, "margin/cpu/tj", FormatPECI},
+	{IpmiRequest{[]byte{0x2e, 0x40, 0x57, 0x01, 0x00, 0x30, 0x05, 0x05, 0xa1, 0x00, 0x10, 0x00, 0x00}, 6, 0x2c, nil}, "margin/cpu/tj", FormatPECI},
 
-	{IpmiRequest{[]byte{0x04, 0x2d, 0x08}, 6, 0x2c}, "thermal/chipset", FormatSR},
+	{IpmiRequest{[]byte{0x04, 0x2d, 0x08}, 6, 0x2c, nil}, "thermal/chipset", FormatSR},
 
-	{IpmiRequest{[]byte{0x2e, 0xc2, 0x57, 0x01, 0x00, 0x0, 0x1}, 6, 0x2c}, "power/policy", FormatPolicy},
+	// policy requests are repeated for every policy found, as power/policy/<domain>/<policy id>
+	{IpmiRequest{[]byte{0x2e, 0xc2, 0x57, 0x01, 0x00, 0x0, 0x0}, 6, 0x2c, nil}, "power/policy", FormatPolicy},
+	{IpmiRequest{[]byte{0x2e, 0xc6, 0x57, 0x01, 0x00, 0x0, 0x0}, 6, 0x2c, nil}, "power/policy", FormatPolicySuspend},
 }
 
 var DCMIVendor = []RequestDescription{
-	{IpmiRequest{[]byte{0x2c, 0x02, 0xdc, 0x01, 0x00, 0x00}, 0, 0}, "power/system", FormatDCMIPower},
+	{IpmiRequest{[]byte{0x2c, 0x02, 0xdc, 0x01, 0x00, 0x00}, 0, 0, nil}, "power/system", FormatDCMIPower},
+	{IpmiRequest{[]byte{0x2c, 0x03, 0xdc, 0x00, 0x00}, 0, 0, nil}, "power/limit", FormatDCMIPowerLimit},
 }
-var DcmiThermal = RequestDescription{IpmiRequest{[]byte{0x4, 0x2d, 0x00}, 0, 0},
+var DcmiThermal = RequestDescription{IpmiRequest{[]byte{0x4, 0x2d, 0x00}, 0, 0, nil},
 	"thermal/inlet", FormatSensorReading}
 
 var CmdDCMIThermalCap = []byte{0x2c, 0x7, 0xdc, 0x01, 0x40, 0x0, 0x0}
@@ -70,3 +73,27 @@ var HealthMetrics =[]string{
 	"health/memory",
 	"health/storage",
 	"health/battery"}
+
+// SensorMetrics are submetrics of every SDR sensor, collected as
+// sensors/<name>/<submetric>.
+var SensorMetrics = []string{"value", "status"}
+
+// SensorLimitMetrics are additional submetrics of threshold sensors.
+var SensorLimitMetrics = []string{
+	"lower_non_recoverable",
+	"lower_critical",
+	"lower_non_critical",
+	"upper_non_critical",
+	"upper_critical",
+	"upper_non_recoverable",
+	"positive_hysteresis",
+	"negative_hysteresis",
+	"nominal",
+	"normal_min",
+	"normal_max",
+}
+
+// SensorMetric returns path of sensor submetric.
+func SensorMetric(name, submetric string) string {
+	return "sensors/" + name + "/" + submetric
+}